@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"strconv"
+	"strings"
+
+	"github.com/alceccentric/matsurihi-cron/internal/jobs"
+	"github.com/alceccentric/matsurihi-cron/models"
+)
+
+func runBackfill(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	common := addCommonFlags(flags)
+	events := flags.String("events", "", "Event IDs and inclusive ranges to backfill, e.g. 10,12,20-25")
+	rankingTypes := flags.String("ranking-types", "", "Comma separated ranking types to backfill, e.g. eventPoint,highScore,idolPoint; all supported types when empty")
+	borders := flags.String("borders", "", "Comma separated borders replacing the configured ones of the ranking types given by -ranking-types, e.g. 100,2500")
+	flags.Parse(args)
+
+	options := jobs.BackfillOptions{}
+	var err error
+	if options.EventIds, err = jobs.ParseEventIds(*events); err != nil {
+		return newUsageError("invalid -events: %w", err)
+	}
+	if len(options.EventIds) == 0 {
+		return newUsageError("-events is required")
+	}
+	for _, rankingType := range splitList(*rankingTypes) {
+		if !models.EventRankingType(rankingType).IsValid() {
+			return newUsageError("unknown ranking type in -ranking-types: %s", rankingType)
+		}
+		options.RankingTypes = append(options.RankingTypes, models.EventRankingType(rankingType))
+	}
+	for _, border := range splitList(*borders) {
+		value, err := strconv.Atoi(border)
+		if err != nil || value <= 0 {
+			return newUsageError("invalid border in -borders: %s", border)
+		}
+		options.Borders = append(options.Borders, value)
+	}
+	if len(options.Borders) > 0 && len(options.RankingTypes) == 0 {
+		return newUsageError("-borders requires -ranking-types")
+	}
+
+	cfg, client, borderDAO, err := common.setup(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDAO(borderDAO)
+	defer common.writeMetrics()
+	err = jobs.RunLocked(ctx, borderDAO, jobs.LOCK_BORDERS, jobs.NewLockOwner(), cfg.Sync.LockTTL, func(ctx context.Context) error {
+		return jobs.RunBackfill(ctx, client, borderDAO, cfg.Sync, options)
+	})
+	return withFanOutFailures(borderDAO, err)
+}
+
+func splitList(value string) []string {
+	var parts []string
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/alceccentric/matsurihi-cron/internal/jobs"
+	"github.com/alceccentric/matsurihi-cron/internal/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+func runDaemon(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	common := addCommonFlags(flags)
+	metricsAddr := flags.String("metrics-addr", "", "Address /metrics is served on while the daemon runs, e.g. :9090; disabled when empty")
+	flags.Parse(args)
+
+	cfg, client, borderDAO, err := common.setup(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDAO(borderDAO)
+	defer common.writeMetrics()
+
+	if *metricsAddr != "" {
+		go func() {
+			if err := metrics.Serve(ctx, *metricsAddr); err != nil {
+				logrus.WithError(err).Error("Failed to serve metrics")
+			}
+		}()
+	}
+
+	return jobs.RunDaemon(ctx, client, borderDAO, cfg.Sync, cfg.Daemon)
+}
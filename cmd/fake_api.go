@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/internal/logging"
+	"github.com/alceccentric/matsurihi-cron/internal/matsurifake"
+	"github.com/sirupsen/logrus"
+)
+
+// runFakeApi serves a fake matsurihi.me API, so that the other commands can run without network
+// by setting client.base_url to its address.
+func runFakeApi(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("fake-api", flag.ExitOnError)
+	addr := flags.String("addr", ":8081", "Address the fake API listens on")
+	fixturePath := flags.String("fixture", "", "Path to the JSON fixture served; a small built-in fixture is served when empty")
+	latency := flags.Duration("latency", 0, "Delay added to every response")
+	faultStatus := flags.Int("fault-status", 0, "Status code of the injected faults, e.g. 429 or 503; disabled when 0")
+	faultRate := flags.Float64("fault-rate", 0, "Share of the requests failing with -fault-status, between 0 and 1; every request fails when 0")
+	faultPath := flags.String("fault-path", "/", "Path prefix of the requests -fault-status applies to")
+	logFormat := flags.String("log-format", logging.FORMAT_TEXT, "Format of the log lines: text or json")
+	flags.Parse(args)
+
+	if err := logging.Configure(*logFormat); err != nil {
+		return &usageError{err: err}
+	}
+	if *faultRate < 0 || *faultRate > 1 {
+		return newUsageError("-fault-rate must be between 0 and 1, got %v", *faultRate)
+	}
+	if *faultStatus != 0 && (*faultStatus < 400 || *faultStatus > 599) {
+		return newUsageError("-fault-status must be a 4xx or 5xx status code, got %d", *faultStatus)
+	}
+
+	fixture := matsurifake.DefaultFixture()
+	if *fixturePath != "" {
+		var err error
+		if fixture, err = matsurifake.LoadFixture(*fixturePath); err != nil {
+			return &usageError{err: err}
+		}
+	}
+	fake := matsurifake.NewServer(fixture).SetLatency(*latency)
+	if *faultStatus != 0 {
+		fake.AddFault(matsurifake.Fault{PathPrefix: *faultPath, StatusCode: *faultStatus, Probability: *faultRate})
+	}
+
+	httpServer := &http.Server{
+		Addr:              *addr,
+		Handler:           fake.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), SERVE_SHUTDOWN_TIMEOUT)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			logrus.WithError(err).Warn("Failed to shut down fake API gracefully")
+		}
+	}()
+
+	logrus.Infof("Serving fake matsurihi.me API with %d events on %s", len(fixture.Events), *addr)
+	if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
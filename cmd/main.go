@@ -1,36 +1,308 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
+	"github.com/alceccentric/matsurihi-cron/internal/config"
 	"github.com/alceccentric/matsurihi-cron/internal/dao"
 	"github.com/alceccentric/matsurihi-cron/internal/jobs"
+	"github.com/alceccentric/matsurihi-cron/internal/logging"
 	"github.com/alceccentric/matsurihi-cron/internal/matsuri"
+	"github.com/alceccentric/matsurihi-cron/internal/metrics"
 	"github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
 )
 
+// Exit codes of the binary
+const (
+	EXIT_OK = iota
+	EXIT_FAILURE
+	// Invalid command, flags or configuration
+	EXIT_USAGE
+	// The sync found no supported events, which usually means the upstream API changed
+	EXIT_NO_SUPPORTED_EVENTS
+	// Another sync or backfill holds the lock on the storage
+	EXIT_LOCKED
+	// The verify command found errors in the stored border infos
+	EXIT_VERIFICATION_FAILED
+	// The command succeeded on the primary backend, but other backends failed writes tolerated by the fan-out policy
+	EXIT_BACKENDS_BEHIND
+)
+
+// errBackendsBehind is returned by commands whose writes were tolerated failures on some fan-out backends.
+var errBackendsBehind = errors.New("some backends failed writes and are behind the primary until the next write")
+
+// usageError marks errors caused by invalid commands, flags or configuration.
+type usageError struct {
+	err error
+}
+
+func (e *usageError) Error() string { return e.err.Error() }
+func (e *usageError) Unwrap() error { return e.err }
+
+func newUsageError(format string, args ...any) error {
+	return &usageError{err: fmt.Errorf(format, args...)}
+}
+
+// Usage: main [sync|backfill|daemon|schedule|verify|predict|serve|mirror|fake-api] [flags]. The sync command runs when no command is given.
 func main() {
 	logrus.SetLevel(logrus.InfoLevel)
-	logrus.SetFormatter(&logrus.TextFormatter{
-		FullTimestamp: true,
+	logging.Configure(logging.FORMAT_TEXT)
+
+	command, args := "sync", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	// SIGINT and SIGTERM cancel every in-flight request of the running command
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+
+	var err error
+	switch command {
+	case "sync":
+		err = runSync(ctx, args)
+	case "backfill":
+		err = runBackfill(ctx, args)
+	case "daemon":
+		err = runDaemon(ctx, args)
+	case "schedule":
+		err = runSchedule(ctx, args)
+	case "verify":
+		err = runVerify(ctx, args)
+	case "predict":
+		err = runPredict(ctx, args)
+	case "serve":
+		err = runServe(ctx, args)
+	case "mirror":
+		err = runMirror(ctx, args)
+	case "fake-api":
+		err = runFakeApi(ctx, args)
+	default:
+		err = newUsageError("unknown command: %s", command)
+	}
+
+	stop()
+
+	if err != nil {
+		logrus.WithError(err).Errorf("Command %s failed", command)
+		os.Exit(exitCode(err))
+	}
+}
+
+func exitCode(err error) int {
+	var usageErr *usageError
+	switch {
+	case err == nil:
+		return EXIT_OK
+	case errors.As(err, &usageErr):
+		return EXIT_USAGE
+	case errors.Is(err, jobs.ErrNoSupportedEvents):
+		return EXIT_NO_SUPPORTED_EVENTS
+	case errors.Is(err, dao.ErrLockHeld):
+		return EXIT_LOCKED
+	case errors.Is(err, jobs.ErrVerificationFailed):
+		return EXIT_VERIFICATION_FAILED
+	case errors.Is(err, errBackendsBehind):
+		return EXIT_BACKENDS_BEHIND
+	default:
+		return EXIT_FAILURE
+	}
+}
+
+func runSync(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	common := addCommonFlags(flags)
+	flags.Parse(args)
+
+	cfg, client, borderDAO, err := common.setup(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDAO(borderDAO)
+	defer common.writeMetrics()
+	err = jobs.RunLocked(ctx, borderDAO, jobs.LOCK_BORDERS, jobs.NewLockOwner(), cfg.Sync.LockTTL, func(ctx context.Context) error {
+		return jobs.RunSync(ctx, client, borderDAO, cfg.Sync)
 	})
+	return withFanOutFailures(borderDAO, err)
+}
 
-	mode := flag.String("mode", "local", "DAO mode: local or r2")
-	flag.Parse()
+// commonFlags are the flags shared by every command.
+type commonFlags struct {
+	mode        *string
+	format      *string
+	configPath  *string
+	metricsFile *string
+	logFormat   *string
+	record      *string
+	replay      *string
+}
 
-	client := matsuri.NewMatsurihiMeClient(matsuri.BASE_URL_V2)
-	var borderDAO dao.DAO
+func addCommonFlags(flags *flag.FlagSet) commonFlags {
+	return commonFlags{
+		mode:        flags.String("mode", "local", "DAO mode: local, r2 or sqlite, or a comma separated list of them to write to all, the first being the primary"),
+		format:      flags.String("format", "", "Storage format: csv or parquet; defaults to storage.format of the config"),
+		configPath:  flags.String("config", "", "Path to the YAML config file; defaults are used when empty"),
+		metricsFile: flags.String("metrics-file", "", "File the metrics are dumped to in the Prometheus text format when the command ends, e.g. to push them to a Pushgateway"),
+		logFormat:   flags.String("log-format", logging.FORMAT_TEXT, "Format of the log lines: text or json"),
+		record:      flags.String("record", "", "Cassette file every matsurihi.me request and response is saved to, to replay the run later"),
+		replay:      flags.String("replay", "", "Cassette file recorded with -record answering the matsurihi.me requests instead of the API"),
+	}
+}
 
-	switch *mode {
+// writeMetrics dumps the metrics to the file given by -metrics-file, if any.
+func (f commonFlags) writeMetrics() {
+	if *f.metricsFile == "" {
+		return
+	}
+	if err := metrics.WriteTextfile(*f.metricsFile); err != nil {
+		logrus.WithError(err).Warnf("Failed to write metrics to %s", *f.metricsFile)
+	}
+}
+
+// setup loads the config and builds the matsurihi.me client and the DAO selected by the flags.
+func (f commonFlags) setup(ctx context.Context) (config.Config, *matsuri.MatsurihiMeClient, dao.DAO, error) {
+	if err := logging.Configure(*f.logFormat); err != nil {
+		return config.Config{}, nil, nil, &usageError{err: err}
+	}
+
+	cfg, err := config.Load(*f.configPath)
+	if err != nil {
+		return config.Config{}, nil, nil, &usageError{err: err}
+	}
+
+	client := matsuri.NewMatsurihiMeClient(cfg.Client.BaseUrl).
+		SetIdolConcurrency(cfg.Client.IdolConcurrency).
+		SetRateLimit(cfg.Client.RequestsPerSecond, max(1, int(math.Ceil(cfg.Client.RequestsPerSecond))))
+	if err := f.setTransport(client); err != nil {
+		return config.Config{}, nil, nil, err
+	}
+
+	borderDAO, err := f.newDAO(ctx, cfg.Storage)
+	if err != nil {
+		return config.Config{}, nil, nil, err
+	}
+	return cfg, client, borderDAO, nil
+}
+
+// setTransport records the requests of the client into the cassette given by -record,
+// or answers them from the cassette given by -replay.
+func (f commonFlags) setTransport(client *matsuri.MatsurihiMeClient) error {
+	switch {
+	case *f.record != "" && *f.replay != "":
+		return newUsageError("-record and -replay are mutually exclusive")
+	case *f.record != "":
+		transport, err := matsuri.NewRecordingTransport(*f.record, nil)
+		if err != nil {
+			return &usageError{err: err}
+		}
+		client.SetTransport(transport)
+		logrus.Infof("Recording matsurihi.me requests to %s", *f.record)
+	case *f.replay != "":
+		interactions, err := matsuri.LoadCassette(*f.replay)
+		if err != nil {
+			return &usageError{err: err}
+		}
+		transport, err := matsuri.NewReplayTransport(interactions)
+		if err != nil {
+			return &usageError{err: err}
+		}
+		// Replayed responses are not rate limited by the API
+		client.SetTransport(transport).SetRateLimit(0, 0)
+		logrus.Infof("Replaying %d matsurihi.me interactions from %s", len(interactions), *f.replay)
+	}
+	return nil
+}
+
+// newDAO builds the DAO of every mode listed by the -mode flag,
+// wrapping them in a fan-out DAO when there are several.
+func (f commonFlags) newDAO(ctx context.Context, storage config.StorageConfig) (dao.DAO, error) {
+	modes := splitList(*f.mode)
+	if len(modes) == 0 {
+		return nil, newUsageError("-mode is required")
+	}
+	if len(modes) == 1 {
+		return f.newBackendDAO(ctx, modes[0], storage)
+	}
+
+	backends := make([]dao.FanOutBackend, 0, len(modes))
+	for _, mode := range modes {
+		backendDAO, err := f.newBackendDAO(ctx, mode, storage)
+		if err != nil {
+			for _, backend := range backends {
+				closeDAO(backend.DAO)
+			}
+			return nil, err
+		}
+		backends = append(backends, dao.FanOutBackend{Name: mode, DAO: backendDAO})
+	}
+	fanOutDAO, err := dao.NewFanOutDAO(storage.FanOutPolicy, backends...)
+	if err != nil {
+		return nil, &usageError{err: err}
+	}
+	return fanOutDAO, nil
+}
+
+func (f commonFlags) newBackendDAO(ctx context.Context, mode string, storage config.StorageConfig) (dao.DAO, error) {
+	format := storage.Format
+	if *f.format != "" {
+		format = *f.format
+	}
+	serializer, err := dao.NewSerializer(format)
+	if err != nil {
+		return nil, &usageError{err: err}
+	}
+
+	switch mode {
 	case "local":
-		borderDAO = dao.NewLocalDAO("data", "border_info", "evnent_info", "metadata")
+		localDAO, err := dao.NewLocalDAO(storage.LocalOutputPath, storage.BorderInfoDir, storage.EventInfoDir, storage.MetadataDir)
+		if err != nil {
+			return nil, err
+		}
+		return localDAO.SetSerializer(serializer), nil
 	case "r2":
-		borderDAO = dao.NewR2DAO("mltd-border-predict", "border_info", "event_info", "metadata")
+		r2DAO, err := dao.NewR2DAO(ctx, storage.Bucket, storage.BorderInfoDir, storage.EventInfoDir, storage.MetadataDir)
+		if err != nil {
+			return nil, err
+		}
+		return r2DAO.SetSerializer(serializer), nil
+	case "sqlite":
+		return dao.NewSQLiteDAO(ctx, storage.SQLitePath)
 	default:
-		logrus.Fatalf("Unknown mode: %s", *mode)
+		return nil, newUsageError("unknown mode: %s", mode)
+	}
+}
+
+// withFanOutFailures turns the write failures a fan-out DAO tolerated into the error of a command
+// that otherwise succeeded, so that the backends falling behind are noticed.
+func withFanOutFailures(borderDAO dao.DAO, err error) error {
+	fanOutDAO, ok := borderDAO.(*dao.FanOutDAO)
+	if err != nil || !ok {
+		return err
 	}
+	var failures error
+	for _, failure := range fanOutDAO.Failures() {
+		failures = multierr.Append(failures, failure)
+	}
+	if failures == nil {
+		return nil
+	}
+	return fmt.Errorf("%w: %w", errBackendsBehind, failures)
+}
 
-	if err := jobs.RunSync(client, borderDAO); err != nil {
-		logrus.Fatal("Job failed: ", err)
+// closeDAO releases the resources held by DAOs that need closing.
+func closeDAO(borderDAO dao.DAO) {
+	if closer, ok := borderDAO.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logrus.WithError(err).Warn("Failed to close DAO")
+		}
 	}
 }
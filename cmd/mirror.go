@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"sort"
+
+	"github.com/alceccentric/matsurihi-cron/internal/config"
+	"github.com/alceccentric/matsurihi-cron/internal/dao"
+	"github.com/alceccentric/matsurihi-cron/internal/jobs"
+	"github.com/alceccentric/matsurihi-cron/internal/logging"
+	"github.com/alceccentric/matsurihi-cron/internal/mirror"
+	"github.com/sirupsen/logrus"
+)
+
+// runMirror downloads the objects of the R2 bucket that changed since the last mirror into a local directory.
+func runMirror(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("mirror", flag.ExitOnError)
+	configPath := flags.String("config", "", "Path to the YAML config file; defaults are used when empty")
+	bucket := flags.String("bucket", "", "Bucket to mirror; defaults to storage.bucket of the config")
+	dest := flags.String("dest", "r2data", "Local directory the objects are mirrored into")
+	prefixes := flags.String("prefix", "", "Comma separated key prefixes to mirror, e.g. b/,e/; every object is mirrored when empty")
+	events := flags.String("events", "", "Comma separated event IDs or ranges, e.g. 310,320-325, the border infos and predictions are mirrored for; all when empty")
+	concurrency := flags.Int("concurrency", mirror.DEFAULT_CONCURRENCY, "How many objects are downloaded in parallel")
+	deleteRemoved := flags.Bool("delete", false, "Delete the local copies of mirrored objects that were deleted from the bucket")
+	logFormat := flags.String("log-format", logging.FORMAT_TEXT, "Format of the log lines: text or json")
+	flags.Parse(args)
+
+	if err := logging.Configure(*logFormat); err != nil {
+		return &usageError{err: err}
+	}
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return &usageError{err: err}
+	}
+	eventIds, err := jobs.ParseEventIds(*events)
+	if err != nil {
+		return newUsageError("invalid -events: %w", err)
+	}
+	opts := mirror.Options{
+		Bucket:      cfg.Storage.Bucket,
+		Dest:        *dest,
+		Prefixes:    splitList(*prefixes),
+		EventIds:    eventIds,
+		Concurrency: *concurrency,
+		Delete:      *deleteRemoved,
+	}
+	if *bucket != "" {
+		opts.Bucket = *bucket
+	}
+	if opts.Bucket == "" {
+		return newUsageError("-bucket is required when storage.bucket is not set")
+	}
+
+	client, err := dao.NewS3Client(ctx)
+	if err != nil {
+		return err
+	}
+	summary, err := mirror.Run(ctx, client, opts)
+	failedKeys := make([]string, 0, len(summary.Failed))
+	for key := range summary.Failed {
+		failedKeys = append(failedKeys, key)
+	}
+	sort.Strings(failedKeys)
+	for _, key := range failedKeys {
+		logrus.WithError(summary.Failed[key]).WithField(logging.FIELD_OBJECT_KEY, key).Error("Failed to mirror object")
+	}
+	logrus.Infof("Mirrored bucket %s into %s: %s", opts.Bucket, opts.Dest, summary)
+	return err
+}
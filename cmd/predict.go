@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/internal/logging"
+	"github.com/alceccentric/matsurihi-cron/internal/predict"
+)
+
+func runPredict(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("predict", flag.ExitOnError)
+	common := addCommonFlags(flags)
+	eventId := flags.Int("event", 0, "ID of the event to predict; defaults to the latest synced event")
+	similarEvents := flags.Int("similar-events", predict.DEFAULT_MAX_SIMILAR_EVENTS, "Maximum number of past events of the same type a prediction is based on")
+	flags.Parse(args)
+
+	if *similarEvents < predict.MIN_SIMILAR_EVENTS {
+		return newUsageError("-similar-events must be at least %d", predict.MIN_SIMILAR_EVENTS)
+	}
+
+	_, _, borderDAO, err := common.setup(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDAO(borderDAO)
+
+	if *eventId == 0 {
+		latest, err := borderDAO.GetLatestEventInfo(ctx)
+		if err != nil {
+			return err
+		}
+		if latest.EventId == 0 {
+			return newUsageError("no event was synced yet, pass -event")
+		}
+		*eventId = latest.EventId
+	}
+
+	predictions, err := predict.NewPredictor(borderDAO).
+		SetMaxSimilarEvents(*similarEvents).
+		PredictEvent(ctx, *eventId, time.Now())
+	if err != nil {
+		return err
+	}
+	for _, prediction := range predictions {
+		fields := logging.BorderFields(prediction.EventId, prediction.RankingType, prediction.IdolId, prediction.Border)
+		fields["current_score"] = prediction.CurrentScore
+		fields["final_score"] = prediction.FinalScore
+		fields["lower_bound"] = prediction.LowerBound
+		fields["upper_bound"] = prediction.UpperBound
+		logging.FromContext(ctx).WithFields(fields).Info("Predicted final border")
+	}
+	return withFanOutFailures(borderDAO, borderDAO.SaveBorderPredictions(ctx, *eventId, predictions))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+
+	"github.com/alceccentric/matsurihi-cron/internal/config"
+	"github.com/alceccentric/matsurihi-cron/internal/dao"
+	"github.com/alceccentric/matsurihi-cron/internal/jobs"
+	"github.com/alceccentric/matsurihi-cron/internal/logging"
+	"github.com/alceccentric/matsurihi-cron/internal/matsuri"
+	"github.com/alceccentric/matsurihi-cron/internal/metrics"
+	"github.com/alceccentric/matsurihi-cron/internal/scheduler"
+	"github.com/sirupsen/logrus"
+)
+
+func runSchedule(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("schedule", flag.ExitOnError)
+	common := addCommonFlags(flags)
+	metricsAddr := flags.String("metrics-addr", "", "Address /metrics is served on while the scheduler runs, e.g. :9090; disabled when empty")
+	flags.Parse(args)
+
+	cfg, client, borderDAO, err := common.setup(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDAO(borderDAO)
+	defer common.writeMetrics()
+
+	var backfillEventIds []int
+	if backfillEventIds, err = jobs.ParseEventIds(cfg.Scheduler.BackfillEvents); err != nil {
+		return newUsageError("invalid scheduler.backfill_events: %w", err)
+	}
+
+	s := scheduler.NewScheduler()
+	for _, job := range []struct {
+		name string
+		spec string
+		run  func(ctx context.Context) error
+	}{
+		{metrics.JOB_SYNC, cfg.Scheduler.Sync, func(ctx context.Context) error {
+			return runLockedJob(ctx, borderDAO, cfg.Sync, func(ctx context.Context) error {
+				return jobs.RunSync(ctx, client, borderDAO, cfg.Sync)
+			})
+		}},
+		{metrics.JOB_BACKFILL, cfg.Scheduler.Backfill, func(ctx context.Context) error {
+			return runLockedJob(ctx, borderDAO, cfg.Sync, func(ctx context.Context) error {
+				return runScheduledBackfill(ctx, client, borderDAO, cfg.Sync, backfillEventIds)
+			})
+		}},
+		{metrics.JOB_VERIFY, cfg.Scheduler.Verify, func(ctx context.Context) error {
+			return jobs.RunVerify(ctx, borderDAO, cfg.Sync, 0)
+		}},
+	} {
+		if job.spec == "" {
+			continue
+		}
+		if err := s.AddJob(job.name, job.spec, job.run); err != nil {
+			return &usageError{err: err}
+		}
+		logrus.WithField("job", job.name).Infof("Scheduled on %q", job.spec)
+	}
+
+	if *metricsAddr != "" {
+		go func() {
+			if err := metrics.Serve(ctx, *metricsAddr); err != nil {
+				logrus.WithError(err).Error("Failed to serve metrics")
+			}
+		}()
+	}
+
+	if err := s.Run(ctx); err != nil {
+		return newUsageError("%v: set at least one of scheduler.sync, scheduler.backfill or scheduler.verify", err)
+	}
+	return nil
+}
+
+// runLockedJob runs a job writing border infos under the borders lock. Every run takes the lock as
+// its own owner, since the scheduler runs different jobs concurrently and a lease held by the same
+// owner is extended rather than refused. Finding the lock held is not a failure of the scheduled run:
+// the run holding it is writing the same data.
+func runLockedJob(ctx context.Context, borderDAO dao.DAO, cfg config.SyncConfig, run func(ctx context.Context) error) error {
+	err := jobs.RunLocked(ctx, borderDAO, jobs.LOCK_BORDERS, jobs.NewLockOwner(), cfg.LockTTL, run)
+	if errors.Is(err, dao.ErrLockHeld) {
+		logging.FromContext(ctx).WithError(err).Warn("Skipping scheduled run")
+		return nil
+	}
+	return err
+}
+
+// runScheduledBackfill backfills the given events, or the latest synced event when there are none.
+func runScheduledBackfill(ctx context.Context, client matsuri.MatsuriClient, borderDAO dao.DAO, cfg config.SyncConfig, eventIds []int) error {
+	if len(eventIds) == 0 {
+		latest, err := borderDAO.GetLatestEventInfo(ctx)
+		if err != nil {
+			return err
+		}
+		if latest.EventId == 0 {
+			logging.FromContext(ctx).Info("No event was synced yet, nothing to backfill")
+			return nil
+		}
+		eventIds = []int{latest.EventId}
+	}
+	return jobs.RunBackfill(ctx, client, borderDAO, cfg, jobs.BackfillOptions{EventIds: eventIds})
+}
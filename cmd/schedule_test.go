@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/internal/config"
+	"github.com/alceccentric/matsurihi-cron/internal/dao"
+	"github.com/alceccentric/matsurihi-cron/internal/scheduler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRunLockedJob_JobsDueAtOnce runs two locked jobs due on the same second, the second of which
+// must skip its run while the first holds the borders lock.
+func TestRunLockedJob_JobsDueAtOnce(t *testing.T) {
+	localDAO, err := dao.NewLocalDAO(t.TempDir(), "b", "e", "m")
+	require.NoError(t, err)
+	cfg := config.Default().Sync
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	defer releaseOnce.Do(func() { close(release) })
+
+	type result struct {
+		ran bool
+		err error
+	}
+	results := make(chan result, 2)
+	s := scheduler.NewScheduler()
+	for _, name := range []string{"sync", "backfill"} {
+		err := s.AddJob(name, "@every 1s", func(ctx context.Context) error {
+			ran := false
+			err := runLockedJob(ctx, localDAO, cfg, func(ctx context.Context) error {
+				ran = true
+				<-release
+				return nil
+			})
+			results <- result{ran: ran, err: err}
+			return err
+		})
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+
+	select {
+	case skipped := <-results:
+		assert.NoError(t, skipped.err, "finding the lock held is not a failure")
+		assert.False(t, skipped.ran, "the second job skips its run")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no job skipped its run")
+	}
+	releaseOnce.Do(func() { close(release) })
+	held := <-results
+	assert.NoError(t, held.err)
+	assert.True(t, held.ran)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/internal/server"
+	"github.com/sirupsen/logrus"
+)
+
+// Time given to in-flight requests to complete once the serve command is stopped
+const SERVE_SHUTDOWN_TIMEOUT = 10 * time.Second
+
+func runServe(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	common := addCommonFlags(flags)
+	addr := flags.String("addr", ":8080", "Address the HTTP API listens on")
+	flags.Parse(args)
+
+	_, _, borderDAO, err := common.setup(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDAO(borderDAO)
+
+	httpServer := &http.Server{
+		Addr:              *addr,
+		Handler:           server.NewServer(borderDAO).Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), SERVE_SHUTDOWN_TIMEOUT)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			logrus.WithError(err).Warn("Failed to shut down HTTP API gracefully")
+		}
+	}()
+
+	logrus.Infof("Serving HTTP API on %s", *addr)
+	if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/alceccentric/matsurihi-cron/internal/jobs"
+)
+
+func runVerify(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	common := addCommonFlags(flags)
+	eventId := flags.Int("event", 0, "ID of the event to verify; defaults to the latest synced event")
+	flags.Parse(args)
+
+	cfg, _, borderDAO, err := common.setup(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeDAO(borderDAO)
+	defer common.writeMetrics()
+	return jobs.RunVerify(ctx, borderDAO, cfg.Sync, *eventId)
+}
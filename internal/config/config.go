@@ -0,0 +1,463 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/internal/dao"
+	"github.com/alceccentric/matsurihi-cron/internal/matsuri"
+	"github.com/alceccentric/matsurihi-cron/internal/scheduler"
+	"github.com/alceccentric/matsurihi-cron/models"
+	"go.uber.org/multierr"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of the cron job, loaded from a YAML file
+// with environment variable overrides on top of the defaults.
+type Config struct {
+	Sync      SyncConfig      `yaml:"sync"`
+	Storage   StorageConfig   `yaml:"storage"`
+	Client    ClientConfig    `yaml:"client"`
+	Daemon    DaemonConfig    `yaml:"daemon"`
+	Scheduler SchedulerConfig `yaml:"scheduler"`
+}
+
+// SyncConfig controls which events and borders are synced.
+type SyncConfig struct {
+	// EventTypes are the PrincessAPI event types to sync
+	EventTypes []models.EventType `yaml:"event_types"`
+	// Borders are the borders collected for each ranking type of normal events.
+	// An event is only processed when it has all event point borders.
+	Borders map[models.EventRankingType][]int `yaml:"borders"`
+	// AnniversaryBorders are the idol point borders collected for anniversary events
+	AnniversaryBorders []int `yaml:"anniversary_borders"`
+	// Timeout bounds a whole sync run, including every HTTP and storage call; zero disables it
+	Timeout time.Duration `yaml:"timeout"`
+	// Validation controls the checks run on the fetched border infos before they are saved
+	Validation ValidationConfig `yaml:"validation"`
+	// LockTTL is the lease of the lock serializing syncs and backfills, renewed while a run lasts.
+	// A run that crashed holds the lock until its lease expires.
+	LockTTL time.Duration `yaml:"lock_ttl"`
+}
+
+// ValidationConfig controls the validation of fetched border infos.
+type ValidationConfig struct {
+	// Cadence is the expected delay between two aggregations of a border; longer delays are reported as gaps
+	Cadence time.Duration `yaml:"cadence"`
+	// Quarantine holds back the border groups with errors instead of saving them
+	Quarantine bool `yaml:"quarantine"`
+}
+
+// StorageConfig controls where the synced data is written.
+type StorageConfig struct {
+	LocalOutputPath string `yaml:"local_output_path"`
+	Bucket          string `yaml:"bucket"`
+	BorderInfoDir   string `yaml:"border_info_dir"`
+	EventInfoDir    string `yaml:"event_info_dir"`
+	MetadataDir     string `yaml:"metadata_dir"`
+	// Format is the file format of the border and event infos: csv or parquet
+	Format string `yaml:"format"`
+	// SQLitePath is the database file used by -mode sqlite
+	SQLitePath string `yaml:"sqlite_path"`
+	// FanOutPolicy decides how writes go to the backends if -mode lists several of them:
+	// fail_fast or require_primary. A write always fails when the primary one fails.
+	FanOutPolicy string `yaml:"fanout_policy"`
+}
+
+// ClientConfig controls how matsurihi.me is queried.
+type ClientConfig struct {
+	BaseUrl           string  `yaml:"base_url"`
+	IdolConcurrency   int     `yaml:"idol_concurrency"`
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+}
+
+// DaemonConfig controls how often the daemon polls border logs.
+type DaemonConfig struct {
+	// IdleInterval is the delay between checks for a live event when none is running
+	IdleInterval time.Duration `yaml:"idle_interval"`
+	// LiveInterval is the polling delay during a live event before its boost starts
+	LiveInterval time.Duration `yaml:"live_interval"`
+	// BoostInterval is the polling delay once the boost of a live event has started
+	BoostInterval time.Duration `yaml:"boost_interval"`
+	// FinalWindow is how long before the end of an event FinalInterval applies
+	FinalWindow time.Duration `yaml:"final_window"`
+	// FinalInterval is the polling delay during the final hours of an event
+	FinalInterval time.Duration `yaml:"final_interval"`
+}
+
+// SchedulerConfig sets the cron expressions the schedule command runs each job on.
+// Jobs with an empty expression are not scheduled.
+type SchedulerConfig struct {
+	Sync     string `yaml:"sync"`
+	Backfill string `yaml:"backfill"`
+	// BackfillEvents are the event IDs and ranges scheduled backfills re-sync, e.g. "10,12,20-25";
+	// the latest synced event when empty
+	BackfillEvents string `yaml:"backfill_events"`
+	// Verify validates the stored border infos of the latest synced event
+	Verify string `yaml:"verify"`
+}
+
+// Environment variables overriding the configuration file
+const (
+	ENV_EVENT_TYPES         = "MATSURI_EVENT_TYPES"
+	ENV_ANNIVERSARY_BORDERS = "MATSURI_ANNIVERSARY_BORDERS"
+	ENV_LOCAL_OUTPUT_PATH   = "MATSURI_LOCAL_OUTPUT_PATH"
+	ENV_BUCKET              = "MATSURI_BUCKET"
+	ENV_BORDER_INFO_DIR     = "MATSURI_BORDER_INFO_DIR"
+	ENV_EVENT_INFO_DIR      = "MATSURI_EVENT_INFO_DIR"
+	ENV_METADATA_DIR        = "MATSURI_METADATA_DIR"
+	ENV_BASE_URL            = "MATSURI_BASE_URL"
+	ENV_IDOL_CONCURRENCY    = "MATSURI_IDOL_CONCURRENCY"
+	ENV_REQUESTS_PER_SECOND = "MATSURI_REQUESTS_PER_SECOND"
+	ENV_SYNC_TIMEOUT        = "MATSURI_SYNC_TIMEOUT"
+	ENV_STORAGE_FORMAT      = "MATSURI_STORAGE_FORMAT"
+	ENV_SQLITE_PATH         = "MATSURI_SQLITE_PATH"
+	ENV_FANOUT_POLICY       = "MATSURI_FANOUT_POLICY"
+	ENV_VALIDATION_CADENCE  = "MATSURI_VALIDATION_CADENCE"
+	ENV_QUARANTINE          = "MATSURI_QUARANTINE"
+	ENV_LOCK_TTL            = "MATSURI_LOCK_TTL"
+	ENV_SYNC_CRON           = "MATSURI_SYNC_CRON"
+	ENV_BACKFILL_CRON       = "MATSURI_BACKFILL_CRON"
+	ENV_BACKFILL_EVENTS     = "MATSURI_BACKFILL_EVENTS"
+	ENV_VERIFY_CRON         = "MATSURI_VERIFY_CRON"
+	// Prefix of the per ranking type border overrides, e.g. MATSURI_BORDERS_EVENTPOINT=100,2500
+	ENV_BORDERS_PREFIX = "MATSURI_BORDERS_"
+)
+
+// Default returns the configuration used when no configuration file is given.
+func Default() Config {
+	return Config{
+		Sync: SyncConfig{
+			EventTypes: []models.EventType{models.Theater, models.Tour, models.Tune, models.Tale, models.Anniversary},
+			Borders: map[models.EventRankingType][]int{
+				models.EventPoint:     {100, 2500},
+				models.HighScore:      {100, 2000},
+				models.HighScore2:     {100, 2000},
+				models.HighScoreTotal: {100, 2000},
+				models.LoungePoint:    {10, 100},
+			},
+			AnniversaryBorders: []int{100, 1000},
+			Timeout:            30 * time.Minute,
+			Validation: ValidationConfig{
+				Cadence: 30 * time.Minute,
+			},
+			LockTTL: 5 * time.Minute,
+		},
+		Storage: StorageConfig{
+			LocalOutputPath: "data",
+			Bucket:          "mltd-border-predict",
+			BorderInfoDir:   "border_info",
+			EventInfoDir:    "event_info",
+			MetadataDir:     "metadata",
+			Format:          dao.FORMAT_CSV,
+			SQLitePath:      "data/matsuri.db",
+			FanOutPolicy:    dao.FAN_OUT_REQUIRE_PRIMARY,
+		},
+		Client: ClientConfig{
+			BaseUrl:           matsuri.BASE_URL_V2,
+			IdolConcurrency:   matsuri.DEFAULT_IDOL_CONCURRENCY,
+			RequestsPerSecond: matsuri.DEFAULT_REQUESTS_PER_SECOND,
+		},
+		Daemon: DaemonConfig{
+			IdleInterval:  time.Hour,
+			LiveInterval:  30 * time.Minute,
+			BoostInterval: 15 * time.Minute,
+			FinalWindow:   6 * time.Hour,
+			FinalInterval: 5 * time.Minute,
+		},
+		Scheduler: SchedulerConfig{
+			Sync: "*/30 * * * *",
+		},
+	}
+}
+
+// Load reads the configuration file at path on top of the defaults, applies the
+// environment variable overrides and validates the result.
+// An empty path skips the file and only applies the overrides.
+func Load(path string) (Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("failed to read config file %s: %w", path, err)
+		}
+		// Borders given in the file replace the default ones rather than being merged into them
+		defaultBorders := cfg.Sync.Borders
+		cfg.Sync.Borders = nil
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return Config{}, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+		if cfg.Sync.Borders == nil {
+			cfg.Sync.Borders = defaultBorders
+		}
+	}
+
+	if err := applyEnvOverrides(&cfg); err != nil {
+		return Config{}, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, fmt.Errorf("invalid config: %w", err)
+	}
+	return cfg, nil
+}
+
+// Validate reports every invalid field of the configuration at once.
+func (c Config) Validate() error {
+	var err error
+
+	if len(c.Sync.EventTypes) == 0 {
+		err = multierr.Append(err, errors.New("sync.event_types must not be empty"))
+	}
+	for _, eventType := range c.Sync.EventTypes {
+		if eventType < models.ShowTime || eventType > models.TalkParty {
+			err = multierr.Append(err, fmt.Errorf("sync.event_types: unknown event type %d", eventType))
+		}
+	}
+	if len(c.Sync.Borders[models.EventPoint]) == 0 {
+		err = multierr.Append(err, fmt.Errorf("sync.borders.%s must not be empty", models.EventPoint))
+	}
+	for rankingType, borders := range c.Sync.Borders {
+		if !isNormalRankingType(rankingType) {
+			err = multierr.Append(err, fmt.Errorf("sync.borders: unsupported ranking type %q", rankingType))
+		}
+		err = multierr.Append(err, validateBorders("sync.borders."+string(rankingType), borders))
+	}
+	if len(c.Sync.AnniversaryBorders) == 0 {
+		err = multierr.Append(err, errors.New("sync.anniversary_borders must not be empty"))
+	}
+	err = multierr.Append(err, validateBorders("sync.anniversary_borders", c.Sync.AnniversaryBorders))
+	if c.Sync.Timeout < 0 {
+		err = multierr.Append(err, fmt.Errorf("sync.timeout must not be negative, got %v", c.Sync.Timeout))
+	}
+	if c.Sync.Validation.Cadence <= 0 {
+		err = multierr.Append(err, fmt.Errorf("sync.validation.cadence must be positive, got %v", c.Sync.Validation.Cadence))
+	}
+	if c.Sync.LockTTL <= 0 {
+		err = multierr.Append(err, fmt.Errorf("sync.lock_ttl must be positive, got %v", c.Sync.LockTTL))
+	}
+
+	for name, value := range map[string]string{
+		"storage.local_output_path": c.Storage.LocalOutputPath,
+		"storage.bucket":            c.Storage.Bucket,
+		"storage.border_info_dir":   c.Storage.BorderInfoDir,
+		"storage.event_info_dir":    c.Storage.EventInfoDir,
+		"storage.metadata_dir":      c.Storage.MetadataDir,
+		"storage.sqlite_path":       c.Storage.SQLitePath,
+		"client.base_url":           c.Client.BaseUrl,
+	} {
+		if strings.TrimSpace(value) == "" {
+			err = multierr.Append(err, fmt.Errorf("%s must not be empty", name))
+		}
+	}
+
+	if c.Storage.Format != dao.FORMAT_CSV && c.Storage.Format != dao.FORMAT_PARQUET {
+		err = multierr.Append(err, fmt.Errorf("storage.format must be %s or %s, got %q", dao.FORMAT_CSV, dao.FORMAT_PARQUET, c.Storage.Format))
+	}
+
+	switch c.Storage.FanOutPolicy {
+	case dao.FAN_OUT_FAIL_FAST, dao.FAN_OUT_REQUIRE_PRIMARY:
+	default:
+		err = multierr.Append(err, fmt.Errorf("storage.fanout_policy must be %s or %s, got %q",
+			dao.FAN_OUT_FAIL_FAST, dao.FAN_OUT_REQUIRE_PRIMARY, c.Storage.FanOutPolicy))
+	}
+
+	if c.Client.IdolConcurrency < 1 {
+		err = multierr.Append(err, fmt.Errorf("client.idol_concurrency must be at least 1, got %d", c.Client.IdolConcurrency))
+	}
+	if c.Client.RequestsPerSecond < 0 {
+		err = multierr.Append(err, fmt.Errorf("client.requests_per_second must not be negative, got %v", c.Client.RequestsPerSecond))
+	}
+
+	for name, interval := range map[string]time.Duration{
+		"daemon.idle_interval":  c.Daemon.IdleInterval,
+		"daemon.live_interval":  c.Daemon.LiveInterval,
+		"daemon.boost_interval": c.Daemon.BoostInterval,
+		"daemon.final_interval": c.Daemon.FinalInterval,
+	} {
+		if interval <= 0 {
+			err = multierr.Append(err, fmt.Errorf("%s must be positive, got %v", name, interval))
+		}
+	}
+	if c.Daemon.FinalWindow < 0 {
+		err = multierr.Append(err, fmt.Errorf("daemon.final_window must not be negative, got %v", c.Daemon.FinalWindow))
+	}
+
+	for name, spec := range map[string]string{
+		"scheduler.sync":     c.Scheduler.Sync,
+		"scheduler.backfill": c.Scheduler.Backfill,
+		"scheduler.verify":   c.Scheduler.Verify,
+	} {
+		if spec == "" {
+			continue
+		}
+		if _, parseErr := scheduler.Parse(spec); parseErr != nil {
+			err = multierr.Append(err, fmt.Errorf("%s: %w", name, parseErr))
+		}
+	}
+
+	return err
+}
+
+func isNormalRankingType(rankingType models.EventRankingType) bool {
+	switch rankingType {
+	case models.EventPoint, models.HighScore, models.HighScore2, models.HighScoreTotal, models.LoungePoint:
+		return true
+	default:
+		return false
+	}
+}
+
+func validateBorders(name string, borders []int) error {
+	var err error
+	for _, border := range borders {
+		if border <= 0 {
+			err = multierr.Append(err, fmt.Errorf("%s: border must be positive, got %d", name, border))
+		}
+	}
+	return err
+}
+
+func applyEnvOverrides(cfg *Config) error {
+	var err error
+
+	stringOverrides := map[string]*string{
+		ENV_LOCAL_OUTPUT_PATH: &cfg.Storage.LocalOutputPath,
+		ENV_BUCKET:            &cfg.Storage.Bucket,
+		ENV_BORDER_INFO_DIR:   &cfg.Storage.BorderInfoDir,
+		ENV_EVENT_INFO_DIR:    &cfg.Storage.EventInfoDir,
+		ENV_METADATA_DIR:      &cfg.Storage.MetadataDir,
+		ENV_STORAGE_FORMAT:    &cfg.Storage.Format,
+		ENV_SQLITE_PATH:       &cfg.Storage.SQLitePath,
+		ENV_FANOUT_POLICY:     &cfg.Storage.FanOutPolicy,
+		ENV_BASE_URL:          &cfg.Client.BaseUrl,
+		ENV_SYNC_CRON:         &cfg.Scheduler.Sync,
+		ENV_BACKFILL_CRON:     &cfg.Scheduler.Backfill,
+		ENV_BACKFILL_EVENTS:   &cfg.Scheduler.BackfillEvents,
+		ENV_VERIFY_CRON:       &cfg.Scheduler.Verify,
+	}
+	for env, field := range stringOverrides {
+		if value, ok := os.LookupEnv(env); ok {
+			*field = value
+		}
+	}
+
+	if value, ok := os.LookupEnv(ENV_EVENT_TYPES); ok {
+		eventTypes, parseErr := parseIntList(value)
+		if parseErr != nil {
+			err = multierr.Append(err, fmt.Errorf("%s: %w", ENV_EVENT_TYPES, parseErr))
+		} else {
+			cfg.Sync.EventTypes = make([]models.EventType, 0, len(eventTypes))
+			for _, eventType := range eventTypes {
+				cfg.Sync.EventTypes = append(cfg.Sync.EventTypes, models.EventType(eventType))
+			}
+		}
+	}
+
+	if value, ok := os.LookupEnv(ENV_ANNIVERSARY_BORDERS); ok {
+		borders, parseErr := parseIntList(value)
+		if parseErr != nil {
+			err = multierr.Append(err, fmt.Errorf("%s: %w", ENV_ANNIVERSARY_BORDERS, parseErr))
+		} else {
+			cfg.Sync.AnniversaryBorders = borders
+		}
+	}
+
+	for _, rankingType := range []models.EventRankingType{
+		models.EventPoint, models.HighScore, models.HighScore2, models.HighScoreTotal, models.LoungePoint,
+	} {
+		env := ENV_BORDERS_PREFIX + strings.ToUpper(string(rankingType))
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+		borders, parseErr := parseIntList(value)
+		if parseErr != nil {
+			err = multierr.Append(err, fmt.Errorf("%s: %w", env, parseErr))
+			continue
+		}
+		if len(borders) == 0 {
+			delete(cfg.Sync.Borders, rankingType)
+		} else {
+			cfg.Sync.Borders[rankingType] = borders
+		}
+	}
+
+	if value, ok := os.LookupEnv(ENV_IDOL_CONCURRENCY); ok {
+		concurrency, parseErr := strconv.Atoi(strings.TrimSpace(value))
+		if parseErr != nil {
+			err = multierr.Append(err, fmt.Errorf("%s: %w", ENV_IDOL_CONCURRENCY, parseErr))
+		} else {
+			cfg.Client.IdolConcurrency = concurrency
+		}
+	}
+
+	if value, ok := os.LookupEnv(ENV_REQUESTS_PER_SECOND); ok {
+		requestsPerSecond, parseErr := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if parseErr != nil {
+			err = multierr.Append(err, fmt.Errorf("%s: %w", ENV_REQUESTS_PER_SECOND, parseErr))
+		} else {
+			cfg.Client.RequestsPerSecond = requestsPerSecond
+		}
+	}
+
+	if value, ok := os.LookupEnv(ENV_SYNC_TIMEOUT); ok {
+		timeout, parseErr := time.ParseDuration(strings.TrimSpace(value))
+		if parseErr != nil {
+			err = multierr.Append(err, fmt.Errorf("%s: %w", ENV_SYNC_TIMEOUT, parseErr))
+		} else {
+			cfg.Sync.Timeout = timeout
+		}
+	}
+
+	if value, ok := os.LookupEnv(ENV_VALIDATION_CADENCE); ok {
+		cadence, parseErr := time.ParseDuration(strings.TrimSpace(value))
+		if parseErr != nil {
+			err = multierr.Append(err, fmt.Errorf("%s: %w", ENV_VALIDATION_CADENCE, parseErr))
+		} else {
+			cfg.Sync.Validation.Cadence = cadence
+		}
+	}
+
+	if value, ok := os.LookupEnv(ENV_LOCK_TTL); ok {
+		ttl, parseErr := time.ParseDuration(strings.TrimSpace(value))
+		if parseErr != nil {
+			err = multierr.Append(err, fmt.Errorf("%s: %w", ENV_LOCK_TTL, parseErr))
+		} else {
+			cfg.Sync.LockTTL = ttl
+		}
+	}
+
+	if value, ok := os.LookupEnv(ENV_QUARANTINE); ok {
+		quarantine, parseErr := strconv.ParseBool(strings.TrimSpace(value))
+		if parseErr != nil {
+			err = multierr.Append(err, fmt.Errorf("%s: %w", ENV_QUARANTINE, parseErr))
+		} else {
+			cfg.Sync.Validation.Quarantine = quarantine
+		}
+	}
+
+	return err
+}
+
+// parseIntList parses a comma separated list of integers. An empty string yields an empty list.
+func parseIntList(value string) ([]int, error) {
+	var ints []int
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		i, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, err
+		}
+		ints = append(ints, i)
+	}
+	return ints, nil
+}
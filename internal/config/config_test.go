@@ -0,0 +1,137 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestLoad_NoFileUsesDefaults(t *testing.T) {
+	cfg, err := Load("")
+	assert.NoError(t, err)
+	assert.Equal(t, Default(), cfg)
+}
+
+func TestLoad_FileOverridesDefaults(t *testing.T) {
+	path := writeConfigFile(t, `
+sync:
+  event_types: [3]
+  borders:
+    eventPoint: [100]
+storage:
+  bucket: other-bucket
+  format: parquet
+client:
+  idol_concurrency: 2
+daemon:
+  live_interval: 20m
+scheduler:
+  verify: "@daily"
+`)
+	cfg, err := Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.EventType{models.Theater}, cfg.Sync.EventTypes)
+	assert.Equal(t, map[models.EventRankingType][]int{models.EventPoint: {100}}, cfg.Sync.Borders)
+	assert.Equal(t, Default().Sync.AnniversaryBorders, cfg.Sync.AnniversaryBorders)
+	assert.Equal(t, "other-bucket", cfg.Storage.Bucket)
+	assert.Equal(t, "parquet", cfg.Storage.Format)
+	assert.Equal(t, Default().Storage.MetadataDir, cfg.Storage.MetadataDir)
+	assert.Equal(t, 2, cfg.Client.IdolConcurrency)
+	assert.Equal(t, 20*time.Minute, cfg.Daemon.LiveInterval)
+	assert.Equal(t, Default().Daemon.FinalInterval, cfg.Daemon.FinalInterval)
+	assert.Equal(t, "@daily", cfg.Scheduler.Verify)
+	assert.Equal(t, Default().Scheduler.Sync, cfg.Scheduler.Sync)
+}
+
+func TestLoad_EnvOverridesFile(t *testing.T) {
+	path := writeConfigFile(t, `
+storage:
+  bucket: file-bucket
+`)
+	t.Setenv(ENV_BUCKET, "env-bucket")
+	t.Setenv(ENV_EVENT_TYPES, "3, 4")
+	t.Setenv(ENV_BORDERS_PREFIX+"LOUNGEPOINT", "")
+	t.Setenv(ENV_BORDERS_PREFIX+"HIGHSCORE", "100,5000")
+	t.Setenv(ENV_REQUESTS_PER_SECOND, "2.5")
+	t.Setenv(ENV_SYNC_TIMEOUT, "10m")
+	t.Setenv(ENV_QUARANTINE, "true")
+	t.Setenv(ENV_LOCK_TTL, "15m")
+	t.Setenv(ENV_SYNC_CRON, "0 * * * *")
+
+	cfg, err := Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "env-bucket", cfg.Storage.Bucket)
+	assert.Equal(t, []models.EventType{models.Theater, models.Tour}, cfg.Sync.EventTypes)
+	assert.NotContains(t, cfg.Sync.Borders, models.LoungePoint)
+	assert.Equal(t, []int{100, 5000}, cfg.Sync.Borders[models.HighScore])
+	assert.Equal(t, 2.5, cfg.Client.RequestsPerSecond)
+	assert.Equal(t, 10*time.Minute, cfg.Sync.Timeout)
+	assert.True(t, cfg.Sync.Validation.Quarantine)
+	assert.Equal(t, 30*time.Minute, cfg.Sync.Validation.Cadence)
+	assert.Equal(t, 15*time.Minute, cfg.Sync.LockTTL)
+	assert.Equal(t, "0 * * * *", cfg.Scheduler.Sync)
+}
+
+func TestLoad_InvalidEnv(t *testing.T) {
+	t.Setenv(ENV_IDOL_CONCURRENCY, "many")
+	_, err := Load("")
+	assert.ErrorContains(t, err, ENV_IDOL_CONCURRENCY)
+}
+
+func TestLoad_MissingFile(t *testing.T) {
+	_, err := Load(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestLoad_ReportsAllValidationErrors(t *testing.T) {
+	path := writeConfigFile(t, `
+sync:
+  event_types: [99]
+  borders:
+    idolPoint: [100]
+  anniversary_borders: [-1]
+  timeout: -1s
+  validation:
+    cadence: 0s
+  lock_ttl: 0s
+storage:
+  bucket: ""
+  format: xml
+  fanout_policy: sometimes
+client:
+  idol_concurrency: 0
+daemon:
+  boost_interval: 0s
+scheduler:
+  backfill: "every day"
+`)
+	_, err := Load(path)
+	assert.Error(t, err)
+	for _, expected := range []string{
+		"unknown event type 99",
+		"sync.borders.eventPoint must not be empty",
+		`unsupported ranking type "idolPoint"`,
+		"sync.anniversary_borders: border must be positive",
+		"sync.timeout must not be negative",
+		"sync.validation.cadence must be positive",
+		"storage.bucket must not be empty",
+		`storage.format must be csv or parquet, got "xml"`,
+		`storage.fanout_policy must be fail_fast or require_primary, got "sometimes"`,
+		"client.idol_concurrency must be at least 1",
+		"daemon.boost_interval must be positive",
+		"sync.lock_ttl must be positive",
+		`scheduler.backfill: invalid cron expression "every day"`,
+	} {
+		assert.ErrorContains(t, err, expected)
+	}
+}
@@ -2,6 +2,12 @@ package dao
 
 import (
 	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/alceccentric/matsurihi-cron/models"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
@@ -9,33 +15,266 @@ import (
 
 const (
 	LATEST_EVENT_BORDER_INFO_FILE = "latest_event_border_info.json"
+	BORDER_HIGH_WATER_MARKS_FILE  = "border_high_water_marks.json"
+	ETAGS_FILE                    = "etags.json"
 	EVENT_INFO_FILENAME           = "event_info_all.csv"
 	BORDER_INFO_FILENAME_FORMAT   = "border_info_%d_%d_%d.csv"
+	// Used by ranking types other than event point and idol point
+	RANKING_BORDER_INFO_FILENAME_FORMAT = "border_info_%d_%s_%d_%d.csv"
+	// Predictions are stored alongside the border infos of their event
+	BORDER_PREDICTION_FILENAME_FORMAT = "border_prediction_%d.json"
 )
 
 type BorderGroupKey struct {
-	EventId int
-	IdolId  int
-	Border  int
+	EventId     int
+	RankingType models.EventRankingType
+	IdolId      int
+	Border      int
+}
+
+// BorderHighWaterMark records the latest AggregatedAt persisted for a border group.
+type BorderHighWaterMark struct {
+	EventId      int                     `json:"event_id"`
+	RankingType  models.EventRankingType `json:"ranking_type"`
+	IdolId       int                     `json:"idol_id"`
+	Border       int                     `json:"border"`
+	AggregatedAt time.Time               `json:"aggregated_at"`
 }
 
 type S3Uploader interface {
 	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
 	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
 }
 
+// DAO persists event and border infos. Every method honours cancellation of ctx;
+// implementations backed by local files check it between writes.
 type DAO interface {
-	SaveEventInfos(eventInfos []models.EventInfo) error
-	SaveBorderInfos(borderInfos []models.BorderInfo) error
-	GetLatestEventInfo() (models.EventInfo, error)
-	SaveLatestEventInfo(models.EventInfo) error
+	SaveEventInfos(ctx context.Context, eventInfos []models.EventInfo) error
+	// SaveBorderInfos merges the given border infos into the stored border groups
+	// and advances the high-water mark of every group it touches. Returns the manifests
+	// of the groups written, sorted by key.
+	SaveBorderInfos(ctx context.Context, borderInfos []models.BorderInfo) ([]BorderGroupManifest, error)
+	GetLatestEventInfo(ctx context.Context) (models.EventInfo, error)
+	SaveLatestEventInfo(ctx context.Context, info models.EventInfo) error
+	// GetBorderHighWaterMarks returns the latest persisted AggregatedAt per border group.
+	GetBorderHighWaterMarks(ctx context.Context) (map[BorderGroupKey]time.Time, error)
+	// GetETags returns the persisted response ETags keyed by request URL.
+	GetETags(ctx context.Context) (map[string]string, error)
+	// SaveETags replaces the persisted response ETags.
+	SaveETags(ctx context.Context, etags map[string]string) error
+	// ListEventInfos returns the stored event infos, or an empty slice if none were saved yet.
+	ListEventInfos(ctx context.Context) ([]models.EventInfo, error)
+	// GetBorderInfos returns the stored border infos of a group sorted by AggregatedAt,
+	// or an empty slice if the group was never saved.
+	GetBorderInfos(ctx context.Context, key BorderGroupKey) ([]models.BorderInfo, error)
+	// ListBorderGroups returns the keys of the border groups stored for an event.
+	ListBorderGroups(ctx context.Context, eventId int) ([]BorderGroupKey, error)
+	// SaveRunManifest saves the manifest of a run and appends it to the manifest index.
+	SaveRunManifest(ctx context.Context, manifest RunManifest) error
+	// GetRunManifestIndex returns the latest RUN_MANIFEST_INDEX_SIZE runs, oldest first.
+	GetRunManifestIndex(ctx context.Context) ([]RunManifestIndexEntry, error)
+	// GetRunManifest returns the manifest of a run, or ErrRunManifestNotFound.
+	GetRunManifest(ctx context.Context, runId string) (RunManifest, error)
+	// SaveBorderPredictions replaces the stored predictions of an event.
+	SaveBorderPredictions(ctx context.Context, eventId int, predictions []models.BorderPrediction) error
+	// GetBorderPredictions returns the stored predictions of an event, or an empty slice if none were saved.
+	GetBorderPredictions(ctx context.Context, eventId int) ([]models.BorderPrediction, error)
+	// AcquireLock leases the lock name to owner for ttl, or extends the lease when owner already holds it.
+	// Returns ErrLockHeld while another owner holds an unexpired lease.
+	AcquireLock(ctx context.Context, name, owner string, ttl time.Duration) (Lease, error)
+	// ReleaseLock ends the lease of owner on the lock name. Locks held by other owners are left untouched.
+	ReleaseLock(ctx context.Context, name, owner string) error
 }
 
 func groupByEventIdAndBorder(infos []models.BorderInfo) map[BorderGroupKey][]models.BorderInfo {
 	groups := make(map[BorderGroupKey][]models.BorderInfo)
 	for _, info := range infos {
-		key := BorderGroupKey{EventId: info.EventId, Border: info.Border, IdolId: info.IdolId}
+		key := BorderGroupKey{EventId: info.EventId, RankingType: info.RankingType, Border: info.Border, IdolId: info.IdolId}
 		groups[key] = append(groups[key], info)
 	}
 	return groups
 }
+
+var borderInfoFilenamePattern = regexp.MustCompile(`^border_info_(\d+)_(?:([a-zA-Z][a-zA-Z0-9]*)_)?(\d+)_(\d+)\.[a-z]+$`)
+
+var borderPredictionFilenamePattern = regexp.MustCompile(`^border_prediction_(\d+)\.json$`)
+
+// ObjectEventId returns the event a stored object belongs to from the file name of its key or path,
+// or false for the objects of no single event, such as event infos and metadata.
+func ObjectEventId(key string) (int, bool) {
+	name := path.Base(key)
+	if group, ok := parseBorderInfoFilename(name); ok {
+		return group.EventId, true
+	}
+	if matches := borderPredictionFilenamePattern.FindStringSubmatch(name); matches != nil {
+		eventId, _ := strconv.Atoi(matches[1])
+		return eventId, true
+	}
+	return 0, false
+}
+
+// borderInfoFilenamePrefix returns the prefix shared by the file names of every border group of an event.
+func borderInfoFilenamePrefix(eventId int) string {
+	return fmt.Sprintf("border_info_%d_", eventId)
+}
+
+// parseBorderInfoFilename is the inverse of borderInfoFilename, whatever the extension of name.
+// Groups stored under the original naming scheme are reported as idol point groups
+// when they belong to an idol and as event point groups otherwise.
+func parseBorderInfoFilename(name string) (BorderGroupKey, bool) {
+	matches := borderInfoFilenamePattern.FindStringSubmatch(name)
+	if matches == nil {
+		return BorderGroupKey{}, false
+	}
+	eventId, _ := strconv.Atoi(matches[1])
+	idolId, _ := strconv.Atoi(matches[3])
+	border, _ := strconv.Atoi(matches[4])
+	key := BorderGroupKey{
+		EventId:     eventId,
+		RankingType: models.EventRankingType(matches[2]),
+		IdolId:      idolId,
+		Border:      border,
+	}
+	if key.RankingType == "" {
+		if key.IdolId > 0 {
+			key.RankingType = models.IdolPoint
+		} else {
+			key.RankingType = models.EventPoint
+		}
+	}
+	return key, true
+}
+
+// borderGroupKeysOf returns the sorted keys of the border groups of an event stored under the
+// given file names, in any of the stored formats.
+func borderGroupKeysOf(names []string, eventId int, serializer Serializer) []BorderGroupKey {
+	seen := make(map[BorderGroupKey]struct{})
+	keys := make([]BorderGroupKey, 0)
+	for _, name := range names {
+		if !hasStoredExtension(name, serializer) {
+			continue
+		}
+		key, ok := parseBorderInfoFilename(name)
+		if _, dup := seen[key]; !ok || dup || key.EventId != eventId {
+			continue
+		}
+		seen[key] = struct{}{}
+		keys = append(keys, key)
+	}
+	sortBorderGroupKeys(keys)
+	return keys
+}
+
+func sortBorderGroupKeys(keys []BorderGroupKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		return lessBorderGroupKey(keys[i], keys[j])
+	})
+}
+
+func lessBorderGroupKey(a, b BorderGroupKey) bool {
+	if a.EventId != b.EventId {
+		return a.EventId < b.EventId
+	}
+	if a.RankingType != b.RankingType {
+		return a.RankingType < b.RankingType
+	}
+	if a.IdolId != b.IdolId {
+		return a.IdolId < b.IdolId
+	}
+	return a.Border < b.Border
+}
+
+// borderInfoFilename returns the file name a border group is stored under.
+// Event point and idol point groups keep the original naming scheme so existing files stay in place.
+func borderInfoFilename(key BorderGroupKey) string {
+	switch key.RankingType {
+	case "", models.EventPoint, models.IdolPoint:
+		return fmt.Sprintf(BORDER_INFO_FILENAME_FORMAT, key.EventId, key.IdolId, key.Border)
+	default:
+		return fmt.Sprintf(RANKING_BORDER_INFO_FILENAME_FORMAT, key.EventId, key.RankingType, key.IdolId, key.Border)
+	}
+}
+
+// mergeBorderInfos merges incoming border infos into existing ones of the same group.
+// Rows are deduplicated by AggregatedAt, with incoming rows taking precedence,
+// and the result is sorted by AggregatedAt in ascending order.
+func mergeBorderInfos(existing, incoming []models.BorderInfo) []models.BorderInfo {
+	byAggregatedAt := make(map[int64]models.BorderInfo, len(existing)+len(incoming))
+	for _, info := range existing {
+		byAggregatedAt[info.AggregatedAt.UnixNano()] = info
+	}
+	for _, info := range incoming {
+		byAggregatedAt[info.AggregatedAt.UnixNano()] = info
+	}
+
+	merged := make([]models.BorderInfo, 0, len(byAggregatedAt))
+	for _, info := range byAggregatedAt {
+		merged = append(merged, info)
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].AggregatedAt.Before(merged[j].AggregatedAt)
+	})
+	return merged
+}
+
+// mergeEventInfos merges incoming event infos into existing ones. Events are deduplicated by ID,
+// with incoming infos taking precedence, and the result is sorted by event ID.
+func mergeEventInfos(existing, incoming []models.EventInfo) []models.EventInfo {
+	byEventId := make(map[int]models.EventInfo, len(existing)+len(incoming))
+	for _, info := range existing {
+		byEventId[info.EventId] = info
+	}
+	for _, info := range incoming {
+		byEventId[info.EventId] = info
+	}
+
+	merged := make([]models.EventInfo, 0, len(byEventId))
+	for _, info := range byEventId {
+		merged = append(merged, info)
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].EventId < merged[j].EventId
+	})
+	return merged
+}
+
+// updateHighWaterMarks advances the high-water marks with the latest AggregatedAt of each group.
+func updateHighWaterMarks(marks map[BorderGroupKey]time.Time, groups map[BorderGroupKey][]models.BorderInfo) {
+	for key, infos := range groups {
+		for _, info := range infos {
+			if info.AggregatedAt.After(marks[key]) {
+				marks[key] = info.AggregatedAt
+			}
+		}
+	}
+}
+
+func highWaterMarksFromList(list []BorderHighWaterMark) map[BorderGroupKey]time.Time {
+	marks := make(map[BorderGroupKey]time.Time, len(list))
+	for _, mark := range list {
+		key := BorderGroupKey{EventId: mark.EventId, RankingType: mark.RankingType, IdolId: mark.IdolId, Border: mark.Border}
+		marks[key] = mark.AggregatedAt
+	}
+	return marks
+}
+
+func highWaterMarksToList(marks map[BorderGroupKey]time.Time) []BorderHighWaterMark {
+	list := make([]BorderHighWaterMark, 0, len(marks))
+	for key, aggregatedAt := range marks {
+		list = append(list, BorderHighWaterMark{
+			EventId:      key.EventId,
+			RankingType:  key.RankingType,
+			IdolId:       key.IdolId,
+			Border:       key.Border,
+			AggregatedAt: aggregatedAt,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return lessBorderGroupKey(
+			BorderGroupKey{EventId: list[i].EventId, RankingType: list[i].RankingType, IdolId: list[i].IdolId, Border: list[i].Border},
+			BorderGroupKey{EventId: list[j].EventId, RankingType: list[j].RankingType, IdolId: list[j].IdolId, Border: list[j].Border},
+		)
+	})
+	return list
+}
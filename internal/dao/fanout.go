@@ -0,0 +1,270 @@
+package dao
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/internal/logging"
+	"github.com/alceccentric/matsurihi-cron/models"
+	"go.uber.org/multierr"
+)
+
+// Policies deciding when a write to a FanOutDAO fails
+const (
+	// FAN_OUT_FAIL_FAST stops at the first backend failing a write and fails the write
+	FAN_OUT_FAIL_FAST = "fail_fast"
+	// FAN_OUT_REQUIRE_PRIMARY writes to every other backend once the primary one succeeded, and only
+	// fails when the primary one fails
+	FAN_OUT_REQUIRE_PRIMARY = "require_primary"
+)
+
+// FanOutBackend is a named backend of a FanOutDAO.
+type FanOutBackend struct {
+	Name string
+	DAO  DAO
+}
+
+// FanOutError reports the backends that failed a write, keyed by backend name.
+type FanOutError struct {
+	Op     string
+	Errors map[string]error
+}
+
+func (e *FanOutError) Error() string {
+	names := make([]string, 0, len(e.Errors))
+	for name := range e.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	messages := make([]string, 0, len(names))
+	for _, name := range names {
+		messages = append(messages, name+": "+e.Errors[name].Error())
+	}
+	return fmt.Sprintf("%s failed on %d backends: %s", e.Op, len(names), strings.Join(messages, "; "))
+}
+
+// FanOutDAO writes to several backends in order and reads from the first one, the primary.
+// A write failing on the primary always fails, as the high-water marks and ETags of the next runs
+// are read from it. The failures of the other backends tolerated by the policy are kept for Failures,
+// and those backends catch up with the next write: border infos they missed are copied from the
+// primary, found from their own high-water marks, while the other writes replace whole records.
+type FanOutDAO struct {
+	backends []FanOutBackend
+	policy   string
+
+	mu       sync.Mutex
+	failures []*FanOutError
+}
+
+func NewFanOutDAO(policy string, backends ...FanOutBackend) (*FanOutDAO, error) {
+	switch policy {
+	case FAN_OUT_FAIL_FAST, FAN_OUT_REQUIRE_PRIMARY:
+	default:
+		return nil, fmt.Errorf("unknown fan-out policy: %s", policy)
+	}
+	if len(backends) == 0 {
+		return nil, errors.New("fan-out DAO needs at least one backend")
+	}
+	names := make(map[string]struct{}, len(backends))
+	for _, backend := range backends {
+		if _, ok := names[backend.Name]; ok {
+			return nil, fmt.Errorf("duplicate fan-out backend: %s", backend.Name)
+		}
+		names[backend.Name] = struct{}{}
+	}
+	return &FanOutDAO{backends: backends, policy: policy}, nil
+}
+
+// Close closes every backend that needs closing.
+func (u *FanOutDAO) Close() error {
+	var err error
+	for _, backend := range u.backends {
+		if closer, ok := backend.DAO.(io.Closer); ok {
+			err = multierr.Append(err, closer.Close())
+		}
+	}
+	return err
+}
+
+func (u *FanOutDAO) primary() DAO {
+	return u.backends[0].DAO
+}
+
+func (u *FanOutDAO) SaveEventInfos(ctx context.Context, eventInfos []models.EventInfo) error {
+	return u.write(ctx, "save event infos", func(backend FanOutBackend) error {
+		return backend.DAO.SaveEventInfos(ctx, eventInfos)
+	})
+}
+
+// SaveBorderInfos returns the manifests of the groups written to the primary. The other backends
+// are also sent the border infos of the primary they missed, unless the primary failed the write.
+func (u *FanOutDAO) SaveBorderInfos(ctx context.Context, borderInfos []models.BorderInfo) ([]BorderGroupManifest, error) {
+	primaryMarks, err := u.primary().GetBorderHighWaterMarks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get high-water marks of the primary backend: %w", err)
+	}
+
+	var manifests []BorderGroupManifest
+	primaryFailed := false
+	err = u.write(ctx, "save border infos", func(backend FanOutBackend) error {
+		if backend.Name == u.backends[0].Name {
+			written, err := backend.DAO.SaveBorderInfos(ctx, borderInfos)
+			manifests, primaryFailed = written, err != nil
+			return err
+		}
+		infos := borderInfos
+		if !primaryFailed {
+			missed, err := u.missedBorderInfos(ctx, backend, primaryMarks)
+			if err != nil {
+				return err
+			}
+			infos = append(missed, borderInfos...)
+		}
+		_, err := backend.DAO.SaveBorderInfos(ctx, infos)
+		return err
+	})
+	return manifests, err
+}
+
+// missedBorderInfos returns the border infos stored by the primary that a backend missed: the ones
+// after its own high-water mark in the groups where it was behind the primary before this write.
+func (u *FanOutDAO) missedBorderInfos(ctx context.Context, backend FanOutBackend, primaryMarks map[BorderGroupKey]time.Time) ([]models.BorderInfo, error) {
+	marks, err := backend.DAO.GetBorderHighWaterMarks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get high-water marks: %w", err)
+	}
+
+	var missed []models.BorderInfo
+	for key, primaryMark := range primaryMarks {
+		mark := marks[key]
+		if !mark.Before(primaryMark) {
+			continue
+		}
+		infos, err := u.primary().GetBorderInfos(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get border infos of the primary backend: %w", err)
+		}
+		for _, info := range infos {
+			if info.AggregatedAt.After(mark) {
+				missed = append(missed, info)
+			}
+		}
+	}
+	if len(missed) > 0 {
+		logging.FromContext(ctx).WithField("backend", backend.Name).Infof("Catching up %d border infos missed by the backend", len(missed))
+	}
+	return missed, nil
+}
+
+func (u *FanOutDAO) SaveLatestEventInfo(ctx context.Context, info models.EventInfo) error {
+	return u.write(ctx, "save latest event info", func(backend FanOutBackend) error {
+		return backend.DAO.SaveLatestEventInfo(ctx, info)
+	})
+}
+
+func (u *FanOutDAO) SaveETags(ctx context.Context, etags map[string]string) error {
+	return u.write(ctx, "save etags", func(backend FanOutBackend) error {
+		return backend.DAO.SaveETags(ctx, etags)
+	})
+}
+
+func (u *FanOutDAO) SaveRunManifest(ctx context.Context, manifest RunManifest) error {
+	return u.write(ctx, "save run manifest", func(backend FanOutBackend) error {
+		return backend.DAO.SaveRunManifest(ctx, manifest)
+	})
+}
+
+func (u *FanOutDAO) SaveBorderPredictions(ctx context.Context, eventId int, predictions []models.BorderPrediction) error {
+	return u.write(ctx, "save border predictions", func(backend FanOutBackend) error {
+		return backend.DAO.SaveBorderPredictions(ctx, eventId, predictions)
+	})
+}
+
+func (u *FanOutDAO) GetLatestEventInfo(ctx context.Context) (models.EventInfo, error) {
+	return u.primary().GetLatestEventInfo(ctx)
+}
+
+func (u *FanOutDAO) GetBorderHighWaterMarks(ctx context.Context) (map[BorderGroupKey]time.Time, error) {
+	return u.primary().GetBorderHighWaterMarks(ctx)
+}
+
+func (u *FanOutDAO) GetETags(ctx context.Context) (map[string]string, error) {
+	return u.primary().GetETags(ctx)
+}
+
+func (u *FanOutDAO) ListEventInfos(ctx context.Context) ([]models.EventInfo, error) {
+	return u.primary().ListEventInfos(ctx)
+}
+
+func (u *FanOutDAO) GetBorderInfos(ctx context.Context, key BorderGroupKey) ([]models.BorderInfo, error) {
+	return u.primary().GetBorderInfos(ctx, key)
+}
+
+func (u *FanOutDAO) ListBorderGroups(ctx context.Context, eventId int) ([]BorderGroupKey, error) {
+	return u.primary().ListBorderGroups(ctx, eventId)
+}
+
+func (u *FanOutDAO) GetRunManifestIndex(ctx context.Context) ([]RunManifestIndexEntry, error) {
+	return u.primary().GetRunManifestIndex(ctx)
+}
+
+func (u *FanOutDAO) GetRunManifest(ctx context.Context, runId string) (RunManifest, error) {
+	return u.primary().GetRunManifest(ctx, runId)
+}
+
+func (u *FanOutDAO) GetBorderPredictions(ctx context.Context, eventId int) ([]models.BorderPrediction, error) {
+	return u.primary().GetBorderPredictions(ctx, eventId)
+}
+
+// AcquireLock only leases the lock on the primary, which every run reads its state from.
+func (u *FanOutDAO) AcquireLock(ctx context.Context, name, owner string, ttl time.Duration) (Lease, error) {
+	return u.primary().AcquireLock(ctx, name, owner, ttl)
+}
+
+func (u *FanOutDAO) ReleaseLock(ctx context.Context, name, owner string) error {
+	return u.primary().ReleaseLock(ctx, name, owner)
+}
+
+// Failures returns the write failures tolerated by the policy so far, oldest first.
+func (u *FanOutDAO) Failures() []*FanOutError {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]*FanOutError(nil), u.failures...)
+}
+
+// write applies fn to the backends in order and decides from the policy whether the failures
+// fail the write. Tolerated failures are logged with their backend and kept for Failures.
+func (u *FanOutDAO) write(ctx context.Context, op string, fn func(backend FanOutBackend) error) error {
+	errs := make(map[string]error)
+	for i, backend := range u.backends {
+		if err := fn(backend); err != nil {
+			errs[backend.Name] = err
+			if u.policy == FAN_OUT_FAIL_FAST || i == 0 {
+				break
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+
+	fanOutErr := &FanOutError{Op: op, Errors: errs}
+	if _, primaryFailed := errs[u.backends[0].Name]; primaryFailed || u.policy == FAN_OUT_FAIL_FAST {
+		return fanOutErr
+	}
+
+	for name, err := range errs {
+		logging.FromContext(ctx).WithError(err).WithField("backend", name).Warnf("Failed to %s, ignored by the %s policy", op, u.policy)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures = append(u.failures, fanOutErr)
+	return nil
+}
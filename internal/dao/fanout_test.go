@@ -0,0 +1,160 @@
+package dao
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingDAO fails every write and delegates reads to the embedded DAO.
+type failingDAO struct {
+	DAO
+	writes int
+}
+
+func (f *failingDAO) SaveEventInfos(context.Context, []models.EventInfo) error {
+	f.writes++
+	return errors.New("backend down")
+}
+
+func newFanOutTestBackends(t *testing.T) (FanOutBackend, FanOutBackend, *failingDAO) {
+	primary := FanOutBackend{Name: "primary", DAO: newTestLocalDAO(t, t.TempDir(), "b", "e", "m")}
+	mirror := FanOutBackend{Name: "mirror", DAO: newTestLocalDAO(t, t.TempDir(), "b", "e", "m")}
+	return primary, mirror, &failingDAO{}
+}
+
+func TestFanOutDAO_WritesToEveryBackend(t *testing.T) {
+	ctx := context.Background()
+	primary, mirror, _ := newFanOutTestBackends(t)
+	dao, err := NewFanOutDAO(FAN_OUT_FAIL_FAST, primary, mirror)
+	assert.NoError(t, err)
+
+	assert.NoError(t, dao.SaveEventInfos(ctx, []models.EventInfo{{EventId: 1}}))
+	for _, backend := range []FanOutBackend{primary, mirror} {
+		infos, err := backend.DAO.ListEventInfos(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, infos, 1, backend.Name)
+	}
+}
+
+func TestFanOutDAO_Policies(t *testing.T) {
+	ctx := context.Background()
+	infos := []models.EventInfo{{EventId: 1}}
+
+	t.Run("fail fast stops at the first failure", func(t *testing.T) {
+		primary, mirror, failing := newFanOutTestBackends(t)
+		dao, _ := NewFanOutDAO(FAN_OUT_FAIL_FAST, FanOutBackend{Name: "broken", DAO: failing}, primary, mirror)
+		err := dao.SaveEventInfos(ctx, infos)
+		var fanOutErr *FanOutError
+		assert.ErrorAs(t, err, &fanOutErr)
+		assert.Contains(t, fanOutErr.Errors, "broken")
+		saved, _ := primary.DAO.ListEventInfos(ctx)
+		assert.Empty(t, saved)
+	})
+
+	t.Run("require primary tolerates mirror failures", func(t *testing.T) {
+		primary, mirror, failing := newFanOutTestBackends(t)
+		dao, _ := NewFanOutDAO(FAN_OUT_REQUIRE_PRIMARY, primary, FanOutBackend{Name: "broken", DAO: failing}, mirror)
+		assert.NoError(t, dao.SaveEventInfos(ctx, infos))
+		assert.Equal(t, 1, failing.writes)
+		saved, _ := mirror.DAO.ListEventInfos(ctx)
+		assert.Len(t, saved, 1, "the backends after a failing one are still written")
+		assert.Len(t, dao.Failures(), 1)
+		assert.Contains(t, dao.Failures()[0].Errors, "broken")
+
+		_, mirror, failing = newFanOutTestBackends(t)
+		dao, _ = NewFanOutDAO(FAN_OUT_REQUIRE_PRIMARY, FanOutBackend{Name: "broken", DAO: failing}, mirror)
+		assert.ErrorContains(t, dao.SaveEventInfos(ctx, infos), "broken: backend down")
+		saved, _ = mirror.DAO.ListEventInfos(ctx)
+		assert.Empty(t, saved, "nothing is written once the primary failed")
+	})
+}
+
+// flakyDAO fails the writes of border infos while down.
+type flakyDAO struct {
+	DAO
+	down bool
+}
+
+func (f *flakyDAO) SaveBorderInfos(ctx context.Context, borderInfos []models.BorderInfo) ([]BorderGroupManifest, error) {
+	if f.down {
+		return nil, errors.New("backend down")
+	}
+	return f.DAO.SaveBorderInfos(ctx, borderInfos)
+}
+
+func TestFanOutDAO_CatchesUpMissedBorderInfos(t *testing.T) {
+	ctx := context.Background()
+	primary, mirror, _ := newFanOutTestBackends(t)
+	flaky := &flakyDAO{DAO: mirror.DAO}
+	dao, err := NewFanOutDAO(FAN_OUT_REQUIRE_PRIMARY, primary, FanOutBackend{Name: "mirror", DAO: flaky})
+	assert.NoError(t, err)
+	t1 := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	info := func(border int, at time.Time, score int) models.BorderInfo {
+		return models.BorderInfo{EventId: 1, RankingType: models.EventPoint, Border: border, AggregatedAt: at, Score: score}
+	}
+
+	saveBorderInfos(t, dao, []models.BorderInfo{info(100, t1, 10)})
+	flaky.down = true
+	saveBorderInfos(t, dao, []models.BorderInfo{info(100, t1.Add(time.Hour), 20), info(2500, t1.Add(time.Hour), 5)})
+	assert.Len(t, dao.Failures(), 1)
+
+	// The next write sends the mirror what it missed along with the new border infos
+	flaky.down = false
+	saveBorderInfos(t, dao, []models.BorderInfo{info(100, t1.Add(2*time.Hour), 30)})
+	for _, border := range []int{100, 2500} {
+		key := BorderGroupKey{EventId: 1, RankingType: models.EventPoint, Border: border}
+		want, err := primary.DAO.GetBorderInfos(ctx, key)
+		assert.NoError(t, err)
+		got, err := mirror.DAO.GetBorderInfos(ctx, key)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got, "border %d", border)
+	}
+	marks, err := mirror.DAO.GetBorderHighWaterMarks(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, marks, 2)
+}
+
+func TestFanOutDAO_ReadsFromPrimary(t *testing.T) {
+	ctx := context.Background()
+	primary, mirror, _ := newFanOutTestBackends(t)
+	assert.NoError(t, mirror.DAO.SaveLatestEventInfo(ctx, models.EventInfo{EventId: 9}))
+	dao, _ := NewFanOutDAO(FAN_OUT_REQUIRE_PRIMARY, primary, mirror)
+
+	latest, err := dao.GetLatestEventInfo(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, latest.EventId)
+}
+
+func TestNewFanOutDAO_InvalidArguments(t *testing.T) {
+	primary, _, _ := newFanOutTestBackends(t)
+	_, err := NewFanOutDAO("sometimes", primary)
+	assert.Error(t, err)
+	_, err = NewFanOutDAO(FAN_OUT_FAIL_FAST)
+	assert.Error(t, err)
+	_, err = NewFanOutDAO(FAN_OUT_FAIL_FAST, primary, primary)
+	assert.ErrorContains(t, err, "duplicate")
+}
+
+func TestFanOutDAO_ManifestsComeFromThePrimary(t *testing.T) {
+	ctx := context.Background()
+	primary, mirror, _ := newFanOutTestBackends(t)
+	mirror.DAO.(*LocalDAO).SetSerializer(ParquetSerializer{})
+	dao, err := NewFanOutDAO(FAN_OUT_FAIL_FAST, primary, mirror)
+	assert.NoError(t, err)
+
+	manifests := saveBorderInfos(t, dao, []models.BorderInfo{{EventId: 1, Border: 100, RankingType: models.EventPoint}})
+	assert.Len(t, manifests, 1)
+	assert.Equal(t, "b/border_info_1_0_100.csv", manifests[0].ObjectKey)
+
+	assert.NoError(t, dao.SaveRunManifest(ctx, RunManifest{RunId: "run", BorderGroups: manifests}))
+	for _, backend := range []FanOutBackend{primary, mirror} {
+		index, err := backend.DAO.GetRunManifestIndex(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, index, 1, backend.Name)
+	}
+}
@@ -1,32 +1,45 @@
 package dao
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"strings"
+	"time"
 
+	"github.com/alceccentric/matsurihi-cron/internal/logging"
+	"github.com/alceccentric/matsurihi-cron/internal/metrics"
 	"github.com/alceccentric/matsurihi-cron/internal/utils"
 	"github.com/alceccentric/matsurihi-cron/models"
-	"github.com/gocarina/gocsv"
 	"github.com/sirupsen/logrus"
 	"go.uber.org/multierr"
 )
 
+// LEGACY_EVENT_INFO_DIR is the directory the local mode stored event infos in before the directories
+// were configurable. Its event infos are moved into the configured directory when the DAO is built.
+const LEGACY_EVENT_INFO_DIR = "evnent_info"
+
 type LocalDAO struct {
 	outputPath         string
 	borderInfoDir      string
 	eventInfoDir       string
 	latestEventInfoDir string
+	serializer         Serializer
 }
 
-func NewLocalDAO(outputPath, borderInfoDir, eventInfoDir, metadataInfoDir string) *LocalDAO {
+func NewLocalDAO(outputPath, borderInfoDir, eventInfoDir, metadataInfoDir string) (*LocalDAO, error) {
 	var err error
 	err = multierr.Append(err, utils.CreateDirectoryIfNotExists(path.Join(outputPath, borderInfoDir)))
 	err = multierr.Append(err, utils.CreateDirectoryIfNotExists(path.Join(outputPath, eventInfoDir)))
 	err = multierr.Append(err, utils.CreateDirectoryIfNotExists(path.Join(outputPath, metadataInfoDir)))
 
 	if err != nil {
-		logrus.WithError(err).Fatal("Failed to create output directories")
+		return nil, fmt.Errorf("failed to create output directories: %w", err)
+	}
+	if err := migrateLegacyEventInfos(outputPath, eventInfoDir); err != nil {
+		return nil, fmt.Errorf("failed to migrate event infos from %s: %w", LEGACY_EVENT_INFO_DIR, err)
 	}
 
 	return &LocalDAO{
@@ -34,10 +47,53 @@ func NewLocalDAO(outputPath, borderInfoDir, eventInfoDir, metadataInfoDir string
 		borderInfoDir:      borderInfoDir,
 		eventInfoDir:       eventInfoDir,
 		latestEventInfoDir: metadataInfoDir,
+		serializer:         CSVSerializer{},
+	}, nil
+}
+
+// migrateLegacyEventInfos moves the event infos of LEGACY_EVENT_INFO_DIR into eventInfoDir, merged
+// with the ones already stored there, which take precedence. The legacy directory is removed once empty.
+func migrateLegacyEventInfos(outputPath, eventInfoDir string) error {
+	legacyDir := path.Join(outputPath, LEGACY_EVENT_INFO_DIR)
+	if eventInfoDir == LEGACY_EVENT_INFO_DIR || !utils.LocalFileExists(legacyDir) {
+		return nil
 	}
+	for _, serializer := range storedSerializers(CSVSerializer{}) {
+		filename := withExtension(EVENT_INFO_FILENAME, serializer)
+		legacyPath := path.Join(legacyDir, filename)
+		if !utils.LocalFileExists(legacyPath) {
+			continue
+		}
+		var legacy, current []models.EventInfo
+		if err := readRecords(legacyPath, serializer, &legacy); err != nil {
+			return err
+		}
+		currentPath := path.Join(outputPath, eventInfoDir, filename)
+		if err := readRecords(currentPath, serializer, &current); err != nil {
+			return err
+		}
+		if _, err := saveRecords(context.Background(), currentPath, serializer, mergeEventInfos(legacy, current)); err != nil {
+			return err
+		}
+		if err := os.Remove(legacyPath); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", legacyPath, err)
+		}
+		logrus.WithField(logging.FIELD_OBJECT_KEY, currentPath).Infof("Migrated %d event infos from %s", len(legacy), legacyPath)
+	}
+	// Other files are left alone, and so is the directory holding them
+	if entries, err := os.ReadDir(legacyDir); err == nil && len(entries) == 0 {
+		os.Remove(legacyDir)
+	}
+	return nil
 }
 
-func (u *LocalDAO) GetLatestEventInfo() (models.EventInfo, error) {
+// SetSerializer sets the format border and event infos are stored in. CSV is used by default.
+func (u *LocalDAO) SetSerializer(serializer Serializer) *LocalDAO {
+	u.serializer = serializer
+	return u
+}
+
+func (u *LocalDAO) GetLatestEventInfo(ctx context.Context) (models.EventInfo, error) {
 	filepath := path.Join(u.outputPath, u.latestEventInfoDir, LATEST_EVENT_BORDER_INFO_FILE)
 	if !utils.LocalFileExists(filepath) {
 		return models.EventInfo{}, nil
@@ -48,60 +104,379 @@ func (u *LocalDAO) GetLatestEventInfo() (models.EventInfo, error) {
 	}
 	return latestInfo, nil
 }
-func (u *LocalDAO) SaveEventInfos(eventInfos []models.EventInfo) error {
-	filepath := path.Join(u.outputPath, u.eventInfoDir, EVENT_INFO_FILENAME)
-	logrus.Infof("Saving %d event infos to %s for the first time", len(eventInfos), filepath)
-	return saveCSV(filepath, eventInfos)
+func (u *LocalDAO) SaveEventInfos(ctx context.Context, eventInfos []models.EventInfo) error {
+	filepath := path.Join(u.outputPath, u.eventInfoDir, withExtension(EVENT_INFO_FILENAME, u.serializer))
+	logging.FromContext(ctx).WithField(logging.FIELD_OBJECT_KEY, filepath).Infof("Saving %d event infos", len(eventInfos))
+	_, err := saveRecords(ctx, filepath, u.serializer, eventInfos)
+	return err
 
 }
 
-func (u *LocalDAO) SaveBorderInfos(borderInfos []models.BorderInfo) error {
+func (u *LocalDAO) SaveBorderInfos(ctx context.Context, borderInfos []models.BorderInfo) ([]BorderGroupManifest, error) {
 	borderInfosByBorderGroupKey := groupByEventIdAndBorder(borderInfos)
-	var err error
+	if len(borderInfosByBorderGroupKey) == 0 {
+		return nil, nil
+	}
+
+	marks, err := u.GetBorderHighWaterMarks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	savedGroups := make(map[BorderGroupKey][]models.BorderInfo)
+	manifests := make([]BorderGroupManifest, 0, len(borderInfosByBorderGroupKey))
 	for key, infos := range borderInfosByBorderGroupKey {
-		filepath := path.Join(u.outputPath, u.borderInfoDir, fmt.Sprintf(BORDER_INFO_FILENAME_FORMAT, key.EventId, key.IdolId, key.Border))
-		logrus.Infof("Saving %d border infos for event ID %d and border %d to %s", len(infos), key.EventId, key.Border, filepath)
-		err = multierr.Append(err, saveCSV(filepath, infos))
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = multierr.Append(err, ctxErr)
+			break
+		}
+		objectKey := path.Join(u.borderInfoDir, withExtension(borderInfoFilename(key), u.serializer))
+		filepath := path.Join(u.outputPath, objectKey)
+		existing, readErr := u.GetBorderInfos(ctx, key)
+		if readErr != nil {
+			err = multierr.Append(err, readErr)
+			continue
+		}
+		merged := mergeBorderInfos(existing, infos)
+		logging.FromContext(ctx).WithFields(logging.BorderFields(key.EventId, key.RankingType, key.IdolId, key.Border)).
+			WithField(logging.FIELD_OBJECT_KEY, filepath).
+			Infof("Saving %d border infos (%d new)", len(merged), len(infos))
+		data, saveErr := saveRecords(ctx, filepath, u.serializer, merged)
+		if saveErr != nil {
+			err = multierr.Append(err, saveErr)
+			continue
+		}
+		savedGroups[key] = infos
+		manifests = append(manifests, newBorderGroupManifest(key, objectKey, merged, data))
 	}
-	return err
+
+	updateHighWaterMarks(marks, savedGroups)
+	sortBorderGroupManifests(manifests)
+	filepath := path.Join(u.outputPath, u.latestEventInfoDir, BORDER_HIGH_WATER_MARKS_FILE)
+	return manifests, multierr.Append(err, saveJson(filepath, highWaterMarksToList(marks), true))
+}
+
+func (u *LocalDAO) GetBorderHighWaterMarks(ctx context.Context) (map[BorderGroupKey]time.Time, error) {
+	filepath := path.Join(u.outputPath, u.latestEventInfoDir, BORDER_HIGH_WATER_MARKS_FILE)
+	if !utils.LocalFileExists(filepath) {
+		return make(map[BorderGroupKey]time.Time), nil
+	}
+	var list []BorderHighWaterMark
+	if err := utils.ReadJSONFile(filepath, &list); err != nil {
+		return nil, err
+	}
+	return highWaterMarksFromList(list), nil
 }
 
-func (u *LocalDAO) SaveLatestEventInfo(info models.EventInfo) error {
+func (u *LocalDAO) SaveLatestEventInfo(ctx context.Context, info models.EventInfo) error {
 	filepath := path.Join(u.outputPath, u.latestEventInfoDir, LATEST_EVENT_BORDER_INFO_FILE)
-	logrus.Infof("Saving latest event info %v to %s", info, filepath)
+	logging.FromContext(ctx).WithField(logging.FIELD_EVENT_ID, info.EventId).WithField(logging.FIELD_OBJECT_KEY, filepath).
+		Infof("Saving latest event info %v", info)
 	return saveJson(filepath, info, false)
 }
 
+func (u *LocalDAO) GetETags(ctx context.Context) (map[string]string, error) {
+	filepath := path.Join(u.outputPath, u.latestEventInfoDir, ETAGS_FILE)
+	etags := make(map[string]string)
+	if !utils.LocalFileExists(filepath) {
+		return etags, nil
+	}
+	if err := utils.ReadJSONFile(filepath, &etags); err != nil {
+		return nil, err
+	}
+	return etags, nil
+}
+
+func (u *LocalDAO) SaveETags(ctx context.Context, etags map[string]string) error {
+	filepath := path.Join(u.outputPath, u.latestEventInfoDir, ETAGS_FILE)
+	logging.FromContext(ctx).WithField(logging.FIELD_OBJECT_KEY, filepath).Infof("Saving %d ETags", len(etags))
+	return saveJson(filepath, etags, true)
+}
+
+// ListEventInfos returns the event infos merged from every format they are stored in,
+// the infos of the current format taking precedence.
+func (u *LocalDAO) ListEventInfos(ctx context.Context) ([]models.EventInfo, error) {
+	eventInfos := make([]models.EventInfo, 0)
+	for _, serializer := range storedSerializers(u.serializer) {
+		filepath := path.Join(u.outputPath, u.eventInfoDir, withExtension(EVENT_INFO_FILENAME, serializer))
+		var stored []models.EventInfo
+		if err := readRecords(filepath, serializer, &stored); err != nil {
+			return nil, err
+		}
+		eventInfos = mergeEventInfos(eventInfos, stored)
+	}
+	return eventInfos, nil
+}
+
+// GetBorderInfos returns the border infos of a group merged from every format it is stored in,
+// the rows of the current format taking precedence.
+func (u *LocalDAO) GetBorderInfos(ctx context.Context, key BorderGroupKey) ([]models.BorderInfo, error) {
+	borderInfos := make([]models.BorderInfo, 0)
+	for _, serializer := range storedSerializers(u.serializer) {
+		filepath := path.Join(u.outputPath, u.borderInfoDir, withExtension(borderInfoFilename(key), serializer))
+		var stored []models.BorderInfo
+		if err := readRecords(filepath, serializer, &stored); err != nil {
+			return nil, err
+		}
+		borderInfos = mergeBorderInfos(borderInfos, stored)
+	}
+	return borderInfos, nil
+}
+
+func (u *LocalDAO) ListBorderGroups(ctx context.Context, eventId int) ([]BorderGroupKey, error) {
+	dir := path.Join(u.outputPath, u.borderInfoDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list directory %s: %w", dir, err)
+	}
+
+	var names []string
+	prefix := borderInfoFilenamePrefix(eventId)
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasPrefix(entry.Name(), prefix) {
+			names = append(names, entry.Name())
+		}
+	}
+	return borderGroupKeysOf(names, eventId, u.serializer), nil
+}
+
+// SaveRunManifest saves the manifest under the manifests directory of the metadata directory.
+// Manifest keys in the index are relative to the output path.
+func (u *LocalDAO) SaveRunManifest(ctx context.Context, manifest RunManifest) error {
+	filename, err := runManifestFilename(manifest.RunId)
+	if err != nil {
+		return err
+	}
+	manifestKey := path.Join(u.latestEventInfoDir, RUN_MANIFESTS_DIR, filename)
+	if err := utils.CreateDirectoryIfNotExists(path.Join(u.outputPath, u.latestEventInfoDir, RUN_MANIFESTS_DIR)); err != nil {
+		return fmt.Errorf("failed to create manifests directory: %w", err)
+	}
+	logging.FromContext(ctx).WithField(logging.FIELD_OBJECT_KEY, manifestKey).
+		Infof("Saving manifest of run %s with %d border groups", manifest.RunId, len(manifest.BorderGroups))
+	if err := saveJson(path.Join(u.outputPath, manifestKey), manifest, true); err != nil {
+		return err
+	}
+
+	index, err := u.GetRunManifestIndex(ctx)
+	if err != nil {
+		return err
+	}
+	index = appendRunManifestIndex(index, newRunManifestIndexEntry(manifest, manifestKey))
+	return saveJson(path.Join(u.outputPath, u.latestEventInfoDir, RUN_MANIFEST_INDEX_FILE), index, true)
+}
+
+func (u *LocalDAO) GetRunManifestIndex(ctx context.Context) ([]RunManifestIndexEntry, error) {
+	filepath := path.Join(u.outputPath, u.latestEventInfoDir, RUN_MANIFEST_INDEX_FILE)
+	index := make([]RunManifestIndexEntry, 0)
+	if !utils.LocalFileExists(filepath) {
+		return index, nil
+	}
+	if err := utils.ReadJSONFile(filepath, &index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func (u *LocalDAO) GetRunManifest(ctx context.Context, runId string) (RunManifest, error) {
+	filename, err := runManifestFilename(runId)
+	if err != nil {
+		return RunManifest{}, err
+	}
+	filepath := path.Join(u.outputPath, u.latestEventInfoDir, RUN_MANIFESTS_DIR, filename)
+	if !utils.LocalFileExists(filepath) {
+		return RunManifest{}, ErrRunManifestNotFound
+	}
+	var manifest RunManifest
+	if err := utils.ReadJSONFile(filepath, &manifest); err != nil {
+		return RunManifest{}, err
+	}
+	return manifest, nil
+}
+
+func (u *LocalDAO) SaveBorderPredictions(ctx context.Context, eventId int, predictions []models.BorderPrediction) error {
+	filepath := path.Join(u.outputPath, u.borderInfoDir, fmt.Sprintf(BORDER_PREDICTION_FILENAME_FORMAT, eventId))
+	logging.FromContext(ctx).WithField(logging.FIELD_EVENT_ID, eventId).WithField(logging.FIELD_OBJECT_KEY, filepath).
+		Infof("Saving %d border predictions", len(predictions))
+	return saveJson(filepath, predictions, true)
+}
+
+func (u *LocalDAO) GetBorderPredictions(ctx context.Context, eventId int) ([]models.BorderPrediction, error) {
+	filepath := path.Join(u.outputPath, u.borderInfoDir, fmt.Sprintf(BORDER_PREDICTION_FILENAME_FORMAT, eventId))
+	predictions := make([]models.BorderPrediction, 0)
+	if !utils.LocalFileExists(filepath) {
+		return predictions, nil
+	}
+	if err := utils.ReadJSONFile(filepath, &predictions); err != nil {
+		return nil, err
+	}
+	return predictions, nil
+}
+
 func saveJson(path string, data interface{}, pretty bool) error {
-	file, err := os.Create(path)
+	startedAt := time.Now()
+	return utils.WriteFileAtomic(path, func(file *os.File) error {
+		if err := utils.WriteJSONFile(file, data, pretty); err != nil {
+			return fmt.Errorf("failed to write JSON to file %s: %w", path, err)
+		}
+		size, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return fmt.Errorf("failed to get size of file %s: %w", path, err)
+		}
+		metrics.ObserveDAOWrite("local", time.Since(startedAt), int(size))
+		return nil
+	})
+}
+
+// readRecords loads the records stored at path into out. A missing file leaves out untouched.
+func readRecords[T any](path string, serializer Serializer, out *[]T) error {
+	if !utils.LocalFileExists(path) {
+		return nil
+	}
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return fmt.Errorf("failed to create file %s: %w", path, err)
+		return fmt.Errorf("failed to read file %s: %w", path, err)
 	}
-	defer file.Close()
-	if err := utils.WriteJSONFile(file, data, pretty); err != nil {
-		return fmt.Errorf("failed to write JSON to file %s: %w", path, err)
+
+	if err := serializer.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to decode file %s: %w", path, err)
 	}
 	return nil
 }
 
-func saveCSV[T any](path string, infos []T) error {
-	var file *os.File
-	var err error
-
-	flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+// saveRecords encodes the records and writes them to path. Returns the encoded records.
+func saveRecords[T any](ctx context.Context, path string, serializer Serializer, infos []T) ([]byte, error) {
 	if len(infos) == 0 {
-		logrus.Warnf("No data to save to %s", path)
-		return nil
+		logging.FromContext(ctx).WithField(logging.FIELD_OBJECT_KEY, path).Warn("No data to save")
+		return nil, nil
+	}
+
+	data, err := serializer.Marshal(infos)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode records for %s: %w", path, err)
 	}
 
-	if file, err = os.OpenFile(path, flag, 0644); err != nil {
+	startedAt := time.Now()
+	err = utils.WriteFileAtomic(path, func(file *os.File) error {
+		_, err := file.Write(data)
 		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	metrics.ObserveDAOWrite("local", time.Since(startedAt), len(data))
+	return data, nil
+}
+
+// AcquireLock stores the lease in a lock file under the locks directory of the metadata directory.
+// A lock file is created exclusively, but taking over an expired lease rewrites the file and is only
+// checked by reading it back, which is enough for runs whose lease is far longer than a write.
+func (u *LocalDAO) AcquireLock(ctx context.Context, name, owner string, ttl time.Duration) (Lease, error) {
+	filepath, err := u.lockPath(name)
+	if err != nil {
+		return Lease{}, err
+	}
+	current, err := readLockFile(filepath)
+	if err != nil {
+		return Lease{}, err
+	}
+	lease, err := nextLease(current, name, owner, ttl, time.Now())
+	if err != nil {
+		return Lease{}, err
+	}
+
+	if current == nil {
+		err = createLockFile(filepath, lease)
+	} else {
+		err = saveJson(filepath, lease, true)
 	}
-	defer file.Close()
+	if err != nil {
+		return Lease{}, err
+	}
+
+	stored, err := readLockFile(filepath)
+	if err != nil {
+		return Lease{}, err
+	}
+	if stored == nil || stored.Owner != owner {
+		return Lease{}, fmt.Errorf("%w: %s was taken over while acquiring it", ErrLockHeld, name)
+	}
+	logging.FromContext(ctx).WithField(logging.FIELD_OBJECT_KEY, filepath).Debugf("Leased lock %s until %v", name, lease.ExpiresAt)
+	return lease, nil
+}
 
-	if err = gocsv.MarshalFile(infos, file); err != nil {
+// ReleaseLock expires the lease in place rather than removing the lock file, so that an owner taking
+// over the lock in the meantime overwrites the expired lease instead of having its own lease removed.
+func (u *LocalDAO) ReleaseLock(ctx context.Context, name, owner string) error {
+	filepath, err := u.lockPath(name)
+	if err != nil {
 		return err
 	}
+	current, err := readLockFile(filepath)
+	if err != nil || current == nil || current.Owner != owner {
+		return err
+	}
+	released := *current
+	released.ExpiresAt = time.Now().UTC()
+	if err := saveJson(filepath, released, true); err != nil {
+		return err
+	}
+	logging.FromContext(ctx).WithField(logging.FIELD_OBJECT_KEY, filepath).Debugf("Released lock %s", name)
+	return nil
+}
+
+func (u *LocalDAO) lockPath(name string) (string, error) {
+	filename, err := lockFilename(name)
+	if err != nil {
+		return "", err
+	}
+	dir := path.Join(u.outputPath, u.latestEventInfoDir, LOCKS_DIR)
+	if err := utils.CreateDirectoryIfNotExists(dir); err != nil {
+		return "", fmt.Errorf("failed to create locks directory: %w", err)
+	}
+	return path.Join(dir, filename), nil
+}
+
+// readLockFile returns the lease stored at path, or nil when there is none. A lock file that cannot be
+// decoded, such as one truncated by a crash, is returned as an expired lease so that it can be taken over.
+func readLockFile(path string) (*Lease, error) {
+	if !utils.LocalFileExists(path) {
+		return nil, nil
+	}
+	var lease Lease
+	if err := utils.ReadJSONFile(path, &lease); err != nil {
+		logrus.Warnf("Treating unreadable lock file %s as expired: %v", path, err)
+		return &Lease{}, nil
+	}
+	return &lease, nil
+}
+
+// createLockFile writes the lease to a temporary file and links it into place, failing with ErrLockHeld
+// when another owner created the lock file first. Linking keeps the exclusive create atomic, so that the
+// lock file is never seen without its lease.
+func createLockFile(lockFile string, lease Lease) error {
+	tmp, err := os.CreateTemp(path.Dir(lockFile), "."+path.Base(lockFile)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary lock file for %s: %w", lockFile, err)
+	}
+	defer os.Remove(tmp.Name())
 
+	if err := utils.WriteJSONFile(tmp, lease, true); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write lock file %s: %w", lockFile, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync lock file %s: %w", lockFile, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close lock file %s: %w", lockFile, err)
+	}
+	err = os.Link(tmp.Name(), lockFile)
+	if os.IsExist(err) {
+		return fmt.Errorf("%w: %s was acquired concurrently", ErrLockHeld, lease.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create lock file %s: %w", lockFile, err)
+	}
 	return nil
 }
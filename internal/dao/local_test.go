@@ -1,6 +1,7 @@
 package dao
 
 import (
+	"context"
 	"encoding/json"
 	"os"
 	"path/filepath"
@@ -17,6 +18,20 @@ func createTempDir(t *testing.T) string {
 	return dir
 }
 
+func newTestLocalDAO(t *testing.T, outputPath, borderInfoDir, eventInfoDir, metadataInfoDir string) *LocalDAO {
+	dao, err := NewLocalDAO(outputPath, borderInfoDir, eventInfoDir, metadataInfoDir)
+	assert.NoError(t, err)
+	return dao
+}
+
+// saveBorderInfos saves border infos through dao, failing the test on error.
+func saveBorderInfos(t *testing.T, dao DAO, infos []models.BorderInfo) []BorderGroupManifest {
+	t.Helper()
+	manifests, err := dao.SaveBorderInfos(context.Background(), infos)
+	assert.NoError(t, err)
+	return manifests
+}
+
 func writeJSONFile(t *testing.T, path string, v interface{}) {
 	f, err := os.Create(path)
 	assert.NoError(t, err)
@@ -28,8 +43,8 @@ func writeJSONFile(t *testing.T, path string, v interface{}) {
 func TestGetLatestEventInfo_FileNotExist(t *testing.T) {
 	tmp := createTempDir(t)
 	defer os.RemoveAll(tmp)
-	dao := NewLocalDAO(tmp, "b", "e", "m")
-	info, err := dao.GetLatestEventInfo()
+	dao := newTestLocalDAO(t, tmp, "b", "e", "m")
+	info, err := dao.GetLatestEventInfo(context.Background())
 	assert.NoError(t, err)
 	assert.Equal(t, 0, info.EventId)
 }
@@ -45,8 +60,8 @@ func TestGetLatestEventInfo_FileExists_Valid(t *testing.T) {
 	}
 	jsonPath := filepath.Join(tmp, metadataDir, "latest_event_border_info.json")
 	writeJSONFile(t, jsonPath, expected)
-	dao := NewLocalDAO(tmp, "b", "e", metadataDir)
-	info, err := dao.GetLatestEventInfo()
+	dao := newTestLocalDAO(t, tmp, "b", "e", metadataDir)
+	info, err := dao.GetLatestEventInfo(context.Background())
 	assert.NoError(t, err)
 	assert.Equal(t, expected.EventId, info.EventId)
 	assert.Equal(t, time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC), info.StartAt)
@@ -59,20 +74,20 @@ func TestGetLatestEventInfo_FileExists_Invalid(t *testing.T) {
 	os.MkdirAll(filepath.Join(tmp, metadataDir), 0755)
 	jsonPath := filepath.Join(tmp, metadataDir, "latest_event_border_info.json")
 	os.WriteFile(jsonPath, []byte("not json"), 0644)
-	dao := NewLocalDAO(tmp, "b", "e", metadataDir)
-	_, err := dao.GetLatestEventInfo()
+	dao := newTestLocalDAO(t, tmp, "b", "e", metadataDir)
+	_, err := dao.GetLatestEventInfo(context.Background())
 	assert.Error(t, err)
 }
 
 func TestSaveEventInfos(t *testing.T) {
 	tmp := createTempDir(t)
 	defer os.RemoveAll(tmp)
-	dao := NewLocalDAO(tmp, "b", "e", "m")
+	dao := newTestLocalDAO(t, tmp, "b", "e", "m")
 	eventInfos := []models.EventInfo{
 		{EventId: 1},
 		{EventId: 2},
 	}
-	err := dao.SaveEventInfos(eventInfos)
+	err := dao.SaveEventInfos(context.Background(), eventInfos)
 	assert.NoError(t, err)
 	// Check file exists in the correct directory
 	_, err = os.Stat(filepath.Join(tmp, "e", EVENT_INFO_FILENAME))
@@ -82,13 +97,13 @@ func TestSaveEventInfos(t *testing.T) {
 func TestSaveBorderInfos(t *testing.T) {
 	tmp := createTempDir(t)
 	defer os.RemoveAll(tmp)
-	dao := NewLocalDAO(tmp, "b", "e", "m")
+	dao := newTestLocalDAO(t, tmp, "b", "e", "m")
 	borderInfos := []models.BorderInfo{
 		{EventId: 1, IdolId: 0, Border: 100, Score: 10, AggregatedAt: time.Now()},
 		{EventId: 1, IdolId: 0, Border: 100, Score: 20, AggregatedAt: time.Now()},
 		{EventId: 2, IdolId: 0, Border: 2500, Score: 30, AggregatedAt: time.Now()},
 	}
-	err := dao.SaveBorderInfos(borderInfos)
+	_, err := dao.SaveBorderInfos(context.Background(), borderInfos)
 	assert.NoError(t, err)
 	// Check files exist
 	_, err = os.Stat(filepath.Join(tmp, "b", "border_info_1_0_100.csv"))
@@ -100,20 +115,20 @@ func TestSaveBorderInfos(t *testing.T) {
 func TestSaveEventInfos_Empty(t *testing.T) {
 	tmp := createTempDir(t)
 	defer os.RemoveAll(tmp)
-	dao := NewLocalDAO(tmp, "b", "e", "m")
-	err := dao.SaveEventInfos([]models.EventInfo{})
+	dao := newTestLocalDAO(t, tmp, "b", "e", "m")
+	err := dao.SaveEventInfos(context.Background(), []models.EventInfo{})
 	assert.NoError(t, err)
 }
 
 func TestSaveLatestEventInfo(t *testing.T) {
 	tmp := createTempDir(t)
 	defer os.RemoveAll(tmp)
-	dao := NewLocalDAO(tmp, "b", "e", "m")
+	dao := newTestLocalDAO(t, tmp, "b", "e", "m")
 	info := models.EventInfo{
 		EventId: 42,
 		StartAt: time.Date(2025, 6, 16, 12, 0, 0, 0, time.UTC),
 	}
-	err := dao.SaveLatestEventInfo(info)
+	err := dao.SaveLatestEventInfo(context.Background(), info)
 	assert.NoError(t, err)
 
 	// Check file exists and content is correct
@@ -131,7 +146,264 @@ func TestSaveLatestEventInfo(t *testing.T) {
 func TestSaveBorderInfos_Empty(t *testing.T) {
 	tmp := createTempDir(t)
 	defer os.RemoveAll(tmp)
-	dao := NewLocalDAO(tmp, "b", "e", "m")
-	err := dao.SaveBorderInfos([]models.BorderInfo{})
+	dao := newTestLocalDAO(t, tmp, "b", "e", "m")
+	_, err := dao.SaveBorderInfos(context.Background(), []models.BorderInfo{})
+	assert.NoError(t, err)
+}
+
+func TestSaveBorderInfos_MergesAndTracksHighWaterMarks(t *testing.T) {
+	tmp := createTempDir(t)
+	defer os.RemoveAll(tmp)
+	dao := newTestLocalDAO(t, tmp, "b", "e", "m")
+	t1 := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(30 * time.Minute)
+	t3 := t2.Add(30 * time.Minute)
+
+	saveBorderInfos(t, dao, []models.BorderInfo{
+		{EventId: 1, Border: 100, Score: 10, AggregatedAt: t1},
+		{EventId: 1, Border: 100, Score: 20, AggregatedAt: t2},
+	})
+	saveBorderInfos(t, dao, []models.BorderInfo{
+		{EventId: 1, Border: 100, Score: 21, AggregatedAt: t2},
+		{EventId: 1, Border: 100, Score: 30, AggregatedAt: t3},
+	})
+
+	var got []models.BorderInfo
+	assert.NoError(t, readRecords(filepath.Join(tmp, "b", "border_info_1_0_100.csv"), CSVSerializer{}, &got))
+	assert.Len(t, got, 3)
+	assert.Equal(t, []int{10, 21, 30}, []int{got[0].Score, got[1].Score, got[2].Score})
+
+	marks, err := dao.GetBorderHighWaterMarks(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, t3.Equal(marks[BorderGroupKey{EventId: 1, Border: 100}]))
+}
+
+func TestSaveBorderInfos_PerRankingTypeFiles(t *testing.T) {
+	tmp := createTempDir(t)
+	defer os.RemoveAll(tmp)
+	dao := newTestLocalDAO(t, tmp, "b", "e", "m")
+	now := time.Now()
+	_, err := dao.SaveBorderInfos(context.Background(), []models.BorderInfo{
+		{EventId: 1, Border: 100, RankingType: models.EventPoint, AggregatedAt: now},
+		{EventId: 1, Border: 100, RankingType: models.HighScore, AggregatedAt: now},
+		{EventId: 1, Border: 100, IdolId: 3, RankingType: models.IdolPoint, AggregatedAt: now},
+	})
+	assert.NoError(t, err)
+	for _, name := range []string{"border_info_1_0_100.csv", "border_info_1_highScore_0_100.csv", "border_info_1_3_100.csv"} {
+		_, err = os.Stat(filepath.Join(tmp, "b", name))
+		assert.NoError(t, err, name)
+	}
+}
+
+func TestGetBorderHighWaterMarks_FileNotExist(t *testing.T) {
+	tmp := createTempDir(t)
+	defer os.RemoveAll(tmp)
+	dao := newTestLocalDAO(t, tmp, "b", "e", "m")
+	marks, err := dao.GetBorderHighWaterMarks(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, marks)
+}
+
+func TestSaveETags_RoundTrip(t *testing.T) {
+	tmp := createTempDir(t)
+	defer os.RemoveAll(tmp)
+	dao := newTestLocalDAO(t, tmp, "b", "e", "m")
+
+	etags, err := dao.GetETags(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, etags)
+
+	expected := map[string]string{"https://example.com/logs/100?": `"v1"`}
+	assert.NoError(t, dao.SaveETags(context.Background(), expected))
+	etags, err = dao.GetETags(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, expected, etags)
+}
+
+func TestReadSide_LocalRoundTrip(t *testing.T) {
+	tmp := createTempDir(t)
+	defer os.RemoveAll(tmp)
+	dao := newTestLocalDAO(t, tmp, "b", "e", "m")
+	t1 := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	infos, err := dao.ListEventInfos(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, infos)
+
+	assert.NoError(t, dao.SaveEventInfos(context.Background(), []models.EventInfo{{EventId: 1, EventName: "One"}}))
+	infos, err = dao.ListEventInfos(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "One", infos[0].EventName)
+
+	saveBorderInfos(t, dao, []models.BorderInfo{
+		{EventId: 1, Border: 2500, RankingType: models.EventPoint, Score: 1, AggregatedAt: t1},
+		{EventId: 1, Border: 100, RankingType: models.LoungePoint, Score: 2, AggregatedAt: t1},
+		{EventId: 1, Border: 100, IdolId: 4, RankingType: models.IdolPoint, Score: 3, AggregatedAt: t1},
+		{EventId: 11, Border: 100, RankingType: models.EventPoint, Score: 4, AggregatedAt: t1},
+	})
+
+	keys, err := dao.ListBorderGroups(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []BorderGroupKey{
+		{EventId: 1, RankingType: models.EventPoint, Border: 2500},
+		{EventId: 1, RankingType: models.IdolPoint, IdolId: 4, Border: 100},
+		{EventId: 1, RankingType: models.LoungePoint, Border: 100},
+	}, keys)
+
+	borderInfos, err := dao.GetBorderInfos(context.Background(), keys[2])
+	assert.NoError(t, err)
+	assert.Len(t, borderInfos, 1)
+	assert.Equal(t, 2, borderInfos[0].Score)
+
+	borderInfos, err = dao.GetBorderInfos(context.Background(), BorderGroupKey{EventId: 2, RankingType: models.EventPoint, Border: 100})
+	assert.NoError(t, err)
+	assert.Empty(t, borderInfos)
+}
+
+func TestNewLocalDAO_CreateDirectoryError(t *testing.T) {
+	tmp := createTempDir(t)
+	defer os.RemoveAll(tmp)
+	// A file where a directory is expected cannot be turned into one
+	assert.NoError(t, os.WriteFile(filepath.Join(tmp, "b"), []byte{}, 0644))
+	dao, err := NewLocalDAO(filepath.Join(tmp, "b"), "b", "e", "m")
+	assert.Error(t, err)
+	assert.Nil(t, dao)
+}
+
+func TestNewLocalDAO_MigratesLegacyEventInfoDir(t *testing.T) {
+	ctx := context.Background()
+	outputPath := t.TempDir()
+	legacy := newTestLocalDAO(t, outputPath, "b", LEGACY_EVENT_INFO_DIR, "m")
+	assert.NoError(t, legacy.SaveEventInfos(ctx, []models.EventInfo{{EventId: 1, EventName: "Old"}, {EventId: 2, EventName: "Stale"}}))
+	// A run with the renamed directory already saved newer event infos
+	assert.NoError(t, os.MkdirAll(filepath.Join(outputPath, "event_info"), 0755))
+	_, err := saveRecords(ctx, filepath.Join(outputPath, "event_info", EVENT_INFO_FILENAME), CSVSerializer{},
+		[]models.EventInfo{{EventId: 2, EventName: "Two"}, {EventId: 3, EventName: "Three"}})
+	assert.NoError(t, err)
+
+	migrated := newTestLocalDAO(t, outputPath, "b", "event_info", "m")
+	eventInfos, err := migrated.ListEventInfos(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.EventInfo{{EventId: 1, EventName: "Old"}, {EventId: 2, EventName: "Two"}, {EventId: 3, EventName: "Three"}}, eventInfos)
+	assert.NoDirExists(t, filepath.Join(outputPath, LEGACY_EVENT_INFO_DIR))
+}
+
+func TestLocalDAO_ParquetRoundTrip(t *testing.T) {
+	tmp := createTempDir(t)
+	defer os.RemoveAll(tmp)
+	dao := newTestLocalDAO(t, tmp, "b", "e", "m").SetSerializer(ParquetSerializer{})
+	ctx := context.Background()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	saveBorderInfos(t, dao, []models.BorderInfo{
+		{EventId: 1, Border: 100, RankingType: models.EventPoint, AggregatedAt: now, Score: 10},
+		{EventId: 1, Border: 100, RankingType: models.HighScore, AggregatedAt: now, Score: 20},
+	})
+	assert.NoError(t, dao.SaveEventInfos(ctx, []models.EventInfo{{EventId: 1, EventName: "E", StartAt: now, EndAt: now}}))
+	// A group stored in CSV by a previous run is still listed
+	assert.NoError(t, os.WriteFile(filepath.Join(tmp, "b", "border_info_1_0_2500.csv"), []byte("event_id\n1\n"), 0644))
+
+	assert.FileExists(t, filepath.Join(tmp, "b", "border_info_1_0_100.parquet"))
+	assert.FileExists(t, filepath.Join(tmp, "e", "event_info_all.parquet"))
+
+	keys, err := dao.ListBorderGroups(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []BorderGroupKey{
+		{EventId: 1, RankingType: models.EventPoint, Border: 100},
+		{EventId: 1, RankingType: models.EventPoint, Border: 2500},
+		{EventId: 1, RankingType: models.HighScore, Border: 100},
+	}, keys)
+
+	infos, err := dao.GetBorderInfos(ctx, keys[2])
+	assert.NoError(t, err)
+	assert.Len(t, infos, 1)
+	assert.Equal(t, 20, infos[0].Score)
+	assert.True(t, now.Equal(infos[0].AggregatedAt))
+
+	eventInfos, err := dao.ListEventInfos(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, eventInfos, 1)
+	assert.Equal(t, "E", eventInfos[0].EventName)
+}
+
+func TestLocalDAO_FormatChangeKeepsEventInfos(t *testing.T) {
+	tmp := t.TempDir()
+	ctx := context.Background()
+	start := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	eventInfo := func(eventId int, name string) models.EventInfo {
+		return models.EventInfo{EventId: eventId, EventName: name, StartAt: start, EndAt: start.Add(time.Hour)}
+	}
+	csvDAO := newTestLocalDAO(t, tmp, "b", "e", "m")
+	assert.NoError(t, csvDAO.SaveEventInfos(ctx, []models.EventInfo{eventInfo(1, "One"), eventInfo(2, "Stale")}))
+
+	// A backfill after the format changed upserts its events into the listed ones
+	parquetDAO := newTestLocalDAO(t, tmp, "b", "e", "m").SetSerializer(ParquetSerializer{})
+	stored, err := parquetDAO.ListEventInfos(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.EventInfo{eventInfo(1, "One"), eventInfo(2, "Stale")}, stored)
+	assert.NoError(t, parquetDAO.SaveEventInfos(ctx, mergeEventInfos(stored, []models.EventInfo{eventInfo(2, "Two"), eventInfo(3, "Three")})))
+
+	expected := []models.EventInfo{eventInfo(1, "One"), eventInfo(2, "Two"), eventInfo(3, "Three")}
+	eventInfos, err := parquetDAO.ListEventInfos(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, eventInfos)
+	// The event infos of the current format alone hold every event
+	var current []models.EventInfo
+	assert.NoError(t, readRecords(filepath.Join(tmp, "e", "event_info_all.parquet"), ParquetSerializer{}, &current))
+	assert.Equal(t, expected, current)
+}
+
+func TestLocalDAO_FormatChangeKeepsHistory(t *testing.T) {
+	tmp := t.TempDir()
+	csvDAO := newTestLocalDAO(t, tmp, "b", "e", "m")
+	ctx := context.Background()
+	t1 := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	key := BorderGroupKey{EventId: 1, RankingType: models.EventPoint, Border: 100}
+	saveBorderInfos(t, csvDAO, []models.BorderInfo{
+		{EventId: 1, Border: 100, RankingType: models.EventPoint, AggregatedAt: t1, Score: 10},
+		{EventId: 1, Border: 100, RankingType: models.EventPoint, AggregatedAt: t1.Add(30 * time.Minute), Score: 20},
+	})
+
+	// Once the format changes, only the rows after the shared high-water mark are fetched
+	parquetDAO := newTestLocalDAO(t, tmp, "b", "e", "m").SetSerializer(ParquetSerializer{})
+	saveBorderInfos(t, parquetDAO, []models.BorderInfo{
+		{EventId: 1, Border: 100, RankingType: models.EventPoint, AggregatedAt: t1.Add(time.Hour), Score: 30},
+	})
+
+	var stored []models.BorderInfo
+	assert.NoError(t, readRecords(filepath.Join(tmp, "b", "border_info_1_0_100.parquet"), ParquetSerializer{}, &stored))
+	assert.Len(t, stored, 3, "the new format holds the full history")
+
+	// Either way, the group is listed once with all its rows
+	for _, dao := range []*LocalDAO{csvDAO, parquetDAO} {
+		keys, err := dao.ListBorderGroups(ctx, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, []BorderGroupKey{key}, keys)
+		infos, err := dao.GetBorderInfos(ctx, key)
+		assert.NoError(t, err)
+		assert.Len(t, infos, 3)
+	}
+}
+
+func TestLocalDAO_BorderPredictionsRoundTrip(t *testing.T) {
+	dao := newTestLocalDAO(t, t.TempDir(), "b", "e", "m")
+	predictions := []models.BorderPrediction{{
+		EventId: 1, RankingType: models.EventPoint, Border: 100, AggregatedAt: time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC),
+		Progress: 0.5, CurrentScore: 1000, FinalScore: 2500, LowerBound: 2000, UpperBound: 3000, ConfidenceLevel: 0.9, SimilarEventIds: []int{3, 2},
+	}}
+	saveBorderInfos(t, dao, []models.BorderInfo{{EventId: 1, Border: 100, RankingType: models.EventPoint, Score: 1000, AggregatedAt: predictions[0].AggregatedAt}})
+	assert.NoError(t, dao.SaveBorderPredictions(context.Background(), 1, predictions))
+
+	stored, err := dao.GetBorderPredictions(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, predictions, stored)
+
+	// Predictions stored next to the border infos are not listed as border groups
+	keys, err := dao.ListBorderGroups(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+
+	stored, err = dao.GetBorderPredictions(context.Background(), 2)
 	assert.NoError(t, err)
+	assert.Empty(t, stored)
 }
@@ -0,0 +1,56 @@
+package dao
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+const (
+	// Locks are stored in this directory under the metadata prefix, one JSON file per lock
+	LOCKS_DIR = "locks"
+)
+
+// ErrLockHeld is returned by AcquireLock while another owner holds an unexpired lease on the lock.
+var ErrLockHeld = errors.New("lock is held by another owner")
+
+var lockNamePattern = regexp.MustCompile(`^[0-9A-Za-z_-]+$`)
+
+// Lease is the hold of an owner on a lock until ExpiresAt. An expired lease can be taken over by
+// any owner, so that a crashed run does not block the next ones for longer than its lease.
+type Lease struct {
+	Name       string    `json:"name"`
+	Owner      string    `json:"owner"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Expired reports whether the lease no longer holds the lock at now.
+func (l Lease) Expired(now time.Time) bool {
+	return !now.Before(l.ExpiresAt)
+}
+
+func lockFilename(name string) (string, error) {
+	if !lockNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid lock name: %q", name)
+	}
+	return name + ".json", nil
+}
+
+// nextLease returns the lease owner gets on a lock whose stored lease is current, if any.
+// The lease is extended when owner already holds it and taken over when it expired.
+func nextLease(current *Lease, name, owner string, ttl time.Duration, now time.Time) (Lease, error) {
+	if ttl <= 0 {
+		return Lease{}, fmt.Errorf("lease of lock %s must be positive, got %v", name, ttl)
+	}
+	lease := Lease{Name: name, Owner: owner, AcquiredAt: now.UTC(), ExpiresAt: now.Add(ttl).UTC()}
+	if current == nil || current.Expired(now) {
+		return lease, nil
+	}
+	if current.Owner != owner {
+		return Lease{}, fmt.Errorf("%w: %s is held by %s until %v", ErrLockHeld, name, current.Owner, current.ExpiresAt)
+	}
+	lease.AcquiredAt = current.AcquiredAt
+	return lease, nil
+}
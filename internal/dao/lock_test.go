@@ -0,0 +1,136 @@
+package dao
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// assertLockContract runs the lock scenarios every DAO must pass.
+func assertLockContract(t *testing.T, dao DAO) {
+	ctx := context.Background()
+
+	lease, err := dao.AcquireLock(ctx, "sync", "a", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, "a", lease.Owner)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), lease.ExpiresAt, 5*time.Second)
+
+	_, err = dao.AcquireLock(ctx, "sync", "b", time.Minute)
+	assert.ErrorIs(t, err, ErrLockHeld)
+	_, err = dao.AcquireLock(ctx, "backfill", "b", time.Minute)
+	assert.NoError(t, err, "locks are independent")
+
+	renewed, err := dao.AcquireLock(ctx, "sync", "a", 2*time.Minute)
+	require.NoError(t, err)
+	assert.True(t, renewed.ExpiresAt.After(lease.ExpiresAt))
+	assert.WithinDuration(t, lease.AcquiredAt, renewed.AcquiredAt, time.Millisecond)
+
+	require.NoError(t, dao.ReleaseLock(ctx, "sync", "b"))
+	_, err = dao.AcquireLock(ctx, "sync", "b", time.Minute)
+	assert.ErrorIs(t, err, ErrLockHeld, "releasing a lock held by another owner is a no-op")
+
+	require.NoError(t, dao.ReleaseLock(ctx, "sync", "a"))
+	_, err = dao.AcquireLock(ctx, "sync", "b", 20*time.Millisecond)
+	require.NoError(t, err)
+
+	time.Sleep(40 * time.Millisecond)
+	lease, err = dao.AcquireLock(ctx, "sync", "c", time.Minute)
+	require.NoError(t, err, "an expired lease is taken over")
+	assert.Equal(t, "c", lease.Owner)
+}
+
+func TestLocalDAO_Lock(t *testing.T) {
+	assertLockContract(t, newTestLocalDAO(t, t.TempDir(), "b", "e", "m"))
+}
+
+func TestLocalDAO_ReleaseLock_ExpiresLeaseInPlace(t *testing.T) {
+	ctx := context.Background()
+	dao := newTestLocalDAO(t, t.TempDir(), "b", "e", "m")
+	_, err := dao.AcquireLock(ctx, "sync", "a", time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, dao.ReleaseLock(ctx, "sync", "a"))
+
+	filepath, err := dao.lockPath("sync")
+	require.NoError(t, err)
+	released, err := readLockFile(filepath)
+	require.NoError(t, err)
+	require.NotNil(t, released, "the lock file is kept")
+	assert.Equal(t, "a", released.Owner)
+	assert.True(t, released.Expired(time.Now()))
+
+	lease, err := dao.AcquireLock(ctx, "sync", "b", time.Minute)
+	require.NoError(t, err, "a released lease is taken over")
+	assert.Equal(t, "b", lease.Owner)
+}
+
+func TestLocalDAO_AcquireLock_LeavesOnlyTheLockFile(t *testing.T) {
+	dao := newTestLocalDAO(t, t.TempDir(), "b", "e", "m")
+	_, err := dao.AcquireLock(context.Background(), "sync", "a", time.Minute)
+	require.NoError(t, err)
+
+	filepath, err := dao.lockPath("sync")
+	require.NoError(t, err)
+	entries, err := os.ReadDir(path.Dir(filepath))
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "the temporary lock file is removed once linked")
+	assert.Equal(t, path.Base(filepath), entries[0].Name())
+}
+
+func TestLocalDAO_AcquireLock_TakesOverUnreadableLockFile(t *testing.T) {
+	ctx := context.Background()
+	dao := newTestLocalDAO(t, t.TempDir(), "b", "e", "m")
+	filepath, err := dao.lockPath("sync")
+	require.NoError(t, err)
+	for _, content := range []string{"", `{"name": "sync", "owner": "a"`} {
+		// Left behind by a crash while writing the lock file
+		require.NoError(t, os.WriteFile(filepath, []byte(content), 0644))
+
+		lease, err := dao.AcquireLock(ctx, "sync", "b", time.Minute)
+		require.NoError(t, err, "an unreadable lock file is treated as expired")
+		assert.Equal(t, "b", lease.Owner)
+		_, err = dao.AcquireLock(ctx, "sync", "c", time.Minute)
+		assert.ErrorIs(t, err, ErrLockHeld)
+	}
+}
+
+func TestSQLiteDAO_Lock(t *testing.T) {
+	assertLockContract(t, newTestSQLiteDAO(t))
+}
+
+func TestNextLease(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	held := &Lease{Name: "sync", Owner: "a", AcquiredAt: now.Add(-time.Minute), ExpiresAt: now.Add(time.Minute)}
+
+	lease, err := nextLease(nil, "sync", "b", time.Hour, now)
+	require.NoError(t, err)
+	assert.Equal(t, Lease{Name: "sync", Owner: "b", AcquiredAt: now, ExpiresAt: now.Add(time.Hour)}, lease)
+
+	lease, err = nextLease(held, "sync", "a", time.Hour, now)
+	require.NoError(t, err)
+	assert.Equal(t, held.AcquiredAt, lease.AcquiredAt)
+	assert.Equal(t, now.Add(time.Hour), lease.ExpiresAt)
+
+	_, err = nextLease(held, "sync", "b", time.Hour, now)
+	assert.ErrorIs(t, err, ErrLockHeld)
+
+	lease, err = nextLease(held, "sync", "b", time.Hour, now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, "b", lease.Owner)
+
+	_, err = nextLease(nil, "sync", "a", 0, now)
+	assert.Error(t, err)
+}
+
+func TestLockFilename_RejectsPaths(t *testing.T) {
+	_, err := lockFilename("../sync")
+	assert.Error(t, err)
+
+	filename, err := lockFilename("sync")
+	require.NoError(t, err)
+	assert.Equal(t, "sync.json", filename)
+}
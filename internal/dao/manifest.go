@@ -0,0 +1,131 @@
+package dao
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/internal/validation"
+	"github.com/alceccentric/matsurihi-cron/models"
+)
+
+const (
+	// Run manifests are stored in this directory under the metadata prefix, one JSON file per run
+	RUN_MANIFESTS_DIR       = "manifests"
+	RUN_MANIFEST_INDEX_FILE = "manifest_index.json"
+	// Number of runs kept in the manifest index, older runs are dropped from it but their manifests are kept
+	RUN_MANIFEST_INDEX_SIZE = 100
+)
+
+// ErrRunManifestNotFound is returned by GetRunManifest when no manifest was saved for the run.
+var ErrRunManifestNotFound = errors.New("run manifest not found")
+
+var runIdPattern = regexp.MustCompile(`^[0-9A-Za-z-]+$`)
+
+// RunManifest records what a sync run wrote.
+type RunManifest struct {
+	RunId     string    `json:"run_id"`
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`
+	// IDs of the events whose borders were synced
+	EventIds []int `json:"event_ids"`
+	// IDs of the events that could not be fetched, whose borders were not synced
+	FailedEventIds []int `json:"failed_event_ids,omitempty"`
+	// Number of border groups that could not be fetched and are retried by the next run
+	FailedBorderGroups int                   `json:"failed_border_groups"`
+	BorderGroups       []BorderGroupManifest `json:"border_groups"`
+	// Issues found in the fetched border infos, and how many border groups were held back because of them
+	Validation validation.Report `json:"validation"`
+}
+
+// BorderGroupManifest describes a border group as stored after a write.
+type BorderGroupManifest struct {
+	EventId     int                     `json:"event_id"`
+	RankingType models.EventRankingType `json:"ranking_type"`
+	IdolId      int                     `json:"idol_id"`
+	Border      int                     `json:"border"`
+	// Key of the object storing the group, empty for backends not storing groups as objects
+	ObjectKey       string    `json:"object_key"`
+	RowCount        int       `json:"row_count"`
+	MinAggregatedAt time.Time `json:"min_aggregated_at"`
+	MaxAggregatedAt time.Time `json:"max_aggregated_at"`
+	// Hex encoded SHA-256 of the stored object
+	SHA256 string `json:"sha256"`
+}
+
+// RunManifestIndexEntry points to the manifest of a run from the manifest index.
+type RunManifestIndexEntry struct {
+	RunId     string    `json:"run_id"`
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`
+	// Key of the manifest object, empty for backends not storing manifests as objects
+	ManifestKey      string `json:"manifest_key"`
+	BorderGroupCount int    `json:"border_group_count"`
+}
+
+func (m BorderGroupManifest) Key() BorderGroupKey {
+	return BorderGroupKey{EventId: m.EventId, RankingType: m.RankingType, IdolId: m.IdolId, Border: m.Border}
+}
+
+// newBorderGroupManifest describes a border group stored under objectKey. rows must be sorted
+// by AggregatedAt and data is the encoded object.
+func newBorderGroupManifest(key BorderGroupKey, objectKey string, rows []models.BorderInfo, data []byte) BorderGroupManifest {
+	checksum := sha256.Sum256(data)
+	manifest := BorderGroupManifest{
+		EventId:     key.EventId,
+		RankingType: key.RankingType,
+		IdolId:      key.IdolId,
+		Border:      key.Border,
+		ObjectKey:   objectKey,
+		RowCount:    len(rows),
+		SHA256:      hex.EncodeToString(checksum[:]),
+	}
+	if len(rows) > 0 {
+		manifest.MinAggregatedAt = rows[0].AggregatedAt
+		manifest.MaxAggregatedAt = rows[len(rows)-1].AggregatedAt
+	}
+	return manifest
+}
+
+func sortBorderGroupManifests(manifests []BorderGroupManifest) {
+	sort.Slice(manifests, func(i, j int) bool {
+		return lessBorderGroupKey(manifests[i].Key(), manifests[j].Key())
+	})
+}
+
+func runManifestFilename(runId string) (string, error) {
+	if !runIdPattern.MatchString(runId) {
+		return "", fmt.Errorf("invalid run ID: %q", runId)
+	}
+	return runId + ".json", nil
+}
+
+func newRunManifestIndexEntry(manifest RunManifest, manifestKey string) RunManifestIndexEntry {
+	return RunManifestIndexEntry{
+		RunId:            manifest.RunId,
+		StartedAt:        manifest.StartedAt,
+		EndedAt:          manifest.EndedAt,
+		ManifestKey:      manifestKey,
+		BorderGroupCount: len(manifest.BorderGroups),
+	}
+}
+
+// appendRunManifestIndex appends entry to the index, oldest run first, and drops the runs
+// beyond RUN_MANIFEST_INDEX_SIZE. An entry of the same run is replaced.
+func appendRunManifestIndex(index []RunManifestIndexEntry, entry RunManifestIndexEntry) []RunManifestIndexEntry {
+	updated := make([]RunManifestIndexEntry, 0, len(index)+1)
+	for _, existing := range index {
+		if existing.RunId != entry.RunId {
+			updated = append(updated, existing)
+		}
+	}
+	updated = append(updated, entry)
+	if len(updated) > RUN_MANIFEST_INDEX_SIZE {
+		updated = updated[len(updated)-RUN_MANIFEST_INDEX_SIZE:]
+	}
+	return updated
+}
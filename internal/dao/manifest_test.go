@@ -0,0 +1,95 @@
+package dao
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppendRunManifestIndex(t *testing.T) {
+	var index []RunManifestIndexEntry
+	for i := 0; i < RUN_MANIFEST_INDEX_SIZE+2; i++ {
+		index = appendRunManifestIndex(index, RunManifestIndexEntry{RunId: fmt.Sprintf("run-%03d", i)})
+	}
+	assert.Len(t, index, RUN_MANIFEST_INDEX_SIZE)
+	assert.Equal(t, "run-002", index[0].RunId)
+	assert.Equal(t, fmt.Sprintf("run-%03d", RUN_MANIFEST_INDEX_SIZE+1), index[len(index)-1].RunId)
+
+	// Saving a run again moves it to the end instead of duplicating it
+	index = appendRunManifestIndex(index, RunManifestIndexEntry{RunId: "run-002", BorderGroupCount: 1})
+	assert.Len(t, index, RUN_MANIFEST_INDEX_SIZE)
+	assert.Equal(t, "run-003", index[0].RunId)
+	assert.Equal(t, 1, index[len(index)-1].BorderGroupCount)
+}
+
+func TestLocalDAO_BorderGroupManifests(t *testing.T) {
+	tmp := createTempDir(t)
+	defer os.RemoveAll(tmp)
+	dao := newTestLocalDAO(t, tmp, "b", "e", "m")
+	t1 := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(30 * time.Minute)
+
+	saveBorderInfos(t, dao, []models.BorderInfo{{EventId: 1, Border: 100, RankingType: models.EventPoint, Score: 10, AggregatedAt: t1}})
+	manifests := saveBorderInfos(t, dao, []models.BorderInfo{
+		{EventId: 1, Border: 2500, RankingType: models.EventPoint, Score: 1, AggregatedAt: t1},
+		{EventId: 1, Border: 100, RankingType: models.EventPoint, Score: 20, AggregatedAt: t2},
+	})
+
+	assert.Len(t, manifests, 2)
+	manifest := manifests[0]
+	assert.Equal(t, BorderGroupKey{EventId: 1, RankingType: models.EventPoint, Border: 100}, manifest.Key())
+	assert.Equal(t, "b/border_info_1_0_100.csv", manifest.ObjectKey)
+	// The manifest describes the whole stored group, not only the rows of the write
+	assert.Equal(t, 2, manifest.RowCount)
+	assert.True(t, t1.Equal(manifest.MinAggregatedAt))
+	assert.True(t, t2.Equal(manifest.MaxAggregatedAt))
+
+	data, err := os.ReadFile(filepath.Join(tmp, manifest.ObjectKey))
+	assert.NoError(t, err)
+	checksum := sha256.Sum256(data)
+	assert.Equal(t, hex.EncodeToString(checksum[:]), manifest.SHA256)
+	assert.Equal(t, 2500, manifests[1].Border)
+}
+
+func TestLocalDAO_RunManifests(t *testing.T) {
+	tmp := createTempDir(t)
+	defer os.RemoveAll(tmp)
+	dao := newTestLocalDAO(t, tmp, "b", "e", "m")
+	ctx := context.Background()
+	start := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	index, err := dao.GetRunManifestIndex(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, index)
+	_, err = dao.GetRunManifest(ctx, "missing")
+	assert.ErrorIs(t, err, ErrRunManifestNotFound)
+	_, err = dao.GetRunManifest(ctx, "../etags")
+	assert.Error(t, err)
+
+	first := RunManifest{RunId: "20250601T000000Z-aa", StartedAt: start, EndedAt: start.Add(time.Minute), EventIds: []int{1},
+		BorderGroups: []BorderGroupManifest{{EventId: 1, RankingType: models.EventPoint, Border: 100, RowCount: 2}}}
+	second := RunManifest{RunId: "20250601T003000Z-bb", StartedAt: start.Add(30 * time.Minute), EndedAt: start.Add(31 * time.Minute)}
+	assert.NoError(t, dao.SaveRunManifest(ctx, first))
+	assert.NoError(t, dao.SaveRunManifest(ctx, second))
+
+	index, err = dao.GetRunManifestIndex(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, index, 2)
+	assert.Equal(t, first.RunId, index[0].RunId)
+	assert.Equal(t, 1, index[0].BorderGroupCount)
+	assert.Equal(t, "m/manifests/20250601T000000Z-aa.json", index[0].ManifestKey)
+	assert.FileExists(t, filepath.Join(tmp, index[1].ManifestKey))
+
+	got, err := dao.GetRunManifest(ctx, first.RunId)
+	assert.NoError(t, err)
+	assert.Equal(t, first.BorderGroups, got.BorderGroups)
+	assert.True(t, first.EndedAt.Equal(got.EndedAt))
+}
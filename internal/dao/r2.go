@@ -6,17 +6,19 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"path"
+	"time"
 
+	"github.com/alceccentric/matsurihi-cron/internal/logging"
+	"github.com/alceccentric/matsurihi-cron/internal/metrics"
 	"github.com/alceccentric/matsurihi-cron/models"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/smithy-go"
-	"github.com/gocarina/gocsv"
 	"github.com/joho/godotenv"
 	"github.com/sirupsen/logrus"
 	"go.uber.org/multierr"
@@ -28,16 +30,22 @@ type R2DAO struct {
 	borderInfoPrefix   string
 	eventInfoPrefix    string
 	metadataInfoPrefix string
+	serializer         Serializer
 }
 
-func NewR2DAO(bucketName, borderInfoPrefix, eventInfoPrefix, metadataInfoPrefix string) *R2DAO {
+func NewR2DAO(ctx context.Context, bucketName, borderInfoPrefix, eventInfoPrefix, metadataInfoPrefix string) (*R2DAO, error) {
+	s3Client, err := NewS3Client(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init S3 client: %w", err)
+	}
 	return &R2DAO{
-		s3:                 initS3Client(),
+		s3:                 s3Client,
 		bucketName:         bucketName,
 		borderInfoPrefix:   borderInfoPrefix,
 		eventInfoPrefix:    eventInfoPrefix,
 		metadataInfoPrefix: metadataInfoPrefix,
-	}
+		serializer:         CSVSerializer{},
+	}, nil
 }
 
 func NewR2DAOWithClient(bucketName, borderInfoPrefix, eventInfoPrefix, metadataInfoPrefix string, s3Client S3Uploader) *R2DAO {
@@ -47,77 +55,290 @@ func NewR2DAOWithClient(bucketName, borderInfoPrefix, eventInfoPrefix, metadataI
 		borderInfoPrefix:   borderInfoPrefix,
 		eventInfoPrefix:    eventInfoPrefix,
 		metadataInfoPrefix: metadataInfoPrefix,
+		serializer:         CSVSerializer{},
 	}
 }
 
-func (u *R2DAO) GetLatestEventInfo() (models.EventInfo, error) {
-	key := path.Join(u.metadataInfoPrefix, LATEST_EVENT_BORDER_INFO_FILE)
-	resp, err := u.s3.GetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(u.bucketName),
-		Key:    aws.String(key),
-	})
-
-	if err != nil {
-		var apiErr smithy.APIError
-		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchKey" {
-			return models.EventInfo{}, nil
-		}
-		return models.EventInfo{}, err
-	}
-	defer resp.Body.Close()
+// SetSerializer sets the format border and event infos are stored in. CSV is used by default.
+func (u *R2DAO) SetSerializer(serializer Serializer) *R2DAO {
+	u.serializer = serializer
+	return u
+}
 
+func (u *R2DAO) GetLatestEventInfo(ctx context.Context) (models.EventInfo, error) {
+	key := path.Join(u.metadataInfoPrefix, LATEST_EVENT_BORDER_INFO_FILE)
 	var latestInfo models.EventInfo
-	decoder := json.NewDecoder(resp.Body)
-	if err := decoder.Decode(&latestInfo); err != nil {
+	if _, err := readJsonFromR2(ctx, u.s3, u.bucketName, key, &latestInfo); err != nil {
 		return models.EventInfo{}, err
 	}
-
 	return latestInfo, nil
 }
 
-func (u *R2DAO) SaveEventInfos(eventInfos []models.EventInfo) error {
+func (u *R2DAO) GetBorderHighWaterMarks(ctx context.Context) (map[BorderGroupKey]time.Time, error) {
+	key := path.Join(u.metadataInfoPrefix, BORDER_HIGH_WATER_MARKS_FILE)
+	var list []BorderHighWaterMark
+	if _, err := readJsonFromR2(ctx, u.s3, u.bucketName, key, &list); err != nil {
+		return nil, err
+	}
+	return highWaterMarksFromList(list), nil
+}
+
+func (u *R2DAO) SaveEventInfos(ctx context.Context, eventInfos []models.EventInfo) error {
 	// Always replace event info file completely
-	key := path.Join(u.eventInfoPrefix, EVENT_INFO_FILENAME)
-	logrus.Infof("Saving %d event infos to bucket: %s with key: %s",
-		len(eventInfos), u.bucketName, key)
-	if err := writeCSVToR2(u.s3, u.bucketName, key, eventInfos); err != nil {
+	key := path.Join(u.eventInfoPrefix, withExtension(EVENT_INFO_FILENAME, u.serializer))
+	logger := u.logger(ctx, key)
+	logger.Infof("Saving %d event infos", len(eventInfos))
+	if err := writeRecordsToR2(ctx, u.s3, u.serializer, u.bucketName, key, eventInfos); err != nil {
 		return err
 	} else {
-		logrus.Infof("Successfully saved %d event infos to bucket: %s with key: %s", len(eventInfos), u.bucketName, key)
+		logger.Infof("Successfully saved %d event infos", len(eventInfos))
 		return nil
 	}
 
 }
 
-func (u *R2DAO) SaveBorderInfos(borderInfos []models.BorderInfo) error {
+func (u *R2DAO) SaveBorderInfos(ctx context.Context, borderInfos []models.BorderInfo) ([]BorderGroupManifest, error) {
 	borderInfosByBorderGroupKey := groupByEventIdAndBorder(borderInfos)
-	var err error
+	if len(borderInfosByBorderGroupKey) == 0 {
+		return nil, nil
+	}
+
+	marks, err := u.GetBorderHighWaterMarks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	savedGroups := make(map[BorderGroupKey][]models.BorderInfo)
+	manifests := make([]BorderGroupManifest, 0, len(borderInfosByBorderGroupKey))
 	for group, infos := range borderInfosByBorderGroupKey {
-		key := path.Join(u.borderInfoPrefix, fmt.Sprintf(BORDER_INFO_FILENAME_FORMAT, group.EventId, group.IdolId, group.Border))
-		err = multierr.Append(err, writeCSVToR2(u.s3, u.bucketName, key, infos))
+		key := path.Join(u.borderInfoPrefix, withExtension(borderInfoFilename(group), u.serializer))
+		existing, readErr := u.GetBorderInfos(ctx, group)
+		if readErr != nil {
+			err = multierr.Append(err, readErr)
+			continue
+		}
+		merged := mergeBorderInfos(existing, infos)
+		u.logger(ctx, key).WithFields(logging.BorderFields(group.EventId, group.RankingType, group.IdolId, group.Border)).
+			Debugf("Saving %d border infos (%d new)", len(merged), len(infos))
+		data, marshalErr := u.serializer.Marshal(merged)
+		if marshalErr != nil {
+			err = multierr.Append(err, fmt.Errorf("failed to marshal records: %w", marshalErr))
+			continue
+		}
+		if writeErr := writeToR2(ctx, u.s3, u.bucketName, key, data); writeErr != nil {
+			err = multierr.Append(err, writeErr)
+			continue
+		}
+		savedGroups[group] = infos
+		manifests = append(manifests, newBorderGroupManifest(group, key, merged, data))
 	}
+
+	updateHighWaterMarks(marks, savedGroups)
+	sortBorderGroupManifests(manifests)
+	marksKey := path.Join(u.metadataInfoPrefix, BORDER_HIGH_WATER_MARKS_FILE)
+	err = multierr.Append(err, writeJsonToR2(ctx, u.s3, u.bucketName, marksKey, highWaterMarksToList(marks)))
 	if err != nil {
-		return err
+		return manifests, err
 	} else {
-		logrus.Infof("Successfully saved %d border infos to bucket: %s", len(borderInfos), u.bucketName)
-		return nil
+		logging.FromContext(ctx).WithField("bucket", u.bucketName).Infof("Successfully saved %d border infos", len(borderInfos))
+		return manifests, nil
 	}
 }
 
-func (u *R2DAO) SaveLatestEventInfo(info models.EventInfo) error {
+func (u *R2DAO) SaveLatestEventInfo(ctx context.Context, info models.EventInfo) error {
 	// Always replace event info file completely
 	key := path.Join(u.metadataInfoPrefix, LATEST_EVENT_BORDER_INFO_FILE)
-	logrus.Infof("Saving latest event info %v to bucket: %s with key: %s", info, u.bucketName, key)
-	err := writeJsonToR2(u.s3, u.bucketName, key, info)
+	logger := u.logger(ctx, key).WithField(logging.FIELD_EVENT_ID, info.EventId)
+	logger.Infof("Saving latest event info %v", info)
+	err := writeJsonToR2(ctx, u.s3, u.bucketName, key, info)
 	if err != nil {
 		return err
 	} else {
-		logrus.Infof("Successfully saved latest event info %v to bucket: %s with key: %s", info, u.bucketName, key)
+		logger.Infof("Successfully saved latest event info %v", info)
 		return nil
 	}
 }
 
-func initS3Client() *s3.Client {
+func (u *R2DAO) GetETags(ctx context.Context) (map[string]string, error) {
+	key := path.Join(u.metadataInfoPrefix, ETAGS_FILE)
+	etags := make(map[string]string)
+	if _, err := readJsonFromR2(ctx, u.s3, u.bucketName, key, &etags); err != nil {
+		return nil, err
+	}
+	return etags, nil
+}
+
+func (u *R2DAO) SaveETags(ctx context.Context, etags map[string]string) error {
+	key := path.Join(u.metadataInfoPrefix, ETAGS_FILE)
+	u.logger(ctx, key).Infof("Saving %d ETags", len(etags))
+	return writeJsonToR2(ctx, u.s3, u.bucketName, key, etags)
+}
+
+// ListEventInfos returns the event infos merged from every format they are stored in,
+// the infos of the current format taking precedence.
+func (u *R2DAO) ListEventInfos(ctx context.Context) ([]models.EventInfo, error) {
+	eventInfos := make([]models.EventInfo, 0)
+	for _, serializer := range storedSerializers(u.serializer) {
+		key := path.Join(u.eventInfoPrefix, withExtension(EVENT_INFO_FILENAME, serializer))
+		var stored []models.EventInfo
+		if _, err := readRecordsFromR2(ctx, u.s3, serializer, u.bucketName, key, &stored); err != nil {
+			return nil, err
+		}
+		eventInfos = mergeEventInfos(eventInfos, stored)
+	}
+	return eventInfos, nil
+}
+
+// GetBorderInfos returns the border infos of a group merged from every format it is stored in,
+// the rows of the current format taking precedence.
+func (u *R2DAO) GetBorderInfos(ctx context.Context, group BorderGroupKey) ([]models.BorderInfo, error) {
+	borderInfos := make([]models.BorderInfo, 0)
+	for _, serializer := range storedSerializers(u.serializer) {
+		key := path.Join(u.borderInfoPrefix, withExtension(borderInfoFilename(group), serializer))
+		var stored []models.BorderInfo
+		if _, err := readRecordsFromR2(ctx, u.s3, serializer, u.bucketName, key, &stored); err != nil {
+			return nil, err
+		}
+		borderInfos = mergeBorderInfos(borderInfos, stored)
+	}
+	return borderInfos, nil
+}
+
+func (u *R2DAO) ListBorderGroups(ctx context.Context, eventId int) ([]BorderGroupKey, error) {
+	prefix := path.Join(u.borderInfoPrefix, borderInfoFilenamePrefix(eventId))
+	objectKeys, err := listKeysFromR2(ctx, u.s3, u.bucketName, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(objectKeys))
+	for _, objectKey := range objectKeys {
+		names = append(names, path.Base(objectKey))
+	}
+	return borderGroupKeysOf(names, eventId, u.serializer), nil
+}
+
+// SaveRunManifest saves the manifest under the manifests prefix of the metadata prefix.
+func (u *R2DAO) SaveRunManifest(ctx context.Context, manifest RunManifest) error {
+	filename, err := runManifestFilename(manifest.RunId)
+	if err != nil {
+		return err
+	}
+	key := path.Join(u.metadataInfoPrefix, RUN_MANIFESTS_DIR, filename)
+	u.logger(ctx, key).Infof("Saving manifest of run %s with %d border groups", manifest.RunId, len(manifest.BorderGroups))
+	if err := writeJsonToR2(ctx, u.s3, u.bucketName, key, manifest); err != nil {
+		return err
+	}
+
+	index, err := u.GetRunManifestIndex(ctx)
+	if err != nil {
+		return err
+	}
+	index = appendRunManifestIndex(index, newRunManifestIndexEntry(manifest, key))
+	indexKey := path.Join(u.metadataInfoPrefix, RUN_MANIFEST_INDEX_FILE)
+	return writeJsonToR2(ctx, u.s3, u.bucketName, indexKey, index)
+}
+
+func (u *R2DAO) GetRunManifestIndex(ctx context.Context) ([]RunManifestIndexEntry, error) {
+	key := path.Join(u.metadataInfoPrefix, RUN_MANIFEST_INDEX_FILE)
+	index := make([]RunManifestIndexEntry, 0)
+	if _, err := readJsonFromR2(ctx, u.s3, u.bucketName, key, &index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func (u *R2DAO) GetRunManifest(ctx context.Context, runId string) (RunManifest, error) {
+	filename, err := runManifestFilename(runId)
+	if err != nil {
+		return RunManifest{}, err
+	}
+	key := path.Join(u.metadataInfoPrefix, RUN_MANIFESTS_DIR, filename)
+	var manifest RunManifest
+	found, err := readJsonFromR2(ctx, u.s3, u.bucketName, key, &manifest)
+	if err != nil {
+		return RunManifest{}, err
+	}
+	if !found {
+		return RunManifest{}, ErrRunManifestNotFound
+	}
+	return manifest, nil
+}
+
+func (u *R2DAO) SaveBorderPredictions(ctx context.Context, eventId int, predictions []models.BorderPrediction) error {
+	key := path.Join(u.borderInfoPrefix, fmt.Sprintf(BORDER_PREDICTION_FILENAME_FORMAT, eventId))
+	u.logger(ctx, key).WithField(logging.FIELD_EVENT_ID, eventId).Infof("Saving %d border predictions", len(predictions))
+	return writeJsonToR2(ctx, u.s3, u.bucketName, key, predictions)
+}
+
+func (u *R2DAO) GetBorderPredictions(ctx context.Context, eventId int) ([]models.BorderPrediction, error) {
+	key := path.Join(u.borderInfoPrefix, fmt.Sprintf(BORDER_PREDICTION_FILENAME_FORMAT, eventId))
+	predictions := make([]models.BorderPrediction, 0)
+	if _, err := readJsonFromR2(ctx, u.s3, u.bucketName, key, &predictions); err != nil {
+		return nil, err
+	}
+	return predictions, nil
+}
+
+// AcquireLock stores the lease in a lock object under the locks prefix of the metadata prefix.
+// The object is written with a conditional put on the ETag read, so that only one of the owners
+// racing for a free or expired lock gets it.
+func (u *R2DAO) AcquireLock(ctx context.Context, name, owner string, ttl time.Duration) (Lease, error) {
+	key, err := u.lockKey(name)
+	if err != nil {
+		return Lease{}, err
+	}
+	current, etag, err := readLeaseFromR2(ctx, u.s3, u.bucketName, key)
+	if err != nil {
+		return Lease{}, err
+	}
+	lease, err := nextLease(current, name, owner, ttl, time.Now())
+	if err != nil {
+		return Lease{}, err
+	}
+	if err := writeLeaseToR2(ctx, u.s3, u.bucketName, key, lease, etag); err != nil {
+		return Lease{}, err
+	}
+	u.logger(ctx, key).Debugf("Leased lock %s until %v", name, lease.ExpiresAt)
+	return lease, nil
+}
+
+// ReleaseLock expires the lease in place rather than deleting the lock object, so that the release
+// is conditional on the lease not having been taken over in the meantime.
+func (u *R2DAO) ReleaseLock(ctx context.Context, name, owner string) error {
+	key, err := u.lockKey(name)
+	if err != nil {
+		return err
+	}
+	current, etag, err := readLeaseFromR2(ctx, u.s3, u.bucketName, key)
+	if err != nil || current == nil || current.Owner != owner {
+		return err
+	}
+	released := *current
+	released.ExpiresAt = time.Now().UTC()
+	if err := writeLeaseToR2(ctx, u.s3, u.bucketName, key, released, etag); err != nil && !errors.Is(err, ErrLockHeld) {
+		return err
+	}
+	u.logger(ctx, key).Debugf("Released lock %s", name)
+	return nil
+}
+
+func (u *R2DAO) lockKey(name string) (string, error) {
+	filename, err := lockFilename(name)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(u.metadataInfoPrefix, LOCKS_DIR, filename), nil
+}
+
+// logger returns the logger of ctx with the fields identifying an object of the bucket.
+func (u *R2DAO) logger(ctx context.Context, key string) *logrus.Entry {
+	return logging.FromContext(ctx).WithFields(logrus.Fields{"bucket": u.bucketName, logging.FIELD_OBJECT_KEY: key})
+}
+
+// NewS3Client builds a client of the R2 endpoint and credentials given by the R2_ENDPOINT,
+// R2_ACCESS_KEY_ID and R2_SECRET_ACCESS_KEY variables.
+func NewS3Client(ctx context.Context) (*s3.Client, error) {
 	// Load .env only for local dev
 	_ = godotenv.Load()
 
@@ -125,37 +346,153 @@ func initS3Client() *s3.Client {
 	accessKeyId := os.Getenv("R2_ACCESS_KEY_ID")
 	accessKeySecret := os.Getenv("R2_SECRET_ACCESS_KEY")
 
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
+	cfg, err := config.LoadDefaultConfig(ctx,
 		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(accessKeyId, accessKeySecret, "")),
 		config.WithRegion("auto"),
 	)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	return s3.NewFromConfig(cfg, func(o *s3.Options) {
 		o.BaseEndpoint = aws.String(endpoint)
+	}), nil
+}
+
+// readFromR2 fetches the object stored at key. It reports false without an error
+// when the object does not exist.
+func readFromR2(ctx context.Context, client S3Uploader, bucket, key string) ([]byte, bool, error) {
+	resp, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchKey" {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read object %s: %w", key, err)
+	}
+	return body, true, nil
+}
+
+// readLeaseFromR2 returns the lease stored at key along with the ETag of its object,
+// or nil when there is none.
+func readLeaseFromR2(ctx context.Context, client S3Uploader, bucket, key string) (*Lease, string, error) {
+	resp, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchKey" {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	var lease Lease
+	if err := json.NewDecoder(resp.Body).Decode(&lease); err != nil {
+		return nil, "", fmt.Errorf("failed to unmarshal lock %s: %w", key, err)
+	}
+	return &lease, aws.ToString(resp.ETag), nil
+}
+
+// writeLeaseToR2 replaces the lock object at key if its ETag is still etag, or creates it if etag
+// is empty. Returns ErrLockHeld when another owner wrote the lock object first.
+func writeLeaseToR2(ctx context.Context, client S3Uploader, bucket, key string, lease Lease, etag string) error {
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return fmt.Errorf("failed to marshal json: %w", err)
+	}
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	}
+	if etag == "" {
+		input.IfNoneMatch = aws.String("*")
+	} else {
+		input.IfMatch = aws.String(etag)
+	}
+
+	startedAt := time.Now()
+	if _, err := client.PutObject(ctx, input); err != nil {
+		var apiErr smithy.APIError
+		// S3 reports a conditional write that lost a race as a conflict rather than a failed precondition
+		if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "PreconditionFailed" || apiErr.ErrorCode() == "ConditionalRequestConflict") {
+			return fmt.Errorf("%w: %s was acquired concurrently", ErrLockHeld, lease.Name)
+		}
+		return err
+	}
+	metrics.ObserveDAOWrite("r2", time.Since(startedAt), len(data))
+	return nil
+}
+
+// listKeysFromR2 returns the keys of every object under prefix.
+func listKeysFromR2(ctx context.Context, client S3Uploader, bucket, prefix string) ([]string, error) {
+	var keys []string
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
 	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects with prefix %s: %w", prefix, err)
+		}
+		for _, object := range page.Contents {
+			keys = append(keys, aws.ToString(object.Key))
+		}
+	}
+	return keys, nil
+}
+
+func readRecordsFromR2[T any](ctx context.Context, client S3Uploader, serializer Serializer, bucket, key string, out *[]T) (bool, error) {
+	body, found, err := readFromR2(ctx, client, bucket, key)
+	if err != nil || !found {
+		return found, err
+	}
+	if err := serializer.Unmarshal(body, out); err != nil {
+		return true, fmt.Errorf("failed to unmarshal records %s: %w", key, err)
+	}
+	return true, nil
+}
+
+func readJsonFromR2(ctx context.Context, client S3Uploader, bucket, key string, v interface{}) (bool, error) {
+	body, found, err := readFromR2(ctx, client, bucket, key)
+	if err != nil || !found {
+		return found, err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return true, fmt.Errorf("failed to unmarshal json %s: %w", key, err)
+	}
+	return true, nil
 }
 
-func writeCSVToR2[T any](
+func writeRecordsToR2[T any](
+	ctx context.Context,
 	client S3Uploader,
+	serializer Serializer,
 	bucket, key string,
 	records []T,
 ) error {
-	csvBytes, err := gocsv.MarshalBytes(records)
+	recordBytes, err := serializer.Marshal(records)
 	if err != nil {
-		return fmt.Errorf("failed to marshal csv: %w", err)
+		return fmt.Errorf("failed to marshal records: %w", err)
 	}
-	_, err = client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: &bucket,
-		Key:    &key,
-		Body:   bytes.NewReader(csvBytes),
-	})
-	return err
+	return writeToR2(ctx, client, bucket, key, recordBytes)
 }
 
 func writeJsonToR2(
+	ctx context.Context,
 	client S3Uploader,
 	bucket, key string,
 	data interface{},
@@ -164,10 +501,19 @@ func writeJsonToR2(
 	if err != nil {
 		return fmt.Errorf("failed to marshal json: %w", err)
 	}
-	_, err = client.PutObject(context.TODO(), &s3.PutObjectInput{
+	return writeToR2(ctx, client, bucket, key, jsonBytes)
+}
+
+func writeToR2(ctx context.Context, client S3Uploader, bucket, key string, data []byte) error {
+	startedAt := time.Now()
+	_, err := client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket: &bucket,
 		Key:    &key,
-		Body:   bytes.NewReader(jsonBytes),
+		Body:   bytes.NewReader(data),
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	metrics.ObserveDAOWrite("r2", time.Since(startedAt), len(data))
+	return nil
 }
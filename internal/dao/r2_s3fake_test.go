@@ -0,0 +1,75 @@
+package dao
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/internal/s3fake"
+	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestR2DAOOnS3Fake builds an R2 DAO with the real S3 client, pointed at an in-memory S3 server
+// through the R2_ENDPOINT override.
+func newTestR2DAOOnS3Fake(t *testing.T) (*R2DAO, *s3fake.Server) {
+	server := s3fake.NewServer().CreateBucket("bucket")
+	httpServer := httptest.NewServer(server.Handler())
+	t.Cleanup(httpServer.Close)
+	t.Setenv("R2_ENDPOINT", httpServer.URL)
+	t.Setenv("R2_ACCESS_KEY_ID", "key")
+	t.Setenv("R2_SECRET_ACCESS_KEY", "secret")
+
+	r2DAO, err := NewR2DAO(context.Background(), "bucket", "b", "e", "m")
+	require.NoError(t, err)
+	return r2DAO, server
+}
+
+func TestR2DAO_S3Fake_Lock(t *testing.T) {
+	r2DAO, _ := newTestR2DAOOnS3Fake(t)
+	assertLockContract(t, r2DAO)
+}
+
+func TestR2DAO_S3Fake_BorderInfos(t *testing.T) {
+	r2DAO, server := newTestR2DAOOnS3Fake(t)
+	server.SetPageSize(1)
+	ctx := context.Background()
+
+	// Missing objects are reported by the SDK as NoSuchKey errors
+	latest, err := r2DAO.GetLatestEventInfo(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, latest.EventId)
+	infos, err := r2DAO.GetBorderInfos(ctx, BorderGroupKey{EventId: 1, RankingType: models.EventPoint, Border: 100})
+	require.NoError(t, err)
+	assert.Empty(t, infos)
+
+	at := time.Date(2024, 5, 1, 6, 30, 0, 0, time.UTC)
+	saved := []models.BorderInfo{
+		{EventId: 1, RankingType: models.EventPoint, Border: 100, Score: 10, AggregatedAt: at},
+		{EventId: 1, RankingType: models.EventPoint, Border: 2500, Score: 5, AggregatedAt: at},
+		{EventId: 1, RankingType: models.HighScore, Border: 100, Score: 7, AggregatedAt: at},
+		{EventId: 2, RankingType: models.EventPoint, Border: 100, Score: 3, AggregatedAt: at},
+	}
+	saveBorderInfos(t, r2DAO, saved)
+
+	// Listing pages through one key at a time
+	groups, err := r2DAO.ListBorderGroups(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []BorderGroupKey{
+		{EventId: 1, RankingType: models.EventPoint, Border: 100},
+		{EventId: 1, RankingType: models.EventPoint, Border: 2500},
+		{EventId: 1, RankingType: models.HighScore, Border: 100},
+	}, groups)
+
+	infos, err = r2DAO.GetBorderInfos(ctx, groups[1])
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	assert.Equal(t, 5, infos[0].Score)
+	assert.True(t, at.Equal(infos[0].AggregatedAt))
+
+	marks, err := r2DAO.GetBorderHighWaterMarks(ctx)
+	require.NoError(t, err)
+	assert.Len(t, marks, 4)
+}
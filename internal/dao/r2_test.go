@@ -1,14 +1,20 @@
 package dao
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"io"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/gocarina/gocsv"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -29,7 +35,13 @@ func (m *MockS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput,
 	return resp, args.Error(1)
 }
 
-func TestWriteCSVToR2_Overwrite_Success(t *testing.T) {
+func (m *MockS3Client) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	args := m.Called(ctx, params)
+	resp, _ := args.Get(0).(*s3.ListObjectsV2Output)
+	return resp, args.Error(1)
+}
+
+func TestWriteRecordsToR2_Overwrite_Success(t *testing.T) {
 	mockS3 := new(MockS3Client)
 	bucket := "b"
 	key := "k.csv"
@@ -46,12 +58,12 @@ func TestWriteCSVToR2_Overwrite_Success(t *testing.T) {
 	}
 	records := []rec{{ID: 4, Name: "Dana"}}
 
-	err := writeCSVToR2(mockS3, bucket, key, records)
+	err := writeRecordsToR2(context.Background(), mockS3, CSVSerializer{}, bucket, key, records)
 	assert.NoError(t, err)
 	mockS3.AssertExpectations(t)
 }
 
-func TestWriteCSVToR2_PutObjectError(t *testing.T) {
+func TestWriteRecordsToR2_PutObjectError(t *testing.T) {
 	mockS3 := new(MockS3Client)
 	bucket := "b"
 	key := "k.csv"
@@ -64,7 +76,7 @@ func TestWriteCSVToR2_PutObjectError(t *testing.T) {
 	}
 	records := []rec{{ID: 5, Name: "FailPut"}}
 
-	err := writeCSVToR2(mockS3, bucket, key, records)
+	err := writeRecordsToR2(context.Background(), mockS3, CSVSerializer{}, bucket, key, records)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "put failed")
 	mockS3.AssertExpectations(t)
@@ -81,7 +93,7 @@ func TestGetLatestEventInfo_Success(t *testing.T) {
 		Body: io.NopCloser(strings.NewReader(jsonStr)),
 	}, nil)
 
-	eventInfo, err := dao.GetLatestEventInfo()
+	eventInfo, err := dao.GetLatestEventInfo(context.Background())
 	assert.NoError(t, err)
 	assert.Equal(t, 10, eventInfo.EventId)
 	mockS3.AssertExpectations(t)
@@ -93,7 +105,7 @@ func TestGetLatestEventInfo_GetObjectError(t *testing.T) {
 
 	mockS3.On("GetObject", mock.Anything, mock.Anything).Return(nil, errors.New("get failed"))
 
-	_, err := dao.GetLatestEventInfo()
+	_, err := dao.GetLatestEventInfo(context.Background())
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "get failed")
 	mockS3.AssertExpectations(t)
@@ -107,7 +119,7 @@ func TestGetLatestEventInfo_JSONDecodeError(t *testing.T) {
 		Body: io.NopCloser(strings.NewReader("not json")),
 	}, nil)
 
-	_, err := dao.GetLatestEventInfo()
+	_, err := dao.GetLatestEventInfo(context.Background())
 	assert.Error(t, err)
 	mockS3.AssertExpectations(t)
 }
@@ -118,7 +130,7 @@ func TestSaveEventInfos_SaveSuccess(t *testing.T) {
 
 	mockS3.On("PutObject", mock.Anything, mock.Anything).Return(&s3.PutObjectOutput{}, nil).Once()
 
-	err := dao.SaveEventInfos([]models.EventInfo{{EventId: 1}})
+	err := dao.SaveEventInfos(context.Background(), []models.EventInfo{{EventId: 1}})
 	assert.NoError(t, err)
 	mockS3.AssertExpectations(t)
 }
@@ -136,7 +148,7 @@ func TestSaveLatestEventInfo_Success(t *testing.T) {
 			strings.HasSuffix(*input.Key, LATEST_EVENT_BORDER_INFO_FILE)
 	})).Return(&s3.PutObjectOutput{}, nil).Once()
 
-	err := dao.SaveLatestEventInfo(info)
+	err := dao.SaveLatestEventInfo(context.Background(), info)
 	assert.NoError(t, err)
 	mockS3.AssertExpectations(t)
 }
@@ -151,7 +163,7 @@ func TestSaveLatestEventInfo_PutObjectError(t *testing.T) {
 
 	mockS3.On("PutObject", mock.Anything, mock.Anything).Return(nil, errors.New("put error")).Once()
 
-	err := dao.SaveLatestEventInfo(info)
+	err := dao.SaveLatestEventInfo(context.Background(), info)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "put error")
 	mockS3.AssertExpectations(t)
@@ -160,14 +172,174 @@ func TestSaveLatestEventInfo_PutObjectError(t *testing.T) {
 func TestSaveBorderInfos_Success(t *testing.T) {
 	mockS3 := new(MockS3Client)
 	dao := NewR2DAOWithClient("bucket", "b", "e", "m", mockS3)
-	mockS3.On("PutObject", mock.Anything, mock.Anything).Return(&s3.PutObjectOutput{}, nil).Times(2)
+	// The high-water marks file, and two border groups in both formats
+	mockS3.On("GetObject", mock.Anything, mock.Anything).Return(nil, &smithy.GenericAPIError{Code: "NoSuchKey"}).Times(5)
+	// Two border groups plus the high-water marks file
+	mockS3.On("PutObject", mock.Anything, mock.Anything).Return(&s3.PutObjectOutput{}, nil).Times(3)
 
 	borderInfos := []models.BorderInfo{
 		{EventId: 1, IdolId: 0, Border: 100},
 		{EventId: 1, IdolId: 0, Border: 200},
 	}
 
-	err := dao.SaveBorderInfos(borderInfos)
+	_, err := dao.SaveBorderInfos(context.Background(), borderInfos)
+	assert.NoError(t, err)
+	mockS3.AssertExpectations(t)
+}
+
+func TestSaveBorderInfos_MergesExisting(t *testing.T) {
+	mockS3 := new(MockS3Client)
+	dao := NewR2DAOWithClient("bucket", "b", "e", "m", mockS3)
+	t1 := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(30 * time.Minute)
+
+	existing, err := gocsv.MarshalString([]models.BorderInfo{
+		{EventId: 1, Border: 100, Score: 10, AggregatedAt: t1},
+	})
+	assert.NoError(t, err)
+
+	mockS3.On("GetObject", mock.Anything, mock.MatchedBy(func(input *s3.GetObjectInput) bool {
+		return strings.HasSuffix(*input.Key, BORDER_HIGH_WATER_MARKS_FILE)
+	})).Return(nil, &smithy.GenericAPIError{Code: "NoSuchKey"}).Once()
+	mockS3.On("GetObject", mock.Anything, mock.MatchedBy(func(input *s3.GetObjectInput) bool {
+		return *input.Key == "b/border_info_1_0_100.csv"
+	})).Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(strings.NewReader(existing)),
+	}, nil).Once()
+	mockS3.On("GetObject", mock.Anything, mock.MatchedBy(func(input *s3.GetObjectInput) bool {
+		return *input.Key == "b/border_info_1_0_100.parquet"
+	})).Return(nil, &smithy.GenericAPIError{Code: "NoSuchKey"}).Once()
+	mockS3.On("PutObject", mock.Anything, mock.MatchedBy(func(input *s3.PutObjectInput) bool {
+		if *input.Key != "b/border_info_1_0_100.csv" {
+			return false
+		}
+		var got []models.BorderInfo
+		bodyBytes, _ := io.ReadAll(input.Body)
+		return gocsv.UnmarshalBytes(bodyBytes, &got) == nil && len(got) == 2 && got[0].Score == 10 && got[1].Score == 20
+	})).Return(&s3.PutObjectOutput{}, nil).Once()
+	mockS3.On("PutObject", mock.Anything, mock.MatchedBy(func(input *s3.PutObjectInput) bool {
+		return strings.HasSuffix(*input.Key, BORDER_HIGH_WATER_MARKS_FILE)
+	})).Return(&s3.PutObjectOutput{}, nil).Once()
+
+	_, err = dao.SaveBorderInfos(context.Background(), []models.BorderInfo{
+		{EventId: 1, Border: 100, Score: 20, AggregatedAt: t2},
+	})
+	assert.NoError(t, err)
+	mockS3.AssertExpectations(t)
+}
+
+func TestListBorderGroups_R2(t *testing.T) {
+	mockS3 := new(MockS3Client)
+	dao := NewR2DAOWithClient("bucket", "b", "e", "m", mockS3)
+
+	mockS3.On("ListObjectsV2", mock.Anything, mock.MatchedBy(func(input *s3.ListObjectsV2Input) bool {
+		return *input.Prefix == "b/border_info_1_" && input.ContinuationToken == nil
+	})).Return(&s3.ListObjectsV2Output{
+		Contents: []types.Object{
+			{Key: aws.String("b/border_info_1_0_2500.csv")},
+			{Key: aws.String("b/border_info_1_highScore_0_100.csv")},
+		},
+		IsTruncated:           aws.Bool(true),
+		NextContinuationToken: aws.String("next"),
+	}, nil).Once()
+	mockS3.On("ListObjectsV2", mock.Anything, mock.MatchedBy(func(input *s3.ListObjectsV2Input) bool {
+		return input.ContinuationToken != nil && *input.ContinuationToken == "next"
+	})).Return(&s3.ListObjectsV2Output{
+		Contents: []types.Object{
+			{Key: aws.String("b/border_info_1_0_100.csv")},
+			{Key: aws.String("b/border_info_1_0_100.parquet")},
+			{Key: aws.String("b/border_info_10_0_100.csv")},
+		},
+		IsTruncated: aws.Bool(false),
+	}, nil).Once()
+
+	keys, err := dao.ListBorderGroups(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []BorderGroupKey{
+		{EventId: 1, RankingType: models.EventPoint, Border: 100},
+		{EventId: 1, RankingType: models.EventPoint, Border: 2500},
+		{EventId: 1, RankingType: models.HighScore, Border: 100},
+	}, keys)
+	mockS3.AssertExpectations(t)
+}
+
+func TestGetBorderInfos_R2_NotFound(t *testing.T) {
+	mockS3 := new(MockS3Client)
+	dao := NewR2DAOWithClient("bucket", "b", "e", "m", mockS3)
+	mockS3.On("GetObject", mock.Anything, mock.Anything).Return(nil, &smithy.GenericAPIError{Code: "NoSuchKey"}).Twice()
+
+	infos, err := dao.GetBorderInfos(context.Background(), BorderGroupKey{EventId: 1, RankingType: models.EventPoint, Border: 100})
 	assert.NoError(t, err)
+	assert.Empty(t, infos)
+	mockS3.AssertExpectations(t)
+}
+
+func TestListEventInfos_R2(t *testing.T) {
+	mockS3 := new(MockS3Client)
+	dao := NewR2DAOWithClient("bucket", "b", "e", "m", mockS3)
+	csv, err := gocsv.MarshalString([]models.EventInfo{{EventId: 1}, {EventId: 2, EventName: "Two"}})
+	assert.NoError(t, err)
+	// Event infos stored before the format changed to CSV are still listed
+	parquet, err := ParquetSerializer{}.Marshal([]models.EventInfo{{EventId: 2, EventName: "Stale"}, {EventId: 3}})
+	assert.NoError(t, err)
+	mockS3.On("GetObject", mock.Anything, mock.MatchedBy(func(input *s3.GetObjectInput) bool {
+		return *input.Key == "e/"+EVENT_INFO_FILENAME
+	})).Return(&s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(csv))}, nil).Once()
+	mockS3.On("GetObject", mock.Anything, mock.MatchedBy(func(input *s3.GetObjectInput) bool {
+		return *input.Key == "e/event_info_all.parquet"
+	})).Return(&s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(parquet))}, nil).Once()
+
+	infos, err := dao.ListEventInfos(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3}, []int{infos[0].EventId, infos[1].EventId, infos[2].EventId})
+	assert.Equal(t, "Two", infos[1].EventName, "the current format takes precedence")
+	mockS3.AssertExpectations(t)
+}
+
+func TestR2DAO_AcquireLock_CreatesLockObject(t *testing.T) {
+	mockS3 := new(MockS3Client)
+	dao := NewR2DAOWithClient("bucket", "b", "e", "m", mockS3)
+
+	mockS3.On("GetObject", mock.Anything, mock.Anything).Return(nil, &smithy.GenericAPIError{Code: "NoSuchKey"}).Once()
+	mockS3.On("PutObject", mock.Anything, mock.MatchedBy(func(input *s3.PutObjectInput) bool {
+		return *input.Key == "m/locks/sync.json" && aws.ToString(input.IfNoneMatch) == "*" && input.IfMatch == nil
+	})).Return(&s3.PutObjectOutput{}, nil).Once()
+
+	lease, err := dao.AcquireLock(context.Background(), "sync", "a", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", lease.Owner)
+	mockS3.AssertExpectations(t)
+}
+
+func TestR2DAO_AcquireLock_HeldByAnotherOwner(t *testing.T) {
+	mockS3 := new(MockS3Client)
+	dao := NewR2DAOWithClient("bucket", "b", "e", "m", mockS3)
+
+	body := `{"name":"sync","owner":"b","expires_at":"` + time.Now().Add(time.Minute).UTC().Format(time.RFC3339Nano) + `"}`
+	mockS3.On("GetObject", mock.Anything, mock.Anything).Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(strings.NewReader(body)),
+		ETag: aws.String(`"v1"`),
+	}, nil).Once()
+
+	_, err := dao.AcquireLock(context.Background(), "sync", "a", time.Minute)
+	assert.ErrorIs(t, err, ErrLockHeld)
+	mockS3.AssertNotCalled(t, "PutObject", mock.Anything, mock.Anything)
+}
+
+func TestR2DAO_AcquireLock_TakesOverExpiredLeaseConditionally(t *testing.T) {
+	mockS3 := new(MockS3Client)
+	dao := NewR2DAOWithClient("bucket", "b", "e", "m", mockS3)
+
+	body := `{"name":"sync","owner":"b","expires_at":"` + time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano) + `"}`
+	mockS3.On("GetObject", mock.Anything, mock.Anything).Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(strings.NewReader(body)),
+		ETag: aws.String(`"v1"`),
+	}, nil).Once()
+	mockS3.On("PutObject", mock.Anything, mock.MatchedBy(func(input *s3.PutObjectInput) bool {
+		return aws.ToString(input.IfMatch) == `"v1"`
+	})).Return(nil, &smithy.GenericAPIError{Code: "PreconditionFailed"}).Once()
+
+	_, err := dao.AcquireLock(context.Background(), "sync", "a", time.Minute)
+	assert.ErrorIs(t, err, ErrLockHeld, "another owner took the expired lease over first")
 	mockS3.AssertExpectations(t)
 }
@@ -0,0 +1,203 @@
+package dao
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/gocarina/gocsv"
+	"github.com/parquet-go/parquet-go"
+)
+
+// Formats the border and event infos can be stored in
+const (
+	FORMAT_CSV     = "csv"
+	FORMAT_PARQUET = "parquet"
+)
+
+// Serializer encodes the border and event infos stored by the DAOs.
+type Serializer interface {
+	// Extension returns the file extension, including the leading dot, of the encoded files.
+	Extension() string
+	// Marshal encodes a slice of records.
+	Marshal(records interface{}) ([]byte, error)
+	// Unmarshal decodes data into the slice pointed to by out.
+	Unmarshal(data []byte, out interface{}) error
+}
+
+// NewSerializer returns the serializer of the given format.
+func NewSerializer(format string) (Serializer, error) {
+	switch format {
+	case FORMAT_CSV:
+		return CSVSerializer{}, nil
+	case FORMAT_PARQUET:
+		return ParquetSerializer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown format: %s", format)
+	}
+}
+
+// withExtension replaces the extension of a file name with the one of the serializer.
+func withExtension(name string, serializer Serializer) string {
+	return strings.TrimSuffix(name, path.Ext(name)) + serializer.Extension()
+}
+
+// storedSerializers returns the serializers of every format border infos may be stored in, ending
+// with the current one. A border group is stored in several formats once the format changed between
+// runs, while the high-water marks are shared by all of them, so its rows are read from every format.
+func storedSerializers(current Serializer) []Serializer {
+	serializers := make([]Serializer, 0, 2)
+	for _, serializer := range []Serializer{CSVSerializer{}, ParquetSerializer{}} {
+		if serializer.Extension() != current.Extension() {
+			serializers = append(serializers, serializer)
+		}
+	}
+	return append(serializers, current)
+}
+
+// hasStoredExtension reports whether name has the extension of one of the stored serializers.
+func hasStoredExtension(name string, current Serializer) bool {
+	for _, serializer := range storedSerializers(current) {
+		if strings.HasSuffix(name, serializer.Extension()) {
+			return true
+		}
+	}
+	return false
+}
+
+// CSVSerializer stores records as CSV using their csv struct tags.
+type CSVSerializer struct{}
+
+func (CSVSerializer) Extension() string {
+	return "." + FORMAT_CSV
+}
+
+func (CSVSerializer) Marshal(records interface{}) ([]byte, error) {
+	return gocsv.MarshalBytes(records)
+}
+
+func (CSVSerializer) Unmarshal(data []byte, out interface{}) error {
+	return gocsv.UnmarshalBytes(data, out)
+}
+
+// ParquetSerializer stores border and event infos as Parquet, with int32 columns for
+// the numeric fields and timestamp columns for the times.
+type ParquetSerializer struct{}
+
+type borderInfoRow struct {
+	EventId      int32     `parquet:"event_id"`
+	IdolId       int32     `parquet:"idol_id"`
+	Border       int32     `parquet:"border"`
+	RankingType  string    `parquet:"ranking_type,dict"`
+	AggregatedAt time.Time `parquet:"aggregated_at,timestamp(millisecond)"`
+	Score        int32     `parquet:"score"`
+}
+
+type eventInfoRow struct {
+	EventId           int32     `parquet:"event_id"`
+	EventName         string    `parquet:"name"`
+	EventType         int32     `parquet:"event_type"`
+	InternalEventType int32     `parquet:"internal_event_type"`
+	StartAt           time.Time `parquet:"start_at,timestamp(millisecond)"`
+	EndAt             time.Time `parquet:"end_at,timestamp(millisecond)"`
+	// Null for events without a boost. Optional times are always stored with nanosecond precision.
+	BoostAt *time.Time `parquet:"boost_at,optional"`
+}
+
+func (ParquetSerializer) Extension() string {
+	return "." + FORMAT_PARQUET
+}
+
+func (ParquetSerializer) Marshal(records interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch records := records.(type) {
+	case []models.BorderInfo:
+		rows := make([]borderInfoRow, 0, len(records))
+		for _, info := range records {
+			rows = append(rows, borderInfoRow{
+				EventId:      int32(info.EventId),
+				IdolId:       int32(info.IdolId),
+				Border:       int32(info.Border),
+				RankingType:  string(info.RankingType),
+				AggregatedAt: info.AggregatedAt,
+				Score:        int32(info.Score),
+			})
+		}
+		err = parquet.Write(&buf, rows)
+	case []models.EventInfo:
+		rows := make([]eventInfoRow, 0, len(records))
+		for _, info := range records {
+			rows = append(rows, eventInfoRow{
+				EventId:           int32(info.EventId),
+				EventName:         info.EventName,
+				EventType:         int32(info.EventType),
+				InternalEventType: int32(info.InternalEventType),
+				StartAt:           info.StartAt,
+				EndAt:             info.EndAt,
+				BoostAt:           optionalTime(info.BoostAt),
+			})
+		}
+		err = parquet.Write(&buf, rows)
+	default:
+		return nil, fmt.Errorf("parquet: unsupported records type %T", records)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (ParquetSerializer) Unmarshal(data []byte, out interface{}) error {
+	reader := bytes.NewReader(data)
+	switch out := out.(type) {
+	case *[]models.BorderInfo:
+		rows, err := parquet.Read[borderInfoRow](reader, reader.Size())
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			*out = append(*out, models.BorderInfo{
+				EventId:      int(row.EventId),
+				IdolId:       int(row.IdolId),
+				Border:       int(row.Border),
+				RankingType:  models.EventRankingType(row.RankingType),
+				AggregatedAt: row.AggregatedAt,
+				Score:        int(row.Score),
+			})
+		}
+	case *[]models.EventInfo:
+		rows, err := parquet.Read[eventInfoRow](reader, reader.Size())
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			info := models.EventInfo{
+				EventId:           int(row.EventId),
+				EventName:         row.EventName,
+				EventType:         models.EventType(row.EventType),
+				InternalEventType: models.InternalEventType(row.InternalEventType),
+				StartAt:           row.StartAt,
+				EndAt:             row.EndAt,
+			}
+			if row.BoostAt != nil {
+				info.BoostAt = *row.BoostAt
+			}
+			*out = append(*out, info)
+		}
+	default:
+		return fmt.Errorf("parquet: unsupported output type %T", out)
+	}
+	return nil
+}
+
+// optionalTime maps the zero time to nil so that it is stored as null.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
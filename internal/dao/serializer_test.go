@@ -0,0 +1,66 @@
+package dao
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParquetSerializer_BorderInfosRoundTrip(t *testing.T) {
+	aggregatedAt := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	infos := []models.BorderInfo{
+		{EventId: 1, IdolId: 0, Border: 100, RankingType: models.EventPoint, AggregatedAt: aggregatedAt, Score: 123456},
+		{EventId: 1, IdolId: 7, Border: 1000, RankingType: models.IdolPoint, AggregatedAt: aggregatedAt.Add(30 * time.Minute), Score: 42},
+	}
+
+	data, err := ParquetSerializer{}.Marshal(infos)
+	assert.NoError(t, err)
+
+	var got []models.BorderInfo
+	assert.NoError(t, ParquetSerializer{}.Unmarshal(data, &got))
+	assert.Len(t, got, 2)
+	for i := range infos {
+		assert.True(t, infos[i].AggregatedAt.Equal(got[i].AggregatedAt))
+		got[i].AggregatedAt = infos[i].AggregatedAt
+	}
+	assert.Equal(t, infos, got)
+}
+
+func TestParquetSerializer_EventInfosRoundTrip(t *testing.T) {
+	startAt := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	infos := []models.EventInfo{
+		{EventId: 1, EventName: "Boosted", EventType: models.Theater, InternalEventType: models.ToInternalEventType(models.Event{Type: int(models.Theater)}),
+			StartAt: startAt, EndAt: startAt.Add(7 * 24 * time.Hour), BoostAt: startAt.Add(4 * 24 * time.Hour)},
+		{EventId: 2, EventName: "Unboosted", EventType: models.Anniversary, StartAt: startAt, EndAt: startAt.Add(14 * 24 * time.Hour)},
+	}
+
+	data, err := ParquetSerializer{}.Marshal(infos)
+	assert.NoError(t, err)
+
+	var got []models.EventInfo
+	assert.NoError(t, ParquetSerializer{}.Unmarshal(data, &got))
+	assert.Len(t, got, 2)
+	assert.Equal(t, "Boosted", got[0].EventName)
+	assert.Equal(t, infos[0].InternalEventType, got[0].InternalEventType)
+	assert.True(t, infos[0].BoostAt.Equal(got[0].BoostAt))
+	assert.True(t, got[1].BoostAt.IsZero())
+	assert.True(t, infos[1].EndAt.Equal(got[1].EndAt))
+}
+
+func TestParquetSerializer_UnsupportedType(t *testing.T) {
+	_, err := ParquetSerializer{}.Marshal([]string{"a"})
+	assert.Error(t, err)
+	assert.Error(t, ParquetSerializer{}.Unmarshal(nil, &[]string{}))
+}
+
+func TestNewSerializer(t *testing.T) {
+	serializer, err := NewSerializer(FORMAT_PARQUET)
+	assert.NoError(t, err)
+	assert.Equal(t, ".parquet", serializer.Extension())
+	assert.Equal(t, "border_info_1_0_100.parquet", withExtension("border_info_1_0_100.csv", serializer))
+
+	_, err = NewSerializer("xml")
+	assert.Error(t, err)
+}
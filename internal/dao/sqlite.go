@@ -0,0 +1,600 @@
+package dao
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/internal/logging"
+	"github.com/alceccentric/matsurihi-cron/internal/metrics"
+	"github.com/alceccentric/matsurihi-cron/internal/utils"
+	"github.com/alceccentric/matsurihi-cron/models"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// Times are stored as UTC text in a fixed width format so that they sort chronologically
+	// and can be used with the SQLite date and time functions.
+	SQLITE_TIME_FORMAT = "2006-01-02 15:04:05.000"
+
+	LATEST_EVENT_INFO_METADATA_KEY = "latest_event_info"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS event_info (
+	event_id            INTEGER PRIMARY KEY,
+	name                TEXT    NOT NULL,
+	event_type          INTEGER NOT NULL,
+	internal_event_type INTEGER NOT NULL,
+	start_at            TEXT    NOT NULL,
+	end_at              TEXT    NOT NULL,
+	boost_at            TEXT
+);
+
+CREATE TABLE IF NOT EXISTS border_info (
+	event_id      INTEGER NOT NULL,
+	ranking_type  TEXT    NOT NULL,
+	idol_id       INTEGER NOT NULL,
+	border        INTEGER NOT NULL,
+	aggregated_at TEXT    NOT NULL,
+	score         INTEGER NOT NULL,
+	PRIMARY KEY (event_id, ranking_type, idol_id, border, aggregated_at)
+) WITHOUT ROWID;
+
+CREATE TABLE IF NOT EXISTS etag (
+	url  TEXT PRIMARY KEY,
+	etag TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS metadata (
+	key   TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS run_manifest (
+	run_id             TEXT    PRIMARY KEY,
+	started_at         TEXT    NOT NULL,
+	ended_at           TEXT    NOT NULL,
+	border_group_count INTEGER NOT NULL,
+	manifest           TEXT    NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS border_prediction (
+	event_id          INTEGER NOT NULL,
+	ranking_type      TEXT    NOT NULL,
+	idol_id           INTEGER NOT NULL,
+	border            INTEGER NOT NULL,
+	aggregated_at     TEXT    NOT NULL,
+	progress          REAL    NOT NULL,
+	current_score     INTEGER NOT NULL,
+	final_score       INTEGER NOT NULL,
+	lower_bound       INTEGER NOT NULL,
+	upper_bound       INTEGER NOT NULL,
+	confidence_level  REAL    NOT NULL,
+	similar_event_ids TEXT    NOT NULL,
+	PRIMARY KEY (event_id, ranking_type, idol_id, border)
+) WITHOUT ROWID;
+
+CREATE TABLE IF NOT EXISTS lock (
+	name        TEXT PRIMARY KEY,
+	owner       TEXT NOT NULL,
+	acquired_at TEXT NOT NULL,
+	expires_at  TEXT NOT NULL
+);
+`
+
+// SQLiteDAO stores event and border infos in a local SQLite database.
+// Rows are upserted, so saving the same infos again leaves the database unchanged.
+// As border groups are not stored as objects, their manifests have no object key and
+// their checksum is the one of the group encoded as CSV.
+type SQLiteDAO struct {
+	db *sql.DB
+}
+
+// sqliteQuerier is implemented by both *sql.DB and *sql.Tx.
+type sqliteQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func NewSQLiteDAO(ctx context.Context, path string) (*SQLiteDAO, error) {
+	if err := utils.CreateDirectoryIfNotExists(filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("failed to create directory of %s: %w", path, err)
+	}
+
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SQLite database %s: %w", path, err)
+	}
+	// SQLite only supports a single writer
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.ExecContext(ctx, sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create SQLite schema in %s: %w", path, err)
+	}
+	return &SQLiteDAO{db: db}, nil
+}
+
+// Close closes the underlying database.
+func (u *SQLiteDAO) Close() error {
+	return u.db.Close()
+}
+
+func (u *SQLiteDAO) SaveEventInfos(ctx context.Context, eventInfos []models.EventInfo) error {
+	logging.FromContext(ctx).Infof("Upserting %d event infos", len(eventInfos))
+	return u.inTx(ctx, func(tx *sql.Tx) error {
+		stmt, err := tx.PrepareContext(ctx, `
+			INSERT INTO event_info (event_id, name, event_type, internal_event_type, start_at, end_at, boost_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (event_id) DO UPDATE SET
+				name = excluded.name,
+				event_type = excluded.event_type,
+				internal_event_type = excluded.internal_event_type,
+				start_at = excluded.start_at,
+				end_at = excluded.end_at,
+				boost_at = excluded.boost_at`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, info := range eventInfos {
+			if _, err := stmt.ExecContext(ctx, info.EventId, info.EventName, int(info.EventType), int(info.InternalEventType),
+				formatSQLiteTime(info.StartAt), formatSQLiteTime(info.EndAt), nullableSQLiteTime(info.BoostAt)); err != nil {
+				return fmt.Errorf("failed to upsert event info %d: %w", info.EventId, err)
+			}
+		}
+		return nil
+	})
+}
+
+func (u *SQLiteDAO) SaveBorderInfos(ctx context.Context, borderInfos []models.BorderInfo) ([]BorderGroupManifest, error) {
+	if len(borderInfos) == 0 {
+		return nil, nil
+	}
+	logging.FromContext(ctx).Infof("Upserting %d border infos", len(borderInfos))
+	var manifests []BorderGroupManifest
+	err := u.inTx(ctx, func(tx *sql.Tx) error {
+		stmt, err := tx.PrepareContext(ctx, `
+			INSERT INTO border_info (event_id, ranking_type, idol_id, border, aggregated_at, score)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (event_id, ranking_type, idol_id, border, aggregated_at) DO UPDATE SET
+				score = excluded.score`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, info := range borderInfos {
+			if _, err := stmt.ExecContext(ctx, info.EventId, string(info.RankingType), info.IdolId, info.Border,
+				formatSQLiteTime(info.AggregatedAt), info.Score); err != nil {
+				return fmt.Errorf("failed to upsert border info of event %d: %w", info.EventId, err)
+			}
+		}
+
+		manifests, err = borderGroupManifests(ctx, tx, borderInfos)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return manifests, nil
+}
+
+// borderGroupManifests describes the border groups touched by borderInfos as stored by q.
+func borderGroupManifests(ctx context.Context, q sqliteQuerier, borderInfos []models.BorderInfo) ([]BorderGroupManifest, error) {
+	manifests := make([]BorderGroupManifest, 0)
+	for key := range groupByEventIdAndBorder(borderInfos) {
+		rows, err := queryBorderInfos(ctx, q, key)
+		if err != nil {
+			return nil, err
+		}
+		data, err := CSVSerializer{}.Marshal(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode border infos: %w", err)
+		}
+		manifests = append(manifests, newBorderGroupManifest(key, "", rows, data))
+	}
+	sortBorderGroupManifests(manifests)
+	return manifests, nil
+}
+
+func (u *SQLiteDAO) GetLatestEventInfo(ctx context.Context) (models.EventInfo, error) {
+	var latestInfo models.EventInfo
+	if _, err := u.getMetadata(ctx, LATEST_EVENT_INFO_METADATA_KEY, &latestInfo); err != nil {
+		return models.EventInfo{}, err
+	}
+	return latestInfo, nil
+}
+
+func (u *SQLiteDAO) SaveLatestEventInfo(ctx context.Context, info models.EventInfo) error {
+	logging.FromContext(ctx).WithField(logging.FIELD_EVENT_ID, info.EventId).Infof("Saving latest event info %v", info)
+	value, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to marshal latest event info: %w", err)
+	}
+	_, err = u.db.ExecContext(ctx, `
+		INSERT INTO metadata (key, value) VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value`,
+		LATEST_EVENT_INFO_METADATA_KEY, string(value))
+	return err
+}
+
+// GetBorderHighWaterMarks derives the high-water marks from the stored border infos.
+func (u *SQLiteDAO) GetBorderHighWaterMarks(ctx context.Context) (map[BorderGroupKey]time.Time, error) {
+	rows, err := u.db.QueryContext(ctx, `
+		SELECT event_id, ranking_type, idol_id, border, MAX(aggregated_at)
+		FROM border_info
+		GROUP BY event_id, ranking_type, idol_id, border`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query border high-water marks: %w", err)
+	}
+	defer rows.Close()
+
+	marks := make(map[BorderGroupKey]time.Time)
+	for rows.Next() {
+		var key BorderGroupKey
+		var aggregatedAt string
+		if err := rows.Scan(&key.EventId, &key.RankingType, &key.IdolId, &key.Border, &aggregatedAt); err != nil {
+			return nil, err
+		}
+		if marks[key], err = parseSQLiteTime(aggregatedAt); err != nil {
+			return nil, err
+		}
+	}
+	return marks, rows.Err()
+}
+
+func (u *SQLiteDAO) GetETags(ctx context.Context) (map[string]string, error) {
+	rows, err := u.db.QueryContext(ctx, `SELECT url, etag FROM etag`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query etags: %w", err)
+	}
+	defer rows.Close()
+
+	etags := make(map[string]string)
+	for rows.Next() {
+		var url, etag string
+		if err := rows.Scan(&url, &etag); err != nil {
+			return nil, err
+		}
+		etags[url] = etag
+	}
+	return etags, rows.Err()
+}
+
+func (u *SQLiteDAO) SaveETags(ctx context.Context, etags map[string]string) error {
+	logging.FromContext(ctx).Infof("Saving %d ETags", len(etags))
+	return u.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM etag`); err != nil {
+			return err
+		}
+		for url, etag := range etags {
+			if _, err := tx.ExecContext(ctx, `INSERT INTO etag (url, etag) VALUES (?, ?)`, url, etag); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (u *SQLiteDAO) ListEventInfos(ctx context.Context) ([]models.EventInfo, error) {
+	rows, err := u.db.QueryContext(ctx, `
+		SELECT event_id, name, event_type, internal_event_type, start_at, end_at, boost_at
+		FROM event_info
+		ORDER BY event_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query event infos: %w", err)
+	}
+	defer rows.Close()
+
+	eventInfos := make([]models.EventInfo, 0)
+	for rows.Next() {
+		var info models.EventInfo
+		var startAt, endAt string
+		var boostAt sql.NullString
+		if err := rows.Scan(&info.EventId, &info.EventName, &info.EventType, &info.InternalEventType, &startAt, &endAt, &boostAt); err != nil {
+			return nil, err
+		}
+		if info.StartAt, err = parseSQLiteTime(startAt); err != nil {
+			return nil, err
+		}
+		if info.EndAt, err = parseSQLiteTime(endAt); err != nil {
+			return nil, err
+		}
+		if boostAt.Valid {
+			if info.BoostAt, err = parseSQLiteTime(boostAt.String); err != nil {
+				return nil, err
+			}
+		}
+		eventInfos = append(eventInfos, info)
+	}
+	return eventInfos, rows.Err()
+}
+
+func (u *SQLiteDAO) GetBorderInfos(ctx context.Context, key BorderGroupKey) ([]models.BorderInfo, error) {
+	return queryBorderInfos(ctx, u.db, key)
+}
+
+func queryBorderInfos(ctx context.Context, q sqliteQuerier, key BorderGroupKey) ([]models.BorderInfo, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT aggregated_at, score
+		FROM border_info
+		WHERE event_id = ? AND ranking_type = ? AND idol_id = ? AND border = ?
+		ORDER BY aggregated_at`,
+		key.EventId, string(key.RankingType), key.IdolId, key.Border)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query border infos: %w", err)
+	}
+	defer rows.Close()
+
+	borderInfos := make([]models.BorderInfo, 0)
+	for rows.Next() {
+		info := models.BorderInfo{EventId: key.EventId, RankingType: key.RankingType, IdolId: key.IdolId, Border: key.Border}
+		var aggregatedAt string
+		if err := rows.Scan(&aggregatedAt, &info.Score); err != nil {
+			return nil, err
+		}
+		if info.AggregatedAt, err = parseSQLiteTime(aggregatedAt); err != nil {
+			return nil, err
+		}
+		borderInfos = append(borderInfos, info)
+	}
+	return borderInfos, rows.Err()
+}
+
+func (u *SQLiteDAO) ListBorderGroups(ctx context.Context, eventId int) ([]BorderGroupKey, error) {
+	rows, err := u.db.QueryContext(ctx, `
+		SELECT DISTINCT ranking_type, idol_id, border
+		FROM border_info
+		WHERE event_id = ?`, eventId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query border groups: %w", err)
+	}
+	defer rows.Close()
+
+	keys := make([]BorderGroupKey, 0)
+	for rows.Next() {
+		key := BorderGroupKey{EventId: eventId}
+		if err := rows.Scan(&key.RankingType, &key.IdolId, &key.Border); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sortBorderGroupKeys(keys)
+	return keys, nil
+}
+
+func (u *SQLiteDAO) SaveRunManifest(ctx context.Context, manifest RunManifest) error {
+	logging.FromContext(ctx).Infof("Saving manifest of run %s with %d border groups", manifest.RunId, len(manifest.BorderGroups))
+	value, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to marshal run manifest: %w", err)
+	}
+	_, err = u.db.ExecContext(ctx, `
+		INSERT INTO run_manifest (run_id, started_at, ended_at, border_group_count, manifest) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (run_id) DO UPDATE SET
+			started_at = excluded.started_at,
+			ended_at = excluded.ended_at,
+			border_group_count = excluded.border_group_count,
+			manifest = excluded.manifest`,
+		manifest.RunId, formatSQLiteTime(manifest.StartedAt), formatSQLiteTime(manifest.EndedAt), len(manifest.BorderGroups), string(value))
+	return err
+}
+
+// GetRunManifestIndex returns the latest runs from the stored manifests, which are all kept.
+func (u *SQLiteDAO) GetRunManifestIndex(ctx context.Context) ([]RunManifestIndexEntry, error) {
+	rows, err := u.db.QueryContext(ctx, `
+		SELECT run_id, started_at, ended_at, border_group_count
+		FROM (SELECT * FROM run_manifest ORDER BY started_at DESC, run_id DESC LIMIT ?)
+		ORDER BY started_at, run_id`, RUN_MANIFEST_INDEX_SIZE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query run manifests: %w", err)
+	}
+	defer rows.Close()
+
+	index := make([]RunManifestIndexEntry, 0)
+	for rows.Next() {
+		var entry RunManifestIndexEntry
+		var startedAt, endedAt string
+		if err := rows.Scan(&entry.RunId, &startedAt, &endedAt, &entry.BorderGroupCount); err != nil {
+			return nil, err
+		}
+		if entry.StartedAt, err = parseSQLiteTime(startedAt); err != nil {
+			return nil, err
+		}
+		if entry.EndedAt, err = parseSQLiteTime(endedAt); err != nil {
+			return nil, err
+		}
+		index = append(index, entry)
+	}
+	return index, rows.Err()
+}
+
+func (u *SQLiteDAO) GetRunManifest(ctx context.Context, runId string) (RunManifest, error) {
+	var value string
+	err := u.db.QueryRowContext(ctx, `SELECT manifest FROM run_manifest WHERE run_id = ?`, runId).Scan(&value)
+	if err == sql.ErrNoRows {
+		return RunManifest{}, ErrRunManifestNotFound
+	}
+	if err != nil {
+		return RunManifest{}, fmt.Errorf("failed to query run manifest %s: %w", runId, err)
+	}
+	var manifest RunManifest
+	if err := json.Unmarshal([]byte(value), &manifest); err != nil {
+		return RunManifest{}, fmt.Errorf("failed to unmarshal run manifest %s: %w", runId, err)
+	}
+	return manifest, nil
+}
+
+func (u *SQLiteDAO) SaveBorderPredictions(ctx context.Context, eventId int, predictions []models.BorderPrediction) error {
+	logging.FromContext(ctx).WithField(logging.FIELD_EVENT_ID, eventId).Infof("Saving %d border predictions", len(predictions))
+	return u.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM border_prediction WHERE event_id = ?`, eventId); err != nil {
+			return err
+		}
+		for _, prediction := range predictions {
+			similarEventIds, err := json.Marshal(prediction.SimilarEventIds)
+			if err != nil {
+				return fmt.Errorf("failed to marshal similar event IDs: %w", err)
+			}
+			if _, err := tx.ExecContext(ctx, `
+				INSERT INTO border_prediction (event_id, ranking_type, idol_id, border, aggregated_at, progress,
+					current_score, final_score, lower_bound, upper_bound, confidence_level, similar_event_ids)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				eventId, string(prediction.RankingType), prediction.IdolId, prediction.Border,
+				formatSQLiteTime(prediction.AggregatedAt), prediction.Progress, prediction.CurrentScore, prediction.FinalScore,
+				prediction.LowerBound, prediction.UpperBound, prediction.ConfidenceLevel, string(similarEventIds)); err != nil {
+				return fmt.Errorf("failed to insert border prediction of event %d: %w", eventId, err)
+			}
+		}
+		return nil
+	})
+}
+
+func (u *SQLiteDAO) GetBorderPredictions(ctx context.Context, eventId int) ([]models.BorderPrediction, error) {
+	rows, err := u.db.QueryContext(ctx, `
+		SELECT ranking_type, idol_id, border, aggregated_at, progress, current_score, final_score,
+			lower_bound, upper_bound, confidence_level, similar_event_ids
+		FROM border_prediction
+		WHERE event_id = ?
+		ORDER BY ranking_type, idol_id, border`, eventId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query border predictions: %w", err)
+	}
+	defer rows.Close()
+
+	predictions := make([]models.BorderPrediction, 0)
+	for rows.Next() {
+		prediction := models.BorderPrediction{EventId: eventId}
+		var aggregatedAt, similarEventIds string
+		if err := rows.Scan(&prediction.RankingType, &prediction.IdolId, &prediction.Border, &aggregatedAt, &prediction.Progress,
+			&prediction.CurrentScore, &prediction.FinalScore, &prediction.LowerBound, &prediction.UpperBound,
+			&prediction.ConfidenceLevel, &similarEventIds); err != nil {
+			return nil, err
+		}
+		if prediction.AggregatedAt, err = parseSQLiteTime(aggregatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(similarEventIds), &prediction.SimilarEventIds); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal similar event IDs: %w", err)
+		}
+		predictions = append(predictions, prediction)
+	}
+	return predictions, rows.Err()
+}
+
+// AcquireLock upserts the lease in the lock table. The lease only replaces the stored one when it
+// belongs to owner or has expired, which the database checks atomically.
+func (u *SQLiteDAO) AcquireLock(ctx context.Context, name, owner string, ttl time.Duration) (Lease, error) {
+	now := time.Now()
+	lease, err := nextLease(nil, name, owner, ttl, now)
+	if err != nil {
+		return Lease{}, err
+	}
+
+	err = u.inTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, `
+			INSERT INTO lock (name, owner, acquired_at, expires_at)
+			VALUES (?, ?, ?, ?)
+			ON CONFLICT (name) DO UPDATE SET
+				owner = excluded.owner,
+				acquired_at = CASE WHEN lock.owner = excluded.owner AND lock.expires_at > ? THEN lock.acquired_at ELSE excluded.acquired_at END,
+				expires_at = excluded.expires_at
+			WHERE lock.owner = excluded.owner OR lock.expires_at <= ?`,
+			name, owner, formatSQLiteTime(lease.AcquiredAt), formatSQLiteTime(lease.ExpiresAt),
+			formatSQLiteTime(now), formatSQLiteTime(now))
+		if err != nil {
+			return fmt.Errorf("failed to upsert lock %s: %w", name, err)
+		}
+		if affected, err := result.RowsAffected(); err != nil {
+			return err
+		} else if affected == 0 {
+			var holder, expiresAt string
+			if err := tx.QueryRowContext(ctx, `SELECT owner, expires_at FROM lock WHERE name = ?`, name).Scan(&holder, &expiresAt); err != nil {
+				return fmt.Errorf("failed to query lock %s: %w", name, err)
+			}
+			return fmt.Errorf("%w: %s is held by %s until %s", ErrLockHeld, name, holder, expiresAt)
+		}
+
+		var acquiredAt string
+		if err := tx.QueryRowContext(ctx, `SELECT acquired_at FROM lock WHERE name = ?`, name).Scan(&acquiredAt); err != nil {
+			return fmt.Errorf("failed to query lock %s: %w", name, err)
+		}
+		lease.AcquiredAt, err = parseSQLiteTime(acquiredAt)
+		return err
+	})
+	if err != nil {
+		return Lease{}, err
+	}
+	logging.FromContext(ctx).Debugf("Leased lock %s until %v", name, lease.ExpiresAt)
+	return lease, nil
+}
+
+func (u *SQLiteDAO) ReleaseLock(ctx context.Context, name, owner string) error {
+	return u.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM lock WHERE name = ? AND owner = ?`, name, owner); err != nil {
+			return fmt.Errorf("failed to delete lock %s: %w", name, err)
+		}
+		return nil
+	})
+}
+
+// inTx runs fn in a transaction, committing it when fn succeeds and rolling it back otherwise.
+func (u *SQLiteDAO) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	startedAt := time.Now()
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	metrics.ObserveDAOWrite("sqlite", time.Since(startedAt), 0)
+	return nil
+}
+
+// getMetadata decodes the JSON value stored under key into v. It reports false when the key is missing.
+func (u *SQLiteDAO) getMetadata(ctx context.Context, key string, v interface{}) (bool, error) {
+	var value string
+	err := u.db.QueryRowContext(ctx, `SELECT value FROM metadata WHERE key = ?`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to query metadata %s: %w", key, err)
+	}
+	if err := json.Unmarshal([]byte(value), v); err != nil {
+		return true, fmt.Errorf("failed to unmarshal metadata %s: %w", key, err)
+	}
+	return true, nil
+}
+
+func formatSQLiteTime(t time.Time) string {
+	return t.UTC().Format(SQLITE_TIME_FORMAT)
+}
+
+func nullableSQLiteTime(t time.Time) sql.NullString {
+	if t.IsZero() {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: formatSQLiteTime(t), Valid: true}
+}
+
+func parseSQLiteTime(value string) (time.Time, error) {
+	t, err := time.ParseInLocation(SQLITE_TIME_FORMAT, value, time.UTC)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse time %q: %w", value, err)
+	}
+	return t, nil
+}
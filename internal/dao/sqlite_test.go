@@ -0,0 +1,171 @@
+package dao
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSQLiteDAO(t *testing.T) *SQLiteDAO {
+	dao, err := NewSQLiteDAO(context.Background(), filepath.Join(t.TempDir(), "db", "matsuri.db"))
+	assert.NoError(t, err)
+	t.Cleanup(func() { dao.Close() })
+	return dao
+}
+
+func TestSQLiteDAO_SaveBorderInfosIsIdempotent(t *testing.T) {
+	dao := newTestSQLiteDAO(t)
+	ctx := context.Background()
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("JST", 9*60*60))
+
+	first := []models.BorderInfo{
+		{EventId: 1, RankingType: models.EventPoint, Border: 100, AggregatedAt: base, Score: 10},
+		{EventId: 1, RankingType: models.EventPoint, Border: 100, AggregatedAt: base.Add(30 * time.Minute), Score: 20},
+	}
+	saveBorderInfos(t, dao, first)
+	// Re-running with an overlapping window updates the shared row and adds the new one
+	saveBorderInfos(t, dao, []models.BorderInfo{
+		{EventId: 1, RankingType: models.EventPoint, Border: 100, AggregatedAt: base.Add(30 * time.Minute), Score: 25},
+		{EventId: 1, RankingType: models.EventPoint, Border: 100, AggregatedAt: base.Add(time.Hour), Score: 30},
+	})
+	saveBorderInfos(t, dao, first[:1])
+
+	key := BorderGroupKey{EventId: 1, RankingType: models.EventPoint, Border: 100}
+	infos, err := dao.GetBorderInfos(ctx, key)
+	assert.NoError(t, err)
+	assert.Len(t, infos, 3)
+	assert.Equal(t, []int{10, 25, 30}, []int{infos[0].Score, infos[1].Score, infos[2].Score})
+	assert.True(t, base.Equal(infos[0].AggregatedAt))
+
+	marks, err := dao.GetBorderHighWaterMarks(ctx)
+	assert.NoError(t, err)
+	assert.True(t, base.Add(time.Hour).Equal(marks[key]))
+}
+
+func TestSQLiteDAO_EventInfosAndMetadata(t *testing.T) {
+	dao := newTestSQLiteDAO(t)
+	ctx := context.Background()
+	startAt := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+
+	latest, err := dao.GetLatestEventInfo(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, models.EventInfo{}, latest)
+
+	assert.NoError(t, dao.SaveEventInfos(ctx, []models.EventInfo{
+		{EventId: 2, EventName: "Old name", EventType: models.Theater, StartAt: startAt, EndAt: startAt.Add(time.Hour)},
+		{EventId: 1, EventName: "First", EventType: models.Tour, StartAt: startAt, EndAt: startAt.Add(time.Hour), BoostAt: startAt.Add(time.Minute)},
+	}))
+	assert.NoError(t, dao.SaveEventInfos(ctx, []models.EventInfo{
+		{EventId: 2, EventName: "New name", EventType: models.Theater, StartAt: startAt, EndAt: startAt.Add(time.Hour)},
+	}))
+
+	eventInfos, err := dao.ListEventInfos(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, eventInfos, 2)
+	assert.Equal(t, 1, eventInfos[0].EventId)
+	assert.Equal(t, models.Tour, eventInfos[0].EventType)
+	assert.True(t, startAt.Add(time.Minute).Equal(eventInfos[0].BoostAt))
+	assert.Equal(t, "New name", eventInfos[1].EventName)
+	assert.True(t, eventInfos[1].BoostAt.IsZero())
+
+	assert.NoError(t, dao.SaveLatestEventInfo(ctx, models.EventInfo{EventId: 2}))
+	latest, err = dao.GetLatestEventInfo(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, latest.EventId)
+
+	assert.NoError(t, dao.SaveETags(ctx, map[string]string{"a": `"1"`, "b": `"2"`}))
+	assert.NoError(t, dao.SaveETags(ctx, map[string]string{"a": `"3"`}))
+	etags, err := dao.GetETags(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": `"3"`}, etags)
+}
+
+func TestSQLiteDAO_ListBorderGroups(t *testing.T) {
+	dao := newTestSQLiteDAO(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	saveBorderInfos(t, dao, []models.BorderInfo{
+		{EventId: 1, RankingType: models.LoungePoint, Border: 10, AggregatedAt: now},
+		{EventId: 1, RankingType: models.EventPoint, Border: 2500, AggregatedAt: now},
+		{EventId: 1, RankingType: models.EventPoint, Border: 100, AggregatedAt: now},
+		{EventId: 1, RankingType: models.EventPoint, Border: 100, AggregatedAt: now.Add(time.Minute)},
+		{EventId: 2, RankingType: models.EventPoint, Border: 100, AggregatedAt: now},
+	})
+
+	keys, err := dao.ListBorderGroups(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []BorderGroupKey{
+		{EventId: 1, RankingType: models.EventPoint, Border: 100},
+		{EventId: 1, RankingType: models.EventPoint, Border: 2500},
+		{EventId: 1, RankingType: models.LoungePoint, Border: 10},
+	}, keys)
+}
+
+func TestSQLiteDAO_RunManifests(t *testing.T) {
+	dao := newTestSQLiteDAO(t)
+	ctx := context.Background()
+	t1 := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	saveBorderInfos(t, dao, []models.BorderInfo{{EventId: 1, RankingType: models.EventPoint, Border: 100, AggregatedAt: t1, Score: 10}})
+	manifests := saveBorderInfos(t, dao, []models.BorderInfo{
+		{EventId: 1, RankingType: models.EventPoint, Border: 100, AggregatedAt: t1.Add(time.Hour), Score: 20},
+	})
+	assert.Len(t, manifests, 1)
+	assert.Empty(t, manifests[0].ObjectKey)
+	assert.Equal(t, 2, manifests[0].RowCount)
+	assert.True(t, t1.Equal(manifests[0].MinAggregatedAt))
+	assert.True(t, t1.Add(time.Hour).Equal(manifests[0].MaxAggregatedAt))
+	assert.Len(t, manifests[0].SHA256, 64)
+
+	for i := 0; i < RUN_MANIFEST_INDEX_SIZE+1; i++ {
+		startedAt := t1.Add(time.Duration(i) * time.Minute)
+		assert.NoError(t, dao.SaveRunManifest(ctx, RunManifest{
+			RunId: fmt.Sprintf("run-%03d", i), StartedAt: startedAt, EndedAt: startedAt.Add(time.Second), BorderGroups: manifests,
+		}))
+	}
+	index, err := dao.GetRunManifestIndex(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, index, RUN_MANIFEST_INDEX_SIZE)
+	assert.Equal(t, "run-001", index[0].RunId)
+	assert.Equal(t, 1, index[0].BorderGroupCount)
+
+	// Manifests dropped from the index are kept
+	got, err := dao.GetRunManifest(ctx, "run-000")
+	assert.NoError(t, err)
+	assert.Equal(t, manifests, got.BorderGroups)
+	_, err = dao.GetRunManifest(ctx, "missing")
+	assert.ErrorIs(t, err, ErrRunManifestNotFound)
+}
+
+func TestSQLiteDAO_BorderPredictions(t *testing.T) {
+	dao := newTestSQLiteDAO(t)
+	ctx := context.Background()
+	at := time.Date(2024, 5, 3, 12, 0, 0, 0, time.UTC)
+
+	predictions, err := dao.GetBorderPredictions(ctx, 1)
+	assert.NoError(t, err)
+	assert.Empty(t, predictions)
+
+	first := []models.BorderPrediction{
+		{EventId: 1, RankingType: models.EventPoint, Border: 100, AggregatedAt: at, Progress: 0.5, CurrentScore: 1000,
+			FinalScore: 2500, LowerBound: 2000, UpperBound: 3000, ConfidenceLevel: 0.9, SimilarEventIds: []int{3, 2}},
+		{EventId: 1, RankingType: models.EventPoint, Border: 2500, AggregatedAt: at, Progress: 0.5, CurrentScore: 100,
+			FinalScore: 250, LowerBound: 200, UpperBound: 300, ConfidenceLevel: 0.9, SimilarEventIds: []int{3, 2}},
+	}
+	assert.NoError(t, dao.SaveBorderPredictions(ctx, 1, first))
+	// Saving again replaces every prediction of the event
+	assert.NoError(t, dao.SaveBorderPredictions(ctx, 1, first[:1]))
+
+	predictions, err = dao.GetBorderPredictions(ctx, 1)
+	assert.NoError(t, err)
+	assert.Len(t, predictions, 1)
+	assert.True(t, predictions[0].AggregatedAt.Equal(at))
+	predictions[0].AggregatedAt = at
+	assert.Equal(t, first[:1], predictions)
+}
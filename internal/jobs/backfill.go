@@ -0,0 +1,255 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/internal/config"
+	"github.com/alceccentric/matsurihi-cron/internal/dao"
+	"github.com/alceccentric/matsurihi-cron/internal/logging"
+	"github.com/alceccentric/matsurihi-cron/internal/matsuri"
+	"github.com/alceccentric/matsurihi-cron/internal/metrics"
+	"github.com/alceccentric/matsurihi-cron/models"
+)
+
+// MAX_EVENT_ID_RANGE is the most event IDs a single range given to ParseEventIds may span,
+// which keeps a typo such as 1-3000000 from expanding into millions of events.
+const MAX_EVENT_ID_RANGE = 1000
+
+// BackfillOptions selects what RunBackfill re-syncs.
+type BackfillOptions struct {
+	// EventIds are the events to re-sync
+	EventIds []int
+	// RankingTypes restricts the ranking types collected; all supported ones are collected when empty
+	RankingTypes []models.EventRankingType
+	// Borders replaces the configured borders collected for the ranking types of RankingTypes,
+	// which must then be set, when not empty
+	Borders []int
+}
+
+// RunBackfill re-fetches the full border history of the given events and merges it into
+// the stored data. Unlike RunSync, it ignores the high-water marks and ETags, including the
+// ones a long-lived client kept from earlier syncs, and
+// never moves the latest event pointer, nor is it bounded by the sync timeout. Like RunSync,
+// it saves a manifest of the run.
+func RunBackfill(ctx context.Context, client matsuri.MatsuriClient, borderDAO dao.DAO, cfg config.SyncConfig, options BackfillOptions) (err error) {
+	if len(options.EventIds) == 0 {
+		return errors.New("no event ids to backfill")
+	}
+	for _, rankingType := range options.RankingTypes {
+		if !rankingType.IsValid() {
+			return fmt.Errorf("unknown ranking type %q", rankingType)
+		}
+	}
+	if len(options.Borders) > 0 && len(options.RankingTypes) == 0 {
+		return errors.New("borders can only be overridden for the ranking types to backfill")
+	}
+	startedAt := time.Now()
+	runId := newRunId(startedAt)
+	ctx = logging.WithRunId(ctx, runId)
+	logger := logging.FromContext(ctx)
+	failedGroups := 0
+	var failedEventIds []int
+	defer func() {
+		// Events that could not be fetched make the run partial, like failed border groups
+		observeRun(metrics.JOB_BACKFILL, startedAt, failedGroups+len(failedEventIds), err)
+	}()
+
+	// An event failing to be fetched is skipped, so that a backfill of many events still fills in the others
+	var events []models.Event
+	for _, eventId := range options.EventIds {
+		event, err := client.GetEvent(ctx, eventId)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			logger.WithField(logging.FIELD_EVENT_ID, eventId).WithError(err).Warn("Failed to get event")
+			failedEventIds = append(failedEventIds, eventId)
+			continue
+		}
+		events = append(events, event)
+	}
+	if len(events) == 0 {
+		return fmt.Errorf("get events: all %d events failed", len(failedEventIds))
+	}
+
+	eventInfos, rankingTypesByEventId, err := collectEventInfos(ctx, client, events, cfg)
+	if err != nil {
+		return errors.New("collect event infos: " + err.Error())
+	}
+	rankingTypesByEventId = filterRankingTypes(rankingTypesByEventId, options.RankingTypes)
+	if len(eventInfos) == 0 {
+		logger.Warn("None of the events to backfill are supported")
+		return nil
+	}
+
+	storedEventInfos, err := borderDAO.ListEventInfos(ctx)
+	if err != nil {
+		return errors.New("list event infos: " + err.Error())
+	}
+	if err := borderDAO.SaveEventInfos(ctx, upsertEventInfos(storedEventInfos, eventInfos)); err != nil {
+		return errors.New("save event infos: " + err.Error())
+	}
+
+	eventIds := make(map[int]struct{})
+	eventInfosById := make(map[int]models.EventInfo)
+	for _, info := range eventInfos {
+		eventIds[info.EventId] = struct{}{}
+		eventInfosById[info.EventId] = info
+	}
+
+	// Events are still selected with the configured borders, the overridden ones only decide what is collected.
+	backfillCfg := backfillSyncConfig(cfg, options)
+	forgetBackfilledETags(client, rankingTypesByEventId, backfillCfg)
+	var borderInfos []models.BorderInfo
+	borderInfos, failedGroups, err = collectBorderInfos(ctx, client, eventIds, rankingTypesByEventId, map[dao.BorderGroupKey]time.Time{}, backfillCfg)
+	if err != nil {
+		return errors.New("collect border infos: " + err.Error())
+	}
+	manifest := newRunManifest(runId, startedAt, eventInfosById)
+	manifest.FailedEventIds = failedEventIds
+	manifest.FailedBorderGroups = failedGroups
+	borderInfos, _, manifest.Validation = validateBorderInfos(ctx, borderInfos, eventInfosById, cfg.Validation)
+	if manifest.BorderGroups, err = borderDAO.SaveBorderInfos(ctx, borderInfos); err != nil {
+		return errors.New("save border infos: " + err.Error())
+	}
+	if err := saveRunManifest(ctx, borderDAO, manifest); err != nil {
+		return err
+	}
+	if len(failedEventIds) > 0 {
+		logger.Warnf("Failed to fetch events %v, run the backfill again to fill them in", failedEventIds)
+	}
+	if failedGroups > 0 {
+		logger.Warnf("Failed to fetch %d border groups, run the backfill again to fill them in", failedGroups)
+	}
+	logger.Infof("Backfilled %d border infos for %d events.", len(borderInfos), len(eventInfos))
+	return nil
+}
+
+// ParseEventIds parses a comma separated list of event IDs and inclusive ranges, e.g. "10,12,20-25".
+// Ranges must not end before they start nor span more than MAX_EVENT_ID_RANGE IDs.
+// The result is sorted and deduplicated.
+func ParseEventIds(spec string) ([]int, error) {
+	seen := make(map[int]struct{})
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil {
+			return nil, fmt.Errorf("invalid event id %q", part)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(strings.TrimSpace(to)); err != nil {
+				return nil, fmt.Errorf("invalid event id range %q", part)
+			}
+		}
+		if first <= 0 || last < first {
+			return nil, fmt.Errorf("invalid event id range %q", part)
+		}
+		if last-first >= MAX_EVENT_ID_RANGE {
+			return nil, fmt.Errorf("event id range %q spans more than %d events", part, MAX_EVENT_ID_RANGE)
+		}
+		for eventId := first; eventId <= last; eventId++ {
+			seen[eventId] = struct{}{}
+		}
+	}
+
+	eventIds := make([]int, 0, len(seen))
+	for eventId := range seen {
+		eventIds = append(eventIds, eventId)
+	}
+	sort.Ints(eventIds)
+	return eventIds, nil
+}
+
+// backfillSyncConfig applies the border override of the options to a copy of cfg, for the ranking
+// types to backfill only. The borders of the idol point ranking are the anniversary borders.
+func backfillSyncConfig(cfg config.SyncConfig, options BackfillOptions) config.SyncConfig {
+	if len(options.Borders) == 0 {
+		return cfg
+	}
+	borders := make(map[models.EventRankingType][]int, len(cfg.Borders))
+	for rankingType, configured := range cfg.Borders {
+		borders[rankingType] = configured
+	}
+	for _, rankingType := range options.RankingTypes {
+		if rankingType == models.IdolPoint {
+			cfg.AnniversaryBorders = options.Borders
+		} else {
+			borders[rankingType] = options.Borders
+		}
+	}
+	cfg.Borders = borders
+	return cfg
+}
+
+// forgetBackfilledETags drops the ETags the client holds for the border groups about to be backfilled.
+// A client reused across runs, like the one of the scheduler, keeps the ETags of earlier syncs, with
+// which the full history requested by the backfill would come back not modified.
+func forgetBackfilledETags(client matsuri.MatsuriClient, rankingTypesByEventId map[int][]models.EventRankingType, cfg config.SyncConfig) {
+	for eventId, rankingTypes := range rankingTypesByEventId {
+		for _, rankingType := range rankingTypes {
+			if rankingType != models.IdolPoint {
+				for _, border := range cfg.Borders[rankingType] {
+					client.ForgetRankingLogsETags(eventId, rankingType, 0, border)
+				}
+				continue
+			}
+			for _, border := range cfg.AnniversaryBorders {
+				for idolId := 1; idolId <= matsuri.IDOL_COUNT; idolId++ {
+					client.ForgetRankingLogsETags(eventId, rankingType, idolId, border)
+				}
+			}
+		}
+	}
+}
+
+func filterRankingTypes(
+	rankingTypesByEventId map[int][]models.EventRankingType,
+	allowed []models.EventRankingType,
+) map[int][]models.EventRankingType {
+	if len(allowed) == 0 {
+		return rankingTypesByEventId
+	}
+	filtered := make(map[int][]models.EventRankingType, len(rankingTypesByEventId))
+	for eventId, rankingTypes := range rankingTypesByEventId {
+		for _, rankingType := range rankingTypes {
+			for _, allowedType := range allowed {
+				if rankingType == allowedType {
+					filtered[eventId] = append(filtered[eventId], rankingType)
+				}
+			}
+		}
+	}
+	return filtered
+}
+
+// upsertEventInfos replaces the stored event infos with the updated ones of the same event,
+// appends the new ones and keeps the result sorted by event ID.
+func upsertEventInfos(stored, updated []models.EventInfo) []models.EventInfo {
+	byEventId := make(map[int]models.EventInfo, len(stored)+len(updated))
+	for _, info := range stored {
+		byEventId[info.EventId] = info
+	}
+	for _, info := range updated {
+		byEventId[info.EventId] = info
+	}
+
+	infos := make([]models.EventInfo, 0, len(byEventId))
+	for _, info := range byEventId {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].EventId < infos[j].EventId
+	})
+	return infos
+}
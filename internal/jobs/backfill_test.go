@@ -0,0 +1,153 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/internal/config"
+	"github.com/alceccentric/matsurihi-cron/internal/dao"
+	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestParseEventIds(t *testing.T) {
+	eventIds, err := ParseEventIds("12, 10,20-23,21")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{10, 12, 20, 21, 22, 23}, eventIds)
+
+	for _, spec := range []string{"a", "5-", "5-3", "0", "1-b", "1-1000000000", "10,1-9223372036854775807"} {
+		_, err := ParseEventIds(spec)
+		assert.Error(t, err, spec)
+	}
+
+	eventIds, err = ParseEventIds(fmt.Sprintf("1-%d", MAX_EVENT_ID_RANGE))
+	assert.NoError(t, err)
+	assert.Len(t, eventIds, MAX_EVENT_ID_RANGE)
+	_, err = ParseEventIds(fmt.Sprintf("1-%d", MAX_EVENT_ID_RANGE+1))
+	assert.ErrorContains(t, err, "spans more than")
+}
+
+func TestRunBackfill_DoesNotMoveLatestPointer(t *testing.T) {
+	mockDao := new(MockDAO)
+	mockClient := new(MockMatsuriClient)
+
+	mockClient.On("GetEvent", 5).Return(models.Event{Id: 5, Type: int(models.Theater), Name: "Event5"}, nil).Once()
+	mockClient.On("GetEventRankingBorders", 5).Return(models.EventRankingBorders{
+		EventPoint: []int{100, 2500},
+		HighScore:  []int{100, 2000},
+	}, nil).Once()
+	// Only high score is backfilled, with the overridden border, ignoring the ETags of earlier runs
+	mockClient.On("ForgetRankingLogsETags", 5, models.HighScore, 0, 2000).Return().Once()
+	mockClient.On("GetEventRankingLogs", 5, models.HighScore, 2000, (*models.EventRankingLogsOptions)(nil)).Return(models.EventRankingLogsResult{}, nil).Once()
+	mockDao.On("ListEventInfos").Return([]models.EventInfo{{EventId: 7}, {EventId: 5, EventName: "stale"}}, nil).Once()
+	mockDao.On("SaveEventInfos", mock.MatchedBy(func(infos []models.EventInfo) bool {
+		return len(infos) == 2 && infos[0].EventId == 5 && infos[0].EventName == "Event5" && infos[1].EventId == 7
+	})).Return(nil).Once()
+	mockDao.On("SaveBorderInfos", mock.Anything).Return(nil).Once()
+	mockDao.On("SaveRunManifest", mock.MatchedBy(func(manifest dao.RunManifest) bool {
+		return assert.ObjectsAreEqual([]int{5}, manifest.EventIds)
+	})).Return(nil).Once()
+
+	err := RunBackfill(context.Background(), mockClient, mockDao, config.Default().Sync, BackfillOptions{
+		EventIds:     []int{5},
+		RankingTypes: []models.EventRankingType{models.HighScore},
+		Borders:      []int{2000},
+	})
+	assert.NoError(t, err)
+	mockDao.AssertExpectations(t)
+	mockClient.AssertExpectations(t)
+	mockDao.AssertNotCalled(t, "SaveLatestEventInfo", mock.Anything)
+}
+
+func TestRunBackfill_RecordsQuarantinedGroups(t *testing.T) {
+	mockDao := new(MockDAO)
+	mockClient := new(MockMatsuriClient)
+	start := time.Now().Add(-time.Hour)
+	event := models.Event{Id: 5, Type: int(models.Theater), Name: "Event5"}
+	event.Schedule.BeginAt = start
+	event.Schedule.EndAt = start.Add(24 * time.Hour)
+	negative := models.EventRankingLog{Rank: 100, Data: []struct {
+		Score        int       `json:"score"`
+		AggregatedAt time.Time `json:"aggregatedAt"`
+	}{{Score: -5, AggregatedAt: start.Add(30 * time.Minute)}}}
+
+	mockClient.On("GetEvent", 5).Return(event, nil).Once()
+	mockClient.On("GetEventRankingBorders", 5).Return(models.EventRankingBorders{EventPoint: []int{100, 2500}}, nil).Once()
+	mockClient.On("ForgetRankingLogsETags", 5, models.EventPoint, 0, mock.Anything).Return().Twice()
+	mockClient.On("GetEventRankingLogs", 5, models.EventPoint, 100, (*models.EventRankingLogsOptions)(nil)).
+		Return(models.EventRankingLogsResult{Logs: []models.EventRankingLog{negative}}, nil).Once()
+	mockClient.On("GetEventRankingLogs", 5, models.EventPoint, 2500, (*models.EventRankingLogsOptions)(nil)).
+		Return(models.EventRankingLogsResult{}, nil).Once()
+	mockDao.On("ListEventInfos").Return(nil, nil).Once()
+	mockDao.On("SaveEventInfos", mock.Anything).Return(nil).Once()
+	mockDao.On("SaveBorderInfos", []models.BorderInfo(nil)).Return(nil).Once()
+	mockDao.On("SaveRunManifest", mock.MatchedBy(func(manifest dao.RunManifest) bool {
+		return manifest.Validation.QuarantinedBorderGroups == 1 && len(manifest.Validation.Issues) == 1
+	})).Return(nil).Once()
+
+	cfg := config.Default().Sync
+	cfg.Validation.Quarantine = true
+	err := RunBackfill(context.Background(), mockClient, mockDao, cfg, BackfillOptions{EventIds: []int{5}})
+	assert.NoError(t, err)
+	mockDao.AssertExpectations(t)
+}
+
+func TestBackfillSyncConfig_OverridesSelectedRankingTypes(t *testing.T) {
+	cfg := config.Default().Sync
+	assert.Equal(t, cfg, backfillSyncConfig(cfg, BackfillOptions{RankingTypes: []models.EventRankingType{models.EventPoint}}))
+
+	overridden := backfillSyncConfig(cfg, BackfillOptions{RankingTypes: []models.EventRankingType{models.EventPoint}, Borders: []int{50}})
+	assert.Equal(t, []int{50}, overridden.Borders[models.EventPoint])
+	assert.Equal(t, cfg.Borders[models.HighScore], overridden.Borders[models.HighScore])
+	assert.Equal(t, cfg.AnniversaryBorders, overridden.AnniversaryBorders)
+	assert.NotEqual(t, []int{50}, cfg.Borders[models.EventPoint], "the config is copied")
+
+	overridden = backfillSyncConfig(cfg, BackfillOptions{RankingTypes: []models.EventRankingType{models.IdolPoint}, Borders: []int{50}})
+	assert.Equal(t, []int{50}, overridden.AnniversaryBorders)
+	assert.Equal(t, cfg.Borders, overridden.Borders)
+}
+
+func TestRunBackfill_InvalidOptions(t *testing.T) {
+	for _, options := range []BackfillOptions{
+		{EventIds: []int{5}, RankingTypes: []models.EventRankingType{"eventPoints"}},
+		{EventIds: []int{5}, Borders: []int{100}},
+	} {
+		err := RunBackfill(context.Background(), new(MockMatsuriClient), new(MockDAO), config.Default().Sync, options)
+		assert.Error(t, err, options)
+	}
+}
+
+func TestRunBackfill_GetEventError(t *testing.T) {
+	mockDao := new(MockDAO)
+	mockClient := new(MockMatsuriClient)
+	mockClient.On("GetEvent", 5).Return(models.Event{}, errors.New("fail")).Once()
+
+	err := RunBackfill(context.Background(), mockClient, mockDao, config.Default().Sync, BackfillOptions{EventIds: []int{5}})
+	assert.ErrorContains(t, err, "all 1 events failed")
+}
+
+func TestRunBackfill_SkipsEventsFailingToBeFetched(t *testing.T) {
+	mockDao := new(MockDAO)
+	mockClient := new(MockMatsuriClient)
+	mockClient.On("GetEvent", 4).Return(models.Event{}, errors.New("fail")).Once()
+	mockClient.On("GetEvent", 5).Return(models.Event{Id: 5, Type: int(models.Theater), Name: "Event5"}, nil).Once()
+	mockClient.On("GetEventRankingBorders", 5).Return(models.EventRankingBorders{EventPoint: []int{100, 2500}}, nil).Once()
+	mockClient.On("ForgetRankingLogsETags", 5, models.EventPoint, 0, mock.Anything).Return().Twice()
+	mockClient.On("GetEventRankingLogs", 5, models.EventPoint, mock.Anything, (*models.EventRankingLogsOptions)(nil)).
+		Return(models.EventRankingLogsResult{}, nil).Twice()
+	mockDao.On("ListEventInfos").Return(nil, nil).Once()
+	mockDao.On("SaveEventInfos", mock.Anything).Return(nil).Once()
+	mockDao.On("SaveBorderInfos", mock.Anything).Return(nil).Once()
+	mockDao.On("SaveRunManifest", mock.MatchedBy(func(manifest dao.RunManifest) bool {
+		return assert.ObjectsAreEqual([]int{5}, manifest.EventIds) && assert.ObjectsAreEqual([]int{4}, manifest.FailedEventIds)
+	})).Return(nil).Once()
+
+	err := RunBackfill(context.Background(), mockClient, mockDao, config.Default().Sync, BackfillOptions{EventIds: []int{4, 5}})
+	assert.NoError(t, err)
+	mockDao.AssertExpectations(t)
+	mockClient.AssertExpectations(t)
+}
@@ -0,0 +1,204 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/internal/config"
+	"github.com/alceccentric/matsurihi-cron/internal/dao"
+	"github.com/alceccentric/matsurihi-cron/internal/logging"
+	"github.com/alceccentric/matsurihi-cron/internal/matsuri"
+	"github.com/alceccentric/matsurihi-cron/internal/metrics"
+	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/sirupsen/logrus"
+)
+
+// daemon keeps the border data of the live event up to date between full syncs.
+type daemon struct {
+	client    matsuri.MatsuriClient
+	borderDAO dao.DAO
+	syncCfg   config.SyncConfig
+	cfg       config.DaemonConfig
+	now       func() time.Time
+	// owner holds the borders lock while a poll writes
+	owner string
+	// liveEvent is the live event a full sync has been run for, if any
+	liveEvent *models.Event
+}
+
+// RunDaemon polls the border logs of the live event until ctx is cancelled.
+// A full sync runs whenever a new event goes live, after which only the live event is polled,
+// more often during its boost and final hours. Once the event ends its borders are synced one
+// last time and the daemon waits for the next event. Polls writing border infos hold the borders
+// lock, and are skipped while another run holds it. Cancelling ctx aborts the in-flight poll,
+// including its pending requests, and stops the daemon.
+func RunDaemon(
+	ctx context.Context,
+	client matsuri.MatsuriClient,
+	borderDAO dao.DAO,
+	syncCfg config.SyncConfig,
+	cfg config.DaemonConfig,
+) error {
+	d := &daemon{
+		client:    client,
+		borderDAO: borderDAO,
+		syncCfg:   syncCfg,
+		cfg:       cfg,
+		now:       time.Now,
+		owner:     NewLockOwner(),
+	}
+
+	logger := logging.FromContext(ctx)
+	for {
+		delay, err := d.poll(ctx)
+		if err != nil && ctx.Err() == nil {
+			logger.WithError(err).Error("Daemon poll failed")
+		}
+		logger.WithField("delay", delay).Info("Scheduled next poll")
+
+		select {
+		case <-ctx.Done():
+			logger.Info("Daemon stopped.")
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
+
+// poll runs one polling step and returns the delay until the next one.
+func (d *daemon) poll(ctx context.Context) (time.Duration, error) {
+	now := d.now()
+	events, err := d.client.GetEvents(ctx, &models.EventsOptions{
+		At:    now,
+		Types: d.syncCfg.EventTypes,
+	})
+	if err != nil {
+		return d.cfg.IdleInterval, errors.New("get live events: " + err.Error())
+	}
+
+	live := findLiveEvent(events, now)
+	if live == nil {
+		if d.liveEvent == nil {
+			return d.cfg.IdleInterval, nil
+		}
+		ended := *d.liveEvent
+		logging.FromContext(ctx).WithField(logging.FIELD_EVENT_ID, ended.Id).Info("Event ended, syncing its borders one last time")
+		err := d.runLocked(ctx, func(ctx context.Context) error {
+			return d.syncEvent(ctx, ended)
+		})
+		if errors.Is(err, dao.ErrLockHeld) {
+			// The ended event is kept so that the next poll syncs it
+			return d.cfg.IdleInterval, skipPoll(ctx, err)
+		}
+		d.liveEvent = nil
+		return d.cfg.IdleInterval, err
+	}
+
+	delay := nextPollDelay(*live, now, d.cfg)
+	if d.liveEvent == nil || d.liveEvent.Id != live.Id {
+		logging.FromContext(ctx).WithField(logging.FIELD_EVENT_ID, live.Id).Info("Event is live, running a full sync")
+		if err := d.runLocked(ctx, func(ctx context.Context) error {
+			return RunSync(ctx, d.client, d.borderDAO, d.syncCfg)
+		}); err != nil {
+			return delay, skipPoll(ctx, err)
+		}
+		d.liveEvent = live
+		return delay, nil
+	}
+
+	return delay, skipPoll(ctx, d.runLocked(ctx, func(ctx context.Context) error {
+		return d.syncEvent(ctx, *live)
+	}))
+}
+
+// runLocked runs a poll writing border infos under the borders lock, shared with the syncs and
+// backfills run by other processes.
+func (d *daemon) runLocked(ctx context.Context, fn func(ctx context.Context) error) error {
+	return RunLocked(ctx, d.borderDAO, LOCK_BORDERS, d.owner, d.syncCfg.LockTTL, fn)
+}
+
+// skipPoll tells a poll skipped because another run holds the borders lock, which is not a failure:
+// that run writes the same data, and the next poll catches up with what it did not.
+func skipPoll(ctx context.Context, err error) error {
+	if errors.Is(err, dao.ErrLockHeld) {
+		logging.FromContext(ctx).WithError(err).Warn("Skipping poll")
+		return nil
+	}
+	return err
+}
+
+// syncEvent syncs the borders of a single event within the sync timeout and saves the manifest of the run.
+func (d *daemon) syncEvent(ctx context.Context, event models.Event) (err error) {
+	ctx, cancel := withSyncTimeout(ctx, d.syncCfg)
+	defer cancel()
+	startedAt := d.now()
+	runId := newRunId(startedAt)
+	ctx = logging.WithRunId(logging.WithFields(ctx, logrus.Fields{logging.FIELD_EVENT_ID: event.Id}), runId)
+	failedGroups := 0
+	// The duration of the run is measured on the wall clock rather than with d.now
+	defer func(measuredFrom time.Time) {
+		observeRun(metrics.JOB_DAEMON, measuredFrom, failedGroups, err)
+	}(time.Now())
+
+	eventInfos, rankingTypesByEventId, err := collectEventInfos(ctx, d.client, []models.Event{event}, d.syncCfg)
+	if err != nil {
+		return errors.New("collect event infos: " + err.Error())
+	}
+	if len(rankingTypesByEventId[event.Id]) == 0 {
+		logging.FromContext(ctx).Info("Event has no supported borders to sync")
+		return nil
+	}
+	events := map[int]models.EventInfo{event.Id: eventInfos[0]}
+	manifest := newRunManifest(runId, startedAt, events)
+	if err := syncBorders(ctx, d.client, d.borderDAO, &manifest, events, rankingTypesByEventId, d.syncCfg); err != nil {
+		return err
+	}
+	failedGroups = manifest.FailedBorderGroups
+	return saveRunManifest(ctx, d.borderDAO, manifest)
+}
+
+// findLiveEvent returns the event running at now, if any.
+func findLiveEvent(events []models.Event, now time.Time) *models.Event {
+	for i := range events {
+		schedule := events[i].Schedule
+		if !now.Before(schedule.BeginAt) && now.Before(schedule.EndAt) {
+			return &events[i]
+		}
+	}
+	return nil
+}
+
+// nextPollDelay returns the polling interval matching the phase of a live event at now:
+// the final interval during the last hours, the boost interval once the boost started and
+// the live interval otherwise. The delay is cut short at the next phase change so that the
+// tighter cadence starts on time, and at the end of the event to catch its final borders.
+func nextPollDelay(event models.Event, now time.Time, cfg config.DaemonConfig) time.Duration {
+	schedule := event.Schedule
+	finalAt := schedule.EndAt.Add(-cfg.FinalWindow)
+	boosted := !schedule.BoostBeginAt.IsZero() && !now.Before(schedule.BoostBeginAt)
+
+	var delay time.Duration
+	var boundaries []time.Time
+	switch {
+	case !now.Before(finalAt):
+		delay = cfg.FinalInterval
+	case boosted:
+		delay = cfg.BoostInterval
+		boundaries = append(boundaries, finalAt)
+	default:
+		delay = cfg.LiveInterval
+		boundaries = append(boundaries, finalAt)
+		if !schedule.BoostBeginAt.IsZero() {
+			boundaries = append(boundaries, schedule.BoostBeginAt)
+		}
+	}
+	boundaries = append(boundaries, schedule.EndAt)
+
+	for _, boundary := range boundaries {
+		if untilBoundary := boundary.Sub(now); untilBoundary > 0 && untilBoundary < delay {
+			delay = untilBoundary
+		}
+	}
+	return delay
+}
@@ -0,0 +1,149 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/internal/config"
+	"github.com/alceccentric/matsurihi-cron/internal/dao"
+	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var daemonTestBegin = time.Date(2025, 6, 1, 15, 0, 0, 0, time.UTC)
+
+func newDaemonTestEvent(id int) models.Event {
+	event := models.Event{Id: id, Type: int(models.Theater), Name: "Event"}
+	event.Schedule.BeginAt = daemonTestBegin
+	event.Schedule.BoostBeginAt = daemonTestBegin.Add(4 * 24 * time.Hour)
+	event.Schedule.EndAt = daemonTestBegin.Add(7*24*time.Hour - 3*time.Hour)
+	return event
+}
+
+func TestNextPollDelay(t *testing.T) {
+	cfg := config.Default().Daemon
+	event := newDaemonTestEvent(1)
+
+	assert.Equal(t, cfg.LiveInterval, nextPollDelay(event, daemonTestBegin.Add(time.Hour), cfg))
+	// Cut short so that polling switches to the boost cadence on time
+	assert.Equal(t, 10*time.Minute, nextPollDelay(event, event.Schedule.BoostBeginAt.Add(-10*time.Minute), cfg))
+	assert.Equal(t, cfg.BoostInterval, nextPollDelay(event, event.Schedule.BoostBeginAt, cfg))
+	assert.Equal(t, cfg.FinalInterval, nextPollDelay(event, event.Schedule.EndAt.Add(-cfg.FinalWindow), cfg))
+	assert.Equal(t, time.Minute, nextPollDelay(event, event.Schedule.EndAt.Add(-time.Minute), cfg))
+
+	event.Schedule.BoostBeginAt = time.Time{}
+	assert.Equal(t, cfg.LiveInterval, nextPollDelay(event, event.Schedule.EndAt.Add(-cfg.FinalWindow-time.Hour), cfg))
+}
+
+func TestFindLiveEvent(t *testing.T) {
+	event := newDaemonTestEvent(1)
+	assert.Nil(t, findLiveEvent([]models.Event{event}, daemonTestBegin.Add(-time.Second)))
+	assert.Equal(t, 1, findLiveEvent([]models.Event{event}, daemonTestBegin).Id)
+	assert.Nil(t, findLiveEvent([]models.Event{event}, event.Schedule.EndAt))
+}
+
+func expectEventBorderSync(mockClient *MockMatsuriClient, mockDao *MockDAO, eventId int) {
+	expectBordersLock(mockDao, nil)
+	mockClient.On("GetEventRankingBorders", eventId).Return(models.EventRankingBorders{EventPoint: []int{100, 2500}}, nil).Once()
+	mockDao.On("GetBorderHighWaterMarks").Return(map[dao.BorderGroupKey]time.Time{}, nil).Once()
+	mockDao.On("GetETags").Return(map[string]string{}, nil).Once()
+	mockClient.On("LoadETags", map[string]string{}).Once()
+	mockClient.On("GetEventRankingLogs", eventId, models.EventPoint, 100, (*models.EventRankingLogsOptions)(nil)).Return(models.EventRankingLogsResult{}, nil).Once()
+	mockClient.On("GetEventRankingLogs", eventId, models.EventPoint, 2500, (*models.EventRankingLogsOptions)(nil)).Return(models.EventRankingLogsResult{}, nil).Once()
+	mockDao.On("SaveBorderInfos", mock.Anything).Return(nil).Once()
+	mockClient.On("ETags").Return(map[string]string{}).Once()
+	mockDao.On("SaveETags", map[string]string{}).Return(nil).Once()
+	mockDao.On("SaveRunManifest", mock.MatchedBy(func(manifest dao.RunManifest) bool {
+		return len(manifest.EventIds) == 1 && manifest.EventIds[0] == eventId
+	})).Return(nil).Once()
+}
+
+// expectBordersLock expects the daemon to take the borders lock, and to release it unless acquiring it fails with err.
+func expectBordersLock(mockDao *MockDAO, err error) {
+	mockDao.On("AcquireLock", LOCK_BORDERS, "daemon", config.Default().Sync.LockTTL).Return(dao.Lease{}, err).Once()
+	if err == nil {
+		mockDao.On("ReleaseLock", LOCK_BORDERS, "daemon").Return(nil).Once()
+	}
+}
+
+func TestDaemonPoll_LiveEventOnlySyncsItsBorders(t *testing.T) {
+	mockDao := new(MockDAO)
+	mockClient := new(MockMatsuriClient)
+	event := newDaemonTestEvent(7)
+	now := daemonTestBegin.Add(time.Hour)
+
+	mockClient.On("GetEvents", mock.MatchedBy(func(options *models.EventsOptions) bool {
+		return options.At.Equal(now)
+	})).Return([]models.Event{event}, nil).Once()
+	expectEventBorderSync(mockClient, mockDao, 7)
+
+	d := &daemon{client: mockClient, borderDAO: mockDao, syncCfg: config.Default().Sync, cfg: config.Default().Daemon,
+		now: func() time.Time { return now }, owner: "daemon", liveEvent: &event}
+	delay, err := d.poll(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, config.Default().Daemon.LiveInterval, delay)
+	mockDao.AssertExpectations(t)
+	mockClient.AssertExpectations(t)
+}
+
+func TestDaemonPoll_EndedEventIsSyncedOnceMore(t *testing.T) {
+	mockDao := new(MockDAO)
+	mockClient := new(MockMatsuriClient)
+	event := newDaemonTestEvent(7)
+
+	mockClient.On("GetEvents", mock.Anything).Return([]models.Event{}, nil).Twice()
+	expectEventBorderSync(mockClient, mockDao, 7)
+
+	d := &daemon{client: mockClient, borderDAO: mockDao, syncCfg: config.Default().Sync, cfg: config.Default().Daemon,
+		now: func() time.Time { return event.Schedule.EndAt }, owner: "daemon", liveEvent: &event}
+	delay, err := d.poll(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, config.Default().Daemon.IdleInterval, delay)
+	assert.Nil(t, d.liveEvent)
+
+	// Nothing left to sync while idle
+	delay, err = d.poll(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, config.Default().Daemon.IdleInterval, delay)
+	mockDao.AssertExpectations(t)
+	mockClient.AssertExpectations(t)
+}
+
+func TestDaemonPoll_SkippedWhileLockHeld(t *testing.T) {
+	mockDao := new(MockDAO)
+	mockClient := new(MockMatsuriClient)
+	live := newDaemonTestEvent(7)
+	ended := newDaemonTestEvent(6)
+	now := daemonTestBegin.Add(time.Hour)
+	mockClient.On("GetEvents", mock.Anything).Return([]models.Event{live}, nil).Once()
+	mockClient.On("GetEvents", mock.Anything).Return([]models.Event{}, nil).Once()
+	expectBordersLock(mockDao, dao.ErrLockHeld)
+	expectBordersLock(mockDao, dao.ErrLockHeld)
+
+	d := &daemon{client: mockClient, borderDAO: mockDao, syncCfg: config.Default().Sync, cfg: config.Default().Daemon,
+		now: func() time.Time { return now }, owner: "daemon"}
+	delay, err := d.poll(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, config.Default().Daemon.LiveInterval, delay)
+	assert.Nil(t, d.liveEvent, "the full sync is run again by the next poll")
+
+	d.liveEvent = &ended
+	_, err = d.poll(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, &ended, d.liveEvent, "the last sync of the ended event is run again by the next poll")
+	mockDao.AssertExpectations(t)
+	mockClient.AssertNotCalled(t, "GetEventRankingBorders", mock.Anything)
+}
+
+func TestDaemonPoll_GetEventsError(t *testing.T) {
+	mockClient := new(MockMatsuriClient)
+	mockClient.On("GetEvents", mock.Anything).Return([]models.Event{}, errors.New("fail")).Once()
+
+	d := &daemon{client: mockClient, syncCfg: config.Default().Sync, cfg: config.Default().Daemon, now: time.Now}
+	delay, err := d.poll(context.Background())
+	assert.ErrorContains(t, err, "get live events")
+	assert.Equal(t, config.Default().Daemon.IdleInterval, delay)
+}
@@ -0,0 +1,197 @@
+package jobs
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/alceccentric/matsurihi-cron/internal/config"
+	"github.com/alceccentric/matsurihi-cron/internal/dao"
+	"github.com/alceccentric/matsurihi-cron/internal/matsuri"
+	"github.com/alceccentric/matsurihi-cron/internal/matsurifake"
+	"github.com/alceccentric/matsurihi-cron/internal/s3fake"
+	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRunSync_FakeApi runs syncs end-to-end against the fake API, with the real client and storage.
+func TestRunSync_FakeApi(t *testing.T) {
+	fake := matsurifake.NewServer(matsurifake.DefaultFixture())
+	api := httptest.NewServer(fake.Handler())
+	defer api.Close()
+	client := matsuri.NewMatsurihiMeClient(api.URL).SetRateLimit(0, 0)
+	localDAO, err := dao.NewLocalDAO(t.TempDir(), "b", "e", "m")
+	assert.NoError(t, err)
+	ctx := context.Background()
+	cfg := config.Default().Sync
+
+	assert.NoError(t, RunSync(ctx, client, localDAO, cfg))
+
+	// The show time event has no borders, the tour is the latest supported event
+	latest, err := localDAO.GetLatestEventInfo(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, latest.EventId)
+	eventInfos, err := localDAO.ListEventInfos(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, eventInfos, 2)
+
+	group := dao.BorderGroupKey{EventId: 2, RankingType: models.EventPoint, Border: 2500}
+	infos, err := localDAO.GetBorderInfos(ctx, group)
+	assert.NoError(t, err)
+	assert.Len(t, infos, 6)
+	etags, err := localDAO.GetETags(ctx)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, etags)
+
+	// Syncing again neither duplicates nor loses border infos
+	assert.NoError(t, RunSync(ctx, client, localDAO, cfg))
+	infos, err = localDAO.GetBorderInfos(ctx, group)
+	assert.NoError(t, err)
+	assert.Len(t, infos, 6)
+	assert.Equal(t, 2, fake.Requests("/events/2/rankings/eventPoint/logs/2500"))
+}
+
+// TestRunBackfill_AfterSyncOnSameClient backfills with the client of an earlier sync, whose ETags
+// must not turn the full history requested by the backfill into not modified responses.
+func TestRunBackfill_AfterSyncOnSameClient(t *testing.T) {
+	api := httptest.NewServer(matsurifake.NewServer(matsurifake.DefaultFixture()).Handler())
+	defer api.Close()
+	client := matsuri.NewMatsurihiMeClient(api.URL).SetRateLimit(0, 0)
+	ctx := context.Background()
+	cfg := config.Default().Sync
+	syncedDAO, err := dao.NewLocalDAO(t.TempDir(), "b", "e", "m")
+	assert.NoError(t, err)
+	assert.NoError(t, RunSync(ctx, client, syncedDAO, cfg))
+
+	backfilledDAO, err := dao.NewLocalDAO(t.TempDir(), "b", "e", "m")
+	assert.NoError(t, err)
+	assert.NoError(t, RunBackfill(ctx, client, backfilledDAO, cfg, BackfillOptions{EventIds: []int{2}}))
+	group := dao.BorderGroupKey{EventId: 2, RankingType: models.EventPoint, Border: 2500}
+	infos, err := backfilledDAO.GetBorderInfos(ctx, group)
+	assert.NoError(t, err)
+	assert.Len(t, infos, 6)
+}
+
+// TestRunSync_Replay re-executes a recorded sync into fresh storage without the API.
+func TestRunSync_Replay(t *testing.T) {
+	api := httptest.NewServer(matsurifake.NewServer(matsurifake.DefaultFixture()).Handler())
+	cassette := filepath.Join(t.TempDir(), "sync.jsonl")
+	recorder, err := matsuri.NewRecordingTransport(cassette, nil)
+	assert.NoError(t, err)
+	client := matsuri.NewMatsurihiMeClient(api.URL).SetTransport(recorder).SetRateLimit(0, 0)
+	recordedDAO, err := dao.NewLocalDAO(t.TempDir(), "b", "e", "m")
+	assert.NoError(t, err)
+	ctx := context.Background()
+	cfg := config.Default().Sync
+	assert.NoError(t, RunSync(ctx, client, recordedDAO, cfg))
+	api.Close()
+
+	interactions, err := matsuri.LoadCassette(cassette)
+	assert.NoError(t, err)
+	replay, err := matsuri.NewReplayTransport(interactions)
+	assert.NoError(t, err)
+	client = matsuri.NewMatsurihiMeClient(api.URL).SetTransport(replay).SetRateLimit(0, 0)
+	replayedDAO, err := dao.NewLocalDAO(t.TempDir(), "b", "e", "m")
+	assert.NoError(t, err)
+	assert.NoError(t, RunSync(ctx, client, replayedDAO, cfg))
+	assert.Zero(t, replay.Remaining())
+
+	for _, eventId := range []int{1, 2} {
+		groups, err := recordedDAO.ListBorderGroups(ctx, eventId)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, groups)
+		for _, group := range groups {
+			recorded, err := recordedDAO.GetBorderInfos(ctx, group)
+			assert.NoError(t, err)
+			replayed, err := replayedDAO.GetBorderInfos(ctx, group)
+			assert.NoError(t, err)
+			assert.Equal(t, recorded, replayed)
+		}
+	}
+}
+
+// TestRunSync_ReplayIntoSyncedStorage replays a sync recorded into fresh storage into storage that was
+// already synced, whose high-water marks and ETags change the since parameters and If-None-Match headers.
+func TestRunSync_ReplayIntoSyncedStorage(t *testing.T) {
+	api := httptest.NewServer(matsurifake.NewServer(matsurifake.DefaultFixture()).Handler())
+	defer api.Close()
+	ctx := context.Background()
+	cfg := config.Default().Sync
+	syncedDAO, err := dao.NewLocalDAO(t.TempDir(), "b", "e", "m")
+	assert.NoError(t, err)
+	assert.NoError(t, RunSync(ctx, matsuri.NewMatsurihiMeClient(api.URL).SetRateLimit(0, 0), syncedDAO, cfg))
+
+	cassette := filepath.Join(t.TempDir(), "sync.jsonl")
+	recorder, err := matsuri.NewRecordingTransport(cassette, nil)
+	assert.NoError(t, err)
+	recordedDAO, err := dao.NewLocalDAO(t.TempDir(), "b", "e", "m")
+	assert.NoError(t, err)
+	assert.NoError(t, RunSync(ctx, matsuri.NewMatsurihiMeClient(api.URL).SetTransport(recorder).SetRateLimit(0, 0), recordedDAO, cfg))
+
+	interactions, err := matsuri.LoadCassette(cassette)
+	assert.NoError(t, err)
+	replay, err := matsuri.NewReplayTransport(interactions)
+	assert.NoError(t, err)
+	client := matsuri.NewMatsurihiMeClient(api.URL).SetTransport(replay).SetRateLimit(0, 0)
+	assert.NoError(t, RunSync(ctx, client, syncedDAO, cfg))
+	// The ranking logs of the ended event synced before are not requested again, while every
+	// request for the live event is answered despite its since parameter and ETag
+	assert.Equal(t, 4, replay.Remaining())
+
+	for _, eventId := range []int{1, 2} {
+		groups, err := recordedDAO.ListBorderGroups(ctx, eventId)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, groups)
+		for _, group := range groups {
+			recorded, err := recordedDAO.GetBorderInfos(ctx, group)
+			assert.NoError(t, err)
+			replayed, err := syncedDAO.GetBorderInfos(ctx, group)
+			assert.NoError(t, err)
+			assert.Equal(t, recorded, replayed)
+		}
+	}
+}
+
+// TestRunSync_R2OnS3Fake runs a locked sync end-to-end from the fake API into the R2 DAO,
+// which talks to an in-memory S3 server through the real SDK.
+func TestRunSync_R2OnS3Fake(t *testing.T) {
+	api := httptest.NewServer(matsurifake.NewServer(matsurifake.DefaultFixture()).Handler())
+	defer api.Close()
+	storage := s3fake.NewServer().CreateBucket("bucket")
+	s3Server := httptest.NewServer(storage.Handler())
+	defer s3Server.Close()
+	t.Setenv("R2_ENDPOINT", s3Server.URL)
+	t.Setenv("R2_ACCESS_KEY_ID", "key")
+	t.Setenv("R2_SECRET_ACCESS_KEY", "secret")
+
+	ctx := context.Background()
+	r2DAO, err := dao.NewR2DAO(ctx, "bucket", "b", "e", "m")
+	assert.NoError(t, err)
+	client := matsuri.NewMatsurihiMeClient(api.URL).SetRateLimit(0, 0)
+	cfg := config.Default().Sync
+	sync := func(ctx context.Context) error {
+		return RunSync(ctx, client, r2DAO, cfg)
+	}
+
+	assert.NoError(t, RunLocked(ctx, r2DAO, LOCK_BORDERS, "a", cfg.LockTTL, sync))
+	assert.NoError(t, RunLocked(ctx, r2DAO, LOCK_BORDERS, "a", cfg.LockTTL, sync))
+
+	latest, err := r2DAO.GetLatestEventInfo(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, latest.EventId)
+	groups, err := r2DAO.ListBorderGroups(ctx, 1)
+	assert.NoError(t, err)
+	assert.Len(t, groups, 4)
+	infos, err := r2DAO.GetBorderInfos(ctx, dao.BorderGroupKey{EventId: 2, RankingType: models.EventPoint, Border: 100})
+	assert.NoError(t, err)
+	assert.Len(t, infos, 6)
+	index, err := r2DAO.GetRunManifestIndex(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, index, 2)
+
+	// The released lock can be acquired by another owner
+	_, err = r2DAO.AcquireLock(ctx, LOCK_BORDERS, "b", cfg.LockTTL)
+	assert.NoError(t, err)
+	assert.Contains(t, storage.Keys("bucket"), "m/locks/borders.json")
+}
@@ -0,0 +1,81 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/internal/dao"
+	"github.com/alceccentric/matsurihi-cron/internal/logging"
+)
+
+// LOCK_BORDERS is the lock serializing the runs that write border infos, syncs and backfills,
+// so that concurrent runs do not read the same high-water marks and overwrite each other's groups.
+const LOCK_BORDERS = "borders"
+
+// NewLockOwner returns an owner name telling apart the processes taking locks, even across hosts.
+func NewLockOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return hostname + "-" + strconv.Itoa(os.Getpid()) + "-" + hex.EncodeToString(suffix)
+}
+
+// RunLocked runs fn while owner holds the lock name, and returns dao.ErrLockHeld without running it
+// if another owner holds the lock. The lease is renewed every third of ttl while fn runs; if the
+// renewal fails, the lock may be taken over, so the context of fn is cancelled and the run fails.
+func RunLocked(ctx context.Context, borderDAO dao.DAO, name, owner string, ttl time.Duration, fn func(ctx context.Context) error) error {
+	if ttl <= 0 {
+		return errors.New("lease of lock " + name + " must be positive, got " + ttl.String())
+	}
+	if _, err := borderDAO.AcquireLock(ctx, name, owner, ttl); err != nil {
+		return err
+	}
+	logger := logging.FromContext(ctx).WithField("lock", name)
+	logger.Infof("Acquired lock as %s", owner)
+	defer func() {
+		// The lock is released even when ctx is cancelled, so that the next run does not wait for the lease to expire
+		if err := borderDAO.ReleaseLock(context.WithoutCancel(ctx), name, owner); err != nil {
+			logger.WithError(err).Warn("Failed to release lock, it is freed when its lease expires")
+		}
+	}()
+
+	runCtx, cancel := context.WithCancel(ctx)
+	renewErr := make(chan error, 1)
+	renewDone := make(chan struct{})
+	go func() {
+		defer close(renewDone)
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-runCtx.Done():
+				return
+			case <-ticker.C:
+				if _, err := borderDAO.AcquireLock(runCtx, name, owner, ttl); err != nil && runCtx.Err() == nil {
+					renewErr <- err
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	err := fn(runCtx)
+	// Stop renewing before the deferred release, which a late renewal would undo
+	cancel()
+	<-renewDone
+	select {
+	case lost := <-renewErr:
+		return errors.New("renew lock " + name + ": " + lost.Error())
+	default:
+		return err
+	}
+}
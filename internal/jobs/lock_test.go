@@ -0,0 +1,62 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/internal/dao"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRunLocked_RunsAndReleases(t *testing.T) {
+	mockDao := new(MockDAO)
+	mockDao.On("AcquireLock", LOCK_BORDERS, "a", time.Minute).Return(dao.Lease{}, nil).Once()
+	mockDao.On("ReleaseLock", LOCK_BORDERS, "a").Return(nil).Once()
+
+	ran := false
+	err := RunLocked(context.Background(), mockDao, LOCK_BORDERS, "a", time.Minute, func(context.Context) error {
+		ran = true
+		return errors.New("run failed")
+	})
+	assert.EqualError(t, err, "run failed")
+	assert.True(t, ran)
+	mockDao.AssertExpectations(t)
+}
+
+func TestRunLocked_LockHeld(t *testing.T) {
+	mockDao := new(MockDAO)
+	mockDao.On("AcquireLock", LOCK_BORDERS, "a", time.Minute).Return(dao.Lease{}, dao.ErrLockHeld).Once()
+
+	err := RunLocked(context.Background(), mockDao, LOCK_BORDERS, "a", time.Minute, func(context.Context) error {
+		t.Fatal("the run must not start without the lock")
+		return nil
+	})
+	assert.ErrorIs(t, err, dao.ErrLockHeld)
+	mockDao.AssertNotCalled(t, "ReleaseLock", mock.Anything, mock.Anything)
+}
+
+func TestRunLocked_LostLeaseCancelsRun(t *testing.T) {
+	mockDao := new(MockDAO)
+	ttl := 30 * time.Millisecond
+	mockDao.On("AcquireLock", LOCK_BORDERS, "a", ttl).Return(dao.Lease{}, nil).Once()
+	mockDao.On("AcquireLock", LOCK_BORDERS, "a", ttl).Return(dao.Lease{}, dao.ErrLockHeld).Once()
+	mockDao.On("ReleaseLock", LOCK_BORDERS, "a").Return(nil).Once()
+
+	err := RunLocked(context.Background(), mockDao, LOCK_BORDERS, "a", ttl, func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+			return nil
+		}
+	})
+	assert.ErrorContains(t, err, "renew lock borders")
+	mockDao.AssertExpectations(t)
+}
+
+func TestNewLockOwner_IsUnique(t *testing.T) {
+	assert.NotEqual(t, NewLockOwner(), NewLockOwner())
+}
@@ -1,106 +1,329 @@
 package jobs
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
-	"strconv"
+	"sort"
+	"time"
 
+	"github.com/alceccentric/matsurihi-cron/internal/config"
 	"github.com/alceccentric/matsurihi-cron/internal/dao"
+	"github.com/alceccentric/matsurihi-cron/internal/logging"
 	"github.com/alceccentric/matsurihi-cron/internal/matsuri"
+	"github.com/alceccentric/matsurihi-cron/internal/metrics"
 	utils "github.com/alceccentric/matsurihi-cron/internal/utils"
+	"github.com/alceccentric/matsurihi-cron/internal/validation"
 	"github.com/alceccentric/matsurihi-cron/models"
 	"github.com/sirupsen/logrus"
 )
 
-var SURPPORTED_BORDERS = []int{100, 2500}
-var ANN_SUPPORTED_BORDERS = []int{100, 1000}
+// ErrNoSupportedEvents is returned by RunSync when none of the fetched events is supported.
+var ErrNoSupportedEvents = errors.New("no supported events to process")
 
-const (
-	SURPPORTED_BORDER_TYPE = models.EventPoint
-)
+// RunSync saves the infos of every supported event and syncs the borders of the latest ones.
+// The run is bounded by cfg.Timeout and aborted, including in-flight requests, when ctx is cancelled.
+func RunSync(ctx context.Context, client matsuri.MatsuriClient, dao dao.DAO, cfg config.SyncConfig) (err error) {
+	ctx, cancel := withSyncTimeout(ctx, cfg)
+	defer cancel()
+	startedAt := time.Now()
+	runId := newRunId(startedAt)
+	ctx = logging.WithRunId(ctx, runId)
+	logger := logging.FromContext(ctx)
+	failedGroups := 0
+	defer func() {
+		observeRun(metrics.JOB_SYNC, startedAt, failedGroups, err)
+	}()
 
-func RunSync(client matsuri.MatsuriClient, dao dao.DAO) error {
-	latest, err := dao.GetLatestEventInfo()
+	latest, err := dao.GetLatestEventInfo(ctx)
 	if err != nil {
 		return errors.New("get latest event info: " + err.Error())
 	}
 
-	events, err := client.GetEvents(&models.EventsOptions{
+	events, err := client.GetEvents(ctx, &models.EventsOptions{
 		OrderBys: []models.EventSortType{models.IdAsc},
-		Types:    []models.EventType{models.Theater, models.Tour, models.Tune, models.Tale, models.Anniversary},
+		Types:    cfg.EventTypes,
 	})
 	if err != nil {
 		return errors.New("get events: " + err.Error())
 	}
-	logrus.Infof("Got %d events before filtering", len(events))
+	logger.Infof("Got %d events before filtering", len(events))
 
-	eventInfos := collectEventInfos(client, events)
+	eventInfos, rankingTypesByEventId, err := collectEventInfos(ctx, client, events, cfg)
+	if err != nil {
+		return errors.New("collect event infos: " + err.Error())
+	}
 	if len(eventInfos) > 0 {
-		logrus.Infof("Got %d events to process", len(eventInfos))
-		if err := dao.SaveEventInfos(eventInfos); err != nil {
+		logger.Infof("Got %d events to process", len(eventInfos))
+		if err := dao.SaveEventInfos(ctx, eventInfos); err != nil {
 			return errors.New("save event infos: " + err.Error())
 		}
 	} else {
-		logrus.Fatalln("No events to process")
-	}
-
-	eventIdToEventInfo := make(map[int]models.EventInfo)
-	for _, info := range eventInfos {
-		eventIdToEventInfo[info.EventId] = info
+		return ErrNoSupportedEvents
 	}
 
-	eventIdsToFetchBorderInfo := make(map[int]struct{})
+	eventsToFetchBorderInfo := make(map[int]models.EventInfo)
 	for _, info := range eventInfos {
 		if latest.EventId > 0 && info.EventId < latest.EventId {
 			continue
 		}
-		eventIdsToFetchBorderInfo[info.EventId] = struct{}{}
+		eventsToFetchBorderInfo[info.EventId] = info
 		if info.EventId > latest.EventId {
 			latest = info
 		}
 	}
 
-	borderInfos := collectBorderInfos(client, eventIdsToFetchBorderInfo, eventIdToEventInfo)
-	if err := dao.SaveBorderInfos(borderInfos); err != nil {
-		return errors.New("save border infos: " + err.Error())
+	manifest := newRunManifest(runId, startedAt, eventsToFetchBorderInfo)
+	if err := syncBorders(ctx, client, dao, &manifest, eventsToFetchBorderInfo, rankingTypesByEventId, cfg); err != nil {
+		return err
+	}
+	failedGroups = manifest.FailedBorderGroups
+	if err := saveRunManifest(ctx, dao, manifest); err != nil {
+		return err
+	}
+	return commitSync(ctx, dao, latest, manifest.FailedBorderGroups)
+}
+
+// newRunManifest starts the manifest of a run syncing the borders of the given events.
+func newRunManifest(runId string, startedAt time.Time, events map[int]models.EventInfo) dao.RunManifest {
+	manifest := dao.RunManifest{
+		RunId:     runId,
+		StartedAt: startedAt.UTC(),
+		EventIds:  make([]int, 0, len(events)),
+	}
+	for eventId := range events {
+		manifest.EventIds = append(manifest.EventIds, eventId)
+	}
+	sort.Ints(manifest.EventIds)
+	return manifest
+}
+
+// newRunId returns an ID sorting runs by start time, with a random suffix telling apart runs started together.
+// It names the manifest of the run and correlates its log lines.
+func newRunId(startedAt time.Time) string {
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return startedAt.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
+}
+
+// observeRun records the outcome of a run in the metrics. Runs failing to fetch
+// some border groups are partial successes.
+func observeRun(job string, startedAt time.Time, failedGroups int, err error) {
+	outcome := metrics.OUTCOME_SUCCESS
+	switch {
+	case errors.Is(err, ErrNoSupportedEvents):
+		outcome = metrics.OUTCOME_NO_SUPPORTED_EVENTS
+	case err != nil:
+		outcome = metrics.OUTCOME_FAILURE
+	case failedGroups > 0:
+		outcome = metrics.OUTCOME_PARTIAL
+	}
+	metrics.ObserveRun(job, outcome, time.Since(startedAt))
+}
+
+// saveRunManifest ends the manifest and saves it, so that consumers can find the border groups written by the run.
+func saveRunManifest(ctx context.Context, borderDAO dao.DAO, manifest dao.RunManifest) error {
+	manifest.EndedAt = time.Now().UTC()
+	if err := borderDAO.SaveRunManifest(ctx, manifest); err != nil {
+		return errors.New("save run manifest: " + err.Error())
+	}
+	logging.FromContext(ctx).Infof("Run wrote %d border groups", len(manifest.BorderGroups))
+	return nil
+}
+
+// commitSync is the last step of a sync run. The latest event pointer decides which events the
+// next run syncs, so it only moves once every border group of the run has been fetched and persisted.
+func commitSync(ctx context.Context, borderDAO dao.DAO, latest models.EventInfo, failedGroups int) error {
+	if failedGroups > 0 {
+		logging.FromContext(ctx).Warnf("Failed to fetch %d border groups, keeping the latest event pointer for the next run", failedGroups)
+		return nil
 	}
 	// TODO: Define a new struct for latest event info to include name but not type
-	if err := dao.SaveLatestEventInfo(latest); err != nil {
+	if err := borderDAO.SaveLatestEventInfo(ctx, latest); err != nil {
 		return errors.New("save latest event info: " + err.Error())
 	}
-	logrus.Info("Job completed successfully.")
+	logging.FromContext(ctx).WithField(logging.FIELD_EVENT_ID, latest.EventId).Info("Job completed successfully.")
+	return nil
+}
+
+// syncBorders fetches the border logs of the given events since their stored high-water marks,
+// using the stored ETags for conditional requests, validates them and merges them into the stored
+// border groups. The border groups written, the validation report and the number of border groups
+// that could not be fetched are recorded in manifest.
+func syncBorders(
+	ctx context.Context,
+	client matsuri.MatsuriClient,
+	borderDAO dao.DAO,
+	manifest *dao.RunManifest,
+	events map[int]models.EventInfo,
+	rankingTypesByEventId map[int][]models.EventRankingType,
+	cfg config.SyncConfig,
+) error {
+	highWaterMarks, err := borderDAO.GetBorderHighWaterMarks(ctx)
+	if err != nil {
+		return errors.New("get border high-water marks: " + err.Error())
+	}
+
+	etags, err := borderDAO.GetETags(ctx)
+	if err != nil {
+		return errors.New("get etags: " + err.Error())
+	}
+	client.LoadETags(etags)
+
+	eventIds := make(map[int]struct{}, len(events))
+	for eventId := range events {
+		eventIds[eventId] = struct{}{}
+	}
+	borderInfos, failedGroups, err := collectBorderInfos(ctx, client, eventIds, rankingTypesByEventId, highWaterMarks, cfg)
+	if err != nil {
+		return errors.New("collect border infos: " + err.Error())
+	}
+	borderInfos, quarantined, report := validateBorderInfos(ctx, borderInfos, events, cfg.Validation)
+	manifest.Validation = report
+	manifest.FailedBorderGroups = failedGroups
+	if manifest.BorderGroups, err = borderDAO.SaveBorderInfos(ctx, borderInfos); err != nil {
+		return errors.New("save border infos: " + err.Error())
+	}
+	// ETags are only persisted once the data they vouch for has been saved, which quarantined data never is.
+	forgetRankingLogsETags(client, quarantined)
+	if err := borderDAO.SaveETags(ctx, client.ETags()); err != nil {
+		return errors.New("save etags: " + err.Error())
+	}
 	return nil
 }
 
+// validateBorderInfos validates the fetched border infos and logs the issues found. With quarantine
+// enabled, the border infos of the border groups with errors are split from the ones to save.
+func validateBorderInfos(
+	ctx context.Context,
+	borderInfos []models.BorderInfo,
+	events map[int]models.EventInfo,
+	cfg config.ValidationConfig,
+) (kept, quarantined []models.BorderInfo, report validation.Report) {
+	report = validation.Validate(borderInfos, events, cfg.Cadence)
+	logValidationIssues(ctx, report)
+	if !cfg.Quarantine {
+		return borderInfos, nil, report
+	}
+
+	kept, quarantined = validation.Quarantine(borderInfos, &report)
+	if report.QuarantinedBorderGroups > 0 {
+		logging.FromContext(ctx).Warnf("Quarantined %d border groups with %d border infos failing validation", report.QuarantinedBorderGroups, len(quarantined))
+	}
+	return kept, quarantined, report
+}
+
+// forgetRankingLogsETags drops the ETags seen for the border groups of the quarantined border infos.
+// As their high-water marks stay put too, the next sync of their event fetches and validates them again
+// instead of being answered with 304 Not Modified.
+func forgetRankingLogsETags(client matsuri.MatsuriClient, quarantined []models.BorderInfo) {
+	forgotten := make(map[dao.BorderGroupKey]struct{})
+	for _, info := range quarantined {
+		key := dao.BorderGroupKey{EventId: info.EventId, RankingType: info.RankingType, IdolId: info.IdolId, Border: info.Border}
+		if _, ok := forgotten[key]; ok {
+			continue
+		}
+		forgotten[key] = struct{}{}
+		client.ForgetRankingLogsETags(key.EventId, key.RankingType, key.IdolId, key.Border)
+	}
+}
+
+// logValidationIssues logs the issues of a validation report, errors as warnings.
+func logValidationIssues(ctx context.Context, report validation.Report) {
+	logger := logging.FromContext(ctx)
+	for _, issue := range report.Issues {
+		issueLog := logger.WithFields(logging.BorderFields(issue.EventId, issue.RankingType, issue.IdolId, issue.Border)).
+			WithFields(logrus.Fields{"kind": issue.Kind, "severity": issue.Severity, "aggregated_at": issue.AggregatedAt})
+		if issue.Severity == validation.SEVERITY_ERROR {
+			issueLog.Warn("Validation error: " + issue.Message)
+		} else {
+			issueLog.Info("Validation warning: " + issue.Message)
+		}
+	}
+}
+
+// collectBorderInfos fetches the border logs of the given events. Failed fetches are logged,
+// skipped and counted per border group; only the cancellation of ctx aborts the collection with an error.
 func collectBorderInfos(
+	ctx context.Context,
 	matsuriClient matsuri.MatsuriClient,
 	eventIds map[int]struct{},
-	eventIdToEventInfo map[int]models.EventInfo,
-) []models.BorderInfo {
+	rankingTypesByEventId map[int][]models.EventRankingType,
+	highWaterMarks map[dao.BorderGroupKey]time.Time,
+	cfg config.SyncConfig,
+) ([]models.BorderInfo, int, error) {
 	var borderInfos []models.BorderInfo
+	failedGroups := 0
 
 	for eventId := range eventIds {
-		eventInfo := eventIdToEventInfo[eventId]
-		if eventInfo.EventType == models.Anniversary {
-			borderInfos = append(borderInfos, collectAnniversaryBorders(matsuriClient, eventId)...)
-		} else {
-			borderInfos = append(borderInfos, collectNormalBorders(matsuriClient, eventId)...)
+		for _, rankingType := range rankingTypesByEventId[eventId] {
+			var infos []models.BorderInfo
+			var failed int
+			if rankingType == models.IdolPoint {
+				infos, failed = collectAnniversaryBorders(ctx, matsuriClient, eventId, highWaterMarks, cfg.AnniversaryBorders)
+			} else {
+				infos, failed = collectNormalBorders(ctx, matsuriClient, eventId, rankingType, highWaterMarks, cfg.Borders[rankingType])
+			}
+			if err := ctx.Err(); err != nil {
+				return nil, 0, err
+			}
+			observeBorderRows(infos)
+			borderInfos = append(borderInfos, infos...)
+			failedGroups += failed
 		}
 	}
-	return borderInfos
+	return borderInfos, failedGroups, nil
+}
+
+// observeBorderRows records the number of border infos collected per event, ranking type and border in the metrics.
+func observeBorderRows(infos []models.BorderInfo) {
+	rows := make(map[dao.BorderGroupKey]int)
+	for _, info := range infos {
+		rows[dao.BorderGroupKey{EventId: info.EventId, RankingType: info.RankingType, Border: info.Border}]++
+	}
+	for key, count := range rows {
+		metrics.AddBorderRows(key.EventId, key.RankingType, key.Border, count)
+	}
 }
 
-func collectAnniversaryBorders(client matsuri.MatsuriClient, eventId int) []models.BorderInfo {
+func collectAnniversaryBorders(
+	ctx context.Context,
+	client matsuri.MatsuriClient,
+	eventId int,
+	highWaterMarks map[dao.BorderGroupKey]time.Time,
+	borders []int,
+) ([]models.BorderInfo, int) {
 	var infos []models.BorderInfo
-	for _, border := range ANN_SUPPORTED_BORDERS {
-		logrus.Infof("Collecting border infos for anniversary event %d with border: %d", eventId, border)
-		idolRankingLogs, err := client.GetEventIdolRankingLogs(eventId, border, nil)
-		if err != nil {
-			logrus.Warnf("Failed to get ranking logs for event %d with border: %d : %s", eventId, border, err.Error())
+	failed := 0
+	for _, border := range borders {
+		if ctx.Err() != nil {
+			return infos, failed
+		}
+		logger := logging.FromContext(ctx).WithFields(logging.BorderFields(eventId, models.IdolPoint, 0, border))
+		// All idols share one request option, so only fetch since the idol lagging the furthest behind.
+		since := anniversarySince(highWaterMarks, eventId, border)
+		logger.Infof("Collecting anniversary border infos since %v", since)
+		idolRankingLogs, err := client.GetEventIdolRankingLogs(ctx, eventId, border, sinceOptions(since))
+		var idolErr *matsuri.IdolRankingLogsError
+		if errors.As(err, &idolErr) {
+			// Keep the idols that succeeded; the failed ones are retried next run as their high-water marks stay put.
+			failed += len(idolErr.Errors)
+			for idolId, e := range idolErr.Errors {
+				logger.WithField(logging.FIELD_IDOL_ID, idolId).WithError(e).Warn("Failed to get ranking logs")
+			}
+		} else if err != nil {
+			logger.WithError(err).Warn("Failed to get ranking logs")
+			failed += matsuri.IDOL_COUNT
 			continue
 		}
 		logCnt := 0
 		for idolId, rankingLogs := range idolRankingLogs {
-			for _, log := range rankingLogs {
+			if rankingLogs.NotModified {
+				logger.WithField(logging.FIELD_IDOL_ID, idolId).Debug("Ranking logs are not modified")
+				continue
+			}
+			for _, log := range rankingLogs.Logs {
 				logCnt += len(log.Data)
 				for _, data := range log.Data {
 					infos = append(infos, models.BorderInfo{
@@ -114,54 +337,121 @@ func collectAnniversaryBorders(client matsuri.MatsuriClient, eventId int) []mode
 				}
 			}
 		}
-		logrus.Infof("Collected %d border infos for event %d with border: %d", logCnt, eventId, border)
+		logger.Infof("Collected %d border infos", logCnt)
 	}
-	return infos
+	return infos, failed
 }
 
-func collectNormalBorders(client matsuri.MatsuriClient, eventId int) []models.BorderInfo {
+func collectNormalBorders(
+	ctx context.Context,
+	client matsuri.MatsuriClient,
+	eventId int,
+	rankingType models.EventRankingType,
+	highWaterMarks map[dao.BorderGroupKey]time.Time,
+	borders []int,
+) ([]models.BorderInfo, int) {
 	var infos []models.BorderInfo
-	for _, border := range SURPPORTED_BORDERS {
-		logrus.Infof("Collecting border infos for normal event %d with border: %d", eventId, border)
-		rankingLogs, err := client.GetEventRankingLogs(eventId, SURPPORTED_BORDER_TYPE, border, nil)
+	failed := 0
+	for _, border := range borders {
+		if ctx.Err() != nil {
+			return infos, failed
+		}
+		logger := logging.FromContext(ctx).WithFields(logging.BorderFields(eventId, rankingType, 0, border))
+		since := highWaterMarks[dao.BorderGroupKey{EventId: eventId, RankingType: rankingType, Border: border}]
+		logger.Infof("Collecting border infos since %v", since)
+		rankingLogs, err := client.GetEventRankingLogs(ctx, eventId, rankingType, border, sinceOptions(since))
 		if err != nil {
-			logrus.Warnf("Failed to get ranking logs for event %d with border: %d : %s", eventId, border, err.Error())
+			logger.WithError(err).Warn("Failed to get ranking logs")
+			failed++
+			continue
+		}
+		if rankingLogs.NotModified {
+			logger.Info("Ranking logs are not modified")
 			continue
 		}
 		logCnt := 0
-		for _, log := range rankingLogs {
+		for _, log := range rankingLogs.Logs {
 			logCnt += len(log.Data)
 			for _, data := range log.Data {
 				infos = append(infos, models.BorderInfo{
 					EventId:      eventId,
 					Border:       border,
-					RankingType:  SURPPORTED_BORDER_TYPE,
+					RankingType:  rankingType,
 					Score:        data.Score,
 					AggregatedAt: data.AggregatedAt,
 				})
 			}
 		}
-		logrus.Infof("Collected %d border infos for event %d with border: %d", logCnt, eventId, border)
+		logger.Infof("Collected %d border infos", logCnt)
+	}
+	return infos, failed
+}
+
+// withSyncTimeout bounds ctx by the sync timeout of cfg, if any.
+func withSyncTimeout(ctx context.Context, cfg config.SyncConfig) (context.Context, context.CancelFunc) {
+	if cfg.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, cfg.Timeout)
+}
+
+// anniversarySince returns the earliest high-water mark among all idols for the given border,
+// or the zero time if any idol has not been stored yet.
+func anniversarySince(highWaterMarks map[dao.BorderGroupKey]time.Time, eventId, border int) time.Time {
+	var since time.Time
+	for idolId := 1; idolId <= matsuri.IDOL_COUNT; idolId++ {
+		mark, ok := highWaterMarks[dao.BorderGroupKey{EventId: eventId, RankingType: models.IdolPoint, IdolId: idolId, Border: border}]
+		if !ok {
+			return time.Time{}
+		}
+		if since.IsZero() || mark.Before(since) {
+			since = mark
+		}
+	}
+	return since
+}
+
+// sinceOptions builds ranking log options fetching only logs since the given time.
+// A zero time yields nil options so that the full history is fetched.
+func sinceOptions(since time.Time) *models.EventRankingLogsOptions {
+	if since.IsZero() {
+		return nil
 	}
-	return infos
+	return &models.EventRankingLogsOptions{Since: since}
 }
 
+// collectEventInfos returns the infos of the supported events along with
+// the ranking types to collect for each of them, keyed by event ID.
+// Events whose borders cannot be fetched are skipped unless ctx was cancelled.
 func collectEventInfos(
+	ctx context.Context,
 	matsuriClient matsuri.MatsuriClient,
 	events []models.Event,
-) []models.EventInfo {
+	cfg config.SyncConfig,
+) ([]models.EventInfo, map[int][]models.EventRankingType, error) {
 	eventInfos := make([]models.EventInfo, 0)
+	rankingTypesByEventId := make(map[int][]models.EventRankingType)
 
 	for _, event := range events {
+		logger := logging.FromContext(ctx).WithField(logging.FIELD_EVENT_ID, event.Id)
 
-		borders, err := matsuriClient.GetEventRankingBorders(event.Id)
+		borders, err := matsuriClient.GetEventRankingBorders(ctx, event.Id)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, nil, ctxErr
+		}
 		if err != nil {
-			logrus.Warn("Failed to get borders for event " + strconv.Itoa(event.Id) + ": " + err.Error())
+			logger.WithError(err).Warn("Failed to get event borders")
 			continue
 		}
 
-		if isSupportedAnniversaryEvent(event, borders, ANN_SUPPORTED_BORDERS) ||
-			isSupportedNormalEvent(event, borders, SURPPORTED_BORDERS) {
+		var rankingTypes []models.EventRankingType
+		if isSupportedAnniversaryEvent(ctx, event, borders, cfg.AnniversaryBorders) {
+			rankingTypes = []models.EventRankingType{models.IdolPoint}
+		} else if isSupportedNormalEvent(event, borders, models.EventPoint, cfg.Borders[models.EventPoint]) {
+			rankingTypes = supportedRankingTypes(event, borders, cfg.Borders)
+		}
+
+		if len(rankingTypes) > 0 {
 			eventInfo := models.EventInfo{
 				EventId:           event.Id,
 				EventType:         models.EventType(event.Type),
@@ -171,28 +461,64 @@ func collectEventInfos(
 				EndAt:             event.Schedule.EndAt,
 				BoostAt:           event.Schedule.BoostBeginAt,
 			}
-			logrus.Infof("Collected info for event %d", event.Id)
+			logger.Infof("Collected event info with ranking types %v", rankingTypes)
 			eventInfos = append(eventInfos, eventInfo)
+			rankingTypesByEventId[event.Id] = rankingTypes
 		} else {
-			logrus.Infof("Event %d with type %d is not supported", event.Id, event.Type)
+			logger.Infof("Event type %d is not supported", event.Type)
 		}
 	}
 
-	return eventInfos
+	return eventInfos, rankingTypesByEventId, nil
+}
+
+// supportedRankingTypes returns the ranking types of a normal event having all of their supported borders,
+// with event point first.
+func supportedRankingTypes(
+	event models.Event,
+	borders models.EventRankingBorders,
+	supportedBordersByRankingType map[models.EventRankingType][]int,
+) []models.EventRankingType {
+	var rankingTypes []models.EventRankingType
+	for rankingType, supportedBorders := range supportedBordersByRankingType {
+		if isSupportedNormalEvent(event, borders, rankingType, supportedBorders) {
+			rankingTypes = append(rankingTypes, rankingType)
+		}
+	}
+	sort.Slice(rankingTypes, func(i, j int) bool {
+		if rankingTypes[i] == models.EventPoint || rankingTypes[j] == models.EventPoint {
+			return rankingTypes[i] == models.EventPoint
+		}
+		return rankingTypes[i] < rankingTypes[j]
+	})
+	return rankingTypes
 }
 
-func isSupportedNormalEvent(event models.Event, borders models.EventRankingBorders, supportedBorders []int) bool {
-	return models.EventType(event.Type) != models.Anniversary && utils.IsSubset(supportedBorders, borders.EventPoint)
+func isSupportedNormalEvent(
+	event models.Event,
+	borders models.EventRankingBorders,
+	rankingType models.EventRankingType,
+	supportedBorders []int,
+) bool {
+	return models.EventType(event.Type) != models.Anniversary &&
+		len(supportedBorders) > 0 &&
+		utils.IsSubset(supportedBorders, borders.Borders(rankingType))
 }
 
-func isSupportedAnniversaryEvent(event models.Event, borders models.EventRankingBorders, anniversarySupportedBorders []int) bool {
+func isSupportedAnniversaryEvent(
+	ctx context.Context,
+	event models.Event,
+	borders models.EventRankingBorders,
+	anniversarySupportedBorders []int,
+) bool {
 	if models.EventType(event.Type) != models.Anniversary {
 		return false
 	}
 
+	logger := logging.FromContext(ctx).WithField(logging.FIELD_EVENT_ID, event.Id)
 	if len(borders.IdolPoint) != 52 {
-		logrus.Debugf("isSupportedAnniversaryEvent: Event %v Borders: %v", event, borders)
-		logrus.Warnf("Event %d has %d idol points, expected 52", event.Id, len(borders.IdolPoint))
+		logger.Debugf("isSupportedAnniversaryEvent: Event %v Borders: %v", event, borders)
+		logger.Warnf("Event has %d idol points, expected 52", len(borders.IdolPoint))
 		return false
 	}
 
@@ -203,7 +529,7 @@ func isSupportedAnniversaryEvent(event models.Event, borders models.EventRanking
 		}
 	}
 	if counter != 52 {
-		logrus.Warnf("Event %d has %d idols with supported anniversary borders, expected 52", event.Id, counter)
+		logger.Warnf("Event has %d idols with supported anniversary borders, expected 52", counter)
 		return false
 	}
 
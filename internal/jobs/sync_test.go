@@ -1,10 +1,14 @@
 package jobs
 
 import (
+	"context"
 	"errors"
 	"testing"
 	"time"
 
+	"github.com/alceccentric/matsurihi-cron/internal/config"
+	"github.com/alceccentric/matsurihi-cron/internal/dao"
+	"github.com/alceccentric/matsurihi-cron/internal/matsuri"
 	"github.com/alceccentric/matsurihi-cron/models"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -16,47 +20,121 @@ type MockDAO struct {
 	mock.Mock
 }
 
-func (m *MockDAO) SaveEventInfos(eventInfos []models.EventInfo) error {
+func (m *MockDAO) SaveEventInfos(_ context.Context, eventInfos []models.EventInfo) error {
 	args := m.Called(eventInfos)
 	return args.Error(0)
 }
-func (m *MockDAO) SaveBorderInfos(borderInfos []models.BorderInfo) error {
+func (m *MockDAO) SaveBorderInfos(_ context.Context, borderInfos []models.BorderInfo) ([]dao.BorderGroupManifest, error) {
 	args := m.Called(borderInfos)
-	return args.Error(0)
+	return nil, args.Error(0)
 }
-func (m *MockDAO) GetLatestEventInfo() (models.EventInfo, error) {
+func (m *MockDAO) GetLatestEventInfo(_ context.Context) (models.EventInfo, error) {
 	args := m.Called()
 	return args.Get(0).(models.EventInfo), args.Error(1)
 }
-func (m *MockDAO) SaveLatestEventInfo(info models.EventInfo) error {
+func (m *MockDAO) SaveLatestEventInfo(_ context.Context, info models.EventInfo) error {
 	args := m.Called(info)
 	return args.Error(0)
 }
+func (m *MockDAO) GetETags(_ context.Context) (map[string]string, error) {
+	args := m.Called()
+	etags, _ := args.Get(0).(map[string]string)
+	return etags, args.Error(1)
+}
+func (m *MockDAO) SaveETags(_ context.Context, etags map[string]string) error {
+	args := m.Called(etags)
+	return args.Error(0)
+}
+func (m *MockDAO) ListEventInfos(_ context.Context) ([]models.EventInfo, error) {
+	args := m.Called()
+	infos, _ := args.Get(0).([]models.EventInfo)
+	return infos, args.Error(1)
+}
+func (m *MockDAO) GetBorderInfos(_ context.Context, key dao.BorderGroupKey) ([]models.BorderInfo, error) {
+	args := m.Called(key)
+	infos, _ := args.Get(0).([]models.BorderInfo)
+	return infos, args.Error(1)
+}
+func (m *MockDAO) ListBorderGroups(_ context.Context, eventId int) ([]dao.BorderGroupKey, error) {
+	args := m.Called(eventId)
+	keys, _ := args.Get(0).([]dao.BorderGroupKey)
+	return keys, args.Error(1)
+}
+func (m *MockDAO) GetBorderHighWaterMarks(_ context.Context) (map[dao.BorderGroupKey]time.Time, error) {
+	args := m.Called()
+	marks, _ := args.Get(0).(map[dao.BorderGroupKey]time.Time)
+	return marks, args.Error(1)
+}
+
+func (m *MockDAO) SaveRunManifest(_ context.Context, manifest dao.RunManifest) error {
+	args := m.Called(manifest)
+	return args.Error(0)
+}
+func (m *MockDAO) GetRunManifestIndex(_ context.Context) ([]dao.RunManifestIndexEntry, error) {
+	args := m.Called()
+	index, _ := args.Get(0).([]dao.RunManifestIndexEntry)
+	return index, args.Error(1)
+}
+func (m *MockDAO) GetRunManifest(_ context.Context, runId string) (dao.RunManifest, error) {
+	args := m.Called(runId)
+	manifest, _ := args.Get(0).(dao.RunManifest)
+	return manifest, args.Error(1)
+}
+
+func (m *MockDAO) SaveBorderPredictions(_ context.Context, eventId int, predictions []models.BorderPrediction) error {
+	args := m.Called(eventId, predictions)
+	return args.Error(0)
+}
+func (m *MockDAO) GetBorderPredictions(_ context.Context, eventId int) ([]models.BorderPrediction, error) {
+	args := m.Called(eventId)
+	predictions, _ := args.Get(0).([]models.BorderPrediction)
+	return predictions, args.Error(1)
+}
+func (m *MockDAO) AcquireLock(_ context.Context, name, owner string, ttl time.Duration) (dao.Lease, error) {
+	args := m.Called(name, owner, ttl)
+	lease, _ := args.Get(0).(dao.Lease)
+	return lease, args.Error(1)
+}
+func (m *MockDAO) ReleaseLock(_ context.Context, name, owner string) error {
+	args := m.Called(name, owner)
+	return args.Error(0)
+}
 
 type MockMatsuriClient struct {
 	mock.Mock
 }
 
-func (m *MockMatsuriClient) GetEvents(options *models.EventsOptions) ([]models.Event, error) {
+func (m *MockMatsuriClient) GetEvents(_ context.Context, options *models.EventsOptions) ([]models.Event, error) {
 	args := m.Called(options)
 	return args.Get(0).([]models.Event), args.Error(1)
 }
-func (m *MockMatsuriClient) GetEvent(eventId int) (models.Event, error) {
+func (m *MockMatsuriClient) GetEvent(_ context.Context, eventId int) (models.Event, error) {
 	args := m.Called(eventId)
 	return args.Get(0).(models.Event), args.Error(1)
 }
-func (m *MockMatsuriClient) GetEventRankingBorders(eventId int) (models.EventRankingBorders, error) {
+func (m *MockMatsuriClient) GetEventRankingBorders(_ context.Context, eventId int) (models.EventRankingBorders, error) {
 	args := m.Called(eventId)
 	return args.Get(0).(models.EventRankingBorders), args.Error(1)
 }
-func (m *MockMatsuriClient) GetEventRankingLogs(eventId int, eventType models.EventRankingType, rankingBorder int, options *models.EventRankingLogsOptions) ([]models.EventRankingLog, error) {
+func (m *MockMatsuriClient) GetEventRankingLogs(_ context.Context, eventId int, eventType models.EventRankingType, rankingBorder int, options *models.EventRankingLogsOptions) (models.EventRankingLogsResult, error) {
 	args := m.Called(eventId, eventType, rankingBorder, options)
-	return args.Get(0).([]models.EventRankingLog), args.Error(1)
+	return args.Get(0).(models.EventRankingLogsResult), args.Error(1)
 }
 
-func (m *MockMatsuriClient) GetEventIdolRankingLogs(eventId int, rankingBorder int, options *models.EventRankingLogsOptions) (map[int][]models.EventRankingLog, error) {
+func (m *MockMatsuriClient) GetEventIdolRankingLogs(_ context.Context, eventId int, rankingBorder int, options *models.EventRankingLogsOptions) (map[int]models.EventRankingLogsResult, error) {
 	args := m.Called(eventId, rankingBorder, options)
-	return args.Get(0).(map[int][]models.EventRankingLog), args.Error(1)
+	return args.Get(0).(map[int]models.EventRankingLogsResult), args.Error(1)
+}
+func (m *MockMatsuriClient) LoadETags(etags map[string]string) {
+	m.Called(etags)
+}
+func (m *MockMatsuriClient) ETags() map[string]string {
+	args := m.Called()
+	etags, _ := args.Get(0).(map[string]string)
+	return etags
+}
+func (m *MockMatsuriClient) ForgetRankingLogsETags(eventId int, rankingType models.EventRankingType, idolId int, rankingBorder int) {
+	m.Called(eventId, rankingType, idolId, rankingBorder)
 }
 
 // --- Tests ---
@@ -81,15 +159,22 @@ func TestRunSync_HappyPath(t *testing.T) {
 	mockDao.On("GetLatestEventInfo").Return(latest, nil).Once()
 	mockClient.On("GetEvents", mock.Anything).Return(events, nil).Once()
 	mockClient.On("GetEventRankingBorders", 2).Return(models.EventRankingBorders{EventPoint: []int{100, 2500}}, nil).Once()
-	mockClient.On("GetEventRankingLogs", 1, models.EventPoint, 100, (*models.EventRankingLogsOptions)(nil)).Return([]models.EventRankingLog{}, nil)
-	mockClient.On("GetEventRankingLogs", 1, models.EventPoint, 2500, (*models.EventRankingLogsOptions)(nil)).Return([]models.EventRankingLog{}, nil)
-	mockClient.On("GetEventRankingLogs", 2, models.EventPoint, 100, (*models.EventRankingLogsOptions)(nil)).Return([]models.EventRankingLog{}, nil)
-	mockClient.On("GetEventRankingLogs", 2, models.EventPoint, 2500, (*models.EventRankingLogsOptions)(nil)).Return([]models.EventRankingLog{}, nil)
+	mockClient.On("GetEventRankingLogs", 2, models.EventPoint, 100, (*models.EventRankingLogsOptions)(nil)).Return(models.EventRankingLogsResult{}, nil)
+	mockClient.On("GetEventRankingLogs", 2, models.EventPoint, 2500, (*models.EventRankingLogsOptions)(nil)).Return(models.EventRankingLogsResult{}, nil)
 	mockDao.On("SaveEventInfos", mock.Anything).Return(nil).Once()
+	mockDao.On("GetBorderHighWaterMarks").Return(map[dao.BorderGroupKey]time.Time{}, nil).Once()
+	mockDao.On("GetETags").Return(map[string]string{}, nil).Once()
+	mockClient.On("LoadETags", map[string]string{}).Once()
 	mockDao.On("SaveBorderInfos", mock.Anything).Return(nil).Once()
+	mockClient.On("ETags").Return(map[string]string{}).Once()
+	mockDao.On("SaveETags", map[string]string{}).Return(nil).Once()
+	mockDao.On("SaveRunManifest", mock.MatchedBy(func(manifest dao.RunManifest) bool {
+		return manifest.RunId != "" && !manifest.EndedAt.Before(manifest.StartedAt) &&
+			assert.ObjectsAreEqual([]int{2}, manifest.EventIds) && manifest.FailedBorderGroups == 0
+	})).Return(nil).Once()
 	mockDao.On("SaveLatestEventInfo", mock.Anything).Return(nil).Once()
 
-	err := RunSync(mockClient, mockDao)
+	err := RunSync(context.Background(), mockClient, mockDao, config.Default().Sync)
 	assert.NoError(t, err)
 	mockDao.AssertExpectations(t)
 	mockClient.AssertExpectations(t)
@@ -100,7 +185,7 @@ func TestRunSync_GetLatestEventInfoError(t *testing.T) {
 	mockDao.On("GetLatestEventInfo").Return(models.EventInfo{}, errors.New("fail")).Once()
 	mockClient := new(MockMatsuriClient)
 
-	err := RunSync(mockClient, mockDao)
+	err := RunSync(context.Background(), mockClient, mockDao, config.Default().Sync)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "get latest event info")
 }
@@ -111,7 +196,7 @@ func TestRunSync_GetEventsError(t *testing.T) {
 	mockClient := new(MockMatsuriClient)
 	mockClient.On("GetEvents", mock.Anything).Return([]models.Event{}, errors.New("fail")).Once()
 
-	err := RunSync(mockClient, mockDao)
+	err := RunSync(context.Background(), mockClient, mockDao, config.Default().Sync)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "get events")
 }
@@ -122,21 +207,12 @@ func TestRunSync_NoNewEvents(t *testing.T) {
 	mockClient := new(MockMatsuriClient)
 	mockClient.On("GetEvents", mock.Anything).Return([]models.Event{}, nil).Once()
 
-	// Border info should still be collected for latest event id (1)
-	mockClient.On("GetEventRankingLogs", 1, models.EventPoint, 100, (*models.EventRankingLogsOptions)(nil)).Return([]models.EventRankingLog{}, nil).Once()
-	mockClient.On("GetEventRankingLogs", 1, models.EventPoint, 2500, (*models.EventRankingLogsOptions)(nil)).Return([]models.EventRankingLog{}, nil).Once()
-
-	// SaveBorderInfos and SaveLatestEventInfo should be called
-	mockDao.On("SaveBorderInfos", mock.Anything).Return(nil).Once()
-	mockDao.On("SaveLatestEventInfo", mock.Anything).Return(nil).Once()
-
-	// SaveEventInfos should NOT be called, but if you want to enforce this:
-	// mockDao.AssertNotCalled(t, "SaveEventInfos", mock.Anything)
-
-	err := RunSync(mockClient, mockDao)
-	assert.NoError(t, err)
+	err := RunSync(context.Background(), mockClient, mockDao, config.Default().Sync)
+	assert.ErrorIs(t, err, ErrNoSupportedEvents)
 	mockDao.AssertExpectations(t)
 	mockClient.AssertExpectations(t)
+	mockDao.AssertNotCalled(t, "SaveEventInfos", mock.Anything)
+	mockDao.AssertNotCalled(t, "SaveLatestEventInfo", mock.Anything)
 }
 
 func TestRunSync_SaveEventInfosError(t *testing.T) {
@@ -158,7 +234,7 @@ func TestRunSync_SaveEventInfosError(t *testing.T) {
 	mockClient.On("GetEventRankingBorders", 2).Return(models.EventRankingBorders{EventPoint: []int{100, 2500}}, nil).Once()
 	mockDao.On("SaveEventInfos", mock.Anything).Return(errors.New("fail")).Once()
 
-	err := RunSync(mockClient, mockDao)
+	err := RunSync(context.Background(), mockClient, mockDao, config.Default().Sync)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "save event infos")
 }
@@ -181,15 +257,18 @@ func TestRunSync_SaveBorderInfosError(t *testing.T) {
 	}, nil).Once()
 	mockClient.On("GetEventRankingBorders", 2).Return(models.EventRankingBorders{EventPoint: []int{100, 2500}}, nil).Once()
 	// Add these lines:
-	mockClient.On("GetEventRankingLogs", 1, models.EventPoint, 100, (*models.EventRankingLogsOptions)(nil)).Return([]models.EventRankingLog{}, nil)
-	mockClient.On("GetEventRankingLogs", 1, models.EventPoint, 2500, (*models.EventRankingLogsOptions)(nil)).Return([]models.EventRankingLog{}, nil)
-	mockClient.On("GetEventRankingLogs", 2, models.EventPoint, 100, (*models.EventRankingLogsOptions)(nil)).Return([]models.EventRankingLog{}, nil)
-	mockClient.On("GetEventRankingLogs", 2, models.EventPoint, 2500, (*models.EventRankingLogsOptions)(nil)).Return([]models.EventRankingLog{}, nil)
+	mockClient.On("GetEventRankingLogs", 1, models.EventPoint, 100, (*models.EventRankingLogsOptions)(nil)).Return(models.EventRankingLogsResult{}, nil)
+	mockClient.On("GetEventRankingLogs", 1, models.EventPoint, 2500, (*models.EventRankingLogsOptions)(nil)).Return(models.EventRankingLogsResult{}, nil)
+	mockClient.On("GetEventRankingLogs", 2, models.EventPoint, 100, (*models.EventRankingLogsOptions)(nil)).Return(models.EventRankingLogsResult{}, nil)
+	mockClient.On("GetEventRankingLogs", 2, models.EventPoint, 2500, (*models.EventRankingLogsOptions)(nil)).Return(models.EventRankingLogsResult{}, nil)
 	// End added lines
 	mockDao.On("SaveEventInfos", mock.Anything).Return(nil).Once()
+	mockDao.On("GetBorderHighWaterMarks").Return(map[dao.BorderGroupKey]time.Time{}, nil).Once()
+	mockDao.On("GetETags").Return(map[string]string{}, nil).Once()
+	mockClient.On("LoadETags", map[string]string{}).Once()
 	mockDao.On("SaveBorderInfos", mock.Anything).Return(errors.New("fail")).Once()
 
-	err := RunSync(mockClient, mockDao)
+	err := RunSync(context.Background(), mockClient, mockDao, config.Default().Sync)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "save border infos")
 }
@@ -212,16 +291,22 @@ func TestRunSync_SaveLatestEventInfoError(t *testing.T) {
 	}, nil).Once()
 	mockClient.On("GetEventRankingBorders", 2).Return(models.EventRankingBorders{EventPoint: []int{100, 2500}}, nil).Once()
 	// Add these lines:
-	mockClient.On("GetEventRankingLogs", 1, models.EventPoint, 100, (*models.EventRankingLogsOptions)(nil)).Return([]models.EventRankingLog{}, nil)
-	mockClient.On("GetEventRankingLogs", 1, models.EventPoint, 2500, (*models.EventRankingLogsOptions)(nil)).Return([]models.EventRankingLog{}, nil)
-	mockClient.On("GetEventRankingLogs", 2, models.EventPoint, 100, (*models.EventRankingLogsOptions)(nil)).Return([]models.EventRankingLog{}, nil)
-	mockClient.On("GetEventRankingLogs", 2, models.EventPoint, 2500, (*models.EventRankingLogsOptions)(nil)).Return([]models.EventRankingLog{}, nil)
+	mockClient.On("GetEventRankingLogs", 1, models.EventPoint, 100, (*models.EventRankingLogsOptions)(nil)).Return(models.EventRankingLogsResult{}, nil)
+	mockClient.On("GetEventRankingLogs", 1, models.EventPoint, 2500, (*models.EventRankingLogsOptions)(nil)).Return(models.EventRankingLogsResult{}, nil)
+	mockClient.On("GetEventRankingLogs", 2, models.EventPoint, 100, (*models.EventRankingLogsOptions)(nil)).Return(models.EventRankingLogsResult{}, nil)
+	mockClient.On("GetEventRankingLogs", 2, models.EventPoint, 2500, (*models.EventRankingLogsOptions)(nil)).Return(models.EventRankingLogsResult{}, nil)
 	// End added lines
 	mockDao.On("SaveEventInfos", mock.Anything).Return(nil).Once()
+	mockDao.On("GetBorderHighWaterMarks").Return(map[dao.BorderGroupKey]time.Time{}, nil).Once()
+	mockDao.On("GetETags").Return(map[string]string{}, nil).Once()
+	mockClient.On("LoadETags", map[string]string{}).Once()
 	mockDao.On("SaveBorderInfos", mock.Anything).Return(nil).Once()
+	mockClient.On("ETags").Return(map[string]string{}).Once()
+	mockDao.On("SaveETags", map[string]string{}).Return(nil).Once()
+	mockDao.On("SaveRunManifest", mock.Anything).Return(nil).Once()
 	mockDao.On("SaveLatestEventInfo", mock.Anything).Return(errors.New("fail")).Once()
 
-	err := RunSync(mockClient, mockDao)
+	err := RunSync(context.Background(), mockClient, mockDao, config.Default().Sync)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "save latest event info")
 }
@@ -236,7 +321,7 @@ func TestCollectEventInfos_SkipOldAndAnniversary(t *testing.T) {
 	}
 	mockClient.On("GetEventRankingBorders", 1).Return(models.EventRankingBorders{}, errors.New("fail")).Once()
 	mockClient.On("GetEventRankingBorders", 2).Return(models.EventRankingBorders{}, errors.New("fail")).Once()
-	infos := collectEventInfos(mockClient, events)
+	infos, _, _ := collectEventInfos(context.Background(), mockClient, events, config.Default().Sync)
 	assert.Len(t, infos, 0)
 }
 
@@ -246,26 +331,115 @@ func TestCollectEventInfos_HandlesGetEventRankingBordersError(t *testing.T) {
 		{Id: 2, Type: int(models.Theater), Name: "Theater"},
 	}
 	mockClient.On("GetEventRankingBorders", 2).Return(models.EventRankingBorders{}, errors.New("fail")).Once()
-	infos := collectEventInfos(mockClient, events)
+	infos, _, _ := collectEventInfos(context.Background(), mockClient, events, config.Default().Sync)
 	assert.Len(t, infos, 0)
 }
 
 func TestCollectBorderInfos_HandlesGetEventRankingLogsError(t *testing.T) {
 	mockClient := new(MockMatsuriClient)
-	mockClient.On("GetEventRankingLogs", 1, models.EventPoint, 100, (*models.EventRankingLogsOptions)(nil)).Return([]models.EventRankingLog{}, errors.New("fail")).Once()
-	mockClient.On("GetEventRankingLogs", 1, models.EventPoint, 2500, (*models.EventRankingLogsOptions)(nil)).Return([]models.EventRankingLog{}, nil).Once()
-	infos := collectBorderInfos(mockClient, map[int]struct{}{1: struct{}{}}, map[int]models.EventInfo{1: models.EventInfo{EventId: 1}})
+	mockClient.On("GetEventRankingLogs", 1, models.EventPoint, 100, (*models.EventRankingLogsOptions)(nil)).Return(models.EventRankingLogsResult{}, errors.New("fail")).Once()
+	mockClient.On("GetEventRankingLogs", 1, models.EventPoint, 2500, (*models.EventRankingLogsOptions)(nil)).Return(models.EventRankingLogsResult{}, nil).Once()
+	infos, _, err := collectBorderInfos(context.Background(), mockClient, map[int]struct{}{1: struct{}{}}, map[int][]models.EventRankingType{1: {models.EventPoint}}, map[dao.BorderGroupKey]time.Time{}, config.Default().Sync)
+	assert.NoError(t, err)
 	assert.Len(t, infos, 0)
 }
 
+func TestCollectNormalBorders_UsesHighWaterMarks(t *testing.T) {
+	mockClient := new(MockMatsuriClient)
+	since := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	highWaterMarks := map[dao.BorderGroupKey]time.Time{
+		{EventId: 1, RankingType: models.EventPoint, Border: 100}: since,
+	}
+	mockClient.On("GetEventRankingLogs", 1, models.EventPoint, 100, &models.EventRankingLogsOptions{Since: since}).Return(models.EventRankingLogsResult{}, nil).Once()
+	mockClient.On("GetEventRankingLogs", 1, models.EventPoint, 2500, (*models.EventRankingLogsOptions)(nil)).Return(models.EventRankingLogsResult{}, nil).Once()
+
+	infos, _ := collectNormalBorders(context.Background(), mockClient, 1, models.EventPoint, highWaterMarks, []int{100, 2500})
+	assert.Len(t, infos, 0)
+	mockClient.AssertExpectations(t)
+}
+
+func TestCollectNormalBorders_SkipsNotModified(t *testing.T) {
+	mockClient := new(MockMatsuriClient)
+	mockClient.On("GetEventRankingLogs", 1, models.EventPoint, 100, (*models.EventRankingLogsOptions)(nil)).Return(models.EventRankingLogsResult{NotModified: true, ETag: "etag"}, nil).Once()
+	mockClient.On("GetEventRankingLogs", 1, models.EventPoint, 2500, (*models.EventRankingLogsOptions)(nil)).Return(models.EventRankingLogsResult{}, nil).Once()
+
+	infos, _ := collectNormalBorders(context.Background(), mockClient, 1, models.EventPoint, map[dao.BorderGroupKey]time.Time{}, []int{100, 2500})
+	assert.Len(t, infos, 0)
+	mockClient.AssertExpectations(t)
+}
+
+func TestAnniversarySince(t *testing.T) {
+	earliest := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	highWaterMarks := make(map[dao.BorderGroupKey]time.Time)
+	for idolId := 1; idolId <= 52; idolId++ {
+		highWaterMarks[dao.BorderGroupKey{EventId: 10, RankingType: models.IdolPoint, IdolId: idolId, Border: 100}] = earliest.Add(time.Duration(idolId) * time.Minute)
+	}
+	highWaterMarks[dao.BorderGroupKey{EventId: 10, RankingType: models.IdolPoint, IdolId: 30, Border: 100}] = earliest
+	assert.Equal(t, earliest, anniversarySince(highWaterMarks, 10, 100))
+
+	delete(highWaterMarks, dao.BorderGroupKey{EventId: 10, RankingType: models.IdolPoint, IdolId: 52, Border: 100})
+	assert.True(t, anniversarySince(highWaterMarks, 10, 100).IsZero())
+}
+
+func TestCollectEventInfos_SupportedRankingTypes(t *testing.T) {
+	mockClient := new(MockMatsuriClient)
+	events := []models.Event{
+		{Id: 2, Type: int(models.Tune), Name: "Tune"},
+		{Id: 3, Type: int(models.Theater), Name: "Theater"},
+	}
+	mockClient.On("GetEventRankingBorders", 2).Return(models.EventRankingBorders{
+		EventPoint:  []int{100, 2500},
+		HighScore:   []int{100, 2000},
+		LoungePoint: []int{10},
+	}, nil).Once()
+	mockClient.On("GetEventRankingBorders", 3).Return(models.EventRankingBorders{
+		HighScore: []int{100, 2000},
+	}, nil).Once()
+
+	infos, rankingTypes, err := collectEventInfos(context.Background(), mockClient, events, config.Default().Sync)
+	assert.NoError(t, err)
+	assert.Len(t, infos, 1)
+	assert.Equal(t, 2, infos[0].EventId)
+	assert.Equal(t, []models.EventRankingType{models.EventPoint, models.HighScore}, rankingTypes[2])
+	assert.NotContains(t, rankingTypes, 3)
+}
+
+func TestCollectBorderInfos_PerRankingType(t *testing.T) {
+	mockClient := new(MockMatsuriClient)
+	now := time.Now()
+	logs := models.EventRankingLogsResult{Logs: []models.EventRankingLog{
+		{
+			Rank: 100,
+			Data: []struct {
+				Score        int       `json:"score"`
+				AggregatedAt time.Time `json:"aggregatedAt"`
+			}{
+				{Score: 1, AggregatedAt: now},
+			},
+		},
+	}}
+	mockClient.On("GetEventRankingLogs", 1, models.EventPoint, 100, (*models.EventRankingLogsOptions)(nil)).Return(logs, nil).Once()
+	mockClient.On("GetEventRankingLogs", 1, models.EventPoint, 2500, (*models.EventRankingLogsOptions)(nil)).Return(models.EventRankingLogsResult{}, nil).Once()
+	mockClient.On("GetEventRankingLogs", 1, models.LoungePoint, 10, (*models.EventRankingLogsOptions)(nil)).Return(models.EventRankingLogsResult{}, nil).Once()
+	mockClient.On("GetEventRankingLogs", 1, models.LoungePoint, 100, (*models.EventRankingLogsOptions)(nil)).Return(logs, nil).Once()
+
+	infos, _, err := collectBorderInfos(context.Background(), mockClient, map[int]struct{}{1: {}},
+		map[int][]models.EventRankingType{1: {models.EventPoint, models.LoungePoint}}, map[dao.BorderGroupKey]time.Time{}, config.Default().Sync)
+	assert.NoError(t, err)
+	assert.Len(t, infos, 2)
+	rankingTypes := []models.EventRankingType{infos[0].RankingType, infos[1].RankingType}
+	assert.ElementsMatch(t, []models.EventRankingType{models.EventPoint, models.LoungePoint}, rankingTypes)
+	mockClient.AssertExpectations(t)
+}
+
 func TestCollectAnniversaryBorders_Success(t *testing.T) {
 	mockClient := new(MockMatsuriClient)
 	eventId := 10
 	border := 100
 	now := time.Now()
 	mockClient.On("GetEventIdolRankingLogs", eventId, border, (*models.EventRankingLogsOptions)(nil)).
-		Return(map[int][]models.EventRankingLog{
-			1: {
+		Return(map[int]models.EventRankingLogsResult{
+			1: {Logs: []models.EventRankingLog{
 				{
 					Rank: 100,
 					Data: []struct {
@@ -275,13 +449,14 @@ func TestCollectAnniversaryBorders_Success(t *testing.T) {
 						{Score: 123, AggregatedAt: now},
 					},
 				},
-			},
+			}},
+			2: {NotModified: true},
 		}, nil).Once()
 	// For the second border (1000), return empty
 	mockClient.On("GetEventIdolRankingLogs", eventId, 1000, (*models.EventRankingLogsOptions)(nil)).
-		Return(map[int][]models.EventRankingLog{}, nil).Once()
+		Return(map[int]models.EventRankingLogsResult{}, nil).Once()
 
-	infos := collectAnniversaryBorders(mockClient, eventId)
+	infos, _ := collectAnniversaryBorders(context.Background(), mockClient, eventId, map[dao.BorderGroupKey]time.Time{}, []int{100, 1000})
 	assert.Len(t, infos, 1)
 	assert.Equal(t, eventId, infos[0].EventId)
 	assert.Equal(t, border, infos[0].Border)
@@ -295,14 +470,40 @@ func TestCollectAnniversaryBorders_Error(t *testing.T) {
 	eventId := 10
 	// Simulate error for both borders
 	mockClient.On("GetEventIdolRankingLogs", eventId, 100, (*models.EventRankingLogsOptions)(nil)).
-		Return(map[int][]models.EventRankingLog{}, errors.New("fail")).Once()
+		Return(map[int]models.EventRankingLogsResult{}, errors.New("fail")).Once()
 	mockClient.On("GetEventIdolRankingLogs", eventId, 1000, (*models.EventRankingLogsOptions)(nil)).
-		Return(map[int][]models.EventRankingLog{}, errors.New("fail")).Once()
+		Return(map[int]models.EventRankingLogsResult{}, errors.New("fail")).Once()
 
-	infos := collectAnniversaryBorders(mockClient, eventId)
+	infos, _ := collectAnniversaryBorders(context.Background(), mockClient, eventId, map[dao.BorderGroupKey]time.Time{}, []int{100, 1000})
 	assert.Len(t, infos, 0)
 }
 
+func TestCollectAnniversaryBorders_PartialFailure(t *testing.T) {
+	mockClient := new(MockMatsuriClient)
+	eventId := 10
+	now := time.Now()
+	mockClient.On("GetEventIdolRankingLogs", eventId, 100, (*models.EventRankingLogsOptions)(nil)).
+		Return(map[int]models.EventRankingLogsResult{
+			1: {Logs: []models.EventRankingLog{
+				{
+					Rank: 100,
+					Data: []struct {
+						Score        int       `json:"score"`
+						AggregatedAt time.Time `json:"aggregatedAt"`
+					}{
+						{Score: 123, AggregatedAt: now},
+					},
+				},
+			}},
+		}, &matsuri.IdolRankingLogsError{EventId: eventId, RankingBorder: 100, Errors: map[int]error{2: errors.New("fail")}}).Once()
+	mockClient.On("GetEventIdolRankingLogs", eventId, 1000, (*models.EventRankingLogsOptions)(nil)).
+		Return(map[int]models.EventRankingLogsResult{}, nil).Once()
+
+	infos, _ := collectAnniversaryBorders(context.Background(), mockClient, eventId, map[dao.BorderGroupKey]time.Time{}, []int{100, 1000})
+	assert.Len(t, infos, 1)
+	assert.Equal(t, 1, infos[0].IdolId)
+}
+
 func TestIsSupportedAnniversaryEvent_True(t *testing.T) {
 	event := models.Event{
 		Id:   1,
@@ -318,7 +519,7 @@ func TestIsSupportedAnniversaryEvent_True(t *testing.T) {
 			Borders: []int{100, 1000},
 		}
 	}
-	assert.True(t, isSupportedAnniversaryEvent(event, borders, []int{100, 1000}))
+	assert.True(t, isSupportedAnniversaryEvent(context.Background(), event, borders, []int{100, 1000}))
 }
 
 func TestIsSupportedAnniversaryEvent_WrongType(t *testing.T) {
@@ -327,7 +528,7 @@ func TestIsSupportedAnniversaryEvent_WrongType(t *testing.T) {
 		Type: int(models.Theater),
 	}
 	borders := models.EventRankingBorders{}
-	assert.False(t, isSupportedAnniversaryEvent(event, borders, []int{100, 1000}))
+	assert.False(t, isSupportedAnniversaryEvent(context.Background(), event, borders, []int{100, 1000}))
 }
 
 func TestIsSupportedAnniversaryEvent_WrongIdolCount(t *testing.T) {
@@ -338,7 +539,7 @@ func TestIsSupportedAnniversaryEvent_WrongIdolCount(t *testing.T) {
 	borders := models.EventRankingBorders{
 		IdolPoint: make([]models.IdolPointBorders, 51), // not 52
 	}
-	result := isSupportedAnniversaryEvent(event, borders, []int{100, 1000})
+	result := isSupportedAnniversaryEvent(context.Background(), event, borders, []int{100, 1000})
 	assert.False(t, result)
 }
 
@@ -362,6 +563,148 @@ func TestIsSupportedAnniversaryEvent_WrongSupportedCount(t *testing.T) {
 		IdolId:  52,
 		Borders: []int{100},
 	}
-	result := isSupportedAnniversaryEvent(event, borders, []int{100, 1000})
+	result := isSupportedAnniversaryEvent(context.Background(), event, borders, []int{100, 1000})
 	assert.False(t, result)
 }
+
+func TestCollectBorderInfos_Cancelled(t *testing.T) {
+	mockClient := new(MockMatsuriClient)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	infos, _, err := collectBorderInfos(ctx, mockClient, map[int]struct{}{1: {}},
+		map[int][]models.EventRankingType{1: {models.EventPoint}}, map[dao.BorderGroupKey]time.Time{}, config.Default().Sync)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, infos)
+	mockClient.AssertNotCalled(t, "GetEventRankingLogs", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestWithSyncTimeout(t *testing.T) {
+	cfg := config.Default().Sync
+	ctx, cancel := withSyncTimeout(context.Background(), cfg)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(cfg.Timeout), deadline, time.Second)
+
+	cfg.Timeout = 0
+	ctx, cancel = withSyncTimeout(context.Background(), cfg)
+	defer cancel()
+	_, ok = ctx.Deadline()
+	assert.False(t, ok)
+}
+
+func TestRunSync_KeepsLatestEventOnFailedBorderGroup(t *testing.T) {
+	mockDao := new(MockDAO)
+	mockClient := new(MockMatsuriClient)
+
+	events := []models.Event{{Id: 2, Type: int(models.Theater), Name: "Event2"}}
+	mockDao.On("GetLatestEventInfo").Return(models.EventInfo{EventId: 1}, nil).Once()
+	mockClient.On("GetEvents", mock.Anything).Return(events, nil).Once()
+	mockClient.On("GetEventRankingBorders", 2).Return(models.EventRankingBorders{EventPoint: []int{100, 2500}}, nil).Once()
+	mockClient.On("GetEventRankingLogs", 2, models.EventPoint, 100, (*models.EventRankingLogsOptions)(nil)).Return(models.EventRankingLogsResult{}, nil)
+	mockClient.On("GetEventRankingLogs", 2, models.EventPoint, 2500, (*models.EventRankingLogsOptions)(nil)).Return(models.EventRankingLogsResult{}, errors.New("fail"))
+	mockDao.On("SaveEventInfos", mock.Anything).Return(nil).Once()
+	mockDao.On("GetBorderHighWaterMarks").Return(map[dao.BorderGroupKey]time.Time{}, nil).Once()
+	mockDao.On("GetETags").Return(map[string]string{}, nil).Once()
+	mockClient.On("LoadETags", map[string]string{}).Once()
+	mockDao.On("SaveBorderInfos", mock.Anything).Return(nil).Once()
+	mockClient.On("ETags").Return(map[string]string{}).Once()
+	mockDao.On("SaveETags", map[string]string{}).Return(nil).Once()
+	mockDao.On("SaveRunManifest", mock.MatchedBy(func(manifest dao.RunManifest) bool {
+		return manifest.FailedBorderGroups == 1
+	})).Return(nil).Once()
+
+	err := RunSync(context.Background(), mockClient, mockDao, config.Default().Sync)
+	assert.NoError(t, err)
+	mockDao.AssertExpectations(t)
+	mockDao.AssertNotCalled(t, "SaveLatestEventInfo", mock.Anything)
+}
+
+func TestRunSync_SaveBorderInfosErrorKeepsLatestEvent(t *testing.T) {
+	mockDao := new(MockDAO)
+	mockClient := new(MockMatsuriClient)
+
+	events := []models.Event{{Id: 2, Type: int(models.Theater), Name: "Event2"}}
+	mockDao.On("GetLatestEventInfo").Return(models.EventInfo{EventId: 1}, nil).Once()
+	mockClient.On("GetEvents", mock.Anything).Return(events, nil).Once()
+	mockClient.On("GetEventRankingBorders", 2).Return(models.EventRankingBorders{EventPoint: []int{100, 2500}}, nil).Once()
+	mockClient.On("GetEventRankingLogs", 2, models.EventPoint, mock.Anything, (*models.EventRankingLogsOptions)(nil)).Return(models.EventRankingLogsResult{}, nil)
+	mockDao.On("SaveEventInfos", mock.Anything).Return(nil).Once()
+	mockDao.On("GetBorderHighWaterMarks").Return(map[dao.BorderGroupKey]time.Time{}, nil).Once()
+	mockDao.On("GetETags").Return(map[string]string{}, nil).Once()
+	mockClient.On("LoadETags", map[string]string{}).Once()
+	mockDao.On("SaveBorderInfos", mock.Anything).Return(errors.New("disk full")).Once()
+
+	err := RunSync(context.Background(), mockClient, mockDao, config.Default().Sync)
+	assert.ErrorContains(t, err, "save border infos")
+	mockDao.AssertNotCalled(t, "SaveETags", mock.Anything)
+	mockDao.AssertNotCalled(t, "SaveLatestEventInfo", mock.Anything)
+}
+
+func TestRunSync_SaveRunManifestErrorKeepsLatestEvent(t *testing.T) {
+	mockDao := new(MockDAO)
+	mockClient := new(MockMatsuriClient)
+
+	events := []models.Event{{Id: 2, Type: int(models.Theater), Name: "Event2"}}
+	mockDao.On("GetLatestEventInfo").Return(models.EventInfo{EventId: 1}, nil).Once()
+	mockClient.On("GetEvents", mock.Anything).Return(events, nil).Once()
+	mockClient.On("GetEventRankingBorders", 2).Return(models.EventRankingBorders{EventPoint: []int{100, 2500}}, nil).Once()
+	mockClient.On("GetEventRankingLogs", 2, models.EventPoint, mock.Anything, (*models.EventRankingLogsOptions)(nil)).Return(models.EventRankingLogsResult{}, nil)
+	mockDao.On("SaveEventInfos", mock.Anything).Return(nil).Once()
+	mockDao.On("GetBorderHighWaterMarks").Return(map[dao.BorderGroupKey]time.Time{}, nil).Once()
+	mockDao.On("GetETags").Return(map[string]string{}, nil).Once()
+	mockClient.On("LoadETags", map[string]string{}).Once()
+	mockDao.On("SaveBorderInfos", mock.Anything).Return(nil).Once()
+	mockClient.On("ETags").Return(map[string]string{}).Once()
+	mockDao.On("SaveETags", map[string]string{}).Return(nil).Once()
+	mockDao.On("SaveRunManifest", mock.Anything).Return(errors.New("fail")).Once()
+
+	err := RunSync(context.Background(), mockClient, mockDao, config.Default().Sync)
+	assert.ErrorContains(t, err, "save run manifest")
+	mockDao.AssertNotCalled(t, "SaveLatestEventInfo", mock.Anything)
+}
+
+func TestNewRunManifest(t *testing.T) {
+	startedAt := time.Date(2025, 6, 1, 9, 30, 0, 0, time.FixedZone("JST", 9*60*60))
+	manifest := newRunManifest(newRunId(startedAt), startedAt, map[int]models.EventInfo{3: {}, 1: {}, 2: {}})
+	assert.Regexp(t, `^20250601T003000Z-[0-9a-f]{8}$`, manifest.RunId)
+	assert.Equal(t, []int{1, 2, 3}, manifest.EventIds)
+	assert.Equal(t, time.UTC, manifest.StartedAt.Location())
+	assert.NotEqual(t, manifest.RunId, newRunManifest(newRunId(startedAt), startedAt, nil).RunId)
+}
+
+func TestValidateBorderInfos(t *testing.T) {
+	start := time.Date(2025, 6, 1, 6, 0, 0, 0, time.UTC)
+	events := map[int]models.EventInfo{1: {EventId: 1, StartAt: start, EndAt: start.Add(24 * time.Hour)}}
+	infos := []models.BorderInfo{
+		{EventId: 1, RankingType: models.EventPoint, Border: 100, AggregatedAt: start.Add(time.Hour), Score: -5},
+		{EventId: 1, RankingType: models.EventPoint, Border: 2500, AggregatedAt: start.Add(time.Hour), Score: 5},
+	}
+	cfg := config.Default().Sync.Validation
+
+	kept, quarantined, report := validateBorderInfos(context.Background(), infos, events, cfg)
+	assert.Equal(t, infos, kept)
+	assert.Empty(t, quarantined)
+	assert.Len(t, report.Issues, 1)
+	assert.Zero(t, report.QuarantinedBorderGroups)
+
+	cfg.Quarantine = true
+	kept, quarantined, report = validateBorderInfos(context.Background(), infos, events, cfg)
+	assert.Equal(t, infos[1:], kept)
+	assert.Equal(t, infos[:1], quarantined)
+	assert.Equal(t, 1, report.QuarantinedBorderGroups)
+}
+
+func TestForgetRankingLogsETags(t *testing.T) {
+	mockClient := new(MockMatsuriClient)
+	mockClient.On("ForgetRankingLogsETags", 1, models.EventPoint, 0, 100).Once()
+	mockClient.On("ForgetRankingLogsETags", 1, models.IdolPoint, 7, 100).Once()
+
+	forgetRankingLogsETags(mockClient, []models.BorderInfo{
+		{EventId: 1, RankingType: models.EventPoint, Border: 100, Score: -5},
+		{EventId: 1, RankingType: models.EventPoint, Border: 100, Score: -4},
+		{EventId: 1, RankingType: models.IdolPoint, IdolId: 7, Border: 100, Score: -3},
+	})
+	mockClient.AssertExpectations(t)
+}
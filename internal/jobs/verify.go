@@ -0,0 +1,81 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/internal/config"
+	"github.com/alceccentric/matsurihi-cron/internal/dao"
+	"github.com/alceccentric/matsurihi-cron/internal/logging"
+	"github.com/alceccentric/matsurihi-cron/internal/metrics"
+	"github.com/alceccentric/matsurihi-cron/internal/validation"
+	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrVerificationFailed is returned by RunVerify when the stored border infos have validation errors.
+var ErrVerificationFailed = errors.New("stored border infos failed verification")
+
+// RunVerify validates every stored border group of an event, the latest synced one when eventId is 0,
+// as RunSync validates fetched border infos. Unlike syncs, it also catches the issues spanning
+// several runs, such as scores decreasing between two syncs. It only reads from storage.
+func RunVerify(ctx context.Context, borderDAO dao.DAO, cfg config.SyncConfig, eventId int) (err error) {
+	startedAt := time.Now()
+	ctx = logging.WithRunId(ctx, newRunId(startedAt))
+	defer func() {
+		observeRun(metrics.JOB_VERIFY, startedAt, 0, err)
+	}()
+
+	if eventId == 0 {
+		latest, err := borderDAO.GetLatestEventInfo(ctx)
+		if err != nil {
+			return errors.New("get latest event info: " + err.Error())
+		}
+		if latest.EventId == 0 {
+			logging.FromContext(ctx).Info("No event was synced yet, nothing to verify")
+			return nil
+		}
+		eventId = latest.EventId
+	}
+	ctx = logging.WithFields(ctx, logrus.Fields{logging.FIELD_EVENT_ID: eventId})
+
+	eventInfos, err := borderDAO.ListEventInfos(ctx)
+	if err != nil {
+		return errors.New("list event infos: " + err.Error())
+	}
+	events := make(map[int]models.EventInfo, 1)
+	for _, info := range eventInfos {
+		if info.EventId == eventId {
+			events[eventId] = info
+		}
+	}
+
+	groups, err := borderDAO.ListBorderGroups(ctx, eventId)
+	if err != nil {
+		return errors.New("list border groups: " + err.Error())
+	}
+	var borderInfos []models.BorderInfo
+	for _, group := range groups {
+		infos, err := borderDAO.GetBorderInfos(ctx, group)
+		if err != nil {
+			return errors.New("get border infos: " + err.Error())
+		}
+		borderInfos = append(borderInfos, infos...)
+	}
+
+	report := validation.Validate(borderInfos, events, cfg.Validation.Cadence)
+	logValidationIssues(ctx, report)
+	errorCount := 0
+	for _, issue := range report.Issues {
+		if issue.Severity == validation.SEVERITY_ERROR {
+			errorCount++
+		}
+	}
+	if errorCount > 0 {
+		return fmt.Errorf("%w: %d errors in %d border groups of event %d", ErrVerificationFailed, errorCount, report.BorderGroups, eventId)
+	}
+	logging.FromContext(ctx).Infof("Verified %d border infos in %d border groups, %d warnings", len(borderInfos), report.BorderGroups, len(report.Issues))
+	return nil
+}
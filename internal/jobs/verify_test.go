@@ -0,0 +1,38 @@
+package jobs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/internal/config"
+	"github.com/alceccentric/matsurihi-cron/internal/dao"
+	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunVerify_NothingSynced(t *testing.T) {
+	mockDao := new(MockDAO)
+	mockDao.On("GetLatestEventInfo").Return(models.EventInfo{}, nil).Once()
+
+	assert.NoError(t, RunVerify(context.Background(), mockDao, config.Default().Sync, 0))
+	mockDao.AssertExpectations(t)
+}
+
+func TestRunVerify_ReportsErrorsOfStoredGroups(t *testing.T) {
+	startAt := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	group := dao.BorderGroupKey{EventId: 5, RankingType: models.EventPoint, Border: 100}
+	mockDao := new(MockDAO)
+	mockDao.On("GetLatestEventInfo").Return(models.EventInfo{EventId: 5}, nil).Once()
+	mockDao.On("ListEventInfos").Return([]models.EventInfo{{EventId: 5, StartAt: startAt, EndAt: startAt.Add(7 * 24 * time.Hour)}}, nil).Once()
+	mockDao.On("ListBorderGroups", 5).Return([]dao.BorderGroupKey{group}, nil).Once()
+	// The score decreased between two syncs
+	mockDao.On("GetBorderInfos", group).Return([]models.BorderInfo{
+		{EventId: 5, RankingType: models.EventPoint, Border: 100, Score: 2000, AggregatedAt: startAt.Add(30 * time.Minute)},
+		{EventId: 5, RankingType: models.EventPoint, Border: 100, Score: 1500, AggregatedAt: startAt.Add(time.Hour)},
+	}, nil).Once()
+
+	err := RunVerify(context.Background(), mockDao, config.Default().Sync, 0)
+	assert.ErrorIs(t, err, ErrVerificationFailed)
+	mockDao.AssertExpectations(t)
+}
@@ -0,0 +1,72 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/sirupsen/logrus"
+)
+
+// Formats of the log lines
+const (
+	FORMAT_TEXT = "text"
+	FORMAT_JSON = "json"
+)
+
+// Fields of the structured log lines, named the same across packages so that they can be queried
+const (
+	FIELD_RUN_ID       = "run_id"
+	FIELD_EVENT_ID     = "event_id"
+	FIELD_IDOL_ID      = "idol_id"
+	FIELD_BORDER       = "border"
+	FIELD_RANKING_TYPE = "ranking_type"
+	FIELD_OBJECT_KEY   = "object_key"
+)
+
+type entryKey struct{}
+
+// Configure sets the format of the log lines written by the standard logger.
+func Configure(format string) error {
+	switch format {
+	case FORMAT_TEXT:
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	case FORMAT_JSON:
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+	return nil
+}
+
+// WithFields returns a context whose logger adds fields to every line, on top of the fields of ctx.
+func WithFields(ctx context.Context, fields logrus.Fields) context.Context {
+	return context.WithValue(ctx, entryKey{}, FromContext(ctx).WithFields(fields))
+}
+
+// WithRunId returns a context whose logger correlates every line with a run.
+func WithRunId(ctx context.Context, runId string) context.Context {
+	return WithFields(ctx, logrus.Fields{FIELD_RUN_ID: runId})
+}
+
+// FromContext returns the logger of ctx, the standard logger when ctx has none.
+func FromContext(ctx context.Context) *logrus.Entry {
+	if entry, ok := ctx.Value(entryKey{}).(*logrus.Entry); ok {
+		return entry
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+// BorderFields are the fields identifying a border group. The idol is left out when idolId is 0,
+// as for the groups of other ranking types than idol point.
+func BorderFields(eventId int, rankingType models.EventRankingType, idolId, border int) logrus.Fields {
+	fields := logrus.Fields{
+		FIELD_EVENT_ID:     eventId,
+		FIELD_RANKING_TYPE: rankingType,
+		FIELD_BORDER:       border,
+	}
+	if idolId > 0 {
+		fields[FIELD_IDOL_ID] = idolId
+	}
+	return fields
+}
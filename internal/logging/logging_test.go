@@ -0,0 +1,60 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigure(t *testing.T) {
+	defer Configure(FORMAT_TEXT)
+
+	require.NoError(t, Configure(FORMAT_JSON))
+	assert.IsType(t, &logrus.JSONFormatter{}, logrus.StandardLogger().Formatter)
+
+	require.NoError(t, Configure(FORMAT_TEXT))
+	assert.IsType(t, &logrus.TextFormatter{}, logrus.StandardLogger().Formatter)
+
+	assert.Error(t, Configure("xml"))
+}
+
+func TestFromContext_DefaultsToStandardLogger(t *testing.T) {
+	entry := FromContext(context.Background())
+
+	assert.Same(t, logrus.StandardLogger(), entry.Logger)
+	assert.Empty(t, entry.Data)
+}
+
+func TestWithFields_AddsToFieldsOfContext(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+
+	ctx := context.WithValue(context.Background(), entryKey{}, logrus.NewEntry(logger))
+	ctx = WithRunId(ctx, "20240101T000000Z-abcd")
+	ctx = WithFields(ctx, BorderFields(300, models.EventPoint, 0, 100))
+	FromContext(ctx).Info("Fetched border infos")
+
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "Fetched border infos", line["msg"])
+	assert.Equal(t, "20240101T000000Z-abcd", line[FIELD_RUN_ID])
+	assert.Equal(t, float64(300), line[FIELD_EVENT_ID])
+	assert.Equal(t, string(models.EventPoint), line[FIELD_RANKING_TYPE])
+	assert.Equal(t, float64(100), line[FIELD_BORDER])
+	assert.NotContains(t, line, FIELD_IDOL_ID)
+}
+
+func TestBorderFields_IncludesIdol(t *testing.T) {
+	fields := BorderFields(300, models.IdolPoint, 12, 1000)
+
+	assert.Equal(t, 12, fields[FIELD_IDOL_ID])
+	assert.Equal(t, models.IdolPoint, fields[FIELD_RANKING_TYPE])
+}
@@ -0,0 +1,245 @@
+package matsuri
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Interaction is a request sent by the client together with the response it got, as saved in a cassette.
+type Interaction struct {
+	Request    RecordedRequest  `json:"request"`
+	Response   RecordedResponse `json:"response"`
+	RecordedAt time.Time        `json:"recordedAt"`
+}
+
+type RecordedRequest struct {
+	Method string      `json:"method"`
+	Url    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+}
+
+type RecordedResponse struct {
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body"`
+}
+
+// RecordingTransport saves every request sent through it and its response into a cassette file,
+// one JSON interaction per line. Interactions are appended as they happen, so that the cassette
+// of a run that crashed or was killed is usable up to its last request.
+type RecordingTransport struct {
+	mu        sync.Mutex
+	transport http.RoundTripper
+	path      string
+}
+
+// NewRecordingTransport records the requests sent through transport, http.DefaultTransport when nil,
+// into a new cassette file at path. An existing file is truncated.
+func NewRecordingTransport(path string, transport http.RoundTripper) (*RecordingTransport, error) {
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		return nil, fmt.Errorf("failed to create cassette %s: %w", path, err)
+	}
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &RecordingTransport{transport: transport, path: path}, nil
+}
+
+func (t *RecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	line, err := json.Marshal(Interaction{
+		Request:    RecordedRequest{Method: req.Method, Url: req.URL.String(), Header: req.Header.Clone()},
+		Response:   RecordedResponse{StatusCode: resp.StatusCode, Header: resp.Header.Clone(), Body: string(body)},
+		RecordedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := t.append(line); err != nil {
+		return nil, fmt.Errorf("failed to record %s %s: %w", req.Method, req.URL, err)
+	}
+	return resp, nil
+}
+
+// append writes a line at the end of the cassette. The file is only open while writing,
+// so that the transport needs no closing.
+func (t *RecordingTransport) append(line []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	file, err := os.OpenFile(t.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// LoadCassette reads the interactions of a cassette file written by a RecordingTransport.
+func LoadCassette(path string) ([]Interaction, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cassette %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var interactions []Interaction
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var interaction Interaction
+		if err := json.Unmarshal(scanner.Bytes(), &interaction); err != nil {
+			return nil, fmt.Errorf("failed to parse line %d of cassette %s: %w", line, path, err)
+		}
+		interactions = append(interactions, interaction)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read cassette %s: %w", path, err)
+	}
+	return interactions, nil
+}
+
+// ErrNoRecordedResponse is returned by a ReplayTransport for requests missing from its cassette.
+var ErrNoRecordedResponse = errors.New("no recorded response")
+
+// ReplayTransport answers requests with the responses of a cassette instead of sending them, so that
+// a recorded run can be executed again deterministically. A request is answered by the next unused
+// interaction with the same method, path, query and If-None-Match header, which replays the retries
+// of a request in order. Hosts are ignored, so that the client can keep its base URL.
+//
+// The since parameter and If-None-Match header of the ranking logs requests come from the high-water
+// marks and ETags in storage, which may differ from the ones at record time. A request without an exact
+// match is thus answered by the next unused interaction matching it without them, skipping the Not
+// Modified responses unless the request has the recorded ETag since they carry no logs.
+type ReplayTransport struct {
+	mu           sync.Mutex
+	interactions []Interaction
+	used         []bool
+	exact        map[string][]int
+	loose        map[string][]int
+}
+
+func NewReplayTransport(interactions []Interaction) (*ReplayTransport, error) {
+	t := &ReplayTransport{
+		interactions: interactions,
+		used:         make([]bool, len(interactions)),
+		exact:        make(map[string][]int),
+		loose:        make(map[string][]int),
+	}
+	for i, interaction := range interactions {
+		u, err := url.Parse(interaction.Request.Url)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recorded url %s: %w", interaction.Request.Url, err)
+		}
+		exactKey := replayKey(interaction.Request.Method, u, interaction.Request.Header)
+		t.exact[exactKey] = append(t.exact[exactKey], i)
+		looseKey := looseReplayKey(interaction.Request.Method, u)
+		t.loose[looseKey] = append(t.loose[looseKey], i)
+	}
+	return t, nil
+}
+
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := replayKey(req.Method, req.URL, req.Header)
+	t.mu.Lock()
+	i, ok := t.next(t.exact[key], func(Interaction) bool { return true })
+	if !ok {
+		etag := req.Header.Get("If-None-Match")
+		i, ok = t.next(t.loose[looseReplayKey(req.Method, req.URL)], func(interaction Interaction) bool {
+			return interaction.Response.StatusCode != http.StatusNotModified ||
+				(etag != "" && interaction.Request.Header.Get("If-None-Match") == etag)
+		})
+	}
+	if !ok {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("%w for %s", ErrNoRecordedResponse, key)
+	}
+	t.used[i] = true
+	interaction := t.interactions[i]
+	t.mu.Unlock()
+
+	recorded := interaction.Response
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", recorded.StatusCode, http.StatusText(recorded.StatusCode)),
+		StatusCode:    recorded.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        recorded.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader([]byte(recorded.Body))),
+		ContentLength: int64(len(recorded.Body)),
+		Request:       req,
+	}, nil
+}
+
+// next returns the first unused interaction of candidates that can answer the request.
+func (t *ReplayTransport) next(candidates []int, answers func(Interaction) bool) (int, bool) {
+	for _, i := range candidates {
+		if !t.used[i] && answers(t.interactions[i]) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Remaining returns how many recorded interactions were not replayed.
+func (t *ReplayTransport) Remaining() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	remaining := 0
+	for _, used := range t.used {
+		if !used {
+			remaining++
+		}
+	}
+	return remaining
+}
+
+// replayKey identifies the requests a recorded response can answer. The query is re-encoded
+// since the client does not send its parameters in a stable order.
+func replayKey(method string, u *url.URL, header http.Header) string {
+	key := method + " " + u.Path
+	if query := u.Query().Encode(); query != "" {
+		key += "?" + query
+	}
+	if etag := header.Get("If-None-Match"); etag != "" {
+		key += " If-None-Match: " + etag
+	}
+	return key
+}
+
+// looseReplayKey identifies the requests a recorded response can answer whatever the state of the
+// storage, leaving out the since parameter and the If-None-Match header.
+func looseReplayKey(method string, u *url.URL) string {
+	query := u.Query()
+	query.Del("since")
+	key := method + " " + u.Path
+	if encoded := query.Encode(); encoded != "" {
+		key += "?" + encoded
+	}
+	return key
+}
@@ -0,0 +1,130 @@
+package matsuri
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	models "github.com/alceccentric/matsurihi-cron/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCassette_RecordAndReplay(t *testing.T) {
+	var requests atomic.Int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		if !strings.HasSuffix(r.URL.Path, "/logs/100") {
+			json.NewEncoder(w).Encode(models.Event{Id: int(n), Name: "Recorded"})
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		json.NewEncoder(w).Encode([]models.EventRankingLog{{Rank: 100}})
+	}
+	server, client := setupTestServer(t, handler)
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "cassette.jsonl")
+	recorder, err := NewRecordingTransport(path, nil)
+	assert.NoError(t, err)
+	client.SetTransport(recorder)
+
+	ctx := context.Background()
+	first, err := client.GetEvent(ctx, 1)
+	assert.NoError(t, err)
+	second, err := client.GetEvent(ctx, 1)
+	assert.NoError(t, err)
+	logs, err := client.GetEventRankingLogs(ctx, 1, models.EventPoint, 100, nil)
+	assert.NoError(t, err)
+	notModified, err := client.GetEventRankingLogs(ctx, 1, models.EventPoint, 100, nil)
+	assert.NoError(t, err)
+	assert.True(t, notModified.NotModified)
+
+	interactions, err := LoadCassette(path)
+	assert.NoError(t, err)
+	assert.Len(t, interactions, 4)
+	assert.Equal(t, http.StatusNotModified, interactions[3].Response.StatusCode)
+
+	// Replayed on another host, the requests get the recorded responses in order
+	replay, err := NewReplayTransport(interactions)
+	assert.NoError(t, err)
+	replayClient := NewMatsurihiMeClient("http://replay.invalid").SetTransport(replay).SetRateLimit(0, 0)
+	event, err := replayClient.GetEvent(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, first, event)
+	event, err = replayClient.GetEvent(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, second, event)
+	result, err := replayClient.GetEventRankingLogs(ctx, 1, models.EventPoint, 100, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, logs.ETag, result.ETag)
+	result, err = replayClient.GetEventRankingLogs(ctx, 1, models.EventPoint, 100, nil)
+	assert.NoError(t, err)
+	assert.True(t, result.NotModified)
+	assert.Zero(t, replay.Remaining())
+	assert.EqualValues(t, 4, requests.Load())
+
+	// Requests that were not recorded fail
+	_, err = replayClient.GetEvent(ctx, 2)
+	assert.ErrorIs(t, err, ErrNoRecordedResponse)
+}
+
+func TestReplayTransport_StorageDiffersFromRecordTime(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v2"`)
+		if r.Header.Get("If-None-Match") == `"v2"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		json.NewEncoder(w).Encode([]models.EventRankingLog{{Rank: 100}})
+	}
+	server, client := setupTestServer(t, handler)
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "cassette.jsonl")
+	recorder, err := NewRecordingTransport(path, nil)
+	assert.NoError(t, err)
+	client.SetTransport(recorder)
+
+	ctx := context.Background()
+	recordedSince := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	_, err = client.GetEventRankingLogs(ctx, 1, models.EventPoint, 100, &models.EventRankingLogsOptions{Since: recordedSince})
+	assert.NoError(t, err)
+	notModified, err := client.GetEventRankingLogs(ctx, 1, models.EventPoint, 100, &models.EventRankingLogsOptions{Since: recordedSince})
+	assert.NoError(t, err)
+	assert.True(t, notModified.NotModified)
+
+	interactions, err := LoadCassette(path)
+	assert.NoError(t, err)
+	replay, err := NewReplayTransport(interactions)
+	assert.NoError(t, err)
+	replayClient := NewMatsurihiMeClient("http://replay.invalid").SetTransport(replay).SetRateLimit(0, 0)
+
+	// Replayed with other marks and ETags, the requests still get the recorded logs
+	replayClient.LoadETags(map[string]string{interactions[0].Request.Url: `"v1"`})
+	otherOptions := &models.EventRankingLogsOptions{Since: recordedSince.Add(time.Hour), IfNonMatch: `"v1"`}
+	result, err := replayClient.GetEventRankingLogs(ctx, 1, models.EventPoint, 100, otherOptions)
+	assert.NoError(t, err)
+	assert.False(t, result.NotModified)
+	assert.Equal(t, `"v2"`, result.ETag)
+
+	// Not Modified carries no logs, so it only answers requests with the recorded ETag
+	_, err = replayClient.GetEventRankingLogs(ctx, 1, models.EventPoint, 100, otherOptions)
+	assert.ErrorIs(t, err, ErrNoRecordedResponse)
+	result, err = replayClient.GetEventRankingLogs(ctx, 1, models.EventPoint, 100, &models.EventRankingLogsOptions{IfNonMatch: `"v2"`})
+	assert.NoError(t, err)
+	assert.True(t, result.NotModified)
+	assert.Zero(t, replay.Remaining())
+}
+
+func TestLoadCassette_Invalid(t *testing.T) {
+	_, err := LoadCassette(filepath.Join(t.TempDir(), "missing.jsonl"))
+	assert.Error(t, err)
+}
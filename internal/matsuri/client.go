@@ -1,60 +1,165 @@
 package matsuri
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"maps"
 	"net/http"
+	"sort"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/alceccentric/matsurihi-cron/internal/logging"
+	"github.com/alceccentric/matsurihi-cron/internal/metrics"
 	utils "github.com/alceccentric/matsurihi-cron/internal/utils"
 	models "github.com/alceccentric/matsurihi-cron/models"
 
 	resty "github.com/go-resty/resty/v2"
-	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 )
 
 const (
 	BASE_URL_V2 = "https://api.matsurihi.me/api/mltd/v2"
+
+	IDOL_COUNT                  = 52
+	DEFAULT_IDOL_CONCURRENCY    = 8
+	DEFAULT_REQUESTS_PER_SECOND = 10
+)
+
+// Path templates of the endpoints, used to label the metrics of the requests
+const (
+	ENDPOINT_EVENTS            = "/events"
+	ENDPOINT_EVENT             = "/events/{id}"
+	ENDPOINT_RANKING_BORDERS   = "/events/{id}/rankings/borders"
+	ENDPOINT_RANKING_LOGS      = "/events/{id}/rankings/{type}/logs/{border}"
+	ENDPOINT_IDOL_RANKING_LOGS = "/events/{id}/rankings/idolPoint/{idolId}/logs/{border}"
 )
 
 // Interface for the Matsurihi.me client to interact with the MLTD API.
 type MatsuriClient interface {
-	GetEvents(options *models.EventsOptions) ([]models.Event, error)
-	GetEvent(eventId int) (models.Event, error)
-	GetEventRankingBorders(eventId int) (models.EventRankingBorders, error)
+	GetEvents(ctx context.Context, options *models.EventsOptions) ([]models.Event, error)
+	GetEvent(ctx context.Context, eventId int) (models.Event, error)
+	GetEventRankingBorders(ctx context.Context, eventId int) (models.EventRankingBorders, error)
 	GetEventRankingLogs(
+		ctx context.Context,
 		eventId int,
 		eventType models.EventRankingType,
 		rankingBorder int,
 		options *models.EventRankingLogsOptions,
-	) ([]models.EventRankingLog, error)
+	) (models.EventRankingLogsResult, error)
 	GetEventIdolRankingLogs(
+		ctx context.Context,
 		eventId int,
 		rankingBorder int,
 		options *models.EventRankingLogsOptions,
-	) (map[int][]models.EventRankingLog, error)
+	) (map[int]models.EventRankingLogsResult, error)
+	// LoadETags seeds the ETags, keyed by request URL, used for conditional ranking log requests.
+	LoadETags(etags map[string]string)
+	// ETags returns the ETags, keyed by request URL, of the ranking log responses seen by this client.
+	ETags() map[string]string
+	// ForgetRankingLogsETags drops the ETags seen for the ranking logs of a border group, idolId being
+	// 0 unless rankingType is idolPoint, so that they are left out of ETags.
+	ForgetRankingLogsETags(eventId int, rankingType models.EventRankingType, idolId int, rankingBorder int)
+}
+
+// IdolRankingLogsError reports the idols whose ranking logs could not be fetched.
+// It is returned together with the results of the idols that succeeded.
+type IdolRankingLogsError struct {
+	EventId       int
+	RankingBorder int
+	Errors        map[int]error
 }
 
+func (e *IdolRankingLogsError) Error() string {
+	idolIds := make([]int, 0, len(e.Errors))
+	for idolId := range e.Errors {
+		idolIds = append(idolIds, idolId)
+	}
+	sort.Ints(idolIds)
+	return fmt.Sprintf("failed to get idol ranking logs of event %d with border %d for %d idols: %v",
+		e.EventId, e.RankingBorder, len(idolIds), idolIds)
+}
+
+// ErrNotModified is returned when the server answers a conditional request with 304 Not Modified.
+var ErrNotModified = errors.New("not modified")
+
 type MatsurihiMeClient struct {
-	baseUrl    string
-	httpClient *resty.Client
+	baseUrl         string
+	httpClient      *resty.Client
+	etags           *etagCache
+	limiter         *rate.Limiter
+	idolConcurrency int
 }
 
 func NewMatsurihiMeClient(baseUrl string) *MatsurihiMeClient {
-	httpClient := resty.New()
-	httpClient.SetRetryCount(3).
+	m := &MatsurihiMeClient{
+		baseUrl:         baseUrl,
+		httpClient:      resty.New(),
+		etags:           newETagCache(),
+		limiter:         rate.NewLimiter(DEFAULT_REQUESTS_PER_SECOND, DEFAULT_REQUESTS_PER_SECOND),
+		idolConcurrency: DEFAULT_IDOL_CONCURRENCY,
+	}
+	m.httpClient.SetRetryCount(3).
 		SetRetryWaitTime(2 * time.Second).
 		SetRetryMaxWaitTime(30 * time.Second).
 		AddRetryCondition(func(r *resty.Response, err error) bool {
+			// There is no response when the request failed before being sent, e.g. waiting for the limiter
+			if r == nil {
+				return false
+			}
 			return r.StatusCode() == 429 || r.StatusCode() == 500 ||
 				r.StatusCode() >= 502 && r.StatusCode() <= 504
+		}).
+		// Resty runs the hook before every attempt, so that retries are rate limited too
+		OnBeforeRequest(func(_ *resty.Client, req *resty.Request) error {
+			return m.limiter.Wait(req.Context())
 		})
-	return &MatsurihiMeClient{
-		baseUrl:    baseUrl,
-		httpClient: httpClient,
+	return m
+}
+
+// SetIdolConcurrency sets how many idol ranking logs are fetched in parallel.
+// Values below 1 are treated as 1.
+func (m *MatsurihiMeClient) SetIdolConcurrency(concurrency int) *MatsurihiMeClient {
+	m.idolConcurrency = max(concurrency, 1)
+	return m
+}
+
+// SetRateLimit sets the rate limit shared by every request sent by the client.
+// A non-positive requestsPerSecond disables rate limiting.
+func (m *MatsurihiMeClient) SetRateLimit(requestsPerSecond float64, burst int) *MatsurihiMeClient {
+	if requestsPerSecond <= 0 {
+		m.limiter = rate.NewLimiter(rate.Inf, 0)
+	} else {
+		m.limiter = rate.NewLimiter(rate.Limit(requestsPerSecond), max(burst, 1))
+	}
+	return m
+}
+
+// SetTransport sets the transport the requests are sent through, e.g. a RecordingTransport
+// or a ReplayTransport.
+func (m *MatsurihiMeClient) SetTransport(transport http.RoundTripper) *MatsurihiMeClient {
+	m.httpClient.SetTransport(transport)
+	return m
+}
+
+func (m *MatsurihiMeClient) LoadETags(etags map[string]string) {
+	m.etags.load(etags)
+}
+
+func (m *MatsurihiMeClient) ETags() map[string]string {
+	return m.etags.snapshot()
+}
+
+func (m *MatsurihiMeClient) ForgetRankingLogsETags(eventId int, rankingType models.EventRankingType, idolId int, rankingBorder int) {
+	url := m.rankingLogsUrl(eventId, rankingType, rankingBorder)
+	if rankingType == models.IdolPoint {
+		url = m.idolRankingLogsUrl(eventId, idolId, rankingBorder)
 	}
+	// Every option of the request is a query parameter, so all the URLs of the border group share this prefix
+	m.etags.forget(url + "?")
 }
 
 // GetEvents retrieves events based on the provided options:
@@ -63,7 +168,7 @@ func NewMatsurihiMeClient(baseUrl string) *MatsurihiMeClient {
 // - options.OrderBys: the order by criteria for the events
 // Returns a slice of events or an error if the request fails.
 // If options is nil, it retrieves all events without any filters.
-func (m *MatsurihiMeClient) GetEvents(options *models.EventsOptions) ([]models.Event, error) {
+func (m *MatsurihiMeClient) GetEvents(ctx context.Context, options *models.EventsOptions) ([]models.Event, error) {
 
 	url := m.baseUrl + "/events"
 
@@ -83,7 +188,7 @@ func (m *MatsurihiMeClient) GetEvents(options *models.EventsOptions) ([]models.E
 
 	var events []models.Event
 
-	if err := m.sendGetRequest(url, params, map[string]string{}, &events); err != nil {
+	if err := m.sendGetRequest(ctx, ENDPOINT_EVENTS, url, params, map[string]string{}, &events); err != nil {
 		return nil, err
 	}
 
@@ -92,13 +197,13 @@ func (m *MatsurihiMeClient) GetEvents(options *models.EventsOptions) ([]models.E
 
 // GetEvent retrieves a specific event by its ID.
 // Returns the event or an error if the request fails.
-func (m *MatsurihiMeClient) GetEvent(eventId int) (models.Event, error) {
+func (m *MatsurihiMeClient) GetEvent(ctx context.Context, eventId int) (models.Event, error) {
 
 	url := m.baseUrl + "/events/" + strconv.Itoa(eventId)
 
 	var event models.Event
 
-	if err := m.sendGetRequest(url, map[string]string{}, map[string]string{}, &event); err != nil {
+	if err := m.sendGetRequest(ctx, ENDPOINT_EVENT, url, map[string]string{}, map[string]string{}, &event); err != nil {
 		return models.Event{}, err
 	}
 
@@ -108,13 +213,13 @@ func (m *MatsurihiMeClient) GetEvent(eventId int) (models.Event, error) {
 // GetEventRankingBorders retrieves the ranking borders for a specific event by its ID.
 // - eventId: the ID of the event
 // Returns ranking borders (i.e., 100, 2500, 5000) available in the event or an error if the request fails.
-func (m *MatsurihiMeClient) GetEventRankingBorders(eventId int) (models.EventRankingBorders, error) {
+func (m *MatsurihiMeClient) GetEventRankingBorders(ctx context.Context, eventId int) (models.EventRankingBorders, error) {
 
 	url := m.baseUrl + "/events/" + strconv.Itoa(eventId) + "/rankings/borders"
 
 	var eventRankingBorders models.EventRankingBorders
 
-	if err := m.sendGetRequest(url, map[string]string{}, map[string]string{}, &eventRankingBorders); err != nil {
+	if err := m.sendGetRequest(ctx, ENDPOINT_RANKING_BORDERS, url, map[string]string{}, map[string]string{}, &eventRankingBorders); err != nil {
 		return models.EventRankingBorders{}, err
 	}
 
@@ -127,21 +232,114 @@ func (m *MatsurihiMeClient) GetEventRankingBorders(eventId int) (models.EventRan
 // - rankingBorder: the border for which to retrieve logs (e.g., 100, 2500, 5000)
 // - options: optional parameters for filtering logs
 //   - "since": a timestamp to filter logs since that time
-//   - "If-None-Match": an ETag value to check for updates
+//   - "If-None-Match": an ETag value to check for updates; defaults to the ETag
+//     previously seen for the same URL
 //
-// Returns a slice of event ranking logs or an error if the request fails.
+// Returns the ranking logs with the response ETag, or a NotModified result if the
+// logs did not change since the given ETag, or an error if the request fails.
 // If options is nil, it retrieves all logs without any filters.
 func (m *MatsurihiMeClient) GetEventRankingLogs(
+	ctx context.Context,
 	eventId int,
 	eventType models.EventRankingType,
 	rankingBorder int,
 	options *models.EventRankingLogsOptions,
-) ([]models.EventRankingLog, error) {
+) (models.EventRankingLogsResult, error) {
+
+	url := m.rankingLogsUrl(eventId, eventType, rankingBorder)
+
+	ctx = logging.WithFields(ctx, logging.BorderFields(eventId, eventType, 0, rankingBorder))
+	return m.getRankingLogs(ctx, ENDPOINT_RANKING_LOGS, url, options)
+}
+
+// GetEventIdolRankingLogs retrieves the idol ranking logs of all 52 idols for a specific
+// anniversary event and border, fetching up to idolConcurrency idols in parallel.
+// Options are applied to every idol, except that the If-None-Match header defaults
+// to the ETag previously seen for each idol's URL.
+// Returns the results keyed by idol ID. If some idols fail, the results of the others
+// are returned together with an *IdolRankingLogsError holding the per-idol errors,
+// unless ctx was cancelled, in which case only the context error is returned.
+func (m *MatsurihiMeClient) GetEventIdolRankingLogs(
+	ctx context.Context,
+	eventId int,
+	rankingBorder int,
+	options *models.EventRankingLogsOptions,
+) (map[int]models.EventRankingLogsResult, error) {
+
+	type idolResult struct {
+		idolId int
+		result models.EventRankingLogsResult
+		err    error
+	}
+
+	idolIds := make(chan int)
+	results := make(chan idolResult)
 
-	url := m.baseUrl + "/events/" + strconv.Itoa(eventId) +
+	var wg sync.WaitGroup
+	for i := 0; i < min(m.idolConcurrency, IDOL_COUNT); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idolId := range idolIds {
+				url := m.idolRankingLogsUrl(eventId, idolId, rankingBorder)
+
+				idolCtx := logging.WithFields(ctx, logging.BorderFields(eventId, models.IdolPoint, idolId, rankingBorder))
+				result, err := m.getRankingLogs(idolCtx, ENDPOINT_IDOL_RANKING_LOGS, url, options)
+				results <- idolResult{idolId: idolId, result: result, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		for idolId := 1; idolId <= IDOL_COUNT; idolId++ {
+			idolIds <- idolId
+		}
+		close(idolIds)
+		wg.Wait()
+		close(results)
+	}()
+
+	resultByIdolId := make(map[int]models.EventRankingLogsResult)
+	errByIdolId := make(map[int]error)
+	for r := range results {
+		if r.err != nil {
+			errByIdolId[r.idolId] = r.err
+			continue
+		}
+		resultByIdolId[r.idolId] = r.result
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(errByIdolId) > 0 {
+		return resultByIdolId, &IdolRankingLogsError{
+			EventId:       eventId,
+			RankingBorder: rankingBorder,
+			Errors:        errByIdolId,
+		}
+	}
+	return resultByIdolId, nil
+}
+
+func (m *MatsurihiMeClient) rankingLogsUrl(eventId int, eventType models.EventRankingType, rankingBorder int) string {
+	return m.baseUrl + "/events/" + strconv.Itoa(eventId) +
 		"/rankings/" + string(eventType) +
 		"/logs/" + strconv.Itoa(rankingBorder)
+}
+
+func (m *MatsurihiMeClient) idolRankingLogsUrl(eventId int, idolId int, rankingBorder int) string {
+	return m.baseUrl + "/events/" + strconv.Itoa(eventId) +
+		"/rankings/idolPoint/" + strconv.Itoa(idolId) +
+		"/logs/" + strconv.Itoa(rankingBorder)
+}
 
+func (m *MatsurihiMeClient) getRankingLogs(
+	ctx context.Context,
+	endpoint string,
+	url string,
+	options *models.EventRankingLogsOptions,
+) (models.EventRankingLogsResult, error) {
 	params := make(map[string]string)
 	headers := make(map[string]string)
 
@@ -156,55 +354,80 @@ func (m *MatsurihiMeClient) GetEventRankingLogs(
 
 	var eventRankingLogs []models.EventRankingLog
 
-	if err := m.sendGetRequest(url, params, headers, &eventRankingLogs); err != nil {
-		return nil, err
+	etag, err := m.sendConditionalGetRequest(ctx, endpoint, url, params, headers, &eventRankingLogs)
+	if errors.Is(err, ErrNotModified) {
+		return models.EventRankingLogsResult{ETag: etag, NotModified: true}, nil
+	}
+	if err != nil {
+		return models.EventRankingLogsResult{}, err
 	}
 
-	return eventRankingLogs, nil
+	return models.EventRankingLogsResult{Logs: eventRankingLogs, ETag: etag}, nil
 }
 
-func (m *MatsurihiMeClient) GetEventIdolRankingLogs(
-	eventId int,
-	rankingBorder int,
-	options *models.EventRankingLogsOptions,
-) (map[int][]models.EventRankingLog, error) {
-
-	rankingLogByIdolId := make(map[int][]models.EventRankingLog)
-
-	for idolId := 1; idolId <= 52; idolId++ {
-		url := m.baseUrl + "/events/" + strconv.Itoa(eventId) +
-			"/rankings/idolPoint/" + strconv.Itoa(idolId) +
-			"/logs/" + strconv.Itoa(rankingBorder)
-
-		params := make(map[string]string)
-		headers := make(map[string]string)
+// sendConditionalGetRequest sends a GET request with an If-None-Match header taken from
+// the ETag cache unless one is given, and records the response ETag for the request URL.
+// Returns the response ETag, or ErrNotModified with the cached ETag on 304.
+func (m *MatsurihiMeClient) sendConditionalGetRequest(
+	ctx context.Context,
+	endpoint string,
+	url string,
+	params map[string]string,
+	headers map[string]string,
+	v interface{},
+) (string, error) {
+	if headers == nil {
+		headers = make(map[string]string)
+	}
 
-		if options != nil {
-			if !options.Since.IsZero() {
-				params["since"] = options.Since.Format(time.RFC3339)
-			}
-			if len(options.IfNonMatch) > 0 {
-				headers["If-None-Match"] = options.IfNonMatch
-			}
+	fullUrl := buildFullUrl(url, params)
+	if _, ok := headers["If-None-Match"]; !ok {
+		if etag := m.etags.get(fullUrl); etag != "" {
+			headers["If-None-Match"] = etag
 		}
+	}
 
-		var eventRankingLogs []models.EventRankingLog
-
-		if err := m.sendGetRequest(url, params, headers, &eventRankingLogs); err != nil {
-			return nil, err
+	resp, err := m.doGetRequest(ctx, endpoint, url, params, headers, v)
+	if errors.Is(err, ErrNotModified) {
+		etag := resp.Header().Get("ETag")
+		if etag == "" {
+			etag = headers["If-None-Match"]
 		}
-		rankingLogByIdolId[idolId] = eventRankingLogs
+		m.etags.set(fullUrl, etag)
+		return etag, err
+	}
+	if err != nil {
+		return "", err
 	}
 
-	return rankingLogByIdolId, nil
+	etag := resp.Header().Get("ETag")
+	m.etags.set(fullUrl, etag)
+	return etag, nil
 }
 
 func (m *MatsurihiMeClient) sendGetRequest(
+	ctx context.Context,
+	endpoint string,
 	url string,
 	params map[string]string,
 	headers map[string]string,
 	v interface{},
 ) error {
+	_, err := m.doGetRequest(ctx, endpoint, url, params, headers, v)
+	return err
+}
+
+// doGetRequest sends a GET request and decodes the JSON response body into v.
+// A 304 response is reported as ErrNotModified without touching v.
+// The request is recorded in the metrics under endpoint, the path template of url.
+func (m *MatsurihiMeClient) doGetRequest(
+	ctx context.Context,
+	endpoint string,
+	url string,
+	params map[string]string,
+	headers map[string]string,
+	v interface{},
+) (*resty.Response, error) {
 	var defaultHeaders = map[string]string{
 		"Content-Type": "application/json",
 	}
@@ -214,27 +437,50 @@ func (m *MatsurihiMeClient) sendGetRequest(
 	}
 
 	maps.Copy(headers, defaultHeaders)
-	fullUrl := url + "?" + utils.BuildQueryParams(params)
+	fullUrl := buildFullUrl(url, params)
 
-	logrus.Debug("Sending GET request on url: " + fullUrl +
+	logging.FromContext(ctx).WithField("endpoint", endpoint).Debug("Sending GET request on url: " + fullUrl +
 		" with headers: " + utils.BuildQueryParams(headers) +
 		" and params: " + utils.BuildQueryParams(params))
 
-	resp, err := m.httpClient.R().EnableTrace().
+	sentAt := time.Now()
+	resp, err := m.httpClient.R().SetContext(ctx).EnableTrace().
 		SetHeaders(headers).
 		Get(fullUrl)
+	observeRequest(endpoint, resp, err, time.Since(sentAt))
 
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if resp.StatusCode() == http.StatusNotModified {
+		return resp, ErrNotModified
 	}
 
 	if resp.StatusCode() < http.StatusOK || resp.StatusCode() >= http.StatusBadRequest {
-		return fmt.Errorf("sending GET request on url %s returned %d", fullUrl, resp.StatusCode())
+		return nil, fmt.Errorf("sending GET request on url %s returned %d", fullUrl, resp.StatusCode())
 	}
 
 	if err := json.Unmarshal(resp.Body(), v); err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return resp, nil
+}
+
+// observeRequest records a request in the metrics, with the status code of its last response
+// or STATUS_CODE_ERROR when it failed without one.
+func observeRequest(endpoint string, resp *resty.Response, err error, duration time.Duration) {
+	code, retries := metrics.STATUS_CODE_ERROR, 0
+	if err == nil && resp != nil {
+		code = strconv.Itoa(resp.StatusCode())
+	}
+	if resp != nil && resp.Request != nil {
+		retries = max(resp.Request.Attempt-1, 0)
+	}
+	metrics.ObserveAPIRequest(endpoint, code, duration, retries)
+}
+
+func buildFullUrl(url string, params map[string]string) string {
+	return url + "?" + utils.BuildQueryParams(params)
 }
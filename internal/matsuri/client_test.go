@@ -1,12 +1,16 @@
 package matsuri
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/alceccentric/matsurihi-cron/internal/metrics"
 	models "github.com/alceccentric/matsurihi-cron/models"
 	resty "github.com/go-resty/resty/v2"
 	"github.com/stretchr/testify/assert"
@@ -16,6 +20,7 @@ func setupTestServer(_ *testing.T, handler http.HandlerFunc) (*httptest.Server,
 	server := httptest.NewServer(handler)
 	client := NewMatsurihiMeClient(server.URL)
 	client.httpClient = resty.New() // Use default resty client for local server
+	client.SetRateLimit(0, 0)
 	return server, client
 }
 
@@ -29,7 +34,7 @@ func TestGetEvents(t *testing.T) {
 	server, client := setupTestServer(t, handler)
 	defer server.Close()
 
-	events, err := client.GetEvents(nil)
+	events, err := client.GetEvents(context.Background(), nil)
 	assert.NoError(t, err)
 	assert.Equal(t, expected, events)
 }
@@ -42,7 +47,7 @@ func TestGetEvent(t *testing.T) {
 	server, client := setupTestServer(t, handler)
 	defer server.Close()
 
-	event, err := client.GetEvent(42)
+	event, err := client.GetEvent(context.Background(), 42)
 	assert.NoError(t, err)
 	assert.Equal(t, expected, event)
 }
@@ -57,7 +62,7 @@ func TestGetEventRankingBorders(t *testing.T) {
 	server, client := setupTestServer(t, handler)
 	defer server.Close()
 
-	borders, err := client.GetEventRankingBorders(1)
+	borders, err := client.GetEventRankingBorders(context.Background(), 1)
 	assert.NoError(t, err)
 	assert.Equal(t, expected, borders)
 }
@@ -77,10 +82,10 @@ func TestGetEventRankingLogs(t *testing.T) {
 	server, client := setupTestServer(t, handler)
 	defer server.Close()
 
-	logs, err := client.GetEventRankingLogs(1, models.EventPoint, 100, nil)
+	result, err := client.GetEventRankingLogs(context.Background(), 1, models.EventPoint, 100, nil)
 	assert.NoError(t, err)
-	assert.Equal(t, expected[0].Rank, logs[0].Rank)
-	assert.Equal(t, expected[0].Data[0].Score, logs[0].Data[0].Score)
+	assert.Equal(t, expected[0].Rank, result.Logs[0].Rank)
+	assert.Equal(t, expected[0].Data[0].Score, result.Logs[0].Data[0].Score)
 }
 
 func TestSendGetRequest_ErrorStatus(t *testing.T) {
@@ -91,7 +96,7 @@ func TestSendGetRequest_ErrorStatus(t *testing.T) {
 	defer server.Close()
 
 	var v interface{}
-	err := client.sendGetRequest(server.URL, nil, nil, &v)
+	err := client.sendGetRequest(context.Background(), ENDPOINT_EVENTS, server.URL, nil, nil, &v)
 	assert.Error(t, err)
 }
 
@@ -103,7 +108,7 @@ func TestSendGetRequest_InvalidJSON(t *testing.T) {
 	defer server.Close()
 
 	var v interface{}
-	err := client.sendGetRequest(server.URL, nil, nil, &v)
+	err := client.sendGetRequest(context.Background(), ENDPOINT_EVENTS, server.URL, nil, nil, &v)
 	assert.Error(t, err)
 }
 
@@ -114,7 +119,7 @@ func TestGetEvents_InvalidJSON(t *testing.T) {
 	server, client := setupTestServer(t, handler)
 	defer server.Close()
 
-	_, err := client.GetEvents(nil)
+	_, err := client.GetEvents(context.Background(), nil)
 	assert.Error(t, err)
 }
 
@@ -125,7 +130,7 @@ func TestGetEvent_NotFound(t *testing.T) {
 	server, client := setupTestServer(t, handler)
 	defer server.Close()
 
-	_, err := client.GetEvent(999)
+	_, err := client.GetEvent(context.Background(), 999)
 	assert.Error(t, err)
 }
 
@@ -136,7 +141,7 @@ func TestGetEventRankingBorders_EmptyResponse(t *testing.T) {
 	server, client := setupTestServer(t, handler)
 	defer server.Close()
 
-	_, err := client.GetEventRankingBorders(1)
+	_, err := client.GetEventRankingBorders(context.Background(), 1)
 	assert.Error(t, err)
 }
 
@@ -147,7 +152,7 @@ func TestGetEventRankingLogs_BadRequest(t *testing.T) {
 	server, client := setupTestServer(t, handler)
 	defer server.Close()
 
-	_, err := client.GetEventRankingLogs(1, models.EventPoint, 100, nil)
+	_, err := client.GetEventRankingLogs(context.Background(), 1, models.EventPoint, 100, nil)
 	assert.Error(t, err)
 }
 
@@ -171,7 +176,7 @@ func TestGetEvents_WithOptions(t *testing.T) {
 		Types:    []models.EventType{models.ShowTime, models.Tour},
 		OrderBys: []models.EventSortType{models.IdAsc, models.TypeDesc},
 	}
-	events, err := client.GetEvents(options)
+	events, err := client.GetEvents(context.Background(), options)
 	assert.NoError(t, err)
 	assert.Equal(t, expected, events)
 }
@@ -202,10 +207,10 @@ func TestGetEventRankingLogs_WithOptions(t *testing.T) {
 		Since:      time.Now().Add(-24 * time.Hour),
 		IfNonMatch: "etag-value",
 	}
-	logs, err := client.GetEventRankingLogs(1, models.EventPoint, 2500, options)
+	result, err := client.GetEventRankingLogs(context.Background(), 1, models.EventPoint, 2500, options)
 	assert.NoError(t, err)
-	assert.Equal(t, expected[0].Rank, logs[0].Rank)
-	assert.Equal(t, expected[0].Data[0].Score, logs[0].Data[0].Score)
+	assert.Equal(t, expected[0].Rank, result.Logs[0].Rank)
+	assert.Equal(t, expected[0].Data[0].Score, result.Logs[0].Data[0].Score)
 }
 
 func TestGetEventIdolRankingLogs(t *testing.T) {
@@ -230,9 +235,238 @@ func TestGetEventIdolRankingLogs(t *testing.T) {
 	server, client := setupTestServer(t, handler)
 	defer server.Close()
 
-	logs, err := client.GetEventIdolRankingLogs(1, 100, nil)
+	results, err := client.GetEventIdolRankingLogs(context.Background(), 1, 100, nil)
 	assert.NoError(t, err)
-	assert.Contains(t, logs, 1)
-	assert.Equal(t, expected[1][0].Rank, logs[1][0].Rank)
-	assert.Equal(t, expected[1][0].Data[0].Score, logs[1][0].Data[0].Score)
+	assert.Contains(t, results, 1)
+	assert.Equal(t, expected[1][0].Rank, results[1].Logs[0].Rank)
+	assert.Equal(t, expected[1][0].Data[0].Score, results[1].Logs[0].Data[0].Score)
+}
+
+func TestGetEventRankingLogs_ETagRoundTrip(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		json.NewEncoder(w).Encode([]models.EventRankingLog{{Rank: 100}})
+	}
+	server, client := setupTestServer(t, handler)
+	defer server.Close()
+
+	first, err := client.GetEventRankingLogs(context.Background(), 1, models.EventPoint, 100, nil)
+	assert.NoError(t, err)
+	assert.False(t, first.NotModified)
+	assert.Equal(t, `"v1"`, first.ETag)
+	assert.Len(t, first.Logs, 1)
+
+	second, err := client.GetEventRankingLogs(context.Background(), 1, models.EventPoint, 100, nil)
+	assert.NoError(t, err)
+	assert.True(t, second.NotModified)
+	assert.Equal(t, `"v1"`, second.ETag)
+	assert.Empty(t, second.Logs)
+
+	etags := client.ETags()
+	assert.Len(t, etags, 1)
+	for _, etag := range etags {
+		assert.Equal(t, `"v1"`, etag)
+	}
+}
+
+func TestGetEventRankingLogs_UsesLoadedETags(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != `"stored"` {
+			t.Errorf("Expected stored ETag to be sent, got %q", r.Header.Get("If-None-Match"))
+		}
+		w.WriteHeader(http.StatusNotModified)
+	}
+	server, client := setupTestServer(t, handler)
+	defer server.Close()
+
+	client.LoadETags(map[string]string{
+		server.URL + "/events/1/rankings/eventPoint/logs/100?": `"stored"`,
+	})
+	result, err := client.GetEventRankingLogs(context.Background(), 1, models.EventPoint, 100, nil)
+	assert.NoError(t, err)
+	assert.True(t, result.NotModified)
+	assert.Equal(t, `"stored"`, result.ETag)
+}
+
+func TestForgetRankingLogsETags(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		json.NewEncoder(w).Encode([]models.EventRankingLog{{Rank: 100}})
+	}
+	server, client := setupTestServer(t, handler)
+	defer server.Close()
+
+	since := &models.EventRankingLogsOptions{Since: time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)}
+	for _, border := range []int{100, 1000} {
+		_, err := client.GetEventRankingLogs(context.Background(), 1, models.EventPoint, border, since)
+		assert.NoError(t, err)
+	}
+	assert.Len(t, client.ETags(), 2)
+
+	client.ForgetRankingLogsETags(1, models.EventPoint, 0, 100)
+	etags := client.ETags()
+	assert.Len(t, etags, 1)
+	assert.Contains(t, etags, server.URL+"/events/1/rankings/eventPoint/logs/1000?since=2025-06-01T00%3A00%3A00Z")
+}
+
+func TestSendGetRequest_NotModified(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}
+	server, client := setupTestServer(t, handler)
+	defer server.Close()
+
+	var v interface{}
+	err := client.sendGetRequest(context.Background(), ENDPOINT_EVENTS, server.URL, nil, nil, &v)
+	assert.ErrorIs(t, err, ErrNotModified)
+}
+
+func TestGetEventIdolRankingLogs_PartialFailure(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/idolPoint/7/") {
+			http.Error(w, "fail", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode([]models.EventRankingLog{{Rank: 100}})
+	}
+	server, client := setupTestServer(t, handler)
+	defer server.Close()
+
+	results, err := client.GetEventIdolRankingLogs(context.Background(), 1, 100, nil)
+	var idolErr *IdolRankingLogsError
+	assert.ErrorAs(t, err, &idolErr)
+	assert.Len(t, idolErr.Errors, 1)
+	assert.Contains(t, idolErr.Errors, 7)
+	assert.Len(t, results, IDOL_COUNT-1)
+	assert.NotContains(t, results, 7)
+}
+
+func TestGetEventIdolRankingLogs_BoundedConcurrency(t *testing.T) {
+	var inFlight, maxInFlight int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			observed := atomic.LoadInt32(&maxInFlight)
+			if current <= observed || atomic.CompareAndSwapInt32(&maxInFlight, observed, current) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		json.NewEncoder(w).Encode([]models.EventRankingLog{})
+	}
+	server, client := setupTestServer(t, handler)
+	defer server.Close()
+	client.SetIdolConcurrency(3)
+
+	results, err := client.GetEventIdolRankingLogs(context.Background(), 1, 100, nil)
+	assert.NoError(t, err)
+	assert.Len(t, results, IDOL_COUNT)
+	assert.LessOrEqual(t, atomic.LoadInt32(&maxInFlight), int32(3))
+}
+
+func TestGetEvent_ContextCancelled(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}
+	server, client := setupTestServer(t, handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := client.GetEvent(ctx, 1)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestGetEventIdolRankingLogs_ContextCancelled(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]models.EventRankingLog{})
+	}
+	server, client := setupTestServer(t, handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	results, err := client.GetEventIdolRankingLogs(ctx, 1, 100, nil)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, results)
+}
+
+// metricValue returns the value of the counter of the metrics registry with the given name and labels.
+func metricValue(t *testing.T, name string, labels map[string]string) float64 {
+	families, err := metrics.Registry.Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if value, ok := labels[label.GetName()]; ok && value != label.GetValue() {
+					continue metrics
+				}
+			}
+			return metric.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestSendGetRequest_RecordsMetrics(t *testing.T) {
+	var requests atomic.Int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("[]"))
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+	client := NewMatsurihiMeClient(server.URL).SetRateLimit(0, 0)
+	client.httpClient.SetRetryWaitTime(time.Millisecond).SetRetryMaxWaitTime(time.Millisecond)
+
+	labels := map[string]string{"endpoint": ENDPOINT_EVENTS, "code": "200"}
+	requestsBefore := metricValue(t, "matsuri_api_requests_total", labels)
+	retriesBefore := metricValue(t, "matsuri_api_retries_total", labels)
+
+	_, err := client.GetEvents(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), requests.Load())
+	assert.Equal(t, 1.0, metricValue(t, "matsuri_api_requests_total", labels)-requestsBefore)
+	assert.Equal(t, 1.0, metricValue(t, "matsuri_api_retries_total", labels)-retriesBefore)
+}
+
+func TestRateLimit_AppliesToRetries(t *testing.T) {
+	var requests atomic.Int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("[]"))
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+	// The limiter refills too slowly to matter, so that each attempt takes one of the two tokens
+	client := NewMatsurihiMeClient(server.URL).SetRateLimit(0.001, 2)
+	client.httpClient.SetRetryWaitTime(time.Millisecond).SetRetryMaxWaitTime(time.Millisecond)
+
+	_, err := client.GetEvents(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, requests.Load())
+	assert.Less(t, client.limiter.Tokens(), 0.5, "the retry waited for a token")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = client.GetEvents(ctx, nil)
+	assert.Error(t, err, "the wait for a token is bounded by the context")
+	assert.EqualValues(t, 2, requests.Load())
 }
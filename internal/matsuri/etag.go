@@ -0,0 +1,71 @@
+package matsuri
+
+import (
+	"strings"
+	"sync"
+)
+
+// etagCache keeps the ETags of ranking log responses keyed by request URL.
+// ETags loaded from a previous run are used for conditional requests, while only
+// the ETags seen during this run are reported back for persisting.
+type etagCache struct {
+	mu     sync.Mutex
+	loaded map[string]string
+	seen   map[string]string
+}
+
+func newETagCache() *etagCache {
+	return &etagCache{
+		loaded: make(map[string]string),
+		seen:   make(map[string]string),
+	}
+}
+
+func (c *etagCache) load(etags map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for url, etag := range etags {
+		c.loaded[url] = etag
+	}
+}
+
+func (c *etagCache) get(url string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if etag, ok := c.seen[url]; ok {
+		return etag
+	}
+	return c.loaded[url]
+}
+
+func (c *etagCache) set(url, etag string) {
+	if etag == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seen[url] = etag
+}
+
+// forget drops the ETags of the URLs starting with prefix, both loaded and seen.
+func (c *etagCache) forget(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, etags := range []map[string]string{c.loaded, c.seen} {
+		for url := range etags {
+			if strings.HasPrefix(url, prefix) {
+				delete(etags, url)
+			}
+		}
+	}
+}
+
+func (c *etagCache) snapshot() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	etags := make(map[string]string, len(c.seen))
+	for url, etag := range c.seen {
+		etags[url] = etag
+	}
+	return etags
+}
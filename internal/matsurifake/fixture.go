@@ -0,0 +1,64 @@
+package matsurifake
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/alceccentric/matsurihi-cron/models"
+)
+
+//go:embed default_fixture.json
+var defaultFixture []byte
+
+// Fixture is the data served by a fake server, in the JSON format of the matsurihi.me API.
+type Fixture struct {
+	Events []models.Event `json:"events"`
+	// RankingBorders are the borders of each event, keyed by event ID
+	RankingBorders map[int]models.EventRankingBorders `json:"rankingBorders"`
+	RankingLogs    []RankingLogs                      `json:"rankingLogs"`
+}
+
+// RankingLogs are the ranking logs of a border group. IdolId is only set for idol point groups.
+type RankingLogs struct {
+	EventId     int                      `json:"eventId"`
+	RankingType models.EventRankingType  `json:"rankingType"`
+	IdolId      int                      `json:"idolId,omitempty"`
+	Border      int                      `json:"border"`
+	Logs        []models.EventRankingLog `json:"logs"`
+}
+
+// DefaultFixture returns a small fixture with a theater and a tour event, both supported by the
+// default sync config, and a show time event that is not.
+func DefaultFixture() Fixture {
+	var fixture Fixture
+	if err := json.Unmarshal(defaultFixture, &fixture); err != nil {
+		panic("invalid default fixture: " + err.Error())
+	}
+	return fixture
+}
+
+// LoadFixture reads a fixture from a JSON file.
+func LoadFixture(path string) (Fixture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Fixture{}, fmt.Errorf("failed to read fixture %s: %w", path, err)
+	}
+	var fixture Fixture
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		return Fixture{}, fmt.Errorf("failed to parse fixture %s: %w", path, err)
+	}
+	return fixture, nil
+}
+
+type groupKey struct {
+	eventId     int
+	rankingType models.EventRankingType
+	idolId      int
+	border      int
+}
+
+func (l RankingLogs) key() groupKey {
+	return groupKey{eventId: l.EventId, rankingType: l.RankingType, idolId: l.IdolId, border: l.Border}
+}
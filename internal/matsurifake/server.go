@@ -0,0 +1,361 @@
+package matsurifake
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/sirupsen/logrus"
+)
+
+// Fault makes the requests whose path starts with PathPrefix fail with StatusCode.
+type Fault struct {
+	PathPrefix string
+	StatusCode int
+	// Times is how many matching requests fail before the fault clears; every one fails when 0
+	Times int
+	// Probability is the share of the matching requests that fail; every one fails when 0
+	Probability float64
+}
+
+type faultState struct {
+	Fault
+	failed int
+}
+
+// Server is a fake of the matsurihi.me API serving a fixture, so that the client and the jobs can
+// run end-to-end without network. It serves the API at the root of its URL, which is the base URL
+// the client is given. Like the API, every response carries an ETag, conditional requests are
+// answered with 304 Not Modified, and ranking logs can be fetched since a given time.
+type Server struct {
+	mu       sync.Mutex
+	events   []models.Event
+	borders  map[int]models.EventRankingBorders
+	logs     map[groupKey][]models.EventRankingLog
+	faults   []*faultState
+	latency  time.Duration
+	requests map[string]int
+	random   *rand.Rand
+}
+
+func NewServer(fixture Fixture) *Server {
+	s := &Server{
+		events:   fixture.Events,
+		borders:  fixture.RankingBorders,
+		logs:     make(map[groupKey][]models.EventRankingLog, len(fixture.RankingLogs)),
+		requests: make(map[string]int),
+		random:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if s.borders == nil {
+		s.borders = make(map[int]models.EventRankingBorders)
+	}
+	for _, logs := range fixture.RankingLogs {
+		s.logs[logs.key()] = logs.Logs
+	}
+	return s
+}
+
+// SetLatency delays every response by latency, e.g. to exercise timeouts.
+func (s *Server) SetLatency(latency time.Duration) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = latency
+	return s
+}
+
+// AddFault injects a fault. Faults are checked in the order they were added, the first one
+// failing a request decides its status code.
+func (s *Server) AddFault(fault Fault) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &faultState{Fault: fault})
+	return s
+}
+
+// ClearFaults removes every injected fault.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// SetRankingLogs replaces the ranking logs of a border group, e.g. to serve new aggregations.
+func (s *Server) SetRankingLogs(logs RankingLogs) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logs[logs.key()] = logs.Logs
+}
+
+// Requests returns how many requests were received on path, failed ones included.
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// Handler serves the API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /events", s.handleEvents)
+	mux.HandleFunc("GET /events/{id}", s.handleEvent)
+	mux.HandleFunc("GET /events/{id}/rankings/borders", s.handleRankingBorders)
+	mux.HandleFunc("GET /events/{id}/rankings/{type}/logs/{border}", s.handleRankingLogs)
+	mux.HandleFunc("GET /events/{id}/rankings/idolPoint/{idolId}/logs/{border}", s.handleRankingLogs)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		latency, status := s.intercept(r)
+		if latency > 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(latency):
+			}
+		}
+		if status != 0 {
+			if status == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", "1")
+			}
+			writeError(w, status, "injected fault")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// intercept counts a request and returns the latency to apply to it and the status code of the fault
+// failing it, if any.
+func (s *Server) intercept(r *http.Request) (time.Duration, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[r.URL.Path]++
+	for _, fault := range s.faults {
+		if !strings.HasPrefix(r.URL.Path, fault.PathPrefix) {
+			continue
+		}
+		if fault.Times > 0 && fault.failed >= fault.Times {
+			continue
+		}
+		if fault.Probability > 0 && s.random.Float64() >= fault.Probability {
+			continue
+		}
+		fault.failed++
+		return s.latency, fault.StatusCode
+	}
+	return s.latency, 0
+}
+
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var at time.Time
+	if value := query.Get("at"); value != "" {
+		var err error
+		if at, err = time.Parse(time.RFC3339, value); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid at: "+value)
+			return
+		}
+	}
+	types := make(map[int]bool)
+	for _, value := range splitQuery(query.Get("type")) {
+		eventType, err := strconv.Atoi(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid type: "+value)
+			return
+		}
+		types[eventType] = true
+	}
+	orderBys := splitQuery(query.Get("orderBy"))
+	for _, orderBy := range orderBys {
+		if _, ok := eventSortKeys[strings.TrimSuffix(orderBy, "!")]; !ok {
+			writeError(w, http.StatusBadRequest, "invalid orderBy: "+orderBy)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	events := make([]models.Event, 0, len(s.events))
+	for _, event := range s.events {
+		if len(types) > 0 && !types[event.Type] {
+			continue
+		}
+		if !at.IsZero() && (at.Before(event.Schedule.BeginAt) || !at.Before(event.Schedule.EndAt)) {
+			continue
+		}
+		events = append(events, event)
+	}
+	s.mu.Unlock()
+
+	sortEvents(events, orderBys)
+	writeJSON(w, r, events)
+}
+
+func (s *Server) handleEvent(w http.ResponseWriter, r *http.Request) {
+	event, ok := s.findEvent(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, r, event)
+}
+
+func (s *Server) handleRankingBorders(w http.ResponseWriter, r *http.Request) {
+	event, ok := s.findEvent(w, r)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	borders := s.borders[event.Id]
+	s.mu.Unlock()
+	writeJSON(w, r, borders)
+}
+
+// handleRankingLogs serves the ranking logs of a border group, only with the aggregations after the
+// since parameter when given. Border groups missing from the fixture have no logs.
+func (s *Server) handleRankingLogs(w http.ResponseWriter, r *http.Request) {
+	event, ok := s.findEvent(w, r)
+	if !ok {
+		return
+	}
+	key := groupKey{eventId: event.Id, rankingType: models.EventRankingType(r.PathValue("type"))}
+	if idolId := r.PathValue("idolId"); idolId != "" {
+		key.rankingType = models.IdolPoint
+		var err error
+		if key.idolId, err = strconv.Atoi(idolId); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid idol: "+idolId)
+			return
+		}
+	}
+	if !isRankingType(key.rankingType) {
+		writeError(w, http.StatusNotFound, "unknown ranking type: "+string(key.rankingType))
+		return
+	}
+	border, err := strconv.Atoi(r.PathValue("border"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid border: "+r.PathValue("border"))
+		return
+	}
+	key.border = border
+
+	var since time.Time
+	if value := r.URL.Query().Get("since"); value != "" {
+		if since, err = time.Parse(time.RFC3339, value); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid since: "+value)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	logs := logsSince(s.logs[key], since)
+	s.mu.Unlock()
+	writeJSON(w, r, logs)
+}
+
+func (s *Server) findEvent(w http.ResponseWriter, r *http.Request) (models.Event, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid event: "+r.PathValue("id"))
+		return models.Event{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, event := range s.events {
+		if event.Id == id {
+			return event, true
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Sprintf("event %d not found", id))
+	return models.Event{}, false
+}
+
+// logsSince returns a copy of the ranking logs with only the aggregations after since, all of them when since is zero.
+func logsSince(logs []models.EventRankingLog, since time.Time) []models.EventRankingLog {
+	filtered := make([]models.EventRankingLog, 0, len(logs))
+	for _, log := range logs {
+		copied := models.EventRankingLog{Rank: log.Rank, Data: log.Data[:0:0]}
+		for _, data := range log.Data {
+			if since.IsZero() || data.AggregatedAt.After(since) {
+				copied.Data = append(copied.Data, data)
+			}
+		}
+		filtered = append(filtered, copied)
+	}
+	return filtered
+}
+
+var eventSortKeys = map[string]func(a, b models.Event) int{
+	string(models.IdAsc):      func(a, b models.Event) int { return a.Id - b.Id },
+	string(models.TypeAsc):    func(a, b models.Event) int { return a.Type - b.Type },
+	string(models.BeginAtAsc): func(a, b models.Event) int { return a.Schedule.BeginAt.Compare(b.Schedule.BeginAt) },
+}
+
+// sortEvents sorts events by the given sort types, by ID when none is given.
+func sortEvents(events []models.Event, orderBys []string) {
+	if len(orderBys) == 0 {
+		orderBys = []string{string(models.IdAsc)}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		for _, orderBy := range orderBys {
+			compare := eventSortKeys[strings.TrimSuffix(orderBy, "!")](events[i], events[j])
+			if strings.HasSuffix(orderBy, "!") {
+				compare = -compare
+			}
+			if compare != 0 {
+				return compare < 0
+			}
+		}
+		return false
+	})
+}
+
+func isRankingType(rankingType models.EventRankingType) bool {
+	switch rankingType {
+	case models.EventPoint, models.HighScore, models.HighScore2, models.HighScoreTotal, models.LoungePoint, models.IdolPoint:
+		return true
+	default:
+		return false
+	}
+}
+
+func splitQuery(value string) []string {
+	var parts []string
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// writeJSON writes v with an ETag derived from its encoding, or 304 Not Modified when the request
+// already has it.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(body); err != nil {
+		logrus.WithError(err).Debugf("Failed to write response to %s", r.URL.Path)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
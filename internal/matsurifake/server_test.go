@@ -0,0 +1,187 @@
+package matsurifake
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func serve(handler http.Handler, path string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func eventIds(t *testing.T, rec *httptest.ResponseRecorder) []int {
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var events []models.Event
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &events))
+	ids := make([]int, 0, len(events))
+	for _, event := range events {
+		ids = append(ids, event.Id)
+	}
+	return ids
+}
+
+func TestServer_Events(t *testing.T) {
+	handler := NewServer(DefaultFixture()).Handler()
+
+	assert.Equal(t, []int{1, 2, 3}, eventIds(t, serve(handler, "/events", nil)))
+	assert.Equal(t, []int{3, 2, 1}, eventIds(t, serve(handler, "/events?orderBy=id!", nil)))
+	assert.Equal(t, []int{2, 1}, eventIds(t, serve(handler, "/events?type=3,4&orderBy=type!", nil)))
+	at := url.QueryEscape("2024-05-13T00:00:00+09:00")
+	assert.Equal(t, []int{2}, eventIds(t, serve(handler, "/events?at="+at, nil)))
+
+	assert.Equal(t, http.StatusBadRequest, serve(handler, "/events?orderBy=name", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(handler, "/events?type=theater", nil).Code)
+
+	rec := serve(handler, "/events/2", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var event models.Event
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &event))
+	assert.Equal(t, 4, event.Type)
+	assert.Equal(t, http.StatusNotFound, serve(handler, "/events/9", nil).Code)
+}
+
+func TestServer_RankingBorders(t *testing.T) {
+	handler := NewServer(DefaultFixture()).Handler()
+
+	rec := serve(handler, "/events/1/rankings/borders", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var borders models.EventRankingBorders
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &borders))
+	assert.Equal(t, []int{100, 2500, 5000}, borders.EventPoint)
+
+	assert.Equal(t, http.StatusNotFound, serve(handler, "/events/9/rankings/borders", nil).Code)
+}
+
+func TestServer_RankingLogsSince(t *testing.T) {
+	handler := NewServer(DefaultFixture()).Handler()
+
+	var logs []models.EventRankingLog
+	rec := serve(handler, "/events/1/rankings/eventPoint/logs/100", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &logs))
+	assert.Len(t, logs, 1)
+	assert.Len(t, logs[0].Data, 6)
+
+	since := logs[0].Data[3].AggregatedAt
+	rec = serve(handler, "/events/1/rankings/eventPoint/logs/100?since="+url.QueryEscape(since.Format(time.RFC3339)), nil)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &logs))
+	assert.Len(t, logs[0].Data, 2)
+	assert.True(t, logs[0].Data[0].AggregatedAt.After(since))
+
+	// Border groups missing from the fixture of known events have no logs
+	rec = serve(handler, "/events/1/rankings/loungePoint/logs/10", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, "[]", rec.Body.String())
+
+	assert.Equal(t, http.StatusNotFound, serve(handler, "/events/9/rankings/eventPoint/logs/100", nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve(handler, "/events/1/rankings/unknown/logs/100", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(handler, "/events/1/rankings/eventPoint/logs/top", nil).Code)
+}
+
+func TestServer_IdolRankingLogs(t *testing.T) {
+	s := NewServer(DefaultFixture())
+	handler := s.Handler()
+	at := time.Date(2024, 5, 1, 6, 30, 0, 0, time.UTC)
+	s.SetRankingLogs(RankingLogs{
+		EventId:     1,
+		RankingType: models.IdolPoint,
+		IdolId:      7,
+		Border:      10,
+		Logs: []models.EventRankingLog{{Rank: 10, Data: []struct {
+			Score        int       `json:"score"`
+			AggregatedAt time.Time `json:"aggregatedAt"`
+		}{{Score: 42, AggregatedAt: at}}}},
+	})
+
+	rec := serve(handler, "/events/1/rankings/idolPoint/7/logs/10", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var logs []models.EventRankingLog
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &logs))
+	assert.Equal(t, 42, logs[0].Data[0].Score)
+	assert.True(t, at.Equal(logs[0].Data[0].AggregatedAt))
+
+	rec = serve(handler, "/events/1/rankings/idolPoint/8/logs/10", nil)
+	assert.JSONEq(t, "[]", rec.Body.String())
+}
+
+func TestServer_ETag(t *testing.T) {
+	s := NewServer(DefaultFixture())
+	handler := s.Handler()
+	path := "/events/1/rankings/eventPoint/logs/100"
+
+	rec := serve(handler, path, nil)
+	etag := rec.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	rec = serve(handler, path, map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Empty(t, rec.Body.Bytes())
+
+	// New aggregations change the ETag
+	logs := DefaultFixture().RankingLogs[0]
+	logs.Logs[0].Data = logs.Logs[0].Data[:1]
+	s.SetRankingLogs(logs)
+	rec = serve(handler, path, map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotEqual(t, etag, rec.Header().Get("ETag"))
+	assert.Equal(t, 3, s.Requests(path))
+}
+
+func TestServer_Faults(t *testing.T) {
+	s := NewServer(DefaultFixture()).
+		AddFault(Fault{PathPrefix: "/events/1/rankings", StatusCode: http.StatusTooManyRequests, Times: 2}).
+		AddFault(Fault{PathPrefix: "/events/2", StatusCode: http.StatusServiceUnavailable})
+	handler := s.Handler()
+
+	for i := 0; i < 2; i++ {
+		rec := serve(handler, "/events/1/rankings/borders", nil)
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	}
+	assert.Equal(t, http.StatusOK, serve(handler, "/events/1/rankings/borders", nil).Code)
+	assert.Equal(t, http.StatusOK, serve(handler, "/events/1", nil).Code)
+	assert.Equal(t, http.StatusServiceUnavailable, serve(handler, "/events/2", nil).Code)
+	assert.Equal(t, 3, s.Requests("/events/1/rankings/borders"))
+
+	s.ClearFaults()
+	assert.Equal(t, http.StatusOK, serve(handler, "/events/2", nil).Code)
+}
+
+func TestServer_Latency(t *testing.T) {
+	handler := NewServer(DefaultFixture()).SetLatency(50 * time.Millisecond).Handler()
+
+	startedAt := time.Now()
+	assert.Equal(t, http.StatusOK, serve(handler, "/events/1", nil).Code)
+	assert.GreaterOrEqual(t, time.Since(startedAt), 50*time.Millisecond)
+
+	// Canceled requests are not answered
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, "/events/1", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Empty(t, rec.Body.Bytes())
+}
+
+func TestLoadFixture(t *testing.T) {
+	_, err := LoadFixture("missing.json")
+	assert.Error(t, err)
+
+	fixture := DefaultFixture()
+	assert.Len(t, fixture.Events, 3)
+	assert.Contains(t, fixture.RankingBorders, 1)
+}
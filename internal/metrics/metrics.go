@@ -0,0 +1,153 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/internal/logging"
+	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const NAMESPACE = "matsuri"
+
+// Jobs whose runs are measured
+const (
+	JOB_SYNC     = "sync"
+	JOB_DAEMON   = "daemon"
+	JOB_BACKFILL = "backfill"
+	JOB_VERIFY   = "verify"
+)
+
+// Outcomes of a run
+const (
+	OUTCOME_SUCCESS = "success"
+	OUTCOME_FAILURE = "failure"
+	// The run succeeded but some border groups could not be fetched
+	OUTCOME_PARTIAL             = "partial"
+	OUTCOME_NO_SUPPORTED_EVENTS = "no_supported_events"
+)
+
+// Status code label of API requests that failed without a response
+const STATUS_CODE_ERROR = "error"
+
+// Registry holds every metric of the process. It is separate from the default registry
+// so that the dumps of one-shot runs only contain the metrics of this package.
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+var (
+	apiRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "api_requests_total",
+		Help:      "Requests sent to matsurihi.me by endpoint and final status code.",
+	}, []string{"endpoint", "code"})
+	apiRequestDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "api_request_duration_seconds",
+		Help:      "Duration of the requests sent to matsurihi.me, retries included.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"endpoint"})
+	apiRetries = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "api_retries_total",
+		Help:      "Retries of the requests sent to matsurihi.me by endpoint.",
+	}, []string{"endpoint"})
+
+	borderRows = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "border_rows_collected_total",
+		Help:      "Border infos collected by event, ranking type and border.",
+	}, []string{"event_id", "ranking_type", "border"})
+
+	daoWriteDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "dao_write_duration_seconds",
+		Help:      "Duration of the writes to storage by backend.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"backend"})
+	daoWriteBytes = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "dao_write_bytes_total",
+		Help:      "Bytes written to storage by backend; not reported by database backends.",
+	}, []string{"backend"})
+
+	runs = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "runs_total",
+		Help:      "Runs by job and outcome.",
+	}, []string{"job", "outcome"})
+	runDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "run_duration_seconds",
+		Help:      "Duration of the runs by job.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"job"})
+	lastRun = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "last_run_timestamp_seconds",
+		Help:      "Unix time the last run of a job with a given outcome ended.",
+	}, []string{"job", "outcome"})
+)
+
+// ObserveAPIRequest records a request to an endpoint of matsurihi.me, identified by its path template.
+// code is the final status code, or STATUS_CODE_ERROR when no response was received.
+func ObserveAPIRequest(endpoint, code string, duration time.Duration, retries int) {
+	apiRequests.WithLabelValues(endpoint, code).Inc()
+	apiRequestDuration.WithLabelValues(endpoint).Observe(duration.Seconds())
+	if retries > 0 {
+		apiRetries.WithLabelValues(endpoint).Add(float64(retries))
+	}
+}
+
+// AddBorderRows records border infos collected for a border group.
+func AddBorderRows(eventId int, rankingType models.EventRankingType, border, rows int) {
+	borderRows.WithLabelValues(strconv.Itoa(eventId), string(rankingType), strconv.Itoa(border)).Add(float64(rows))
+}
+
+// ObserveDAOWrite records a write of size bytes to a storage backend.
+func ObserveDAOWrite(backend string, duration time.Duration, size int) {
+	daoWriteDuration.WithLabelValues(backend).Observe(duration.Seconds())
+	daoWriteBytes.WithLabelValues(backend).Add(float64(size))
+}
+
+// ObserveRun records the outcome of a run of a job.
+func ObserveRun(job, outcome string, duration time.Duration) {
+	runs.WithLabelValues(job, outcome).Inc()
+	runDuration.WithLabelValues(job).Observe(duration.Seconds())
+	lastRun.WithLabelValues(job, outcome).SetToCurrentTime()
+}
+
+// Handler serves the metrics of Registry in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Serve exposes the metrics on /metrics of addr until ctx is cancelled.
+func Serve(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	logging.FromContext(ctx).WithField("addr", addr).Info("Serving metrics on /metrics")
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// WriteTextfile dumps the metrics to path in the text exposition format, which can be
+// pushed to a Pushgateway or collected by the textfile collector of the node exporter.
+func WriteTextfile(path string) error {
+	return prometheus.WriteToTextfile(path, Registry)
+}
@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteTextfile(t *testing.T) {
+	ObserveRun(JOB_SYNC, OUTCOME_PARTIAL, 3*time.Second)
+	AddBorderRows(42, models.EventPoint, 100, 12)
+	ObserveDAOWrite("local", time.Millisecond, 2048)
+
+	path := filepath.Join(t.TempDir(), "metrics.prom")
+	assert.NoError(t, WriteTextfile(path))
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	text := string(data)
+	assert.Contains(t, text, `matsuri_runs_total{job="sync",outcome="partial"} 1`)
+	assert.Contains(t, text, `matsuri_border_rows_collected_total{border="100",event_id="42",ranking_type="eventPoint"} 12`)
+	assert.Contains(t, text, `matsuri_dao_write_bytes_total{backend="local"} 2048`)
+	assert.Contains(t, text, `matsuri_last_run_timestamp_seconds{job="sync",outcome="partial"}`)
+}
+
+func TestHandler(t *testing.T) {
+	ObserveAPIRequest("/events", "429", time.Second, 2)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `matsuri_api_requests_total{code="429",endpoint="/events"} 1`)
+	assert.Contains(t, rec.Body.String(), `matsuri_api_retries_total{endpoint="/events"} 2`)
+}
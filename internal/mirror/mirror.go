@@ -0,0 +1,344 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/internal/dao"
+	"github.com/alceccentric/matsurihi-cron/internal/logging"
+	"github.com/alceccentric/matsurihi-cron/internal/utils"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.uber.org/multierr"
+)
+
+const (
+	DEFAULT_CONCURRENCY = 8
+	// File at the root of the destination recording the remote objects the local files were downloaded from
+	STATE_FILE = ".mirror_state.json"
+)
+
+// S3Client is the part of the S3 API a mirror reads the bucket with.
+type S3Client interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+}
+
+type Options struct {
+	Bucket string
+	// Dest is the local directory the objects are mirrored into, under their key
+	Dest string
+	// Prefixes restrict the mirror to the objects under one of them; every object is mirrored when empty
+	Prefixes []string
+	// EventIds restrict the objects of events, border infos and predictions, to these events.
+	// The objects of no single event are always mirrored.
+	EventIds []int
+	// Concurrency is how many objects are downloaded in parallel
+	Concurrency int
+	// Delete removes the local copies of mirrored objects that were deleted from the bucket
+	Delete bool
+}
+
+// ObjectState is what is known of the remote object a local file was downloaded from.
+type ObjectState struct {
+	ETag         string    `json:"etag"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// Summary counts what a mirror run did. Failed holds the error of each object that failed to be
+// downloaded or deleted, keyed by object key.
+type Summary struct {
+	Listed     int
+	Downloaded int
+	Unchanged  int
+	Deleted    int
+	Failed     map[string]error
+}
+
+func (s Summary) String() string {
+	return fmt.Sprintf("%d objects listed, %d downloaded, %d unchanged, %d deleted, %d failed",
+		s.Listed, s.Downloaded, s.Unchanged, s.Deleted, len(s.Failed))
+}
+
+// Run mirrors the objects of a bucket into a local directory. Only the objects whose ETag, size or
+// last modification time changed since they were last mirrored are downloaded, in parallel. Objects
+// are written atomically, so that a failed download leaves the previous copy in place.
+// Failing objects do not stop the run: the error returned sums them up once every object was tried.
+func Run(ctx context.Context, client S3Client, opts Options) (Summary, error) {
+	logger := logging.FromContext(ctx)
+	summary := Summary{Failed: make(map[string]error)}
+
+	statePath := filepath.Join(opts.Dest, STATE_FILE)
+	state, err := loadState(statePath)
+	if err != nil {
+		return summary, err
+	}
+
+	objects, err := listObjects(ctx, client, opts)
+	if err != nil {
+		return summary, err
+	}
+	summary.Listed = len(objects)
+
+	var toDownload []string
+	for key, listed := range objects {
+		if isUpToDate(opts.Dest, key, state[key], listed) {
+			summary.Unchanged++
+			continue
+		}
+		toDownload = append(toDownload, key)
+	}
+	sort.Strings(toDownload)
+	logger.Infof("Mirroring %d of %d objects of bucket %s into %s", len(toDownload), len(objects), opts.Bucket, opts.Dest)
+
+	var mu sync.Mutex
+	downloadAll(ctx, toDownload, opts.Concurrency, func(key string) {
+		downloaded, err := download(ctx, client, opts.Bucket, opts.Dest, key)
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			summary.Failed[key] = err
+			return
+		}
+		state[key] = downloaded
+		summary.Downloaded++
+	})
+	if err := ctx.Err(); err != nil {
+		return summary, multierr.Append(err, saveState(statePath, state))
+	}
+
+	if opts.Delete {
+		for key := range state {
+			if _, ok := objects[key]; ok || !inScope(key, opts) {
+				continue
+			}
+			if err := deleteLocal(opts.Dest, key); err != nil {
+				summary.Failed[key] = err
+				continue
+			}
+			delete(state, key)
+			summary.Deleted++
+		}
+	}
+
+	if err := saveState(statePath, state); err != nil {
+		return summary, err
+	}
+	if len(summary.Failed) > 0 {
+		return summary, failuresError(summary.Failed)
+	}
+	return summary, nil
+}
+
+// listObjects lists the objects of the bucket in the scope of the options, keyed by key.
+func listObjects(ctx context.Context, client S3Client, opts Options) (map[string]ObjectState, error) {
+	prefixes := opts.Prefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+	objects := make(map[string]ObjectState)
+	for _, prefix := range prefixes {
+		paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+			Bucket: aws.String(opts.Bucket),
+			Prefix: aws.String(prefix),
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list objects with prefix %s: %w", prefix, err)
+			}
+			for _, object := range page.Contents {
+				key := aws.ToString(object.Key)
+				if !inScope(key, opts) {
+					continue
+				}
+				objects[key] = ObjectState{
+					ETag:         aws.ToString(object.ETag),
+					Size:         aws.ToInt64(object.Size),
+					LastModified: aws.ToTime(object.LastModified),
+				}
+			}
+		}
+	}
+	return objects, nil
+}
+
+// inScope reports whether an object is selected by the prefix and event filters of the options.
+func inScope(key string, opts Options) bool {
+	if len(opts.Prefixes) > 0 {
+		matched := false
+		for _, prefix := range opts.Prefixes {
+			if strings.HasPrefix(key, prefix) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(opts.EventIds) == 0 {
+		return true
+	}
+	eventId, ok := dao.ObjectEventId(key)
+	if !ok {
+		return true
+	}
+	for _, id := range opts.EventIds {
+		if id == eventId {
+			return true
+		}
+	}
+	return false
+}
+
+// isUpToDate reports whether the local copy of an object was downloaded from its listed version.
+func isUpToDate(dest, key string, mirrored, listed ObjectState) bool {
+	if mirrored.ETag != listed.ETag || mirrored.Size != listed.Size || !mirrored.LastModified.Equal(listed.LastModified) {
+		return false
+	}
+	localPath, err := localPath(dest, key)
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(localPath)
+	return err == nil && info.Size() == listed.Size
+}
+
+// downloadAll calls download for every key, from up to concurrency goroutines, until ctx is cancelled.
+func downloadAll(ctx context.Context, keys []string, concurrency int, download func(key string)) {
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < min(max(concurrency, 1), len(keys)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range queue {
+				download(key)
+			}
+		}()
+	}
+feed:
+	for _, key := range keys {
+		select {
+		case <-ctx.Done():
+			break feed
+		case queue <- key:
+		}
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// download writes an object to its local path and returns the version that was downloaded,
+// which may be newer than the listed one.
+func download(ctx context.Context, client S3Client, bucket, dest, key string) (ObjectState, error) {
+	localPath, err := localPath(dest, key)
+	if err != nil {
+		return ObjectState{}, err
+	}
+	logging.FromContext(ctx).WithField(logging.FIELD_OBJECT_KEY, key).Debug("Downloading object")
+
+	resp, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return ObjectState{}, fmt.Errorf("failed to get object: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if err := utils.CreateDirectoryIfNotExists(filepath.Dir(localPath)); err != nil {
+		return ObjectState{}, err
+	}
+	var size int64
+	if err := utils.WriteFileAtomic(localPath, func(file *os.File) error {
+		size, err = io.Copy(file, resp.Body)
+		if err != nil {
+			return fmt.Errorf("failed to download object: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return ObjectState{}, err
+	}
+
+	downloaded := ObjectState{ETag: aws.ToString(resp.ETag), Size: size, LastModified: aws.ToTime(resp.LastModified)}
+	if !downloaded.LastModified.IsZero() {
+		// Best effort: the modification time only helps humans browsing the mirror
+		_ = os.Chtimes(localPath, downloaded.LastModified, downloaded.LastModified)
+	}
+	return downloaded, nil
+}
+
+func deleteLocal(dest, key string) error {
+	localPath, err := localPath(dest, key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(localPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete local copy: %w", err)
+	}
+	return nil
+}
+
+// localPath returns the path an object is mirrored to, refusing keys that would escape dest.
+func localPath(dest, key string) (string, error) {
+	if key == "" || key == STATE_FILE || !filepath.IsLocal(filepath.FromSlash(key)) {
+		return "", fmt.Errorf("object key %q cannot be mirrored under %s", key, dest)
+	}
+	return filepath.Join(dest, filepath.FromSlash(key)), nil
+}
+
+// loadState reads the state of the mirror at path, which is empty before the first run.
+func loadState(path string) (map[string]ObjectState, error) {
+	state := make(map[string]ObjectState)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mirror state %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse mirror state %s: %w", path, err)
+	}
+	return state, nil
+}
+
+func saveState(path string, state map[string]ObjectState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal mirror state: %w", err)
+	}
+	if err := utils.CreateDirectoryIfNotExists(filepath.Dir(path)); err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(path, func(file *os.File) error {
+		_, err := file.Write(data)
+		return err
+	})
+}
+
+// failuresError combines the failures of a run in key order.
+func failuresError(failed map[string]error) error {
+	keys := make([]string, 0, len(failed))
+	for key := range failed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var err error
+	for _, key := range keys {
+		err = multierr.Append(err, fmt.Errorf("%s: %w", key, failed[key]))
+	}
+	return fmt.Errorf("failed to mirror %d objects: %w", len(keys), err)
+}
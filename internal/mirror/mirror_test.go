@@ -0,0 +1,151 @@
+package mirror
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alceccentric/matsurihi-cron/internal/s3fake"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testBucket = "bucket"
+
+// newTestClient serves storage through handler, which defaults to the storage handler.
+func newTestClient(t *testing.T, storage *s3fake.Server, handler http.Handler) *s3.Client {
+	if handler == nil {
+		handler = storage.Handler()
+	}
+	httpServer := httptest.NewServer(handler)
+	t.Cleanup(httpServer.Close)
+	return s3.New(s3.Options{
+		BaseEndpoint: aws.String(httpServer.URL),
+		Region:       "auto",
+		Credentials:  credentials.NewStaticCredentialsProvider("key", "secret", ""),
+		UsePathStyle: true,
+	})
+}
+
+func readLocal(t *testing.T, dest, key string) string {
+	data, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(key)))
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestRun_Incremental(t *testing.T) {
+	storage := s3fake.NewServer().SetPageSize(2)
+	storage.PutObject(testBucket, "b/border_info_1_0_100.csv", []byte("one"))
+	storage.PutObject(testBucket, "b/border_info_2_0_100.csv", []byte("two"))
+	storage.PutObject(testBucket, "e/event_info_all.csv", []byte("events"))
+	client := newTestClient(t, storage, nil)
+	dest := t.TempDir()
+	opts := Options{Bucket: testBucket, Dest: dest, Concurrency: 2}
+	ctx := context.Background()
+
+	summary, err := Run(ctx, client, opts)
+	require.NoError(t, err)
+	assert.Equal(t, Summary{Listed: 3, Downloaded: 3, Failed: map[string]error{}}, summary)
+	assert.Equal(t, "one", readLocal(t, dest, "b/border_info_1_0_100.csv"))
+	assert.Equal(t, "events", readLocal(t, dest, "e/event_info_all.csv"))
+
+	// Only changed objects are downloaded again
+	storage.PutObject(testBucket, "b/border_info_2_0_100.csv", []byte("two, updated"))
+	summary, err = Run(ctx, client, opts)
+	require.NoError(t, err)
+	assert.Equal(t, 1, summary.Downloaded)
+	assert.Equal(t, 2, summary.Unchanged)
+	assert.Equal(t, "two, updated", readLocal(t, dest, "b/border_info_2_0_100.csv"))
+
+	// Local copies altered since they were mirrored are downloaded again
+	require.NoError(t, os.WriteFile(filepath.Join(dest, "e", "event_info_all.csv"), []byte("truncated"), 0644))
+	summary, err = Run(ctx, client, opts)
+	require.NoError(t, err)
+	assert.Equal(t, 1, summary.Downloaded)
+	assert.Equal(t, "events", readLocal(t, dest, "e/event_info_all.csv"))
+}
+
+func TestRun_Filters(t *testing.T) {
+	storage := s3fake.NewServer()
+	storage.PutObject(testBucket, "b/border_info_1_0_100.csv", []byte("one"))
+	storage.PutObject(testBucket, "b/border_info_2_highScore_0_100.csv", []byte("two"))
+	storage.PutObject(testBucket, "b/border_prediction_2.json", []byte("{}"))
+	storage.PutObject(testBucket, "b/notes.txt", []byte("notes"))
+	storage.PutObject(testBucket, "m/etags.json", []byte("{}"))
+	dest := t.TempDir()
+
+	summary, err := Run(context.Background(), newTestClient(t, storage, nil), Options{
+		Bucket:   testBucket,
+		Dest:     dest,
+		Prefixes: []string{"b/"},
+		EventIds: []int{2},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, summary.Downloaded)
+	assert.FileExists(t, filepath.Join(dest, "b", "border_info_2_highScore_0_100.csv"))
+	assert.FileExists(t, filepath.Join(dest, "b", "border_prediction_2.json"))
+	assert.FileExists(t, filepath.Join(dest, "b", "notes.txt"), "objects of no event are kept")
+	assert.NoFileExists(t, filepath.Join(dest, "b", "border_info_1_0_100.csv"))
+	assert.NoFileExists(t, filepath.Join(dest, "m", "etags.json"))
+}
+
+func TestRun_Delete(t *testing.T) {
+	storage := s3fake.NewServer()
+	storage.PutObject(testBucket, "b/border_info_1_0_100.csv", []byte("one"))
+	storage.PutObject(testBucket, "m/etags.json", []byte("{}"))
+	client := newTestClient(t, storage, nil)
+	dest := t.TempDir()
+	ctx := context.Background()
+	_, err := Run(ctx, client, Options{Bucket: testBucket, Dest: dest})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dest, "b", "local.csv"), []byte("mine"), 0644))
+
+	removed := s3fake.NewServer()
+	removed.CreateBucket(testBucket)
+	client = newTestClient(t, removed, nil)
+
+	// Out of scope or without -delete, local copies are kept
+	summary, err := Run(ctx, client, Options{Bucket: testBucket, Dest: dest})
+	require.NoError(t, err)
+	assert.Zero(t, summary.Deleted)
+	summary, err = Run(ctx, client, Options{Bucket: testBucket, Dest: dest, Prefixes: []string{"b/"}, Delete: true})
+	require.NoError(t, err)
+	assert.Equal(t, 1, summary.Deleted)
+	assert.NoFileExists(t, filepath.Join(dest, "b", "border_info_1_0_100.csv"))
+	assert.FileExists(t, filepath.Join(dest, "m", "etags.json"))
+	assert.FileExists(t, filepath.Join(dest, "b", "local.csv"), "files that were not mirrored are never deleted")
+}
+
+func TestRun_ReportsFailures(t *testing.T) {
+	storage := s3fake.NewServer()
+	storage.PutObject(testBucket, "b/border_info_1_0_100.csv", []byte("one"))
+	storage.PutObject(testBucket, "b/border_info_2_0_100.csv", []byte("two"))
+	storage.PutObject(testBucket, "../escape.csv", []byte("escape"))
+	failing := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "border_info_2_0_100.csv") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		storage.Handler().ServeHTTP(w, r)
+	})
+	client := newTestClient(t, storage, failing)
+	dest := filepath.Join(t.TempDir(), "mirror")
+
+	summary, err := Run(context.Background(), client, Options{Bucket: testBucket, Dest: dest})
+	assert.ErrorContains(t, err, "failed to mirror 2 objects")
+	assert.Equal(t, 1, summary.Downloaded)
+	assert.Contains(t, summary.Failed, "b/border_info_2_0_100.csv")
+	assert.Contains(t, summary.Failed, "../escape.csv")
+	assert.NoFileExists(t, filepath.Join(dest, "..", "escape.csv"))
+
+	// The objects that succeeded are not downloaded again
+	summary, _ = Run(context.Background(), client, Options{Bucket: testBucket, Dest: dest})
+	assert.Equal(t, 1, summary.Unchanged)
+}
@@ -0,0 +1,286 @@
+package predict
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/internal/dao"
+	"github.com/alceccentric/matsurihi-cron/internal/logging"
+	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DEFAULT_MAX_SIMILAR_EVENTS = 5
+	// At least this many similar events are needed to estimate the spread of a prediction
+	MIN_SIMILAR_EVENTS = 2
+	// Confidence level of the prediction intervals
+	CONFIDENCE_LEVEL = 0.9
+	// Past events are only used when their border infos were collected until this close to their end
+	FINAL_SCORE_TOLERANCE = time.Hour
+)
+
+// Quantiles of Student's t-distribution at (1+CONFIDENCE_LEVEL)/2, indexed by degrees of freedom.
+// The normal quantile is used beyond the table.
+var tQuantiles = []float64{0, 6.314, 2.920, 2.353, 2.132, 2.015, 1.943, 1.895, 1.860, 1.833, 1.812}
+
+const normalQuantile = 1.645
+
+// Predictor estimates the final borders of an event from the stored border infos of
+// past events of the same internal event type.
+//
+// The score of a past event at the same point of its schedule is compared to its final score, and
+// the ratio between them is applied to the current score. Schedules are aligned on their boost when
+// both events have one, as scores pick up once it starts, and on their elapsed share otherwise.
+type Predictor struct {
+	borderDAO        dao.DAO
+	maxSimilarEvents int
+}
+
+func NewPredictor(borderDAO dao.DAO) *Predictor {
+	return &Predictor{
+		borderDAO:        borderDAO,
+		maxSimilarEvents: DEFAULT_MAX_SIMILAR_EVENTS,
+	}
+}
+
+// SetMaxSimilarEvents sets how many of the latest similar events a prediction is based on.
+func (p *Predictor) SetMaxSimilarEvents(maxSimilarEvents int) *Predictor {
+	p.maxSimilarEvents = maxSimilarEvents
+	return p
+}
+
+// PredictEvent predicts the final score of every stored border group of an event from its border infos
+// aggregated until at. Border groups without enough similar past events are skipped.
+func (p *Predictor) PredictEvent(ctx context.Context, eventId int, at time.Time) ([]models.BorderPrediction, error) {
+	eventInfos, err := p.borderDAO.ListEventInfos(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list event infos: %w", err)
+	}
+	event, ok := findEvent(eventInfos, eventId)
+	if !ok {
+		return nil, fmt.Errorf("event %d is not stored", eventId)
+	}
+	similarEvents := findSimilarEvents(eventInfos, event, at)
+
+	groups, err := p.borderDAO.ListBorderGroups(ctx, eventId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list border groups of event %d: %w", eventId, err)
+	}
+
+	predictions := make([]models.BorderPrediction, 0, len(groups))
+	for _, group := range groups {
+		infos, err := p.borderDAO.GetBorderInfos(ctx, group)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get border infos of event %d: %w", eventId, err)
+		}
+		current, ok := latestBefore(infos, at)
+		if !ok {
+			continue
+		}
+
+		var samples []sample
+		for _, similar := range similarEvents {
+			if len(samples) == p.maxSimilarEvents {
+				break
+			}
+			s, ok, err := p.sampleEvent(ctx, similar, group, event, current.AggregatedAt)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				samples = append(samples, s)
+			}
+		}
+
+		prediction, ok := predict(event, current, samples)
+		if !ok {
+			logging.FromContext(ctx).WithFields(logging.BorderFields(eventId, group.RankingType, group.IdolId, group.Border)).
+				Debug("Not enough similar events to predict border group")
+			continue
+		}
+		predictions = append(predictions, prediction)
+	}
+	logging.FromContext(ctx).WithFields(logrus.Fields{
+		logging.FIELD_EVENT_ID: eventId,
+		"predicted_groups":     len(predictions),
+		"border_groups":        len(groups),
+	}).Info("Predicted border groups")
+	return predictions, nil
+}
+
+// sample is the growth of the score of a border group of a past event, from the
+// point of its schedule matching the current event to its end.
+type sample struct {
+	eventId int
+	ratio   float64
+}
+
+// sampleEvent computes the growth of the border group matching group in a past event
+// from the point of its schedule matching at in the current event.
+func (p *Predictor) sampleEvent(
+	ctx context.Context,
+	past models.EventInfo,
+	group dao.BorderGroupKey,
+	current models.EventInfo,
+	at time.Time,
+) (sample, bool, error) {
+	group.EventId = past.EventId
+	infos, err := p.borderDAO.GetBorderInfos(ctx, group)
+	if err != nil {
+		return sample{}, false, fmt.Errorf("failed to get border infos of event %d: %w", past.EventId, err)
+	}
+	if len(infos) == 0 || infos[len(infos)-1].AggregatedAt.Before(past.EndAt.Add(-FINAL_SCORE_TOLERANCE)) {
+		return sample{}, false, nil
+	}
+
+	alignOnBoost := hasBoost(current) && hasBoost(past)
+	scoreThen, ok := scoreAt(infos, timeAt(past, phaseAt(current, at, alignOnBoost), alignOnBoost))
+	if !ok || scoreThen <= 0 {
+		return sample{}, false, nil
+	}
+	return sample{eventId: past.EventId, ratio: float64(infos[len(infos)-1].Score) / scoreThen}, true, nil
+}
+
+// predict applies the growth of the samples to the current score. The prediction interval assumes
+// normally distributed growths, and is never below the current score as scores do not decrease.
+func predict(event models.EventInfo, current models.BorderInfo, samples []sample) (models.BorderPrediction, bool) {
+	if len(samples) < MIN_SIMILAR_EVENTS || current.Score <= 0 {
+		return models.BorderPrediction{}, false
+	}
+
+	n := float64(len(samples))
+	var mean float64
+	similarEventIds := make([]int, 0, len(samples))
+	for _, s := range samples {
+		mean += s.ratio / n
+		similarEventIds = append(similarEventIds, s.eventId)
+	}
+	var variance float64
+	for _, s := range samples {
+		variance += (s.ratio - mean) * (s.ratio - mean) / (n - 1)
+	}
+	margin := tQuantile(len(samples)-1) * math.Sqrt(variance) * math.Sqrt(1+1/n)
+
+	score := float64(current.Score)
+	return models.BorderPrediction{
+		EventId:         current.EventId,
+		IdolId:          current.IdolId,
+		Border:          current.Border,
+		RankingType:     current.RankingType,
+		AggregatedAt:    current.AggregatedAt,
+		Progress:        phaseAt(event, current.AggregatedAt, false),
+		CurrentScore:    current.Score,
+		FinalScore:      int(math.Round(score * math.Max(mean, 1))),
+		LowerBound:      int(math.Round(score * math.Max(mean-margin, 1))),
+		UpperBound:      int(math.Round(score * math.Max(mean+margin, 1))),
+		ConfidenceLevel: CONFIDENCE_LEVEL,
+		SimilarEventIds: similarEventIds,
+	}, true
+}
+
+func tQuantile(degreesOfFreedom int) float64 {
+	if degreesOfFreedom < len(tQuantiles) {
+		return tQuantiles[degreesOfFreedom]
+	}
+	return normalQuantile
+}
+
+func findEvent(eventInfos []models.EventInfo, eventId int) (models.EventInfo, bool) {
+	for _, info := range eventInfos {
+		if info.EventId == eventId {
+			return info, true
+		}
+	}
+	return models.EventInfo{}, false
+}
+
+// findSimilarEvents returns the events of the same internal type as event that ended before at, latest first.
+func findSimilarEvents(eventInfos []models.EventInfo, event models.EventInfo, at time.Time) []models.EventInfo {
+	var similar []models.EventInfo
+	for _, info := range eventInfos {
+		if info.EventId != event.EventId && info.InternalEventType == event.InternalEventType && !info.EndAt.After(at) {
+			similar = append(similar, info)
+		}
+	}
+	sort.Slice(similar, func(i, j int) bool {
+		return similar[i].StartAt.After(similar[j].StartAt)
+	})
+	return similar
+}
+
+// latestBefore returns the latest of the border infos, sorted by AggregatedAt, aggregated until at.
+func latestBefore(infos []models.BorderInfo, at time.Time) (models.BorderInfo, bool) {
+	for i := len(infos) - 1; i >= 0; i-- {
+		if !infos[i].AggregatedAt.After(at) {
+			return infos[i], true
+		}
+	}
+	return models.BorderInfo{}, false
+}
+
+// scoreAt interpolates the score at t from the border infos, sorted by AggregatedAt.
+// It reports false when t is not within the aggregated period.
+func scoreAt(infos []models.BorderInfo, t time.Time) (float64, bool) {
+	i := sort.Search(len(infos), func(i int) bool {
+		return !infos[i].AggregatedAt.Before(t)
+	})
+	if i == len(infos) {
+		return 0, false
+	}
+	if infos[i].AggregatedAt.Equal(t) {
+		return float64(infos[i].Score), true
+	}
+	if i == 0 {
+		// Before the first aggregation, scores grow from zero at the start of the event
+		return 0, false
+	}
+	before, after := infos[i-1], infos[i]
+	share := float64(t.Sub(before.AggregatedAt)) / float64(after.AggregatedAt.Sub(before.AggregatedAt))
+	return float64(before.Score) + share*float64(after.Score-before.Score), true
+}
+
+func hasBoost(event models.EventInfo) bool {
+	return event.BoostAt.After(event.StartAt) && event.BoostAt.Before(event.EndAt)
+}
+
+// phaseAt maps t to the schedule of event, from 0 at its start to 1 at its end.
+// Aligned on the boost, the time before the boost maps to [0, 0.5] and the time after it to [0.5, 1].
+func phaseAt(event models.EventInfo, t time.Time, alignOnBoost bool) float64 {
+	var phase float64
+	if alignOnBoost {
+		if t.Before(event.BoostAt) {
+			phase = 0.5 * share(event.StartAt, event.BoostAt, t)
+		} else {
+			phase = 0.5 + 0.5*share(event.BoostAt, event.EndAt, t)
+		}
+	} else {
+		phase = share(event.StartAt, event.EndAt, t)
+	}
+	return math.Min(math.Max(phase, 0), 1)
+}
+
+// timeAt is the inverse of phaseAt.
+func timeAt(event models.EventInfo, phase float64, alignOnBoost bool) time.Time {
+	if !alignOnBoost {
+		return timeBetween(event.StartAt, event.EndAt, phase)
+	}
+	if phase < 0.5 {
+		return timeBetween(event.StartAt, event.BoostAt, phase/0.5)
+	}
+	return timeBetween(event.BoostAt, event.EndAt, (phase-0.5)/0.5)
+}
+
+func share(from, to, t time.Time) float64 {
+	if !to.After(from) {
+		return 1
+	}
+	return float64(t.Sub(from)) / float64(to.Sub(from))
+}
+
+func timeBetween(from, to time.Time, share float64) time.Time {
+	return from.Add(time.Duration(share * float64(to.Sub(from))))
+}
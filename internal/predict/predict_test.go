@@ -0,0 +1,126 @@
+package predict
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/internal/dao"
+	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/stretchr/testify/assert"
+)
+
+var testStart = time.Date(2025, 1, 1, 6, 0, 0, 0, time.UTC)
+
+const testEventLength = 6 * 24 * time.Hour
+
+func newTestEvent(eventId int, internalType models.InternalEventType) models.EventInfo {
+	start := testStart.Add(time.Duration(eventId) * 10 * 24 * time.Hour)
+	return models.EventInfo{
+		EventId:           eventId,
+		InternalEventType: internalType,
+		StartAt:           start,
+		EndAt:             start.Add(testEventLength),
+		BoostAt:           start.Add(testEventLength / 2),
+	}
+}
+
+// linearBorderInfos aggregates a score growing linearly to final every 30 minutes from the start of
+// the event until until.
+func linearBorderInfos(event models.EventInfo, border, final int, until time.Time) []models.BorderInfo {
+	var infos []models.BorderInfo
+	for t := event.StartAt.Add(30 * time.Minute); !t.After(until); t = t.Add(30 * time.Minute) {
+		share := float64(t.Sub(event.StartAt)) / float64(event.EndAt.Sub(event.StartAt))
+		infos = append(infos, models.BorderInfo{
+			EventId: event.EventId, RankingType: models.EventPoint, Border: border, AggregatedAt: t, Score: int(share * float64(final)),
+		})
+	}
+	return infos
+}
+
+func newTestDAO(t *testing.T, events []models.EventInfo, infos []models.BorderInfo) dao.DAO {
+	localDAO, err := dao.NewLocalDAO(t.TempDir(), "b", "e", "m")
+	assert.NoError(t, err)
+	assert.NoError(t, localDAO.SaveEventInfos(context.Background(), events))
+	_, err = localDAO.SaveBorderInfos(context.Background(), infos)
+	assert.NoError(t, err)
+	return localDAO
+}
+
+func TestPredictEvent(t *testing.T) {
+	current := newTestEvent(4, models.Internal_Theater)
+	events := []models.EventInfo{newTestEvent(1, models.Internal_Theater), newTestEvent(2, models.Internal_Theater), newTestEvent(3, models.Internal_Tour), current}
+	var infos []models.BorderInfo
+	infos = append(infos, linearBorderInfos(events[0], 100, 10000, events[0].EndAt)...)
+	infos = append(infos, linearBorderInfos(events[1], 100, 20000, events[1].EndAt)...)
+	// Events of other types are not similar
+	infos = append(infos, linearBorderInfos(events[2], 100, 1000000, events[2].EndAt)...)
+	now := current.StartAt.Add(testEventLength / 4)
+	infos = append(infos, linearBorderInfos(current, 100, 40000, now)...)
+	// Past events lack this border, so it is not predicted
+	infos = append(infos, linearBorderInfos(current, 2500, 4000, now)...)
+
+	predictions, err := NewPredictor(newTestDAO(t, events, infos)).PredictEvent(context.Background(), current.EventId, now)
+	assert.NoError(t, err)
+	assert.Len(t, predictions, 1)
+	prediction := predictions[0]
+	assert.Equal(t, 100, prediction.Border)
+	assert.Equal(t, 10000, prediction.CurrentScore)
+	assert.InDelta(t, 0.25, prediction.Progress, 1e-9)
+	// Both past events grew fourfold since the same point of their schedule
+	assert.Equal(t, 40000, prediction.FinalScore)
+	assert.Equal(t, 40000, prediction.LowerBound)
+	assert.Equal(t, 40000, prediction.UpperBound)
+	assert.Equal(t, []int{2, 1}, prediction.SimilarEventIds)
+	assert.Equal(t, CONFIDENCE_LEVEL, prediction.ConfidenceLevel)
+}
+
+func TestPredictEvent_UnknownEvent(t *testing.T) {
+	_, err := NewPredictor(newTestDAO(t, []models.EventInfo{newTestEvent(1, models.Internal_Theater)}, nil)).
+		PredictEvent(context.Background(), 2, testStart)
+	assert.Error(t, err)
+}
+
+func TestPredict_Interval(t *testing.T) {
+	event := newTestEvent(1, models.Internal_Theater)
+	current := models.BorderInfo{EventId: 1, Border: 100, AggregatedAt: event.StartAt.Add(testEventLength / 2), Score: 1000}
+
+	_, ok := predict(event, current, []sample{{eventId: 2, ratio: 2}})
+	assert.False(t, ok)
+
+	prediction, ok := predict(event, current, []sample{{eventId: 2, ratio: 2}, {eventId: 3, ratio: 3}})
+	assert.True(t, ok)
+	assert.Equal(t, 2500, prediction.FinalScore)
+	// mean ± t(1) * sd * sqrt(1 + 1/n) with sd = 0.707
+	// The lower bound of the growth is below 1 and floored at the current score
+	assert.Equal(t, 1000, prediction.LowerBound)
+	assert.InDelta(t, 2500+6.314*707.1*1.2247, prediction.UpperBound, 2)
+}
+
+func TestPhaseAt_AlignsOnBoost(t *testing.T) {
+	event := newTestEvent(1, models.Internal_Theater)
+	event.BoostAt = event.StartAt.Add(testEventLength / 4)
+	quarter := event.StartAt.Add(testEventLength / 4)
+
+	assert.InDelta(t, 0.25, phaseAt(event, quarter, false), 1e-9)
+	assert.InDelta(t, 0.5, phaseAt(event, quarter, true), 1e-9)
+	assert.Equal(t, quarter, timeAt(event, 0.5, true))
+	assert.Equal(t, 1.0, phaseAt(event, event.EndAt.Add(time.Hour), true))
+
+	event.BoostAt = time.Time{}
+	assert.False(t, hasBoost(event))
+}
+
+func TestScoreAt(t *testing.T) {
+	infos := []models.BorderInfo{
+		{AggregatedAt: testStart, Score: 100},
+		{AggregatedAt: testStart.Add(time.Hour), Score: 200},
+	}
+	score, ok := scoreAt(infos, testStart.Add(15*time.Minute))
+	assert.True(t, ok)
+	assert.Equal(t, 125.0, score)
+	_, ok = scoreAt(infos, testStart.Add(-time.Minute))
+	assert.False(t, ok)
+	_, ok = scoreAt(infos, testStart.Add(2*time.Hour))
+	assert.False(t, ok)
+}
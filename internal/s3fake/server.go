@@ -0,0 +1,362 @@
+package s3fake
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Keys listed per ListObjectsV2 page when the request does not ask for fewer, as S3
+	DEFAULT_MAX_KEYS = 1000
+	// Prefix of the headers carrying the checksums of uploaded objects, which are returned on download
+	CHECKSUM_HEADER_PREFIX = "x-amz-checksum-"
+)
+
+type object struct {
+	data         []byte
+	etag         string
+	lastModified time.Time
+	// checksums are the x-amz-checksum-* headers the object was uploaded with
+	checksums http.Header
+}
+
+// Server is an in-memory stand-in for an S3-compatible object storage such as R2, serving the
+// GetObject, HeadObject, PutObject, DeleteObject and ListObjectsV2 operations of the AWS SDK with
+// path-style addressing. Like S3, it answers with XML errors, honours conditional writes and pages
+// object listings. Requests are not authenticated.
+type Server struct {
+	mu       sync.Mutex
+	buckets  map[string]map[string]*object
+	pageSize int
+	now      func() time.Time
+}
+
+func NewServer() *Server {
+	return &Server{
+		buckets:  make(map[string]map[string]*object),
+		pageSize: DEFAULT_MAX_KEYS,
+		now:      func() time.Time { return time.Now().UTC().Truncate(time.Second) },
+	}
+}
+
+// CreateBucket creates an empty bucket. Requests on buckets that were not created fail with NoSuchBucket.
+func (s *Server) CreateBucket(bucket string) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.buckets[bucket]; !ok {
+		s.buckets[bucket] = make(map[string]*object)
+	}
+	return s
+}
+
+// SetPageSize caps the keys listed per ListObjectsV2 page, e.g. to exercise pagination with few objects.
+func (s *Server) SetPageSize(pageSize int) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pageSize = max(pageSize, 1)
+	return s
+}
+
+// Object returns the content of an object.
+func (s *Server) Object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.buckets[bucket][key]
+	if !ok {
+		return nil, false
+	}
+	return bytes.Clone(obj.data), true
+}
+
+// PutObject stores an object, creating its bucket if needed, e.g. to seed a test.
+func (s *Server) PutObject(bucket, key string, data []byte) {
+	s.CreateBucket(bucket)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[bucket][key] = s.newObject(data)
+}
+
+// Keys returns the sorted keys of the objects of a bucket.
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Handler serves the S3 API with the bucket as the first path segment.
+func (s *Server) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		if bucket == "" {
+			writeError(w, r, http.StatusBadRequest, "InvalidBucketName", "The bucket is missing from the path.")
+			return
+		}
+
+		switch {
+		case key == "" && r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+			s.listObjectsV2(w, r, bucket)
+		case key == "":
+			writeError(w, r, http.StatusNotImplemented, "NotImplemented", "Only ListObjectsV2 is supported on buckets.")
+		case r.Method == http.MethodGet, r.Method == http.MethodHead:
+			s.getObject(w, r, bucket, key)
+		case r.Method == http.MethodPut:
+			s.putObject(w, r, bucket, key)
+		case r.Method == http.MethodDelete:
+			s.deleteObject(w, r, bucket, key)
+		default:
+			writeError(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "The method is not allowed against this resource.")
+		}
+	})
+}
+
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	s.mu.Lock()
+	objects, ok := s.buckets[bucket]
+	var obj *object
+	if ok {
+		obj = objects[key]
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.")
+		return
+	}
+	if obj == nil {
+		writeError(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+
+	header := w.Header()
+	header.Set("ETag", obj.etag)
+	header.Set("Last-Modified", obj.lastModified.Format(http.TimeFormat))
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Content-Length", strconv.Itoa(len(obj.data)))
+	for name, values := range obj.checksums {
+		header[name] = values
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := w.Write(obj.data); err != nil {
+		logrus.WithError(err).Debugf("Failed to write object %s/%s", bucket, key)
+	}
+}
+
+// putObject stores an object unless the If-Match or If-None-Match precondition of the request fails.
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	if strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		writeError(w, r, http.StatusNotImplemented, "NotImplemented", "Chunked uploads are not supported.")
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	checksums := make(http.Header)
+	for name, values := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), CHECKSUM_HEADER_PREFIX) {
+			checksums[name] = values
+		}
+	}
+	if crc := checksums.Get(CHECKSUM_HEADER_PREFIX + "crc32"); crc != "" && crc != checksumCRC32(data) {
+		writeError(w, r, http.StatusBadRequest, "BadDigest", "The CRC32 you specified did not match the calculated checksum.")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.")
+		return
+	}
+	existing := objects[key]
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch == "*" && existing != nil {
+		writeError(w, r, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+		return
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if existing == nil {
+			writeError(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		if ifMatch != existing.etag {
+			writeError(w, r, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+			return
+		}
+	}
+	obj := s.newObject(data)
+	obj.checksums = checksums
+	objects[key] = obj
+	w.Header().Set("ETag", obj.etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+// deleteObject removes an object. Like S3, deleting a missing object succeeds.
+func (s *Server) deleteObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.")
+		return
+	}
+	delete(objects, key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name       `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	KeyCount              int            `xml:"KeyCount"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	Contents              []listedObject `xml:"Contents"`
+}
+
+type listedObject struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+// listObjectsV2 lists the objects whose key starts with the prefix parameter in key order, a page at a time.
+// Continuation tokens are the encoded last key of the previous page.
+func (s *Server) listObjectsV2(w http.ResponseWriter, r *http.Request, bucket string) {
+	query := r.URL.Query()
+	result := listBucketResult{
+		Name:              bucket,
+		Prefix:            query.Get("prefix"),
+		StartAfter:        query.Get("start-after"),
+		ContinuationToken: query.Get("continuation-token"),
+	}
+	after := result.StartAfter
+	if result.ContinuationToken != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(result.ContinuationToken)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect")
+			return
+		}
+		after = string(decoded)
+	}
+
+	s.mu.Lock()
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		s.mu.Unlock()
+		writeError(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.")
+		return
+	}
+	result.MaxKeys = s.pageSize
+	if value := query.Get("max-keys"); value != "" {
+		maxKeys, err := strconv.Atoi(value)
+		if err != nil || maxKeys < 0 {
+			s.mu.Unlock()
+			writeError(w, r, http.StatusBadRequest, "InvalidArgument", "Provided max-keys not an integer or within integer range")
+			return
+		}
+		result.MaxKeys = min(maxKeys, s.pageSize)
+	}
+	keys := make([]string, 0, len(objects))
+	for key := range objects {
+		if strings.HasPrefix(key, result.Prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if result.MaxKeys == 0 {
+		keys = nil
+	} else if len(keys) > result.MaxKeys {
+		keys = keys[:result.MaxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(keys[len(keys)-1]))
+	}
+	for _, key := range keys {
+		obj := objects[key]
+		result.Contents = append(result.Contents, listedObject{
+			Key:          key,
+			LastModified: obj.lastModified.Format("2006-01-02T15:04:05.000Z"),
+			ETag:         obj.etag,
+			Size:         len(obj.data),
+			StorageClass: "STANDARD",
+		})
+	}
+	s.mu.Unlock()
+	result.KeyCount = len(result.Contents)
+
+	writeXML(w, r, http.StatusOK, result)
+}
+
+// newObject wraps data with an MD5 ETag, as S3 does for objects uploaded in a single part.
+func (s *Server) newObject(data []byte) *object {
+	sum := md5.Sum(data)
+	return &object{
+		data:         bytes.Clone(data),
+		etag:         `"` + hex.EncodeToString(sum[:]) + `"`,
+		lastModified: s.now(),
+	}
+}
+
+// checksumCRC32 encodes the CRC32 of data as in the x-amz-checksum-crc32 header.
+func checksumCRC32(data []byte) string {
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc32.ChecksumIEEE(data))
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+type errorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestId string   `xml:"RequestId"`
+}
+
+// writeError answers with an S3 error. Like S3, responses to HEAD requests have no body,
+// which the SDK reports with the status text as error code.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+	writeXML(w, r, status, errorResponse{Code: code, Message: message, Resource: r.URL.Path, RequestId: "s3fake"})
+}
+
+func writeXML(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if _, err := w.Write(append([]byte(xml.Header), body...)); err != nil {
+		logrus.WithError(err).Debugf("Failed to write response to %s", r.URL.Path)
+	}
+}
@@ -0,0 +1,158 @@
+package s3fake
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+)
+
+const testBucket = "bucket"
+
+func newTestClient(t *testing.T, server *Server) *s3.Client {
+	httpServer := httptest.NewServer(server.Handler())
+	t.Cleanup(httpServer.Close)
+	return s3.New(s3.Options{
+		BaseEndpoint: aws.String(httpServer.URL),
+		Region:       "auto",
+		Credentials:  credentials.NewStaticCredentialsProvider("key", "secret", ""),
+		UsePathStyle: true,
+		// As clients built from the default config
+		RequestChecksumCalculation: aws.RequestChecksumCalculationWhenSupported,
+		ResponseChecksumValidation: aws.ResponseChecksumValidationWhenSupported,
+	})
+}
+
+func errorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
+
+func TestServer_Objects(t *testing.T) {
+	server := NewServer().CreateBucket(testBucket)
+	client := newTestClient(t, server)
+	ctx := context.Background()
+
+	_, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(testBucket), Key: aws.String("a/b.json")})
+	var noSuchKey *types.NoSuchKey
+	assert.ErrorAs(t, err, &noSuchKey)
+	_, err = client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(testBucket), Key: aws.String("a/b.json")})
+	var notFound *types.NotFound
+	assert.ErrorAs(t, err, &notFound)
+
+	put, err := client.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String(testBucket), Key: aws.String("a/b.json"), Body: bytes.NewReader([]byte("hello"))})
+	assert.NoError(t, err)
+	got, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(testBucket), Key: aws.String("a/b.json")})
+	assert.NoError(t, err)
+	body, err := io.ReadAll(got.Body)
+	assert.NoError(t, err)
+	got.Body.Close()
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, aws.ToString(put.ETag), aws.ToString(got.ETag))
+
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(testBucket), Key: aws.String("a/b.json")})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 5, aws.ToInt64(head.ContentLength))
+	assert.NotNil(t, head.LastModified)
+
+	_, err = client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(testBucket), Key: aws.String("a/b.json")})
+	assert.NoError(t, err)
+	_, found := server.Object(testBucket, "a/b.json")
+	assert.False(t, found)
+	// Deleting a missing object succeeds
+	_, err = client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(testBucket), Key: aws.String("a/b.json")})
+	assert.NoError(t, err)
+
+	_, err = client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("missing"), Key: aws.String("a")})
+	assert.Equal(t, "NoSuchBucket", errorCode(err))
+}
+
+func TestServer_ConditionalPut(t *testing.T) {
+	server := NewServer().CreateBucket(testBucket)
+	client := newTestClient(t, server)
+	ctx := context.Background()
+	put := func(data string, ifMatch, ifNoneMatch *string) (*s3.PutObjectOutput, error) {
+		return client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(testBucket),
+			Key:         aws.String("lock.json"),
+			Body:        bytes.NewReader([]byte(data)),
+			IfMatch:     ifMatch,
+			IfNoneMatch: ifNoneMatch,
+		})
+	}
+
+	created, err := put("v1", nil, aws.String("*"))
+	assert.NoError(t, err)
+	_, err = put("v2", nil, aws.String("*"))
+	assert.Equal(t, "PreconditionFailed", errorCode(err))
+
+	updated, err := put("v2", created.ETag, nil)
+	assert.NoError(t, err)
+	_, err = put("v3", created.ETag, nil)
+	assert.Equal(t, "PreconditionFailed", errorCode(err))
+
+	data, _ := server.Object(testBucket, "lock.json")
+	assert.Equal(t, "v2", string(data))
+	assert.NotEqual(t, aws.ToString(created.ETag), aws.ToString(updated.ETag))
+}
+
+func TestServer_ListObjectsV2(t *testing.T) {
+	server := NewServer().SetPageSize(2)
+	for i := 0; i < 5; i++ {
+		server.PutObject(testBucket, fmt.Sprintf("b/%d.csv", i), []byte("x"))
+	}
+	server.PutObject(testBucket, "e/event_info_all.csv", []byte("x"))
+	client := newTestClient(t, server)
+
+	var keys []string
+	pages := 0
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{Bucket: aws.String(testBucket), Prefix: aws.String("b/")})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.Background())
+		assert.NoError(t, err)
+		pages++
+		for _, object := range page.Contents {
+			keys = append(keys, aws.ToString(object.Key))
+			assert.EqualValues(t, 1, aws.ToInt64(object.Size))
+		}
+	}
+	assert.Equal(t, []string{"b/0.csv", "b/1.csv", "b/2.csv", "b/3.csv", "b/4.csv"}, keys)
+	assert.Equal(t, 3, pages)
+	assert.Len(t, server.Keys(testBucket), 6)
+}
+
+func TestServer_Checksums(t *testing.T) {
+	server := NewServer().CreateBucket(testBucket)
+	client := newTestClient(t, server)
+	ctx := context.Background()
+
+	// The SDK uploads with a CRC32 checksum and validates it on download
+	_, err := client.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String(testBucket), Key: aws.String("a"), Body: bytes.NewReader([]byte("hello"))})
+	assert.NoError(t, err)
+	got, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(testBucket), Key: aws.String("a"), ChecksumMode: types.ChecksumModeEnabled})
+	assert.NoError(t, err)
+	assert.Equal(t, checksumCRC32([]byte("hello")), aws.ToString(got.ChecksumCRC32))
+	got.Body.Close()
+
+	req := httptest.NewRequest(http.MethodPut, "/"+testBucket+"/b", strings.NewReader("hello"))
+	req.Header.Set("x-amz-checksum-crc32", checksumCRC32([]byte("other")))
+	rec := httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "<Code>BadDigest</Code>")
+}
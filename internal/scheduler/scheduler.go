@@ -0,0 +1,100 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/internal/logging"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+)
+
+var parser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// Parse parses a cron expression with five fields (minute, hour, day of month, month and day of week),
+// or a descriptor such as @hourly or @every 15m. Expressions are evaluated in the local time zone
+// unless prefixed with CRON_TZ=, e.g. "CRON_TZ=Asia/Tokyo 0 15 * * *".
+func Parse(spec string) (cron.Schedule, error) {
+	schedule, err := parser.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cron expression %q: %w", spec, err)
+	}
+	return schedule, nil
+}
+
+type job struct {
+	name     string
+	schedule cron.Schedule
+	run      func(ctx context.Context) error
+}
+
+// Scheduler runs jobs on cron schedules within the process.
+type Scheduler struct {
+	jobs []job
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{}
+}
+
+// AddJob schedules run with the cron expression spec under name.
+func (s *Scheduler) AddJob(name, spec string, run func(ctx context.Context) error) error {
+	schedule, err := Parse(spec)
+	if err != nil {
+		return fmt.Errorf("job %s: %w", name, err)
+	}
+	s.addSchedule(name, schedule, run)
+	return nil
+}
+
+func (s *Scheduler) addSchedule(name string, schedule cron.Schedule, run func(ctx context.Context) error) {
+	s.jobs = append(s.jobs, job{name: name, schedule: schedule, run: run})
+}
+
+// Run runs every job on its schedule until ctx is cancelled, then waits for the runs in flight,
+// which see ctx cancelled too. Runs of a job never overlap: the times a job is due while it is still
+// running are skipped. Runs of different jobs may overlap, the jobs serialize their writes themselves.
+func (s *Scheduler) Run(ctx context.Context) error {
+	if len(s.jobs) == 0 {
+		return errors.New("no jobs to schedule")
+	}
+
+	var wg sync.WaitGroup
+	for _, j := range s.jobs {
+		wg.Add(1)
+		go func(j job) {
+			defer wg.Done()
+			j.loop(ctx)
+		}(j)
+	}
+	wg.Wait()
+	logging.FromContext(ctx).Info("Scheduler stopped.")
+	return nil
+}
+
+func (j job) loop(ctx context.Context) {
+	ctx = logging.WithFields(ctx, logrus.Fields{"job": j.name})
+	logger := logging.FromContext(ctx)
+	for {
+		next := j.schedule.Next(time.Now())
+		logger.WithField("next_run", next.Format(time.RFC3339)).Info("Scheduled next run")
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		startedAt := time.Now()
+		if err := j.run(ctx); err != nil && ctx.Err() == nil {
+			logger.WithError(err).Error("Scheduled run failed")
+		} else {
+			logger.Infof("Scheduled run ended after %v", time.Since(startedAt).Round(time.Millisecond))
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// every runs jobs at a fixed delay, which cron expressions cannot go below a second for.
+type every time.Duration
+
+func (e every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+func TestParse(t *testing.T) {
+	from := time.Date(2024, 5, 1, 12, 7, 0, 0, time.UTC)
+
+	schedule, err := Parse("CRON_TZ=UTC */15 * * * *")
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 5, 1, 12, 15, 0, 0, time.UTC), schedule.Next(from).UTC())
+
+	schedule, err = Parse("@every 10m")
+	require.NoError(t, err)
+	assert.Equal(t, from.Add(10*time.Minute), schedule.Next(from))
+
+	_, err = Parse("* * * *")
+	assert.Error(t, err)
+	_, err = Parse("0 0 * * * *")
+	assert.Error(t, err, "seconds are not supported")
+}
+
+func TestAddJob_InvalidSpec(t *testing.T) {
+	err := NewScheduler().AddJob("sync", "every minute", func(context.Context) error { return nil })
+	assert.ErrorContains(t, err, "job sync")
+}
+
+func TestRun_NoJobs(t *testing.T) {
+	assert.Error(t, NewScheduler().Run(context.Background()))
+}
+
+func TestRun_RunsJobsUntilCancelled(t *testing.T) {
+	var syncs, verifies atomic.Int32
+	s := NewScheduler()
+	s.addSchedule("sync", every(20*time.Millisecond), func(context.Context) error {
+		syncs.Add(1)
+		return errors.New("failed runs do not stop the job")
+	})
+	s.addSchedule("verify", every(20*time.Millisecond), func(context.Context) error {
+		verifies.Add(1)
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 110*time.Millisecond)
+	defer cancel()
+	require.NoError(t, s.Run(ctx))
+
+	assert.GreaterOrEqual(t, syncs.Load(), int32(3))
+	assert.GreaterOrEqual(t, verifies.Load(), int32(3))
+}
+
+func TestRun_RunsOfAJobDoNotOverlap(t *testing.T) {
+	var running, maxRunning, runs atomic.Int32
+	s := NewScheduler()
+	s.addSchedule("sync", every(10*time.Millisecond), func(ctx context.Context) error {
+		current := running.Add(1)
+		defer running.Add(-1)
+		if current > maxRunning.Load() {
+			maxRunning.Store(current)
+		}
+		runs.Add(1)
+		select {
+		case <-ctx.Done():
+		case <-time.After(35 * time.Millisecond):
+		}
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Millisecond)
+	defer cancel()
+	require.NoError(t, s.Run(ctx))
+
+	assert.Equal(t, int32(1), maxRunning.Load())
+	assert.LessOrEqual(t, runs.Load(), int32(4), "times due during a run are skipped")
+	assert.Equal(t, int32(0), running.Load(), "Run waits for the runs in flight")
+}
@@ -0,0 +1,312 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/internal/dao"
+	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/sirupsen/logrus"
+)
+
+// Content types the API responds with
+const (
+	CONTENT_TYPE_JSON = "application/json"
+	CONTENT_TYPE_CSV  = "text/csv"
+)
+
+// errNotAcceptable is returned by negotiate when the client accepts none of the content types.
+var errNotAcceptable = errors.New("not acceptable")
+
+// Server exposes the data collected by the sync jobs over HTTP, reading it through a DAO
+// so that clients do not need to know how it is stored.
+//
+// Every endpoint responds with JSON, or with CSV in the stored column layout when the Accept
+// header prefers text/csv. Responses carry an ETag derived from their body, and requests whose
+// If-None-Match matches it get a 304 Not Modified.
+type Server struct {
+	borderDAO dao.DAO
+}
+
+func NewServer(borderDAO dao.DAO) *Server {
+	return &Server{borderDAO: borderDAO}
+}
+
+// Handler returns the handler routing the endpoints of the API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /events", s.handleEvents)
+	mux.HandleFunc("GET /events/{id}", s.handleEvent)
+	mux.HandleFunc("GET /events/{id}/borders/{rankingType}/{border}", s.handleBorders)
+	mux.HandleFunc("GET /events/{id}/idols/{idolId}/borders/{border}", s.handleIdolBorders)
+	mux.HandleFunc("GET /latest", s.handleLatest)
+	return mux
+}
+
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	eventInfos, err := s.borderDAO.ListEventInfos(r.Context())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, fmt.Errorf("failed to list event infos: %w", err))
+		return
+	}
+	writeRecords(w, r, eventInfos)
+}
+
+func (s *Server) handleEvent(w http.ResponseWriter, r *http.Request) {
+	eventId, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+	eventInfos, err := s.borderDAO.ListEventInfos(r.Context())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, fmt.Errorf("failed to list event infos: %w", err))
+		return
+	}
+	for _, info := range eventInfos {
+		if info.EventId == eventId {
+			writeRecords(w, r, []models.EventInfo{info})
+			return
+		}
+	}
+	writeError(w, r, http.StatusNotFound, fmt.Errorf("event %d not found", eventId))
+}
+
+func (s *Server) handleBorders(w http.ResponseWriter, r *http.Request) {
+	rankingType := models.EventRankingType(r.PathValue("rankingType"))
+	if rankingType == models.IdolPoint {
+		writeError(w, r, http.StatusNotFound, errors.New("idol point borders are served under /events/{id}/idols/{idolId}/borders/{border}"))
+		return
+	}
+	eventId, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+	border, ok := pathInt(w, r, "border")
+	if !ok {
+		return
+	}
+	s.writeBorderGroup(w, r, dao.BorderGroupKey{EventId: eventId, RankingType: rankingType, Border: border})
+}
+
+func (s *Server) handleIdolBorders(w http.ResponseWriter, r *http.Request) {
+	eventId, ok := pathInt(w, r, "id")
+	if !ok {
+		return
+	}
+	idolId, ok := pathInt(w, r, "idolId")
+	if !ok {
+		return
+	}
+	border, ok := pathInt(w, r, "border")
+	if !ok {
+		return
+	}
+	s.writeBorderGroup(w, r, dao.BorderGroupKey{EventId: eventId, RankingType: models.IdolPoint, IdolId: idolId, Border: border})
+}
+
+func (s *Server) writeBorderGroup(w http.ResponseWriter, r *http.Request, key dao.BorderGroupKey) {
+	borderInfos, err := s.borderDAO.GetBorderInfos(r.Context(), key)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, fmt.Errorf("failed to get border infos: %w", err))
+		return
+	}
+	if len(borderInfos) == 0 {
+		writeError(w, r, http.StatusNotFound, fmt.Errorf("no border infos for event %d, ranking type %s, idol %d and border %d",
+			key.EventId, key.RankingType, key.IdolId, key.Border))
+		return
+	}
+	writeRecords(w, r, borderInfos)
+}
+
+func (s *Server) handleLatest(w http.ResponseWriter, r *http.Request) {
+	latest, err := s.borderDAO.GetLatestEventInfo(r.Context())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, fmt.Errorf("failed to get latest event info: %w", err))
+		return
+	}
+	if latest.EventId == 0 {
+		writeError(w, r, http.StatusNotFound, errors.New("no event was synced yet"))
+		return
+	}
+	writeRecords(w, r, []models.EventInfo{latest})
+}
+
+// pathInt parses the integer path value name, responding with 400 Bad Request when it is invalid.
+func pathInt(w http.ResponseWriter, r *http.Request, name string) (int, bool) {
+	value, err := strconv.Atoi(r.PathValue(name))
+	if err != nil || value < 0 {
+		writeError(w, r, http.StatusBadRequest, fmt.Errorf("invalid %s: %q", name, r.PathValue(name)))
+		return 0, false
+	}
+	return value, true
+}
+
+// borderInfoJSON and eventInfoJSON are the JSON representations of the records, named after
+// the CSV columns. The models are left without json tags since their Go field names are what
+// the DAOs already store in JSON files, such as the latest event info.
+type borderInfoJSON struct {
+	EventId      int                     `json:"event_id"`
+	IdolId       int                     `json:"idol_id"`
+	Border       int                     `json:"border"`
+	RankingType  models.EventRankingType `json:"ranking_type"`
+	AggregatedAt time.Time               `json:"aggregated_at"`
+	Score        int                     `json:"score"`
+}
+
+type eventInfoJSON struct {
+	EventId           int                      `json:"event_id"`
+	EventName         string                   `json:"name"`
+	EventType         models.EventType         `json:"event_type"`
+	InternalEventType models.InternalEventType `json:"internal_event_type"`
+	StartAt           time.Time                `json:"start_at"`
+	EndAt             time.Time                `json:"end_at"`
+	BoostAt           time.Time                `json:"boost_at"`
+}
+
+// marshalJSON encodes border or event infos with the field names of their CSV columns.
+func marshalJSON(records interface{}) ([]byte, error) {
+	switch records := records.(type) {
+	case []models.BorderInfo:
+		infos := make([]borderInfoJSON, 0, len(records))
+		for _, info := range records {
+			infos = append(infos, borderInfoJSON(info))
+		}
+		return json.Marshal(infos)
+	case []models.EventInfo:
+		infos := make([]eventInfoJSON, 0, len(records))
+		for _, info := range records {
+			infos = append(infos, eventInfoJSON(info))
+		}
+		return json.Marshal(infos)
+	default:
+		return nil, fmt.Errorf("json: unsupported records type %T", records)
+	}
+}
+
+// writeRecords encodes records, border or event infos, in the content type negotiated with the client.
+// Both content types name the fields after the stored CSV columns.
+func writeRecords(w http.ResponseWriter, r *http.Request, records interface{}) {
+	contentType, err := negotiate(r.Header.Get("Accept"))
+	if err != nil {
+		writeError(w, r, http.StatusNotAcceptable, fmt.Errorf("only %s and %s are supported", CONTENT_TYPE_JSON, CONTENT_TYPE_CSV))
+		return
+	}
+
+	var body []byte
+	if contentType == CONTENT_TYPE_CSV {
+		body, err = dao.CSVSerializer{}.Marshal(records)
+	} else {
+		body, err = marshalJSON(records)
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, fmt.Errorf("failed to encode response: %w", err))
+		return
+	}
+	writeBody(w, r, http.StatusOK, contentType, body)
+}
+
+// writeError responds with the error message as a JSON object.
+func writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if status >= http.StatusInternalServerError {
+		logrus.WithError(err).Errorf("Failed to serve %s", r.URL.Path)
+	}
+	body, _ := json.Marshal(map[string]string{"error": err.Error()})
+	writeBody(w, r, status, CONTENT_TYPE_JSON, body)
+}
+
+// writeBody writes a response with a strong ETag of its body, or 304 Not Modified
+// when a successful response matches the If-None-Match header.
+func writeBody(w http.ResponseWriter, r *http.Request, status int, contentType string, body []byte) {
+	checksum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(checksum[:16]) + `"`
+
+	header := w.Header()
+	header.Set("Vary", "Accept")
+	header.Set("ETag", etag)
+	if status == http.StatusOK && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	header.Set("Content-Type", contentType+"; charset=utf-8")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if _, err := w.Write(body); err != nil {
+		logrus.WithError(err).Debugf("Failed to write response to %s", r.URL.Path)
+	}
+}
+
+// etagMatches reports whether an If-None-Match header matches etag, using the weak comparison.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiate picks the content type of the response from an Accept header. Each content type gets the quality
+// of the most specific media range matching it; ties go to the content type matched by the more specific range,
+// then to JSON. A missing header accepts JSON.
+func negotiate(accept string) (string, error) {
+	if strings.TrimSpace(accept) == "" {
+		return CONTENT_TYPE_JSON, nil
+	}
+
+	jsonQuality, jsonSpecificity := acceptQuality(accept, CONTENT_TYPE_JSON)
+	csvQuality, csvSpecificity := acceptQuality(accept, CONTENT_TYPE_CSV)
+	switch {
+	case jsonQuality <= 0 && csvQuality <= 0:
+		return "", errNotAcceptable
+	case csvQuality > jsonQuality, csvQuality == jsonQuality && csvSpecificity > jsonSpecificity:
+		return CONTENT_TYPE_CSV, nil
+	default:
+		return CONTENT_TYPE_JSON, nil
+	}
+}
+
+// acceptQuality returns the quality an Accept header gives to contentType, 0 if it is not accepted, and the
+// specificity of the media range it was taken from: 2 for the content type itself, 1 for type/* and 0 for */*.
+func acceptQuality(accept, contentType string) (quality float64, specificity int) {
+	mainType, _, _ := strings.Cut(contentType, "/")
+	specificity = -1
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+
+		var rangeSpecificity int
+		switch mediaType {
+		case contentType:
+			rangeSpecificity = 2
+		case mainType + "/*":
+			rangeSpecificity = 1
+		case "*/*":
+			rangeSpecificity = 0
+		default:
+			continue
+		}
+		if rangeSpecificity <= specificity {
+			continue
+		}
+
+		rangeQuality := 1.0
+		if q, ok := params["q"]; ok {
+			if rangeQuality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		quality, specificity = rangeQuality, rangeSpecificity
+	}
+	return quality, specificity
+}
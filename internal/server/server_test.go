@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/internal/dao"
+	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/stretchr/testify/assert"
+)
+
+var testAggregatedAt = time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+
+func newTestServer(t *testing.T) http.Handler {
+	localDAO, err := dao.NewLocalDAO(t.TempDir(), "b", "e", "m")
+	assert.NoError(t, err)
+	ctx := context.Background()
+	event := models.EventInfo{EventId: 1, EventName: "One", StartAt: testAggregatedAt, EndAt: testAggregatedAt.Add(time.Hour)}
+	assert.NoError(t, localDAO.SaveEventInfos(ctx, []models.EventInfo{event, {EventId: 2, EventName: "Two"}}))
+	assert.NoError(t, localDAO.SaveLatestEventInfo(ctx, event))
+	_, err = localDAO.SaveBorderInfos(ctx, []models.BorderInfo{
+		{EventId: 1, RankingType: models.EventPoint, Border: 100, AggregatedAt: testAggregatedAt, Score: 10},
+		{EventId: 1, RankingType: models.EventPoint, Border: 100, AggregatedAt: testAggregatedAt.Add(30 * time.Minute), Score: 20},
+		{EventId: 1, RankingType: models.IdolPoint, IdolId: 4, Border: 10, AggregatedAt: testAggregatedAt, Score: 30},
+	})
+	assert.NoError(t, err)
+	return NewServer(localDAO).Handler()
+}
+
+func serve(handler http.Handler, path string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestServer_Events(t *testing.T) {
+	handler := newTestServer(t)
+
+	rec := serve(handler, "/events", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json; charset=utf-8", rec.Header().Get("Content-Type"))
+	var events []eventInfoJSON
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &events))
+	assert.Len(t, events, 2)
+
+	rec = serve(handler, "/events/2", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &events))
+	assert.Equal(t, "Two", events[0].EventName)
+
+	assert.Equal(t, http.StatusNotFound, serve(handler, "/events/3", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(handler, "/events/abc", nil).Code)
+}
+
+func TestServer_Borders(t *testing.T) {
+	handler := newTestServer(t)
+
+	rec := serve(handler, "/events/1/borders/eventPoint/100", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var borderInfos []borderInfoJSON
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &borderInfos))
+	assert.Len(t, borderInfos, 2)
+	assert.Equal(t, 20, borderInfos[1].Score)
+
+	rec = serve(handler, "/events/1/idols/4/borders/10", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &borderInfos))
+	assert.Equal(t, []borderInfoJSON{
+		{EventId: 1, RankingType: models.IdolPoint, IdolId: 4, Border: 10, AggregatedAt: testAggregatedAt, Score: 30},
+	}, borderInfos)
+
+	assert.Equal(t, http.StatusNotFound, serve(handler, "/events/1/borders/eventPoint/2500", nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve(handler, "/events/1/borders/idolPoint/10", nil).Code)
+}
+
+func TestServer_Latest(t *testing.T) {
+	rec := serve(newTestServer(t), "/latest", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var events []eventInfoJSON
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &events))
+	assert.Equal(t, 1, events[0].EventId)
+
+	localDAO, err := dao.NewLocalDAO(t.TempDir(), "b", "e", "m")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, serve(NewServer(localDAO).Handler(), "/latest", nil).Code)
+}
+
+func TestServer_CSV(t *testing.T) {
+	rec := serve(newTestServer(t), "/events/1/borders/eventPoint/100", map[string]string{"Accept": "text/csv"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "event_id,idol_id,border,ranking_type,aggregated_at,score\n"+
+		"1,0,100,eventPoint,2025-06-01T00:00:00Z,10\n"+
+		"1,0,100,eventPoint,2025-06-01T00:30:00Z,20\n", rec.Body.String())
+}
+
+func TestServer_JSONFieldsMatchCSVColumns(t *testing.T) {
+	handler := newTestServer(t)
+	for _, path := range []string{"/events", "/events/1/borders/eventPoint/100"} {
+		csvRec := serve(handler, path, map[string]string{"Accept": "text/csv"})
+		columns := strings.Split(strings.SplitN(csvRec.Body.String(), "\n", 2)[0], ",")
+
+		var records []map[string]interface{}
+		assert.NoError(t, json.Unmarshal(serve(handler, path, nil).Body.Bytes(), &records), path)
+		assert.NotEmpty(t, records, path)
+		for _, record := range records {
+			fields := make([]string, 0, len(record))
+			for field := range record {
+				fields = append(fields, field)
+			}
+			assert.ElementsMatch(t, columns, fields, path)
+		}
+	}
+}
+
+func TestServer_ETag(t *testing.T) {
+	handler := newTestServer(t)
+
+	rec := serve(handler, "/events", nil)
+	etag := rec.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.Equal(t, etag, serve(handler, "/events", nil).Header().Get("ETag"))
+
+	rec = serve(handler, "/events", map[string]string{"If-None-Match": `"other", ` + etag})
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Empty(t, rec.Body.String())
+
+	// The CSV representation has its own ETag
+	rec = serve(handler, "/events", map[string]string{"Accept": "text/csv", "If-None-Match": etag})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotEqual(t, etag, rec.Header().Get("ETag"))
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept   string
+		expected string
+	}{
+		{"", CONTENT_TYPE_JSON},
+		{"*/*", CONTENT_TYPE_JSON},
+		{"text/csv", CONTENT_TYPE_CSV},
+		{"text/csv, */*", CONTENT_TYPE_CSV},
+		{"text/csv;q=0.5, application/json", CONTENT_TYPE_JSON},
+		{"application/json;q=0.5, text/*", CONTENT_TYPE_CSV},
+		{"*/*, application/json;q=0", CONTENT_TYPE_CSV},
+	}
+	for _, test := range tests {
+		contentType, err := negotiate(test.accept)
+		assert.NoError(t, err, test.accept)
+		assert.Equal(t, test.expected, contentType, test.accept)
+	}
+
+	_, err := negotiate("application/xml")
+	assert.ErrorIs(t, err, errNotAcceptable)
+	assert.Equal(t, http.StatusNotAcceptable, serve(newTestServer(t), "/events", map[string]string{"Accept": "image/png"}).Code)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -29,10 +30,9 @@ func JoinSlice[T any](slice []T, delimeter string) string {
 }
 
 func CreateDirectoryIfNotExists(dir string) error {
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return fmt.Errorf("failed to create directory %s: %w", dir, err)
-		}
+	// MkdirAll is a no-op for existing directories and fails when a file is in the way
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
 	}
 	return nil
 }
@@ -42,6 +42,36 @@ func LocalFileExists(path string) bool {
 	return !os.IsNotExist(err)
 }
 
+// WriteFileAtomic writes a file through write into a temporary file next to path, then renames
+// it over path, so that readers and crashes only ever see the old or the new content.
+func WriteFileAtomic(path string, write func(file *os.File) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for %s: %w", path, err)
+	}
+	// Removing fails harmlessly once the file has been renamed
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temporary file for %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file for %s: %w", path, err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to set permissions of temporary file for %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename temporary file to %s: %w", path, err)
+	}
+	return nil
+}
+
 func ReadJSONFile(path string, v interface{}) error {
 	file, err := os.Open(path)
 	if err != nil {
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFileAtomic_ReplacesContent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.csv")
+	assert.NoError(t, os.WriteFile(path, []byte("old"), 0644))
+
+	err := WriteFileAtomic(path, func(file *os.File) error {
+		_, err := file.WriteString("new")
+		return err
+	})
+	assert.NoError(t, err)
+
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(content))
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	assert.Len(t, entries, 1)
+}
+
+func TestWriteFileAtomic_KeepsOldContentOnFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.csv")
+	assert.NoError(t, os.WriteFile(path, []byte("old"), 0644))
+
+	err := WriteFileAtomic(path, func(file *os.File) error {
+		file.WriteString("partial")
+		return errors.New("crash")
+	})
+	assert.EqualError(t, err, "crash")
+
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "old", string(content))
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	assert.Len(t, entries, 1, "the temporary file is cleaned up")
+}
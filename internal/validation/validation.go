@@ -0,0 +1,170 @@
+package validation
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/models"
+)
+
+// Kinds of issues found in fetched border infos
+const (
+	ISSUE_NEGATIVE_SCORE          = "negative_score"
+	ISSUE_DUPLICATE_AGGREGATED_AT = "duplicate_aggregated_at"
+	ISSUE_OUTSIDE_EVENT           = "outside_event"
+	ISSUE_NON_MONOTONIC_SCORE     = "non_monotonic_score"
+	ISSUE_CADENCE_GAP             = "cadence_gap"
+)
+
+// Severities of the issues. Only errors make a border group suspicious: gaps in the
+// aggregation cadence also happen when matsurihi.me misses aggregations.
+const (
+	SEVERITY_WARNING = "warning"
+	SEVERITY_ERROR   = "error"
+)
+
+// Issue is a problem found in the border infos of a border group.
+type Issue struct {
+	Kind         string                  `json:"kind"`
+	Severity     string                  `json:"severity"`
+	EventId      int                     `json:"event_id"`
+	RankingType  models.EventRankingType `json:"ranking_type"`
+	IdolId       int                     `json:"idol_id"`
+	Border       int                     `json:"border"`
+	AggregatedAt time.Time               `json:"aggregated_at"`
+	Message      string                  `json:"message"`
+}
+
+// Report lists the issues found in a batch of border infos.
+type Report struct {
+	// Number of border groups validated
+	BorderGroups int     `json:"border_groups"`
+	Issues       []Issue `json:"issues"`
+	// Number of border groups held back from storage because of their errors
+	QuarantinedBorderGroups int `json:"quarantined_border_groups"`
+}
+
+type groupKey struct {
+	eventId     int
+	rankingType models.EventRankingType
+	idolId      int
+	border      int
+}
+
+func keyOf(info models.BorderInfo) groupKey {
+	return groupKey{eventId: info.EventId, rankingType: info.RankingType, idolId: info.IdolId, border: info.Border}
+}
+
+// Validate checks the border infos of every border group against the event they belong to
+// and the aggregation cadence of matsurihi.me. Border infos of events missing from eventInfos
+// are not checked against the event schedule.
+func Validate(borderInfos []models.BorderInfo, eventInfos map[int]models.EventInfo, cadence time.Duration) Report {
+	groups := make(map[groupKey][]models.BorderInfo)
+	for _, info := range borderInfos {
+		groups[keyOf(info)] = append(groups[keyOf(info)], info)
+	}
+
+	report := Report{BorderGroups: len(groups), Issues: make([]Issue, 0)}
+	for _, infos := range groups {
+		event, hasEvent := eventInfos[infos[0].EventId]
+		report.Issues = append(report.Issues, validateGroup(infos, event, hasEvent, cadence)...)
+	}
+	sort.SliceStable(report.Issues, func(i, j int) bool {
+		a, b := report.Issues[i], report.Issues[j]
+		if a.groupKey() != b.groupKey() {
+			return lessGroupKey(a.groupKey(), b.groupKey())
+		}
+		return a.AggregatedAt.Before(b.AggregatedAt)
+	})
+	return report
+}
+
+// Quarantine splits the border infos into the ones to save and the ones of the border groups
+// having errors in the report, and records the number of quarantined groups in the report.
+func Quarantine(borderInfos []models.BorderInfo, report *Report) (kept, quarantined []models.BorderInfo) {
+	suspicious := make(map[groupKey]struct{})
+	for _, issue := range report.Issues {
+		if issue.Severity == SEVERITY_ERROR {
+			suspicious[issue.groupKey()] = struct{}{}
+		}
+	}
+	for _, info := range borderInfos {
+		if _, ok := suspicious[keyOf(info)]; ok {
+			quarantined = append(quarantined, info)
+		} else {
+			kept = append(kept, info)
+		}
+	}
+	report.QuarantinedBorderGroups = len(suspicious)
+	return kept, quarantined
+}
+
+// validateGroup checks the border infos of a single border group.
+func validateGroup(infos []models.BorderInfo, event models.EventInfo, hasEvent bool, cadence time.Duration) []Issue {
+	sorted := make([]models.BorderInfo, len(infos))
+	copy(sorted, infos)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].AggregatedAt.Before(sorted[j].AggregatedAt)
+	})
+
+	var issues []Issue
+	for i, info := range sorted {
+		if info.Score < 0 {
+			issues = append(issues, newIssue(ISSUE_NEGATIVE_SCORE, SEVERITY_ERROR, info, "score %d is negative", info.Score))
+		}
+		if hasEvent && (info.AggregatedAt.Before(event.StartAt) || info.AggregatedAt.After(event.EndAt)) {
+			issues = append(issues, newIssue(ISSUE_OUTSIDE_EVENT, SEVERITY_ERROR, info,
+				"aggregated outside of the event running from %v to %v", event.StartAt, event.EndAt))
+		}
+		if i == 0 {
+			continue
+		}
+
+		previous := sorted[i-1]
+		gap := info.AggregatedAt.Sub(previous.AggregatedAt)
+		switch {
+		case gap == 0:
+			issues = append(issues, newIssue(ISSUE_DUPLICATE_AGGREGATED_AT, SEVERITY_ERROR, info,
+				"aggregated more than once, with scores %d and %d", previous.Score, info.Score))
+		case info.Score < previous.Score:
+			issues = append(issues, newIssue(ISSUE_NON_MONOTONIC_SCORE, SEVERITY_ERROR, info,
+				"score dropped from %d to %d since %v", previous.Score, info.Score, previous.AggregatedAt))
+		}
+		if cadence > 0 && gap > cadence {
+			issues = append(issues, newIssue(ISSUE_CADENCE_GAP, SEVERITY_WARNING, info,
+				"no aggregation for %v since %v", gap, previous.AggregatedAt))
+		}
+	}
+	return issues
+}
+
+func newIssue(kind, severity string, info models.BorderInfo, format string, args ...interface{}) Issue {
+	return Issue{
+		Kind:         kind,
+		Severity:     severity,
+		EventId:      info.EventId,
+		RankingType:  info.RankingType,
+		IdolId:       info.IdolId,
+		Border:       info.Border,
+		AggregatedAt: info.AggregatedAt,
+		Message:      fmt.Sprintf(format, args...),
+	}
+}
+
+func (i Issue) groupKey() groupKey {
+	return groupKey{eventId: i.EventId, rankingType: i.RankingType, idolId: i.IdolId, border: i.Border}
+}
+
+func lessGroupKey(a, b groupKey) bool {
+	if a.eventId != b.eventId {
+		return a.eventId < b.eventId
+	}
+	if a.rankingType != b.rankingType {
+		return a.rankingType < b.rankingType
+	}
+	if a.idolId != b.idolId {
+		return a.idolId < b.idolId
+	}
+	return a.border < b.border
+}
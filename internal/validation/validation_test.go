@@ -0,0 +1,86 @@
+package validation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alceccentric/matsurihi-cron/models"
+	"github.com/stretchr/testify/assert"
+)
+
+var testStart = time.Date(2025, 6, 1, 6, 0, 0, 0, time.UTC)
+
+func testEvents() map[int]models.EventInfo {
+	return map[int]models.EventInfo{1: {EventId: 1, StartAt: testStart, EndAt: testStart.Add(24 * time.Hour)}}
+}
+
+func row(border int, offset time.Duration, score int) models.BorderInfo {
+	return models.BorderInfo{EventId: 1, RankingType: models.EventPoint, Border: border, AggregatedAt: testStart.Add(offset), Score: score}
+}
+
+func issueKinds(report Report) []string {
+	kinds := make([]string, 0, len(report.Issues))
+	for _, issue := range report.Issues {
+		kinds = append(kinds, issue.Kind)
+	}
+	return kinds
+}
+
+func TestValidate_CleanGroup(t *testing.T) {
+	report := Validate([]models.BorderInfo{
+		row(100, time.Hour, 20), row(100, 30*time.Minute, 10), row(100, 90*time.Minute, 20),
+	}, testEvents(), 30*time.Minute)
+	assert.Equal(t, 1, report.BorderGroups)
+	assert.Empty(t, report.Issues)
+}
+
+func TestValidate_DetectsIssues(t *testing.T) {
+	tests := []struct {
+		name     string
+		infos    []models.BorderInfo
+		expected []string
+	}{
+		{"negative score", []models.BorderInfo{row(100, 30*time.Minute, -1)}, []string{ISSUE_NEGATIVE_SCORE}},
+		{"before the event", []models.BorderInfo{row(100, -30*time.Minute, 1)}, []string{ISSUE_OUTSIDE_EVENT}},
+		{"after the event", []models.BorderInfo{row(100, 25*time.Hour, 1)}, []string{ISSUE_OUTSIDE_EVENT}},
+		{"duplicate timestamp", []models.BorderInfo{row(100, time.Hour, 10), row(100, time.Hour, 12)}, []string{ISSUE_DUPLICATE_AGGREGATED_AT}},
+		{"score drop", []models.BorderInfo{row(100, time.Hour, 10), row(100, 90*time.Minute, 5)}, []string{ISSUE_NON_MONOTONIC_SCORE}},
+		{"gap", []models.BorderInfo{row(100, time.Hour, 10), row(100, 3*time.Hour, 50)}, []string{ISSUE_CADENCE_GAP}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, issueKinds(Validate(test.infos, testEvents(), 30*time.Minute)))
+		})
+	}
+}
+
+func TestValidate_GroupsAreCheckedSeparately(t *testing.T) {
+	idol := row(100, time.Hour, 5)
+	idol.IdolId = 3
+	idol.RankingType = models.IdolPoint
+	// Rows of other groups neither duplicate nor precede each other
+	report := Validate([]models.BorderInfo{row(100, time.Hour, 10), row(2500, time.Hour, 1), idol}, testEvents(), 30*time.Minute)
+	assert.Equal(t, 3, report.BorderGroups)
+	assert.Empty(t, report.Issues)
+}
+
+func TestValidate_UnknownEventSkipsScheduleCheck(t *testing.T) {
+	info := row(100, 48*time.Hour, 1)
+	info.EventId = 2
+	assert.Empty(t, Validate([]models.BorderInfo{info}, testEvents(), 30*time.Minute).Issues)
+}
+
+func TestQuarantine(t *testing.T) {
+	infos := []models.BorderInfo{
+		row(100, time.Hour, 10), row(100, 90*time.Minute, 5),
+		row(2500, time.Hour, 1), row(2500, 5*time.Hour, 2),
+	}
+	report := Validate(infos, testEvents(), 30*time.Minute)
+	assert.Equal(t, []string{ISSUE_NON_MONOTONIC_SCORE, ISSUE_CADENCE_GAP}, issueKinds(report))
+
+	kept, quarantined := Quarantine(infos, &report)
+	// Gaps are only reported, so the 2500 group is kept
+	assert.Equal(t, infos[2:], kept)
+	assert.Equal(t, infos[:2], quarantined)
+	assert.Equal(t, 1, report.QuarantinedBorderGroups)
+}
@@ -145,10 +145,31 @@ type IdolPointBorders struct {
 }
 
 type EventRankingBorders struct {
-	EventPoint  []int              `json:"eventPoint"`
-	HighScore   []int              `json:"highScore"`
-	LoungePoint []int              `json:"loungePoint"`
-	IdolPoint   []IdolPointBorders `json:"idolPoint"`
+	EventPoint     []int              `json:"eventPoint"`
+	HighScore      []int              `json:"highScore"`
+	HighScore2     []int              `json:"highScore2"`
+	HighScoreTotal []int              `json:"highScoreTotal"`
+	LoungePoint    []int              `json:"loungePoint"`
+	IdolPoint      []IdolPointBorders `json:"idolPoint"`
+}
+
+// Borders returns the borders available for the given ranking type.
+// Idol point borders are per idol and therefore not returned here.
+func (b EventRankingBorders) Borders(rankingType EventRankingType) []int {
+	switch rankingType {
+	case EventPoint:
+		return b.EventPoint
+	case HighScore:
+		return b.HighScore
+	case HighScore2:
+		return b.HighScore2
+	case HighScoreTotal:
+		return b.HighScoreTotal
+	case LoungePoint:
+		return b.LoungePoint
+	default:
+		return nil
+	}
 }
 
 type EventRankingLogsOptions struct {
@@ -164,13 +185,31 @@ type EventRankingLog struct {
 	} `json:"data"`
 }
 
+// EventRankingLogsResult carries the ranking logs of one request together with its response ETag.
+// NotModified is set when the server answered 304 to a conditional request, in which case Logs is empty.
+type EventRankingLogsResult struct {
+	Logs        []EventRankingLog
+	ETag        string
+	NotModified bool
+}
+
 type EventRankingType string
 
 const (
 	EventPoint     EventRankingType = "eventPoint"
 	HighScore      EventRankingType = "highScore"
-	highScore2     EventRankingType = "highScore2"
+	HighScore2     EventRankingType = "highScore2"
 	HighScoreTotal EventRankingType = "highScoreTotal"
 	LoungePoint    EventRankingType = "loungePoint"
 	IdolPoint      EventRankingType = "idolPoint"
 )
+
+// IsValid reports whether the ranking type is one of the API.
+func (t EventRankingType) IsValid() bool {
+	switch t {
+	case EventPoint, HighScore, HighScore2, HighScoreTotal, LoungePoint, IdolPoint:
+		return true
+	default:
+		return false
+	}
+}
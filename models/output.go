@@ -20,3 +20,23 @@ type EventInfo struct {
 	EndAt             time.Time         `csv:"end_at"`
 	BoostAt           time.Time         `csv:"boost_at"`
 }
+
+// BorderPrediction is the estimated final score of a border group of an event.
+type BorderPrediction struct {
+	EventId     int              `json:"event_id"`
+	IdolId      int              `json:"idol_id"`
+	Border      int              `json:"border"`
+	RankingType EventRankingType `json:"ranking_type"`
+	// Time of the latest border info the prediction is based on
+	AggregatedAt time.Time `json:"aggregated_at"`
+	// Elapsed share of the event at AggregatedAt, between 0 and 1
+	Progress     float64 `json:"progress"`
+	CurrentScore int     `json:"current_score"`
+	FinalScore   int     `json:"final_score"`
+	// Bounds of the prediction interval of the final score at ConfidenceLevel
+	LowerBound      int     `json:"lower_bound"`
+	UpperBound      int     `json:"upper_bound"`
+	ConfidenceLevel float64 `json:"confidence_level"`
+	// Past events of the same internal type the prediction is based on
+	SimilarEventIds []int `json:"similar_event_ids"`
+}